@@ -0,0 +1,152 @@
+package tpmk
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpmutil"
+)
+
+// Magic value at the start of every TPMS_ATTEST structure (TPM_GENERATED_VALUE)
+const attestMagic uint32 = 0xff544347
+
+// Structure tag of NV attestations, missing in go-tpm
+const tagAttestNV tpmutil.Tag = 0x8014
+
+// NVAttestation is a signed statement from the TPM about the public area and contents of an NV
+// index. Since the TPM signs the name of the index, which is a hash over its public area, the
+// attestation proves the index attributes, including whether it is write-locked.
+type NVAttestation struct {
+	Public    tpm2.NVPublic
+	Attest    []byte
+	Signature []byte
+}
+
+// NVCertify produces an attestation of an NV index and its contents, signed with an RSA
+// Attestation Key (AK) in the TPM using RSASSA-SHA256, like the ones created by GenAK. The signer
+// needs to be a restricted signing key, an unrestricted key would sign any digest, including that
+// of a forged attestation. The nonce is included in the signed data and should be provided by the
+// remote party to prove freshness. Reading the index is authorized with the owner password, as
+// for NVRead.
+func NVCertify(dev io.ReadWriteCloser, index tpmutil.Handle, password string, signer tpmutil.Handle, signerPW string, nonce []byte) (NVAttestation, error) {
+	signerPub, _, _, err := tpm2.ReadPublic(dev, signer)
+	if err != nil {
+		return NVAttestation{}, err
+	}
+	if signerPub.Type != tpm2.AlgRSA {
+		return NVAttestation{}, fmt.Errorf("unsupported AK algorithm 0x%x", signerPub.Type)
+	}
+	if signerPub.Attributes&(tpm2.FlagRestricted|tpm2.FlagSign|tpm2.FlagDecrypt) != tpm2.FlagRestricted|tpm2.FlagSign {
+		return NVAttestation{}, errors.New("AK needs to be a restricted signing key")
+	}
+	public, err := tpm2.NVReadPublic(dev, index)
+	if err != nil {
+		return NVAttestation{}, err
+	}
+	cmd, err := encodeCommand(
+		[]interface{}{signer, tpm2.HandleOwner, index},
+		[]tpm2.AuthCommand{passwordAuth(signerPW), passwordAuth(password)},
+		nonce, tpm2.AlgRSASSA, tpm2.AlgSHA256, public.DataSize, uint16(0),
+	)
+	if err != nil {
+		return NVAttestation{}, err
+	}
+	resp, err := runCommand(dev, tpm2.TagSessions, cmdNVCertify, cmd)
+	if err != nil {
+		return NVAttestation{}, err
+	}
+	var (
+		paramSize uint32
+		attest    []byte
+		sigAlg    tpm2.Algorithm
+		hashAlg   tpm2.Algorithm
+		signature []byte
+	)
+	if _, err := tpmutil.Unpack(resp, &paramSize, &attest, &sigAlg, &hashAlg, &signature); err != nil {
+		return NVAttestation{}, err
+	}
+	return NVAttestation{public, attest, signature}, nil
+}
+
+// VerifyNVLocked checks that an NV attestation was signed by pub, includes the nonce and that the
+// index is write-locked. It returns the certified contents of the index. The result only proves
+// anything if pub is known to be a restricted AK of the TPM, for example one certified against
+// the EK with ActivateCredential.
+func VerifyNVLocked(pub crypto.PublicKey, att NVAttestation, nonce []byte) ([]byte, error) {
+	info, err := verifyNVAttestation(pub, att, nonce)
+	if err != nil {
+		return nil, err
+	}
+	if tpm2.NVAttr(att.Public.Attributes)&tpm2.AttrWriteLocked == 0 {
+		return nil, errors.New("NV index is not write-locked")
+	}
+	return info.contents, nil
+}
+
+// nvCertifyInfo holds the attested data of an NV attestation.
+type nvCertifyInfo struct {
+	name     []byte
+	offset   uint16
+	contents []byte
+}
+
+// verifyNVAttestation verifies the signature of an NV attestation and that it matches the
+// included public area and nonce.
+func verifyNVAttestation(pub crypto.PublicKey, att NVAttestation, nonce []byte) (nvCertifyInfo, error) {
+	digest := sha256.Sum256(att.Attest)
+	rsaPub, ok := pub.(*rsa.PublicKey)
+	if !ok {
+		return nvCertifyInfo{}, fmt.Errorf("unsupported key type %T", pub)
+	}
+	if err := rsa.VerifyPKCS1v15(rsaPub, crypto.SHA256, digest[:], att.Signature); err != nil {
+		return nvCertifyInfo{}, err
+	}
+
+	// Decode the TPMS_ATTEST structure
+	var (
+		magic     uint32
+		typ       tpmutil.Tag
+		signer    []byte
+		extraData []byte
+		clock     tpm2.ClockInfo
+		firmware  uint64
+		info      nvCertifyInfo
+	)
+	if _, err := tpmutil.Unpack(att.Attest, &magic, &typ, &signer, &extraData, &clock, &firmware, &info.name, &info.offset, &info.contents); err != nil {
+		return info, err
+	}
+	if magic != attestMagic {
+		return info, errors.New("attestation not generated by a TPM")
+	}
+	if typ != tagAttestNV {
+		return info, fmt.Errorf("not an NV attestation, type 0x%x", typ)
+	}
+	if !bytes.Equal(extraData, nonce) {
+		return info, errors.New("attestation nonce mismatch")
+	}
+
+	// The public area needs to match the name the TPM signed
+	name, err := nvName(att.Public)
+	if err != nil {
+		return info, err
+	}
+	if !bytes.Equal(name, info.name) {
+		return info, errors.New("NV public area doesn't match the attested name")
+	}
+	return info, nil
+}
+
+// nvName calculates the name of an NV index from its public area.
+func nvName(public tpm2.NVPublic) ([]byte, error) {
+	b, err := tpmutil.Pack(public)
+	if err != nil {
+		return nil, err
+	}
+	return objectName(public.NameAlg, b)
+}
@@ -0,0 +1,67 @@
+package tpmk
+
+import (
+	"testing"
+
+	"github.com/google/go-tpm-tools/simulator"
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpmutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNVCertifyLocked(t *testing.T) {
+	dev, err := simulator.Get()
+	require.NoError(t, err)
+	defer dev.Close()
+
+	const (
+		index   tpmutil.Handle = 0x1000000
+		signer  tpmutil.Handle = 0x81000000
+		other   tpmutil.Handle = 0x81000001
+		pw                     = ""
+		attr                   = tpm2.AttrOwnerWrite | tpm2.AttrOwnerRead | tpm2.AttrWriteDefine
+		keyAttr                = tpm2.FlagSign | tpm2.FlagFixedTPM | tpm2.FlagUserWithAuth | tpm2.FlagFixedParent | tpm2.FlagSensitiveDataOrigin
+	)
+	data := []byte("certificate")
+	nonce := []byte("nonce")
+
+	pub, err := GenAK(dev, signer, pw, pw)
+	require.NoError(t, err)
+	err = NVDefine(dev, tpm2.HandleOwner, pw, index, pw, attr, uint16(len(data)))
+	require.NoError(t, err)
+	err = tpm2.NVWrite(dev, tpm2.HandleOwner, index, pw, data, 0)
+	require.NoError(t, err)
+
+	// Unrestricted keys can sign anything and aren't accepted
+	_, err = GenRSAPrimaryKey(dev, other, pw, pw, keyAttr)
+	require.NoError(t, err)
+	_, err = NVCertify(dev, index, pw, other, pw, nonce)
+	require.EqualError(t, err, "AK needs to be a restricted signing key")
+
+	// Not locked yet
+	att, err := NVCertify(dev, index, pw, signer, pw, nonce)
+	require.NoError(t, err)
+	_, err = VerifyNVLocked(pub, att, nonce)
+	require.EqualError(t, err, "NV index is not write-locked")
+
+	// Lock the index and try again
+	err = NVWriteLock(dev, index, pw)
+	require.NoError(t, err)
+	err = tpm2.NVWrite(dev, tpm2.HandleOwner, index, pw, data, 0)
+	require.Error(t, err)
+
+	att, err = NVCertify(dev, index, pw, signer, pw, nonce)
+	require.NoError(t, err)
+	contents, err := VerifyNVLocked(pub, att, nonce)
+	require.NoError(t, err)
+	require.Equal(t, data, contents)
+
+	// Verification fails with the wrong nonce
+	_, err = VerifyNVLocked(pub, att, []byte("other"))
+	require.Error(t, err)
+
+	// Claiming the index is locked without the TPM having signed it fails as well
+	att.Public.Attributes ^= tpm2.KeyProp(tpm2.AttrWriteLocked)
+	_, err = verifyNVAttestation(pub, att, nonce)
+	require.Error(t, err)
+}
@@ -0,0 +1,47 @@
+package tpmk
+
+import (
+	"crypto"
+	"time"
+
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpmutil"
+)
+
+// AuditRecord describes a single signing operation. It doesn't contain the digest or any other
+// data that was signed.
+type AuditRecord struct {
+	Time    time.Time
+	Handle  tpmutil.Handle
+	Hash    crypto.Hash
+	Scheme  tpm2.Algorithm
+	Success bool
+	Err     error
+}
+
+// AuditSink receives audit records of key operations. Implementations need to be safe for
+// concurrent use if the key is used concurrently.
+type AuditSink interface {
+	Record(AuditRecord)
+}
+
+// WithAudit returns a copy of the key that sends a record to sink for every signature.
+func (k RSAPrivateKey) WithAudit(sink AuditSink) RSAPrivateKey {
+	k.audit = sink
+	return k
+}
+
+// record sends an audit record to the sink, if there is one.
+func (k RSAPrivateKey) record(hash crypto.Hash, scheme tpm2.Algorithm, err error) {
+	if k.audit == nil {
+		return
+	}
+	k.audit.Record(AuditRecord{
+		Time:    time.Now(),
+		Handle:  k.handle,
+		Hash:    hash,
+		Scheme:  scheme,
+		Success: err == nil,
+		Err:     err,
+	})
+}
@@ -0,0 +1,56 @@
+package tpmk
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"testing"
+
+	"github.com/google/go-tpm-tools/simulator"
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpmutil"
+	"github.com/stretchr/testify/require"
+)
+
+type memorySink []AuditRecord
+
+func (s *memorySink) Record(r AuditRecord) { *s = append(*s, r) }
+
+func TestSignAudit(t *testing.T) {
+	dev, err := simulator.Get()
+	require.NoError(t, err)
+	defer dev.Close()
+
+	const (
+		handle tpmutil.Handle = 0x81000000
+		pw                    = ""
+		attr                  = tpm2.FlagSign | tpm2.FlagUserWithAuth | tpm2.FlagSensitiveDataOrigin
+	)
+
+	_, err = GenRSAPrimaryKey(dev, handle, pw, pw, attr)
+	require.NoError(t, err)
+	priv, err := NewRSAPrivateKey(dev, handle, pw)
+	require.NoError(t, err)
+
+	var sink memorySink
+	priv = priv.WithAudit(&sink)
+
+	digest := sha256.Sum256([]byte("This is a test"))
+	_, err = priv.Sign(nil, digest[:], crypto.SHA256)
+	require.NoError(t, err)
+	_, err = priv.Sign(nil, digest[:], &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthAuto, Hash: crypto.SHA256})
+	require.NoError(t, err)
+	_, err = priv.Sign(nil, digest[:], crypto.MD5)
+	require.Error(t, err)
+
+	require.Len(t, sink, 3)
+	for _, r := range sink {
+		require.Equal(t, handle, r.Handle)
+		require.False(t, r.Time.IsZero())
+	}
+	require.Equal(t, AuditRecord{Time: sink[0].Time, Handle: handle, Hash: crypto.SHA256, Scheme: tpm2.AlgRSASSA, Success: true}, sink[0])
+	require.Equal(t, AuditRecord{Time: sink[1].Time, Handle: handle, Hash: crypto.SHA256, Scheme: tpm2.AlgRSAPSS, Success: true}, sink[1])
+	require.Equal(t, crypto.MD5, sink[2].Hash)
+	require.False(t, sink[2].Success)
+	require.Error(t, sink[2].Err)
+}
@@ -0,0 +1,58 @@
+package tpmk
+
+import (
+	"crypto"
+	"fmt"
+)
+
+// SignBatch signs several digests with the same options and returns the signatures in the same
+// order. The signatures are the same as those of calling Sign for every digest, but a key that
+// needs a session, like one with WithPolicySession or WithHMACSession, starts it only once and
+// uses it for all of them, which saves several TPM commands per signature. The device is locked
+// for the whole batch. Every digest counts towards the key's RateLimiter and is recorded in its
+// AuditSink. It stops at the first failure and returns the index of the digest that failed in
+// the error.
+func (k RSAPrivateKey) SignBatch(digests [][]byte, opts crypto.SignerOpts) ([][]byte, error) {
+	alg := k.signatureAlgorithm(opts)
+	defer lockDevice(k.dev)()
+	scheme, err := k.sigScheme(opts)
+	if err != nil {
+		k.record(opts.HashFunc(), alg, err)
+		return nil, err
+	}
+	sign, done, err := k.startSigning(scheme)
+	if err != nil {
+		k.record(opts.HashFunc(), alg, err)
+		return nil, err
+	}
+	defer done()
+
+	signatures := make([][]byte, 0, len(digests))
+	for i, digest := range digests {
+		sig, err := k.signInBatch(sign, digest, opts)
+		k.record(opts.HashFunc(), alg, err)
+		if err != nil {
+			return nil, fmt.Errorf("signing digest %d: %v", i, err)
+		}
+		signatures = append(signatures, sig)
+	}
+	return signatures, nil
+}
+
+// signInBatch signs one digest of a batch.
+func (k RSAPrivateKey) signInBatch(sign func([]byte) ([]byte, error), digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	if err := checkDigestLength(opts.HashFunc(), digest); err != nil {
+		return nil, err
+	}
+	if err := k.allow(); err != nil {
+		return nil, err
+	}
+	sig, err := sign(digest)
+	if err != nil {
+		return nil, err
+	}
+	if err := k.checkSaltLength(opts, sig); err != nil {
+		return nil, err
+	}
+	return sig, nil
+}
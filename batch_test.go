@@ -0,0 +1,125 @@
+package tpmk
+
+import (
+	"crypto"
+	"crypto/sha256"
+	"fmt"
+	"testing"
+
+	"github.com/google/go-tpm-tools/simulator"
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpmutil"
+	"github.com/stretchr/testify/require"
+)
+
+// batchDigests returns n different digests to sign.
+func batchDigests(n int) [][]byte {
+	digests := make([][]byte, n)
+	for i := range digests {
+		d := sha256.Sum256([]byte(fmt.Sprintf("file-%d", i)))
+		digests[i] = d[:]
+	}
+	return digests
+}
+
+func TestSignBatch(t *testing.T) {
+	dev, err := simulator.Get()
+	require.NoError(t, err)
+	defer dev.Close()
+
+	const (
+		saltKey  tpmutil.Handle = 0x81000000
+		handle   tpmutil.Handle = 0x81000001
+		signOnly tpmutil.Handle = 0x81000002
+		pw                      = "password"
+		attr                    = tpm2.FlagSign | tpm2.FlagFixedTPM | tpm2.FlagUserWithAuth | tpm2.FlagFixedParent | tpm2.FlagSensitiveDataOrigin
+	)
+	_, err = GenRSAPrimaryKey(dev, saltKey, "", "", tpm2.FlagStorageDefault)
+	require.NoError(t, err)
+	_, err = GenRSAPrimaryKey(dev, handle, "", pw, attr)
+	require.NoError(t, err)
+	_, err = GenRSAPrimaryKey(dev, signOnly, "", pw, attr, WithSignOnlyPolicy())
+	require.NoError(t, err)
+	key, err := NewRSAPrivateKey(dev, handle, pw)
+	require.NoError(t, err)
+	signOnlyKey, err := NewRSAPrivateKey(dev, signOnly, pw)
+	require.NoError(t, err)
+
+	keys := map[string]RSAPrivateKey{
+		"password":     key,
+		"HMAC session": key.WithHMACSession(saltKey),
+		"sign-only":    signOnlyKey,
+	}
+	digests := batchDigests(5)
+	for name, k := range keys {
+		t.Run(name, func(t *testing.T) {
+			var sink memorySink
+			k := k.WithAudit(&sink)
+			signatures, err := k.SignBatch(digests, crypto.SHA256)
+			require.NoError(t, err)
+			require.Len(t, signatures, len(digests))
+			require.Len(t, sink, len(digests))
+
+			// PKCS#1 v1.5 signatures are deterministic, so they're the same as from Sign
+			for i, digest := range digests {
+				sig, err := k.Sign(nil, digest, crypto.SHA256)
+				require.NoError(t, err)
+				require.Equal(t, sig, signatures[i])
+			}
+
+			// No sessions are left behind
+			sessions, err := GetHandles(dev, tpm2.TPMProp(tpm2.HandleTypeHMACSession)<<24)
+			require.NoError(t, err)
+			require.Empty(t, sessions)
+			sessions, err = GetHandles(dev, tpm2.TPMProp(tpm2.HandleTypePolicySession)<<24)
+			require.NoError(t, err)
+			require.Empty(t, sessions)
+		})
+	}
+
+	// A failing digest stops the batch
+	_, err = key.SignBatch([][]byte{digests[0], []byte("too long for SHA256, too long for SHA256")}, crypto.SHA256)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "digest 1")
+
+	// Limits apply to every digest
+	limited := key.WithRateLimit(NewRateLimiter(0.001, 3))
+	_, err = limited.SignBatch(digests, crypto.SHA256)
+	require.Error(t, err)
+}
+
+func BenchmarkSignBatch(b *testing.B) {
+	dev, err := simulator.Get()
+	require.NoError(b, err)
+	defer dev.Close()
+
+	const (
+		saltKey = 0x81000000
+		handle  = 0x81000001
+		pw      = "password"
+		attr    = tpm2.FlagSign | tpm2.FlagFixedTPM | tpm2.FlagUserWithAuth | tpm2.FlagFixedParent | tpm2.FlagSensitiveDataOrigin
+	)
+	_, err = GenRSAPrimaryKey(dev, saltKey, "", "", tpm2.FlagStorageDefault)
+	require.NoError(b, err)
+	_, err = GenRSAPrimaryKey(dev, handle, "", pw, attr)
+	require.NoError(b, err)
+	key, err := NewRSAPrivateKey(dev, handle, pw)
+	require.NoError(b, err)
+
+	// Starting a salted session costs an RSA decryption in the TPM, about as much as a signature
+	key = key.WithHMACSession(saltKey)
+	b.Run("per digest", func(b *testing.B) {
+		digests := batchDigests(b.N)
+		b.ResetTimer()
+		for _, digest := range digests {
+			_, err := key.Sign(nil, digest, crypto.SHA256)
+			require.NoError(b, err)
+		}
+	})
+	b.Run("batch", func(b *testing.B) {
+		digests := batchDigests(b.N)
+		b.ResetTimer()
+		_, err := key.SignBatch(digests, crypto.SHA256)
+		require.NoError(b, err)
+	})
+}
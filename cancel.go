@@ -0,0 +1,61 @@
+package tpmk
+
+import (
+	"context"
+	"crypto"
+	"io"
+)
+
+// RunWithContext runs op, which uses dev, and returns ctx.Err() if the context is done first.
+// Nothing is run if the context is already done. TPM commands can't be cancelled, so if the
+// context ends while op is still running, dev is closed to unblock it, if it implements io.Closer,
+// and RunWithContext returns right away. Closing the device affects everyone using it, not only
+// op: keys and other callers sharing dev fail from then on, and it needs to be opened again. Op
+// is left to finish in the background, so it shouldn't set anything the caller reads after an
+// error. This bounds the time spent waiting on a slow or wedged TPM, even if closing the device
+// doesn't unblock it, for example:
+//
+//	err := RunWithContext(ctx, dev, func() (err error) {
+//	    pub, err = GenRSAPrimaryKey(dev, handle, parentPW, ownerPW, attr)
+//	    return err
+//	})
+func RunWithContext(ctx context.Context, dev io.ReadWriter, op func() error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	done := make(chan error, 1)
+	go func() { done <- op() }()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		if c, ok := dev.(io.Closer); ok {
+			c.Close()
+		}
+		return ctx.Err()
+	}
+}
+
+// SignContext signs like Sign, and stops waiting for the TPM when the context is done, see
+// RunWithContext.
+func (k RSAPrivateKey) SignContext(ctx context.Context, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	return signContext(ctx, k.dev, k, digest, opts)
+}
+
+// SignContext signs like Sign, and stops waiting for the TPM when the context is done, see
+// RunWithContext.
+func (k ECPrivateKey) SignContext(ctx context.Context, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	return signContext(ctx, k.dev, k, digest, opts)
+}
+
+func signContext(ctx context.Context, dev io.ReadWriter, key crypto.Signer, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	var signature []byte
+	err := RunWithContext(ctx, dev, func() (err error) {
+		signature, err = key.Sign(nil, digest, opts)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return signature, nil
+}
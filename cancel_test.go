@@ -0,0 +1,119 @@
+package tpmk
+
+import (
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/google/go-tpm-tools/simulator"
+	"github.com/google/go-tpm/tpm2"
+	"github.com/stretchr/testify/require"
+)
+
+// wedgedDev accepts commands but never responds until it's closed, like a hung TPM.
+type wedgedDev struct {
+	closed chan struct{}
+}
+
+func (d *wedgedDev) Write(b []byte) (int, error) { return len(b), nil }
+
+func (d *wedgedDev) Read(b []byte) (int, error) {
+	<-d.closed
+	return 0, errors.New("device closed")
+}
+
+func (d *wedgedDev) Close() error {
+	close(d.closed)
+	return nil
+}
+
+func TestSignContext(t *testing.T) {
+	sim, err := simulator.Get()
+	require.NoError(t, err)
+	defer sim.Close()
+
+	const (
+		handle = 0x81000000
+		pw     = ""
+		attr   = tpm2.FlagSign | tpm2.FlagUserWithAuth | tpm2.FlagSensitiveDataOrigin
+	)
+	_, err = GenRSAPrimaryKey(sim, handle, pw, pw, attr)
+	require.NoError(t, err)
+	dev := &recordingDev{ReadWriteCloser: sim}
+	priv, err := NewRSAPrivateKey(dev, handle, pw)
+	require.NoError(t, err)
+	digest := sha256.Sum256([]byte("This is a test"))
+
+	// Sign normally while the context is live
+	signature, err := priv.SignContext(context.Background(), digest[:], crypto.SHA256)
+	require.NoError(t, err)
+	require.NoError(t, rsa.VerifyPKCS1v15(priv.Public().(*rsa.PublicKey), crypto.SHA256, digest[:], signature))
+
+	// Nothing is sent to the TPM when the context is already done
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	dev.written.Reset()
+	_, err = priv.SignContext(ctx, digest[:], crypto.SHA256)
+	require.Equal(t, context.Canceled, err)
+	require.Zero(t, dev.written.Len())
+
+	// A hung TPM is closed when the deadline passes
+	wedged := &wedgedDev{closed: make(chan struct{})}
+	priv.dev = wedged
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = priv.SignContext(ctx, digest[:], crypto.SHA256)
+	require.Equal(t, context.DeadlineExceeded, err)
+	select {
+	case <-wedged.closed:
+	default:
+		t.Fatal("device wasn't closed")
+	}
+
+	// The signature fails on the closed device in the background and releases its lock
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(10 * time.Millisecond) {
+		devLocksMu.Lock()
+		n := len(devLocks)
+		devLocksMu.Unlock()
+		if n == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("lock of the device wasn't released")
+		}
+	}
+}
+
+func TestRunWithContext(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	wedged := &wedgedDev{closed: make(chan struct{})}
+	finished := make(chan struct{})
+	err := RunWithContext(ctx, wedged, func() error {
+		defer close(finished)
+		_, err := io.ReadFull(wedged, make([]byte, 10))
+		return err
+	})
+	require.Equal(t, context.DeadlineExceeded, err)
+	select {
+	case <-finished:
+	case <-time.After(time.Second):
+		t.Fatal("op still running on the closed device")
+	}
+
+	// Devices that stay blocked after being closed don't block the caller
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	stuck := make(chan struct{})
+	defer close(stuck)
+	err = RunWithContext(ctx, nopCloser{wedged}, func() error {
+		<-stuck
+		return nil
+	})
+	require.Equal(t, context.DeadlineExceeded, err)
+}
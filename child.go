@@ -0,0 +1,241 @@
+package tpmk
+
+import (
+	"encoding/asn1"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"regexp"
+
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpmutil"
+)
+
+// PEM block type of child key blobs
+const childKeyPEMType = "TPM CHILD KEY"
+
+// ChildKeyAttributes are the attributes of keys created by LoadChildKey. The keys are signing
+// keys that can't leave the TPM, suitable for TLS.
+const ChildKeyAttributes = tpm2.FlagSign | tpm2.FlagFixedTPM | tpm2.FlagFixedParent | tpm2.FlagSensitiveDataOrigin | tpm2.FlagUserWithAuth
+
+// childKeyName restricts the names of child keys so they can be used as file names.
+var childKeyName = regexp.MustCompile(`^[a-zA-Z0-9_.-]+$`)
+
+// childKey is the ASN.1 structure of a child key blob. The private part is encrypted by the
+// parent and can only be loaded under it.
+//
+//	TPMChildKey ::= SEQUENCE {
+//	  version INTEGER,      -- 0
+//	  parent  INTEGER,      -- Handle of the persistent parent
+//	  public  OCTET STRING, -- TPM2B_PUBLIC
+//	  private OCTET STRING  -- TPM2B_PRIVATE
+//	}
+type childKey struct {
+	Version int
+	Parent  int64
+	Public  []byte
+	Private []byte
+}
+
+// LoadChildKey loads a named RSA child key of a persistent storage key, creating it first if it
+// doesn't exist yet. This allows a device to have separate keys, for example for different TLS
+// identities, while only using one persistent handle. The key is stored as blob in the directory,
+// in the file "<name>.tpmkey", and can only be used with the TPM and parent it was created with.
+// password is the password of the child key.
+//
+// The key is loaded under a transient handle, which needs to be flushed with tpm2.FlushContext
+// when the key is no longer used.
+func LoadChildKey(dev io.ReadWriteCloser, parent tpmutil.Handle, parentPW, dir, name, password string) (RSAPrivateKey, error) {
+	if !childKeyName.MatchString(name) {
+		return RSAPrivateKey{}, fmt.Errorf("invalid key name %q", name)
+	}
+	path := filepath.Join(dir, name+".tpmkey")
+	b, err := ioutil.ReadFile(path)
+	switch {
+	case os.IsNotExist(err):
+		if b, err = createChildKey(dev, parent, parentPW, password, path); err != nil {
+			return RSAPrivateKey{}, err
+		}
+	case err != nil:
+		return RSAPrivateKey{}, err
+	}
+
+	blk, _ := pem.Decode(b)
+	if blk == nil || blk.Type != childKeyPEMType {
+		return RSAPrivateKey{}, fmt.Errorf("failed to decode PEM block containing child key in %s", path)
+	}
+	var key childKey
+	rest, err := asn1.Unmarshal(blk.Bytes, &key)
+	if err != nil {
+		return RSAPrivateKey{}, err
+	}
+	if len(rest) > 0 {
+		return RSAPrivateKey{}, errors.New("trailing data after child key")
+	}
+	if key.Version != 0 {
+		return RSAPrivateKey{}, fmt.Errorf("unsupported child key version %d", key.Version)
+	}
+	if key.Parent != int64(parent) {
+		return RSAPrivateKey{}, fmt.Errorf("child key %s belongs to parent 0x%x, not 0x%x", name, key.Parent, parent)
+	}
+	handle, err := LoadKey(dev, parent, parentPW, key.Public, key.Private)
+	if err != nil {
+		return RSAPrivateKey{}, err
+	}
+	k, err := NewRSAPrivateKey(dev, handle, password)
+	if err != nil {
+		tpm2.FlushContext(dev, handle)
+		return RSAPrivateKey{}, err
+	}
+	return k, nil
+}
+
+// createChildKey creates a child key and writes its blob to the file. The file is written under
+// a temporary name first so an interrupted attempt doesn't leave a partial blob behind.
+func createChildKey(dev io.ReadWriteCloser, parent tpmutil.Handle, parentPW, password, path string) ([]byte, error) {
+	private, public, err := GenRSAChildKey(dev, parent, parentPW, password, ChildKeyAttributes)
+	if err != nil {
+		return nil, err
+	}
+	der, err := asn1.Marshal(childKey{Parent: int64(parent), Public: public, Private: private})
+	if err != nil {
+		return nil, err
+	}
+	b := pem.EncodeToMemory(&pem.Block{Type: childKeyPEMType, Bytes: der})
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return nil, err
+	}
+	return b, nil
+}
+
+// GenRSAChildKey creates an RSA key under a storage key, such as a persistent Storage Root Key
+// created with GenRSAPrimaryKey and tpm2.FlagStorageDefault. Unlike primary keys, child keys are
+// generated randomly, and the TPM only returns them as blobs, with the private part encrypted
+// by the parent. The blobs can be stored anywhere and loaded with LoadKey whenever the key is
+// needed, which allows for any number of keys without using up persistent handles. With
+// tpm2.FlagRestricted and tpm2.FlagDecrypt set, the key is itself a storage key. Of the options,
+// only WithDuplication is supported.
+func GenRSAChildKey(dev io.ReadWriteCloser, parent tpmutil.Handle, parentPW, keyPW string, attr tpm2.KeyProp, opts ...KeyOption) (private, public []byte, err error) {
+	var o keyOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.signOnly || o.policy != nil || o.unique != nil || o.keyBits != 0 || o.selfTest {
+		return nil, nil, errors.New("unsupported option for child keys")
+	}
+	if o.duplicable && attr&(tpm2.FlagFixedTPM|tpm2.FlagFixedParent) != 0 {
+		return nil, nil, errors.New("duplicable keys can't have tpm2.FlagFixedTPM or tpm2.FlagFixedParent set")
+	}
+	pub := tpm2.Public{
+		Type:       tpm2.AlgRSA,
+		NameAlg:    tpm2.AlgSHA256,
+		Attributes: attr,
+		RSAParameters: &tpm2.RSAParams{
+			Sign: &tpm2.SigScheme{
+				Alg:  tpm2.AlgNull,
+				Hash: tpm2.AlgNull,
+			},
+			KeyBits: 2048,
+			Modulus: big.NewInt(0),
+		},
+	}
+	if isStorageKey(attr) {
+		pub.RSAParameters.Symmetric = &tpm2.SymScheme{Alg: tpm2.AlgAES, KeyBits: 128, Mode: tpm2.AlgCFB}
+	}
+	if o.duplicable {
+		pub.AuthPolicy = duplicationPolicy()
+	}
+	return tpm2.CreateKey(dev, parent, tpm2.PCRSelection{}, parentPW, keyPW, pub)
+}
+
+// LoadKey loads a key created with GenRSAChildKey under its parent and returns the transient
+// handle, which can be used with NewRSAPrivateKey. It needs to be flushed with tpm2.FlushContext
+// when the key is no longer used.
+func LoadKey(dev io.ReadWriteCloser, parent tpmutil.Handle, parentPW string, public, private []byte) (tpmutil.Handle, error) {
+	handle, _, err := tpm2.Load(dev, parent, parentPW, public, private)
+	if err != nil {
+		return 0, foreignKeyError(err)
+	}
+	return handle, nil
+}
+
+// LoadKeyFromFiles loads a key from the public and private files written by tpm2_create of
+// tpm2-tools (-u and -r), or tpm2_pytss, under its parent. Unlike the blobs of GenRSAChildKey,
+// the files hold TPM2B structures, prefixed with their size as big-endian uint16. Like LoadKey, it
+// returns the transient handle, which needs to be flushed with tpm2.FlushContext.
+func LoadKeyFromFiles(dev io.ReadWriteCloser, parent tpmutil.Handle, parentPW, pubPath, privPath string) (tpmutil.Handle, error) {
+	public, err := readTPM2BFile(pubPath)
+	if err != nil {
+		return 0, err
+	}
+	private, err := readTPM2BFile(privPath)
+	if err != nil {
+		return 0, err
+	}
+	return LoadKey(dev, parent, parentPW, public, private)
+}
+
+// readTPM2BFile reads a file holding a single TPM2B structure and returns its contents without
+// the size prefix.
+func readTPM2BFile(path string) ([]byte, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) < 2 {
+		return nil, fmt.Errorf("%s is too short to be a TPM2B structure", path)
+	}
+	size := int(binary.BigEndian.Uint16(b))
+	switch {
+	case size == 0:
+		return nil, fmt.Errorf("%s holds an empty TPM2B structure", path)
+	case size != len(b)-2:
+		return nil, fmt.Errorf("size %d in %s doesn't match the %d bytes that follow it", size, path, len(b)-2)
+	}
+	return b[2:], nil
+}
+
+// ChangeAuth changes the password of a child key, such as one created with GenRSAChildKey, that
+// is loaded under the parent. The TPM returns a new private blob with the new password, which
+// needs to be stored and loaded with LoadKey in place of the old one. The old blob remains valid
+// with the old password, so it has to be deleted for the change to have any effect. The loaded
+// key keeps the old password until it's flushed. Primary keys can't change their password since
+// they aren't loaded from blobs, create a child key instead if the password needs to be rotated.
+// Persistent handles and hierarchies are rejected, handle needs to be a loaded child key.
+func ChangeAuth(dev io.ReadWriteCloser, handle, parent tpmutil.Handle, oldPW, newPW string) ([]byte, error) {
+	switch tpm2.HandleType(handle >> 24) {
+	case tpm2.HandleTypePersistent, tpm2.HandleTypePermanent:
+		return nil, errors.New("the password of primary keys can't be changed, use a child key created with GenRSAChildKey to be able to change it")
+	}
+	cmd, err := encodeCommand(
+		[]interface{}{handle, parent},
+		[]tpm2.AuthCommand{passwordAuth(oldPW)},
+		[]byte(newPW),
+	)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := runCommand(dev, tpm2.TagSessions, cmdObjectChangeAuth, cmd)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		paramSize uint32
+		private   []byte
+	)
+	if _, err := tpmutil.Unpack(resp, &paramSize, &private); err != nil {
+		return nil, err
+	}
+	return private, nil
+}
@@ -0,0 +1,208 @@
+package tpmk
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-tpm-tools/simulator"
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpmutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadChildKey(t *testing.T) {
+	const (
+		parent tpmutil.Handle = 0x81000000
+		pw                    = ""
+	)
+	dev, err := simulator.Get()
+	require.NoError(t, err)
+	defer dev.Close()
+
+	_, err = GenRSAPrimaryKey(dev, parent, pw, pw, tpm2.FlagStorageDefault)
+	require.NoError(t, err)
+
+	dir, err := ioutil.TempDir("", "tpmk")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// Create three identities under the same parent, only one is loaded at a time
+	names := []string{"web", "mqtt", "client"}
+	for _, name := range names {
+		key, err := LoadChildKey(dev, parent, pw, dir, name, "pw-"+name)
+		require.NoError(t, err)
+		require.NoError(t, tpm2.FlushContext(dev, key.Handle()))
+	}
+	for _, name := range names {
+		_, err := os.Stat(filepath.Join(dir, name+".tpmkey"))
+		require.NoError(t, err)
+	}
+
+	// Loading them again returns the same keys, each one is used in its own TLS config
+	for i, name := range names {
+		key, err := LoadChildKey(dev, parent, pw, dir, name, "pw-"+name)
+		require.NoError(t, err)
+		other, err := LoadChildKey(dev, parent, pw, dir, names[(i+1)%len(names)], "pw-"+names[(i+1)%len(names)])
+		require.NoError(t, err)
+		require.NotEqual(t, key.Public(), other.Public())
+
+		testMutualTLS(t, key, other)
+		require.NoError(t, tpm2.FlushContext(dev, other.Handle()))
+
+		again, err := LoadChildKey(dev, parent, pw, dir, name, "pw-"+name)
+		require.NoError(t, err)
+		require.Equal(t, key.Public(), again.Public())
+		require.NoError(t, tpm2.FlushContext(dev, key.Handle()))
+		require.NoError(t, tpm2.FlushContext(dev, again.Handle()))
+	}
+
+	// Invalid names and blobs of other parents are rejected
+	_, err = LoadChildKey(dev, parent, pw, dir, "../web", pw)
+	require.Error(t, err)
+	_, err = LoadChildKey(dev, parent+1, pw, dir, "web", pw)
+	require.Error(t, err)
+}
+
+func TestGenRSAChildKey(t *testing.T) {
+	const (
+		srk tpmutil.Handle = 0x81000000
+		pw                 = "key-password"
+	)
+	dev, err := simulator.Get()
+	require.NoError(t, err)
+	defer dev.Close()
+
+	_, err = GenRSAPrimaryKey(dev, srk, "", "", tpm2.FlagStorageDefault)
+	require.NoError(t, err)
+
+	// An intermediate storage key with a signing key under it
+	private, public, err := GenRSAChildKey(dev, srk, "", "", tpm2.FlagStorageDefault)
+	require.NoError(t, err)
+	parent, err := LoadKey(dev, srk, "", public, private)
+	require.NoError(t, err)
+	defer tpm2.FlushContext(dev, parent)
+	private, public, err = GenRSAChildKey(dev, parent, "", pw, ChildKeyAttributes)
+	require.NoError(t, err)
+	handle, err := LoadKey(dev, parent, "", public, private)
+	require.NoError(t, err)
+
+	key, err := NewRSAPrivateKey(dev, handle, pw)
+	require.NoError(t, err)
+	digest := sha256.Sum256([]byte("This is a test"))
+	sig, err := key.Sign(nil, digest[:], crypto.SHA256)
+	require.NoError(t, err)
+	require.NoError(t, rsa.VerifyPKCS1v15(key.Public().(*rsa.PublicKey), crypto.SHA256, digest[:], sig))
+
+	require.NoError(t, tpm2.FlushContext(dev, handle))
+
+	// The blobs can only be loaded under their parent
+	_, err = LoadKey(dev, srk, "", public, private)
+	require.Equal(t, ErrForeignKey, err)
+}
+
+func TestChangeAuth(t *testing.T) {
+	const (
+		parent tpmutil.Handle = 0x81000000
+		pw                    = ""
+		oldPW                 = "old"
+		newPW                 = "new"
+	)
+	dev, err := simulator.Get()
+	require.NoError(t, err)
+	defer dev.Close()
+
+	_, err = GenRSAPrimaryKey(dev, parent, pw, pw, tpm2.FlagStorageDefault)
+	require.NoError(t, err)
+	private, public, err := GenRSAChildKey(dev, parent, pw, oldPW, ChildKeyAttributes)
+	require.NoError(t, err)
+	handle, err := LoadKey(dev, parent, pw, public, private)
+	require.NoError(t, err)
+	newPrivate, err := ChangeAuth(dev, handle, parent, oldPW, newPW)
+	require.NoError(t, err)
+	require.NoError(t, tpm2.FlushContext(dev, handle))
+
+	// The new blob needs the new password
+	handle, err = LoadKey(dev, parent, pw, public, newPrivate)
+	require.NoError(t, err)
+	defer tpm2.FlushContext(dev, handle)
+	digest := sha256.Sum256([]byte("rotated"))
+	key, err := NewRSAPrivateKey(dev, handle, oldPW)
+	require.NoError(t, err)
+	_, err = key.Sign(nil, digest[:], crypto.SHA256)
+	require.Error(t, err)
+	key, err = NewRSAPrivateKey(dev, handle, newPW)
+	require.NoError(t, err)
+	sig, err := key.Sign(nil, digest[:], crypto.SHA256)
+	require.NoError(t, err)
+	require.NoError(t, rsa.VerifyPKCS1v15(key.Public().(*rsa.PublicKey), crypto.SHA256, digest[:], sig))
+
+	// Primary keys and hierarchies can't be changed
+	const msg = "the password of primary keys can't be changed, use a child key created with GenRSAChildKey to be able to change it"
+	_, err = ChangeAuth(dev, parent, parent, pw, newPW)
+	require.EqualError(t, err, msg)
+	_, err = ChangeAuth(dev, tpm2.HandleOwner, parent, pw, newPW)
+	require.EqualError(t, err, msg)
+}
+
+func TestLoadKeyFromFiles(t *testing.T) {
+	// The fixture is a child key in the file format of tpm2_create, created under the storage key
+	// of a simulator with the fixed seed 1. The storage key is derived from the seed, so it can be
+	// recreated to load it.
+	dev, err := simulator.GetWithFixedSeedInsecure(1)
+	require.NoError(t, err)
+	defer dev.Close()
+
+	const (
+		parent tpmutil.Handle = 0x81000001
+		pw                    = "key-password"
+	)
+	_, err = GenRSAPrimaryKey(dev, parent, "", "", tpm2.FlagStorageDefault)
+	require.NoError(t, err)
+
+	handle, err := LoadKeyFromFiles(dev, parent, "", "testdata/tpm2-tools/key.pub", "testdata/tpm2-tools/key.priv")
+	require.NoError(t, err)
+	defer tpm2.FlushContext(dev, handle)
+	priv, err := NewRSAPrivateKey(dev, handle, pw)
+	require.NoError(t, err)
+	digest := sha256.Sum256([]byte("This is a test"))
+	sig, err := priv.Sign(nil, digest[:], crypto.SHA256)
+	require.NoError(t, err)
+	require.NoError(t, rsa.VerifyPKCS1v15(priv.Public().(*rsa.PublicKey), crypto.SHA256, digest[:], sig))
+
+	// Files that aren't a single TPM2B structure
+	pub, err := ioutil.ReadFile("testdata/tpm2-tools/key.pub")
+	require.NoError(t, err)
+	dir, err := ioutil.TempDir("", "tpmk")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	tests := map[string]struct {
+		content []byte
+		err     string
+	}{
+		"empty file":       {nil, "is too short to be a TPM2B structure"},
+		"size only":        {[]byte{0x01}, "is too short to be a TPM2B structure"},
+		"empty structure":  {[]byte{0, 0}, "holds an empty TPM2B structure"},
+		"no size prefix":   {pub[2:], "doesn't match the 276 bytes that follow it"},
+		"truncated":        {pub[:len(pub)-1], "size 278 in"},
+		"trailing data":    {append(pub[:len(pub):len(pub)], 0), "doesn't match the 279 bytes that follow it"},
+		"little-endian":    {append([]byte{pub[1], pub[0]}, pub[2:]...), "size 5633 in"},
+		"missing the file": {nil, "no such file or directory"},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(dir, "key.pub")
+			os.Remove(path)
+			if name != "missing the file" {
+				require.NoError(t, ioutil.WriteFile(path, test.content, 0600))
+			}
+			_, err := LoadKeyFromFiles(dev, parent, "", path, "testdata/tpm2-tools/key.priv")
+			require.Error(t, err)
+			require.Contains(t, err.Error(), test.err)
+		})
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -72,6 +73,32 @@ func parseNVAttributes(s string) (tpm2.NVAttr, error) {
 	return nvAttr, nil
 }
 
+// formatKeyAttributes is the reverse of parseKeyAttributes, listing the attributes in the order
+// of their bits.
+func formatKeyAttributes(attr tpm2.KeyProp) string {
+	var names []string
+	for name, v := range stringToKeyAttribute {
+		if attr&v != 0 {
+			names = append(names, name)
+		}
+	}
+	sort.Slice(names, func(i, j int) bool { return stringToKeyAttribute[names[i]] < stringToKeyAttribute[names[j]] })
+	return strings.Join(names, "|")
+}
+
+// formatNVAttributes is the reverse of parseNVAttributes, listing the attributes in the order
+// of their bits.
+func formatNVAttributes(attr tpm2.NVAttr) string {
+	var names []string
+	for name, v := range stringToNVAttribute {
+		if attr&v != 0 {
+			names = append(names, name)
+		}
+	}
+	sort.Slice(names, func(i, j int) bool { return stringToNVAttribute[names[i]] < stringToNVAttribute[names[j]] })
+	return strings.Join(names, "|")
+}
+
 var stringToKeyAttribute = map[string]tpm2.KeyProp{
 	"fixedtpm":            tpm2.FlagFixedTPM,
 	"fixedparent":         tpm2.FlagFixedParent,
@@ -28,3 +28,10 @@ func TestParseNVAttributes(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, expected, actual)
 }
+
+func TestFormatAttributes(t *testing.T) {
+	keyAttr := tpm2.FlagSign | tpm2.FlagFixedTPM | tpm2.FlagFixedParent
+	require.Equal(t, "fixedtpm|fixedparent|sign", formatKeyAttributes(keyAttr))
+	nvAttr := tpm2.AttrOwnerWrite | tpm2.AttrOwnerRead | tpm2.AttrAuthRead | tpm2.AttrPPRead
+	require.Equal(t, "ownerwrite|ppread|ownerread|authread", formatNVAttributes(nvAttr))
+}
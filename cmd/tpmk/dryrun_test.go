@@ -0,0 +1,54 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/folbricht/tpmk"
+	"github.com/google/go-tpm-tools/simulator"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDryRun(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "tpmk")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpdir)
+
+	pubKeyFile := filepath.Join(tmpdir, "pub-key.pem")
+	dataFile := filepath.Join(tmpdir, "data")
+	require.NoError(t, ioutil.WriteFile(dataFile, []byte("This is a test"), 0644))
+
+	// Open sim device
+	var dev io.ReadWriteCloser
+	dev, err = simulator.Get()
+	require.NoError(t, err)
+	defer dev.Close()
+	tpmk.SimDev = nopCloser{dev}
+
+	// Provision a key and an NV index in dry-run mode
+	cmd := newKeyGenCommand()
+	cmd.SetArgs([]string{"-d", "sim", "--dry-run", "0x81000000", pubKeyFile})
+	require.NoError(t, cmd.Execute())
+	cmd = newNVWriteCommand()
+	cmd.SetArgs([]string{"-d", "sim", "--dry-run", "0x1000000", dataFile})
+	require.NoError(t, cmd.Execute())
+
+	// Nothing should have been created
+	keys, err := tpmk.KeyList(dev)
+	require.NoError(t, err)
+	require.Empty(t, keys)
+	indexes, err := tpmk.NVList(dev)
+	require.NoError(t, err)
+	require.Empty(t, indexes)
+	_, err = os.Stat(pubKeyFile)
+	require.True(t, os.IsNotExist(err))
+
+	// A dry-run for an existing index fails
+	require.NoError(t, tpmk.NVWrite(dev, 0x1000000, []byte("data"), "", tpmk.NVDefaultAttr))
+	cmd = newNVWriteCommand()
+	cmd.SetArgs([]string{"-d", "sim", "--dry-run", "0x1000000", dataFile})
+	require.Error(t, cmd.Execute())
+}
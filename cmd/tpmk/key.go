@@ -16,6 +16,8 @@ func newKeyCommand() *cobra.Command {
 		newKeyReadCommand(),
 		newKeyLsCommand(),
 		newKeyImportCommand(),
+		newKeySignCommand(),
+		newKeyServeCommand(),
 	)
 	return cmd
 }
@@ -1,10 +1,15 @@
 package main
 
 import (
+	"encoding/hex"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 
 	"github.com/folbricht/tpmk"
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpmutil"
 	"github.com/pkg/errors"
 	"github.com/spf13/cobra"
 )
@@ -13,6 +18,8 @@ type keygenOptions struct {
 	device   string
 	password string
 	attr     string
+	policy   string
+	dryRun   bool
 }
 
 func newKeyGenCommand() *cobra.Command {
@@ -38,6 +45,17 @@ Available attributes:
   decrypt
   sign
 
+With noda, failed password attempts don't trigger the TPM's
+dictionary attack lockout. Use it for keys in automated services
+where lockouts are undesirable, and only with strong passwords.
+
+With --policy, the key can only be used in a session that satisfies
+the policy with the given SHA256 digest (hex). userwithauth is
+cleared and adminwithpolicy set.
+
+With --dry-run, the key that would be generated is reported but
+nothing is changed in the TPM.
+
 Use '-' to write the key to STDOUT.`,
 		Example: `  tpmk key generate 0x81000000 public.pem`,
 		Args:    cobra.ExactArgs(2),
@@ -50,6 +68,8 @@ Use '-' to write the key to STDOUT.`,
 	flags.StringVarP(&opt.device, "device", "d", "/dev/tpmrm0", "TPM device, 'sim' for simulator")
 	flags.StringVarP(&opt.password, "password", "p", "", "Password")
 	flags.StringVarP(&opt.attr, "attributes", "a", "sign|decrypt|userwithauth|sensitivedataorigin", "Key attributes")
+	flags.StringVar(&opt.policy, "policy", "", "Policy digest (hex) required to use the key")
+	flags.BoolVar(&opt.dryRun, "dry-run", false, "Only report what would be done without changing the TPM")
 	return cmd
 }
 
@@ -64,6 +84,14 @@ func runKeyGen(opt keygenOptions, args []string) error {
 	if err != nil {
 		return errors.Wrap(err, "key attributes")
 	}
+	var keyOpts []tpmk.KeyOption
+	if opt.policy != "" {
+		policy, err := hex.DecodeString(opt.policy)
+		if err != nil {
+			return errors.Wrap(err, "policy")
+		}
+		keyOpts = append(keyOpts, tpmk.WithPolicy(policy))
+	}
 
 	// Open device or simulator
 	dev, err := tpmk.OpenDevice(opt.device)
@@ -72,8 +100,12 @@ func runKeyGen(opt keygenOptions, args []string) error {
 	}
 	defer dev.Close()
 
+	if opt.dryRun {
+		return keyGenDryRun(dev, handle, attr)
+	}
+
 	// Generate the key
-	pub, err := tpmk.GenRSAPrimaryKey(dev, handle, opt.password, opt.password, attr)
+	pub, err := tpmk.GenRSAPrimaryKey(dev, handle, opt.password, opt.password, attr, keyOpts...)
 	if err != nil {
 		return err
 	}
@@ -91,3 +123,18 @@ func runKeyGen(opt keygenOptions, args []string) error {
 	}
 	return ioutil.WriteFile(output, pem, 0755)
 }
+
+// keyGenDryRun reports the key that would be generated and whether the handle is already in use.
+func keyGenDryRun(dev io.ReadWriteCloser, handle tpmutil.Handle, attr tpm2.KeyProp) error {
+	handles, err := tpmk.KeyList(dev)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("generate primary RSA key 0x%x with attributes %s\n", handle, formatKeyAttributes(attr))
+	for _, h := range handles {
+		if h == handle {
+			fmt.Printf("handle 0x%x is already in use, generating only succeeds if it holds the same key\n", handle)
+		}
+	}
+	return nil
+}
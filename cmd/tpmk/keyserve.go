@@ -0,0 +1,94 @@
+package main
+
+import (
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+
+	"github.com/folbricht/tpmk"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+type keyServeOptions struct {
+	device   string
+	password string
+	mode     string
+}
+
+func newKeyServeCommand() *cobra.Command {
+	var opt keyServeOptions
+
+	cmd := &cobra.Command{
+		Use:   "serve <handle> <socket>",
+		Short: "Serve a key on a unix socket",
+		Long: `Expose a key in the TPM to other processes on a unix socket.
+Processes that can't open the TPM, for example because they're
+sandboxed, can then sign with the key through the socket using
+tpmk.DialSigner. Access to the key is controlled with the
+permissions of the socket.
+
+The command runs until it's interrupted, the socket is removed
+when it exits.`,
+		Example: `  tpmk key serve --mode 0660 0x81000000 /run/tpmk.sock`,
+		Args:    cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runKeyServe(opt, args)
+		},
+		SilenceUsage: true,
+	}
+	flags := cmd.Flags()
+	flags.StringVarP(&opt.device, "device", "d", "/dev/tpmrm0", "TPM device, 'sim' for simulator")
+	flags.StringVarP(&opt.password, "password", "p", "", "Password")
+	flags.StringVarP(&opt.mode, "mode", "m", "0600", "Permissions of the socket")
+	return cmd
+}
+
+func runKeyServe(opt keyServeOptions, args []string) error {
+	// Parse arguments
+	handle, err := parseHandle(args[0])
+	if err != nil {
+		return err
+	}
+	socket := args[1]
+	mode, err := strconv.ParseUint(opt.mode, 8, 32)
+	if err != nil {
+		return errors.Wrap(err, "parsing mode")
+	}
+
+	// Open device or simulator
+	dev, err := tpmk.OpenDevice(opt.device)
+	if err != nil {
+		return err
+	}
+	defer dev.Close()
+
+	priv, err := tpmk.NewRSAPrivateKey(dev, handle, opt.password)
+	if err != nil {
+		return errors.Wrap(err, "reading key")
+	}
+
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+	if err := os.Chmod(socket, os.FileMode(mode)); err != nil {
+		return err
+	}
+
+	// Stop serving on SIGINT or SIGTERM, closing the listener removes the socket
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(stop)
+	done := make(chan error, 1)
+	go func() { done <- tpmk.NewSignerServer(priv).Serve(l) }()
+	select {
+	case <-stop:
+		return nil
+	case err := <-done:
+		return err
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"io/ioutil"
+	"os"
+
+	"github.com/folbricht/tpmk"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+type keySignOptions struct {
+	device   string
+	password string
+	pss      bool
+}
+
+func newKeySignCommand() *cobra.Command {
+	var opt keySignOptions
+
+	cmd := &cobra.Command{
+		Use:   "sign <handle> <file> <signature>",
+		Short: "Sign data with a key",
+		Long: `Sign the SHA256 hash of a file with a key in the TPM. The
+signature uses RSASSA-PKCS1-v1_5 unless --pss is given. If the key
+is restricted to one of the schemes, the other can't be used.
+
+Use '-' to read the data from STDIN, or to write the signature
+to STDOUT.`,
+		Example: `  tpmk key sign --pss 0x81000000 data.txt data.sig`,
+		Args:    cobra.ExactArgs(3),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runKeySign(opt, args)
+		},
+		SilenceUsage: true,
+	}
+	flags := cmd.Flags()
+	flags.StringVarP(&opt.device, "device", "d", "/dev/tpmrm0", "TPM device, 'sim' for simulator")
+	flags.StringVarP(&opt.password, "password", "p", "", "Password")
+	flags.BoolVar(&opt.pss, "pss", false, "Use the RSASSA-PSS signature scheme instead of PKCS1 v1.5")
+	return cmd
+}
+
+func runKeySign(opt keySignOptions, args []string) error {
+	// Parse arguments
+	handle, err := parseHandle(args[0])
+	if err != nil {
+		return err
+	}
+	input := args[1]
+	output := args[2]
+
+	// Read the input, from file or stdin
+	var b []byte
+	if input == "-" {
+		b, err = ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			return err
+		}
+	} else {
+		b, err = ioutil.ReadFile(input)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Open device or simulator
+	dev, err := tpmk.OpenDevice(opt.device)
+	if err != nil {
+		return err
+	}
+	defer dev.Close()
+
+	priv, err := tpmk.NewRSAPrivateKey(dev, handle, opt.password)
+	if err != nil {
+		return errors.Wrap(err, "reading key")
+	}
+
+	// Sign the hash of the data with the selected scheme
+	var opts crypto.SignerOpts = crypto.SHA256
+	if opt.pss {
+		opts = &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthAuto, Hash: crypto.SHA256}
+	}
+	digest := sha256.Sum256(b)
+	sig, err := priv.Sign(nil, digest[:], opts)
+	if err != nil {
+		return errors.Wrap(err, "signing")
+	}
+
+	// Write the signature to file or STDOUT
+	if output == "-" {
+		_, err = os.Stdout.Write(sig)
+		return err
+	}
+	return ioutil.WriteFile(output, sig, 0755)
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/folbricht/tpmk"
+	"github.com/google/go-tpm-tools/simulator"
+	"github.com/google/go-tpm/tpm2"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeySignScheme(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "tpmk")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpdir)
+
+	dataFile := filepath.Join(tmpdir, "data")
+	sigFile := filepath.Join(tmpdir, "data.sig")
+	data := []byte("This is a test")
+	require.NoError(t, ioutil.WriteFile(dataFile, data, 0644))
+
+	// Open sim device
+	var dev io.ReadWriteCloser
+	dev, err = simulator.Get()
+	require.NoError(t, err)
+	defer dev.Close()
+	tpmk.SimDev = nopCloser{dev}
+
+	// Create a key that can only be used with PKCS1 v1.5
+	const handle = "0x81000000"
+	h, pub, err := tpm2.CreatePrimary(dev, tpm2.HandleOwner, tpm2.PCRSelection{}, "", "", tpm2.Public{
+		Type:       tpm2.AlgRSA,
+		NameAlg:    tpm2.AlgSHA256,
+		Attributes: tpm2.FlagSign | tpm2.FlagUserWithAuth | tpm2.FlagSensitiveDataOrigin,
+		RSAParameters: &tpm2.RSAParams{
+			Sign:    &tpm2.SigScheme{Alg: tpm2.AlgRSASSA, Hash: tpm2.AlgSHA256},
+			KeyBits: 2048,
+			Modulus: big.NewInt(0),
+		},
+	})
+	require.NoError(t, err)
+	require.NoError(t, tpm2.EvictControl(dev, "", tpm2.HandleOwner, h, 0x81000000))
+	require.NoError(t, tpm2.FlushContext(dev, h))
+
+	// Signing with PSS should fail with a clear error
+	cmd := newKeySignCommand()
+	cmd.SetArgs([]string{"-d", "sim", "--pss", handle, dataFile, sigFile})
+	err = cmd.Execute()
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "restricted to the PKCS#1 v1.5 signature scheme")
+
+	// The default scheme works
+	cmd = newKeySignCommand()
+	cmd.SetArgs([]string{"-d", "sim", handle, dataFile, sigFile})
+	err = cmd.Execute()
+	require.NoError(t, err)
+
+	sig, err := ioutil.ReadFile(sigFile)
+	require.NoError(t, err)
+	digest := sha256.Sum256(data)
+	err = rsa.VerifyPKCS1v15(pub.(*rsa.PublicKey), crypto.SHA256, digest[:], sig)
+	require.NoError(t, err)
+}
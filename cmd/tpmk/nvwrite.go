@@ -1,10 +1,14 @@
 package main
 
 import (
+	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 
 	"github.com/folbricht/tpmk"
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpmutil"
 	"github.com/pkg/errors"
 	"github.com/spf13/cobra"
 )
@@ -13,6 +17,7 @@ type nvwriteOptions struct {
 	device   string
 	password string
 	attr     string
+	dryRun   bool
 }
 
 func newNVWriteCommand() *cobra.Command {
@@ -48,6 +53,9 @@ Available attributes:
   platformcreate
   readstclear
 
+With --dry-run, the index that would be defined is reported but
+nothing is changed in the TPM. It fails if the index exists.
+
 Use '-' to read the data from STDIN.`,
 		Example: `  tpmk nv write 0x1500000 cert.der`,
 		Args:    cobra.ExactArgs(2),
@@ -60,6 +68,7 @@ Use '-' to read the data from STDIN.`,
 	flags.StringVarP(&opt.device, "device", "d", "/dev/tpmrm0", "TPM device, 'sim' for simulator")
 	flags.StringVarP(&opt.password, "password", "p", "", "Password")
 	flags.StringVarP(&opt.attr, "attributes", "a", "ownerwrite|ownerread|authread|ppread", "NV index attributes")
+	flags.BoolVar(&opt.dryRun, "dry-run", false, "Only report what would be done without changing the TPM")
 	return cmd
 }
 
@@ -96,6 +105,26 @@ func runNVWrite(opt nvwriteOptions, args []string) error {
 	}
 	defer dev.Close()
 
+	if opt.dryRun {
+		// NVWrite defines the index with the default attributes
+		return nvWriteDryRun(dev, index, tpmk.NVDefaultAttr, len(b))
+	}
+
 	// Write to the index
 	return tpmk.NVWrite(dev, index, b, opt.password, attr)
 }
+
+// nvWriteDryRun reports the NV index that would be defined and fails if it already exists.
+func nvWriteDryRun(dev io.ReadWriteCloser, index tpmutil.Handle, attr tpm2.NVAttr, size int) error {
+	indexes, err := tpmk.NVList(dev)
+	if err != nil {
+		return err
+	}
+	for _, i := range indexes {
+		if i == index {
+			return fmt.Errorf("NV index 0x%x already exists", index)
+		}
+	}
+	fmt.Printf("define NV index 0x%x of %d bytes with attributes %s and write the data\n", index, size, formatNVAttributes(attr))
+	return nil
+}
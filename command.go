@@ -0,0 +1,170 @@
+package tpmk
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpmutil"
+)
+
+// TPM command codes that have no corresponding function in go-tpm.
+const (
+	cmdClear                 tpmutil.Command = 0x00000126
+	cmdHierarchyChangeAuth   tpmutil.Command = 0x00000129
+	cmdCreatePrimary         tpmutil.Command = 0x00000131
+	cmdNVSetBits             tpmutil.Command = 0x00000135
+	cmdNVWriteLock           tpmutil.Command = 0x00000138
+	cmdPCRReset              tpmutil.Command = 0x0000013D
+	cmdSequenceComplete      tpmutil.Command = 0x0000013E
+	cmdNVCertify             tpmutil.Command = 0x00000184
+	cmdPolicyNV              tpmutil.Command = 0x00000149
+	cmdStartup               tpmutil.Command = 0x00000144
+	cmdDuplicate             tpmutil.Command = 0x0000014B
+	cmdGetSessionAuditDigest tpmutil.Command = 0x0000014D
+	cmdObjectChangeAuth      tpmutil.Command = 0x00000150
+	cmdHMAC                  tpmutil.Command = 0x00000155
+	cmdImport                tpmutil.Command = 0x00000156
+	cmdQuote                 tpmutil.Command = 0x00000158
+	cmdHMACStart             tpmutil.Command = 0x0000015B
+	cmdSequenceUpdate        tpmutil.Command = 0x0000015C
+	cmdSign                  tpmutil.Command = 0x0000015D
+	cmdPolicyAuthValue       tpmutil.Command = 0x0000016B
+	cmdPolicyCommandCode     tpmutil.Command = 0x0000016C
+	cmdStartAuthSession      tpmutil.Command = 0x00000176
+	cmdVerifySig             tpmutil.Command = 0x00000177
+	cmdGetCap                tpmutil.Command = 0x0000017A
+	cmdTestParms             tpmutil.Command = 0x0000018A
+	cmdSignSequenceComplete  tpmutil.Command = 0x000001A4
+	cmdSignSequenceStart     tpmutil.Command = 0x000001AA
+)
+
+// TPM command codes of functions in go-tpm, which doesn't export them. They're used to name the
+// commands sent to a device, see NewLoggedDevice.
+const (
+	cmdNVUndefineSpaceSpecial tpmutil.Command = 0x0000011F
+	cmdEvictControl           tpmutil.Command = 0x00000120
+	cmdNVUndefineSpace        tpmutil.Command = 0x00000122
+	cmdClockSet               tpmutil.Command = 0x00000128
+	cmdNVDefineSpace          tpmutil.Command = 0x0000012A
+	cmdPCRAllocate            tpmutil.Command = 0x0000012B
+	cmdNVIncrement            tpmutil.Command = 0x00000134
+	cmdNVExtend               tpmutil.Command = 0x00000136
+	cmdNVWrite                tpmutil.Command = 0x00000137
+	cmdPCREvent               tpmutil.Command = 0x0000013C
+	cmdShutdown               tpmutil.Command = 0x00000145
+	cmdStirRandom             tpmutil.Command = 0x00000146
+	cmdActivateCredential     tpmutil.Command = 0x00000147
+	cmdCertify                tpmutil.Command = 0x00000148
+	cmdCertifyCreation        tpmutil.Command = 0x0000014A
+	cmdNVRead                 tpmutil.Command = 0x0000014E
+	cmdCreate                 tpmutil.Command = 0x00000153
+	cmdLoad                   tpmutil.Command = 0x00000157
+	cmdRSADecrypt             tpmutil.Command = 0x00000159
+	cmdUnseal                 tpmutil.Command = 0x0000015E
+	cmdContextLoad            tpmutil.Command = 0x00000161
+	cmdContextSave            tpmutil.Command = 0x00000162
+	cmdEncryptDecrypt         tpmutil.Command = 0x00000164
+	cmdFlushContext           tpmutil.Command = 0x00000165
+	cmdLoadExternal           tpmutil.Command = 0x00000167
+	cmdMakeCredential         tpmutil.Command = 0x00000168
+	cmdNVReadPublic           tpmutil.Command = 0x00000169
+	cmdReadPublic             tpmutil.Command = 0x00000173
+	cmdRSAEncrypt             tpmutil.Command = 0x00000174
+	cmdGetRandom              tpmutil.Command = 0x0000017B
+	cmdHash                   tpmutil.Command = 0x0000017D
+	cmdPCRRead                tpmutil.Command = 0x0000017E
+	cmdReadClock              tpmutil.Command = 0x00000181
+	cmdPCRExtend              tpmutil.Command = 0x00000182
+	cmdPolicyGetDigest        tpmutil.Command = 0x00000189
+	cmdPolicyPassword         tpmutil.Command = 0x0000018C
+)
+
+// runCommand executes a TPM command that isn't available in go-tpm. The response code is decoded
+// into the same error types that go-tpm uses.
+func runCommand(dev io.ReadWriter, tag tpmutil.Tag, cmd tpmutil.Command, in ...interface{}) ([]byte, error) {
+	resp, code, err := tpmutil.RunCommand(dev, tag, cmd, in...)
+	if err != nil {
+		return nil, err
+	}
+	if err := decodeResponse(code); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// decodeResponse turns a TPM response code into an error, following the "Response Code
+// Evaluation" chart in Part 1 of the TPM 2.0 specification.
+func decodeResponse(code tpmutil.ResponseCode) error {
+	switch {
+	case code == tpmutil.RCSuccess:
+		return nil
+	case code&0x180 == 0: // TPM 1.2 response code
+		return fmt.Errorf("response status 0x%x", code)
+	case code&0x80 == 0 && code&0x400 > 0:
+		return tpm2.VendorError{Code: uint32(code)}
+	case code&0x80 == 0 && code&0x800 > 0:
+		return tpm2.Warning{Code: tpm2.RCWarn(code & 0x7f)}
+	case code&0x80 == 0:
+		return tpm2.Error{Code: tpm2.RCFmt0(code & 0x7f)}
+	case code&0x40 > 0:
+		return tpm2.ParameterError{Code: tpm2.RCFmt1(code & 0x3f), Parameter: tpm2.RCIndex((code & 0xf00) >> 8)}
+	case code&0x800 == 0:
+		return tpm2.HandleError{Code: tpm2.RCFmt1(code & 0x3f), Handle: tpm2.RCIndex((code & 0x700) >> 8)}
+	default:
+		return tpm2.SessionError{Code: tpm2.RCFmt1(code & 0x3f), Session: tpm2.RCIndex((code & 0x700) >> 8)}
+	}
+}
+
+// isTPMError returns true if the error was returned by the TPM in response to a command, as
+// opposed to errors communicating with it.
+func isTPMError(err error) bool {
+	switch err.(type) {
+	case tpm2.Error, tpm2.Warning, tpm2.VendorError, tpm2.ParameterError, tpm2.HandleError, tpm2.SessionError:
+		return true
+	default:
+		return false
+	}
+}
+
+// encodeAuthArea serializes authorization sessions for the authorization area of a command.
+func encodeAuthArea(sessions ...tpm2.AuthCommand) ([]byte, error) {
+	var b []byte
+	for _, s := range sessions {
+		buf, err := tpmutil.Pack(s)
+		if err != nil {
+			return nil, err
+		}
+		b = append(b, buf...)
+	}
+	size, err := tpmutil.Pack(uint32(len(b)))
+	if err != nil {
+		return nil, err
+	}
+	return append(size, b...), nil
+}
+
+// passwordAuth returns an authorization session that uses a plain password.
+func passwordAuth(password string) tpm2.AuthCommand {
+	return tpm2.AuthCommand{Session: tpm2.HandlePasswordSession, Attributes: tpm2.AttrContinueSession, Auth: []byte(password)}
+}
+
+// encodeCommand joins the handle, authorization and parameter areas of a command.
+func encodeCommand(handles []interface{}, auth []tpm2.AuthCommand, params ...interface{}) (tpmutil.RawBytes, error) {
+	h, err := tpmutil.Pack(handles...)
+	if err != nil {
+		return nil, err
+	}
+	var a []byte
+	if len(auth) > 0 {
+		if a, err = encodeAuthArea(auth...); err != nil {
+			return nil, err
+		}
+	}
+	p, err := tpmutil.Pack(params...)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.Join([][]byte{h, a, p}, nil), nil
+}
@@ -0,0 +1,221 @@
+package tpmk
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/google/go-tpm-tools/simulator"
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpmutil"
+	"github.com/stretchr/testify/require"
+)
+
+// The conformance tests run the same operations on the simulator and, if TPMK_DEVICE is set to
+// the path of a TPM, on real hardware, and require both to behave the same. They use handles at
+// the end of the owner ranges and are skipped if any of them is already in use, so existing keys
+// and NV indexes are never touched. Only objects the tests created are removed again. The owner
+// password of the TPM has to be empty.
+const (
+	conformanceKey   tpmutil.Handle = 0x817ffffe
+	conformancePeer  tpmutil.Handle = 0x817fffff
+	conformanceIndex tpmutil.Handle = 0x13fffff
+)
+
+// testDevice is a TPM the conformance tests run on.
+type testDevice struct {
+	name string
+	open func() (io.ReadWriteCloser, error)
+}
+
+// testDevices returns the simulator, followed by the TPM in TPMK_DEVICE if set.
+func testDevices() []testDevice {
+	devices := []testDevice{{
+		name: "simulator",
+		open: func() (io.ReadWriteCloser, error) { return simulator.Get() },
+	}}
+	if path := os.Getenv("TPMK_DEVICE"); path != "" {
+		devices = append(devices, testDevice{
+			name: path,
+			open: func() (io.ReadWriteCloser, error) { return OpenDevice(path) },
+		})
+	}
+	return devices
+}
+
+// testConformance runs a test on every device and requires the observations it returns to be
+// the same on all of them.
+func testConformance(t *testing.T, test func(t *testing.T, dev io.ReadWriteCloser) interface{}) {
+	var (
+		first    interface{}
+		firstDev string
+	)
+	for _, d := range testDevices() {
+		d := d
+		t.Run(d.name, func(t *testing.T) {
+			dev, err := d.open()
+			require.NoError(t, err)
+			defer dev.Close()
+
+			// The handles need to be free, anything found there afterwards was created by the test
+			keys, indexes := conformanceHandles(t, dev)
+			if len(keys) > 0 || len(indexes) > 0 {
+				t.Skipf("handles %#x of the conformance tests are in use", append(keys, indexes...))
+			}
+			defer func() {
+				keys, indexes := conformanceHandles(t, dev)
+				for _, h := range keys {
+					require.NoError(t, DeleteKey(dev, h, ""))
+				}
+				for _, h := range indexes {
+					require.NoError(t, NVDelete(dev, h, ""))
+				}
+			}()
+
+			observed := test(t, dev)
+			if firstDev == "" {
+				first, firstDev = observed, d.name
+				return
+			}
+			require.Equal(t, first, observed, "%s behaves differently from %s", d.name, firstDev)
+		})
+	}
+}
+
+// conformanceHandles returns the handles used by the conformance tests that are in use.
+func conformanceHandles(t *testing.T, dev io.ReadWriteCloser) (keys, indexes []tpmutil.Handle) {
+	persistent, err := KeyList(dev)
+	require.NoError(t, err)
+	for _, h := range persistent {
+		if h == conformanceKey || h == conformancePeer {
+			keys = append(keys, h)
+		}
+	}
+	nv, err := NVList(dev)
+	require.NoError(t, err)
+	for _, h := range nv {
+		if h == conformanceIndex {
+			indexes = append(indexes, h)
+		}
+	}
+	return keys, indexes
+}
+
+func TestConformanceCreate(t *testing.T) {
+	testConformance(t, func(t *testing.T, dev io.ReadWriteCloser) interface{} {
+		const attr = tpm2.FlagSign | tpm2.FlagFixedTPM | tpm2.FlagUserWithAuth | tpm2.FlagFixedParent | tpm2.FlagSensitiveDataOrigin
+		pub, err := GenRSAPrimaryKey(dev, conformanceKey, "", "", attr)
+		require.NoError(t, err)
+		public, publicKey, err := ReadPublicKey(dev, conformanceKey)
+		require.NoError(t, err)
+		require.Equal(t, pub, publicKey)
+
+		// The key differs between TPMs, everything else in the public part must not
+		require.Equal(t, 2048, publicKey.(*rsa.PublicKey).N.BitLen())
+		public.RSAParameters.ModulusRaw = nil
+		public.RSAParameters.Modulus = nil
+		return public
+	})
+}
+
+func TestConformanceSign(t *testing.T) {
+	testConformance(t, func(t *testing.T, dev io.ReadWriteCloser) interface{} {
+		// Exempt from dictionary attack protection so the wrong password doesn't count towards a lockout
+		const attr = tpm2.FlagSign | tpm2.FlagFixedTPM | tpm2.FlagUserWithAuth | tpm2.FlagFixedParent | tpm2.FlagSensitiveDataOrigin | tpm2.FlagNoDA
+		pub, err := GenRSAPrimaryKey(dev, conformanceKey, "", "", attr)
+		require.NoError(t, err)
+		priv, err := NewRSAPrivateKey(dev, conformanceKey, "")
+		require.NoError(t, err)
+
+		digest := sha256.Sum256([]byte("This is a test"))
+		tests := map[string]crypto.SignerOpts{
+			"PKCS#1 v1.5": crypto.SHA256,
+			"PSS":         &rsa.PSSOptions{Hash: crypto.SHA256},
+		}
+		observed := make(map[string]string)
+		for name, opts := range tests {
+			sig, err := priv.Sign(nil, digest[:], opts)
+			require.NoError(t, err)
+			if pss, ok := opts.(*rsa.PSSOptions); ok {
+				err = rsa.VerifyPSS(pub.(*rsa.PublicKey), crypto.SHA256, digest[:], sig, pss)
+			} else {
+				err = rsa.VerifyPKCS1v15(pub.(*rsa.PublicKey), crypto.SHA256, digest[:], sig)
+			}
+			observed[name] = fmt.Sprint(err)
+		}
+
+		// Signing with the wrong password must fail the same way
+		priv, err = NewRSAPrivateKey(dev, conformanceKey, "wrong")
+		require.NoError(t, err)
+		_, err = priv.Sign(nil, digest[:], crypto.SHA256)
+		require.Error(t, err)
+		observed["wrong password"] = err.Error()
+		return observed
+	})
+}
+
+func TestConformanceNV(t *testing.T) {
+	testConformance(t, func(t *testing.T, dev io.ReadWriteCloser) interface{} {
+		const attr = tpm2.AttrOwnerWrite | tpm2.AttrOwnerRead | tpm2.AttrAuthRead | tpm2.AttrPPRead
+		data := []byte("conformance")
+		require.NoError(t, NVWrite(dev, conformanceIndex, data, "", attr))
+		out, err := NVRead(dev, conformanceIndex, "")
+		require.NoError(t, err)
+		require.Equal(t, data, out)
+
+		public, err := tpm2.NVReadPublic(dev, conformanceIndex)
+		require.NoError(t, err)
+		indexes, err := NVList(dev)
+		require.NoError(t, err)
+		require.Contains(t, indexes, conformanceIndex)
+
+		require.NoError(t, NVDelete(dev, conformanceIndex, ""))
+		_, err = NVRead(dev, conformanceIndex, "")
+		require.Error(t, err)
+		return public
+	})
+}
+
+func TestConformanceSeal(t *testing.T) {
+	testConformance(t, func(t *testing.T, dev io.ReadWriteCloser) interface{} {
+		_, err := GenRSAPrimaryKey(dev, conformanceKey, "", "", tpm2.FlagStorageDefault)
+		require.NoError(t, err)
+
+		// Seal to the current values of the PCRs and to values they don't have
+		data := []byte("secret")
+		sel := tpm2.PCRSelection{Hash: tpm2.AlgSHA256, PCRs: []int{0, 7}}
+		sealed, err := SealPCRs(dev, conformanceKey, "", sel, nil, data)
+		require.NoError(t, err)
+		out, err := UnsealPCRs(dev, conformanceKey, "", sealed)
+		require.NoError(t, err)
+		require.Equal(t, data, out)
+
+		wrong := sha256.Sum256([]byte("other state"))
+		sealed, err = SealPCRs(dev, conformanceKey, "", sel, wrong[:], data)
+		require.NoError(t, err)
+		_, err = UnsealPCRs(dev, conformanceKey, "", sealed)
+		require.Error(t, err)
+		return err.Error()
+	})
+}
+
+func TestConformanceMutualTLS(t *testing.T) {
+	testConformance(t, func(t *testing.T, dev io.ReadWriteCloser) interface{} {
+		const attr = tpm2.FlagSign | tpm2.FlagFixedTPM | tpm2.FlagUserWithAuth | tpm2.FlagFixedParent | tpm2.FlagSensitiveDataOrigin
+		_, err := GenRSAPrimaryKey(dev, conformanceKey, "", "", attr)
+		require.NoError(t, err)
+		_, err = GenRSAPrimaryKey(dev, conformancePeer, "", "", attr)
+		require.NoError(t, err)
+		clientPriv, err := NewRSAPrivateKey(dev, conformanceKey, "")
+		require.NoError(t, err)
+		serverPriv, err := NewRSAPrivateKey(dev, conformancePeer, "")
+		require.NoError(t, err)
+
+		testMutualTLS(t, clientPriv, serverPriv)
+		return nil
+	})
+}
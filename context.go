@@ -0,0 +1,94 @@
+package tpmk
+
+import (
+	"crypto"
+	"errors"
+	"io"
+
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpmutil"
+)
+
+// ErrForeignKey is returned when a key or sealed object fails the TPM's integrity checks while
+// being loaded. That's typically the case when it was created on a different TPM, or before the
+// TPM was cleared. For key contexts, it's also returned after the TPM was reset.
+var ErrForeignKey = errors.New("key at handle was not created by this TPM (did the TPM change?)")
+
+// SaveKeyContext saves the context of a transient key so it can be loaded again with
+// LoadKeyContext after it was flushed. This allows keeping many keys available for loading on
+// demand without using persistent handles, which are limited. The context is bound to the TPM
+// and its current boot cycle, it can't be loaded once the TPM was reset, typically by rebooting
+// the machine. Keys that need to survive a reboot should be kept as blobs created with
+// GenRSAChildKey and loaded with LoadKey instead.
+func SaveKeyContext(dev io.ReadWriteCloser, handle tpmutil.Handle) ([]byte, error) {
+	return tpm2.ContextSave(dev, handle)
+}
+
+// LoadKeyContext loads a key context saved with SaveKeyContext and returns its new transient
+// handle. ErrForeignKey is returned if the context was saved on a different TPM or before the
+// TPM was reset.
+func LoadKeyContext(dev io.ReadWriteCloser, context []byte) (tpmutil.Handle, error) {
+	handle, err := tpm2.ContextLoad(dev, context)
+	return handle, foreignKeyError(err)
+}
+
+// foreignKeyError returns ErrForeignKey if err is an integrity failure of a loaded object, and err
+// otherwise.
+func foreignKeyError(err error) error {
+	if e, ok := err.(tpm2.ParameterError); ok && e.Code == tpm2.RCIntegrity {
+		return ErrForeignKey
+	}
+	return err
+}
+
+// ContextSigner is an RSA signing key that is kept as a saved context rather than occupying an
+// object slot in the TPM. The key is loaded for every signature and flushed again afterwards,
+// which allows using more keys than the TPM can hold at a time, at the cost of latency.
+type ContextSigner struct {
+	dev       io.ReadWriteCloser
+	context   []byte
+	pub       tpm2.Public
+	publicKey crypto.PublicKey
+	password  string
+}
+
+// NewContextSigner returns a signer for a key context saved with SaveKeyContext.
+func NewContextSigner(dev io.ReadWriteCloser, context []byte, password string) (ContextSigner, error) {
+	handle, err := LoadKeyContext(dev, context)
+	if err != nil {
+		return ContextSigner{}, err
+	}
+	defer tpm2.FlushContext(dev, handle)
+	pub, publicKey, err := ReadPublicKey(dev, handle)
+	if err != nil {
+		return ContextSigner{}, err
+	}
+	if pub.Type != tpm2.AlgRSA {
+		return ContextSigner{}, UnsupportedKeyError{Key: publicKey}
+	}
+	return ContextSigner{dev: dev, context: context, pub: pub, publicKey: publicKey, password: password}, nil
+}
+
+// Public returns the public part of the key.
+func (k ContextSigner) Public() crypto.PublicKey {
+	return k.publicKey
+}
+
+// Close releases the TPM resources held by the key. The key is only loaded while signing, so
+// Close always returns nil.
+func (k ContextSigner) Close() error {
+	return nil
+}
+
+// Sign loads the key, signs the digest like RSAPrivateKey.Sign, and flushes it. The device is
+// locked for all three steps, so it's safe to call concurrently.
+func (k ContextSigner) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	defer lockDevice(k.dev)()
+	handle, err := LoadKeyContext(k.dev, k.context)
+	if err != nil {
+		return nil, err
+	}
+	defer tpm2.FlushContext(k.dev, handle)
+	key := RSAPrivateKey{dev: k.dev, handle: handle, pub: k.pub, publicKey: k.publicKey, password: k.password}
+	return key.sign(digest, opts, false)
+}
@@ -0,0 +1,176 @@
+package tpmk
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"math/big"
+	"sync"
+	"testing"
+
+	"github.com/google/go-tpm-tools/simulator"
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpmutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestForeignKey(t *testing.T) {
+	const (
+		parent  tpmutil.Handle = 0x81000000
+		counter tpmutil.Handle = 0x1000000
+		pw                     = ""
+		attr                   = tpm2.FlagSign | tpm2.FlagFixedTPM | tpm2.FlagUserWithAuth | tpm2.FlagFixedParent | tpm2.FlagSensitiveDataOrigin
+	)
+	setup := func(dev *simulator.Simulator) {
+		_, err := GenRSAPrimaryKey(dev, parent, pw, pw, tpm2.FlagStorageDefault)
+		require.NoError(t, err)
+		require.NoError(t, NVDefineCounter(dev, counter, pw))
+	}
+
+	// Save a key context and seal data on one TPM
+	dev, err := simulator.Get()
+	require.NoError(t, err)
+	setup(dev)
+	handle, _, err := tpm2.CreatePrimary(dev, tpm2.HandleOwner, tpm2.PCRSelection{}, pw, pw, tpm2.Public{
+		Type:       tpm2.AlgRSA,
+		NameAlg:    tpm2.AlgSHA256,
+		Attributes: attr,
+		RSAParameters: &tpm2.RSAParams{
+			KeyBits: 2048,
+			Modulus: big.NewInt(0),
+		},
+	})
+	require.NoError(t, err)
+	context, err := SaveKeyContext(dev, handle)
+	require.NoError(t, err)
+	require.NoError(t, tpm2.FlushContext(dev, handle))
+	sealed, err := AntiRollbackSeal(dev, parent, pw, counter, pw, 0, []byte("secret"))
+	require.NoError(t, err)
+
+	// Both can be loaded on the same TPM
+	handle, err = LoadKeyContext(dev, context)
+	require.NoError(t, err)
+	require.NoError(t, tpm2.FlushContext(dev, handle))
+	_, err = AntiRollbackUnseal(dev, parent, pw, pw, sealed)
+	require.NoError(t, err)
+	require.NoError(t, dev.Close())
+
+	// A new simulator has different seeds, like a replaced TPM
+	dev, err = simulator.Get()
+	require.NoError(t, err)
+	defer dev.Close()
+	setup(dev)
+	_, err = LoadKeyContext(dev, context)
+	require.Equal(t, ErrForeignKey, err)
+	_, err = AntiRollbackUnseal(dev, parent, pw, pw, sealed)
+	require.Equal(t, ErrForeignKey, err)
+}
+
+func TestContextSigner(t *testing.T) {
+	dev, err := simulator.Get()
+	require.NoError(t, err)
+	defer dev.Close()
+
+	const (
+		parent tpmutil.Handle = 0x81000000
+		pw                    = ""
+		attr                  = tpm2.FlagSign | tpm2.FlagFixedTPM | tpm2.FlagUserWithAuth | tpm2.FlagFixedParent | tpm2.FlagSensitiveDataOrigin
+	)
+	_, err = GenRSAPrimaryKey(dev, parent, pw, pw, tpm2.FlagStorageDefault)
+	require.NoError(t, err)
+
+	// Create more child keys than the simulator can hold at once (3) and only keep their contexts
+	var signers []ContextSigner
+	for i := 0; i < 5; i++ {
+		private, public, err := tpm2.CreateKey(dev, parent, tpm2.PCRSelection{}, pw, pw, tpm2.Public{
+			Type:       tpm2.AlgRSA,
+			NameAlg:    tpm2.AlgSHA256,
+			Attributes: attr,
+			RSAParameters: &tpm2.RSAParams{
+				KeyBits: 2048,
+				Modulus: big.NewInt(0),
+			},
+		})
+		require.NoError(t, err)
+		handle, _, err := tpm2.Load(dev, parent, pw, public, private)
+		require.NoError(t, err)
+		context, err := SaveKeyContext(dev, handle)
+		require.NoError(t, err)
+		require.NoError(t, tpm2.FlushContext(dev, handle))
+		signer, err := NewContextSigner(dev, context, pw)
+		require.NoError(t, err)
+		signers = append(signers, signer)
+	}
+
+	// Sign with them in round-robin
+	digest := sha256.Sum256([]byte("data"))
+	for round := 0; round < 3; round++ {
+		for _, signer := range signers {
+			sig, err := signer.Sign(nil, digest[:], crypto.SHA256)
+			require.NoError(t, err)
+			require.NoError(t, rsa.VerifyPKCS1v15(signer.Public().(*rsa.PublicKey), crypto.SHA256, digest[:], sig))
+		}
+	}
+
+	// Sign with all of them at once, loading more keys than the simulator can hold if the load,
+	// sign and flush of one signer weren't serialized with the others
+	var wg sync.WaitGroup
+	errs := make([]error, 20)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			signer := signers[i%len(signers)]
+			sig, err := signer.Sign(nil, digest[:], crypto.SHA256)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			errs[i] = rsa.VerifyPKCS1v15(signer.Public().(*rsa.PublicKey), crypto.SHA256, digest[:], sig)
+		}(i)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		require.NoError(t, err)
+	}
+
+	// No keys should be left loaded
+	handles, err := GetHandles(dev, tpm2.TransientFirst)
+	require.NoError(t, err)
+	require.Empty(t, handles)
+}
+
+func TestKeyContextReset(t *testing.T) {
+	const (
+		parent tpmutil.Handle = 0x81000000
+		pw                    = ""
+	)
+	dev, err := simulator.Get()
+	require.NoError(t, err)
+	defer dev.Close()
+
+	_, err = GenRSAPrimaryKey(dev, parent, pw, pw, tpm2.FlagStorageDefault)
+	require.NoError(t, err)
+	private, public, err := GenRSAChildKey(dev, parent, pw, pw, ChildKeyAttributes)
+	require.NoError(t, err)
+	handle, err := LoadKey(dev, parent, pw, public, private)
+	require.NoError(t, err)
+	context, err := SaveKeyContext(dev, handle)
+	require.NoError(t, err)
+	require.NoError(t, tpm2.FlushContext(dev, handle))
+
+	// The context can be loaded any number of times until the TPM is reset
+	for i := 0; i < 2; i++ {
+		handle, err = LoadKeyContext(dev, context)
+		require.NoError(t, err)
+		require.NoError(t, tpm2.FlushContext(dev, handle))
+	}
+	require.NoError(t, dev.Reset())
+	_, err = LoadKeyContext(dev, context)
+	require.Equal(t, ErrForeignKey, err)
+
+	// The key blob is still valid
+	handle, err = LoadKey(dev, parent, pw, public, private)
+	require.NoError(t, err)
+	require.NoError(t, tpm2.FlushContext(dev, handle))
+}
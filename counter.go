@@ -0,0 +1,53 @@
+package tpmk
+
+import (
+	"encoding/binary"
+	"io"
+	"sync"
+
+	"github.com/google/go-tpm/tpmutil"
+)
+
+// CommandCounter wraps a TPM device and counts the commands sent to it by command code. It can
+// be used to measure how many TPM commands an operation requires.
+type CommandCounter struct {
+	io.ReadWriteCloser
+
+	mu     sync.Mutex
+	counts map[tpmutil.Command]int
+}
+
+// NewCommandCounter returns a device that counts commands before passing them on to dev.
+func NewCommandCounter(dev io.ReadWriteCloser) *CommandCounter {
+	return &CommandCounter{ReadWriteCloser: dev, counts: make(map[tpmutil.Command]int)}
+}
+
+// Write counts a command and sends it to the TPM. Commands are expected to be written in one
+// call, starting with the tag, size and command code header.
+func (c *CommandCounter) Write(b []byte) (int, error) {
+	if len(b) >= 10 {
+		code := tpmutil.Command(binary.BigEndian.Uint32(b[6:10]))
+		c.mu.Lock()
+		c.counts[code]++
+		c.mu.Unlock()
+	}
+	return c.ReadWriteCloser.Write(b)
+}
+
+// Counts returns the number of commands sent since the counter was created or last reset.
+func (c *CommandCounter) Counts() map[tpmutil.Command]int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	counts := make(map[tpmutil.Command]int, len(c.counts))
+	for code, n := range c.counts {
+		counts[code] = n
+	}
+	return counts
+}
+
+// Reset clears all counts. Call before an operation to only count its commands.
+func (c *CommandCounter) Reset() {
+	c.mu.Lock()
+	c.counts = make(map[tpmutil.Command]int)
+	c.mu.Unlock()
+}
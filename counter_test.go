@@ -0,0 +1,37 @@
+package tpmk
+
+import (
+	"crypto"
+	"testing"
+
+	"github.com/google/go-tpm-tools/simulator"
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpmutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCommandCounter(t *testing.T) {
+	sim, err := simulator.Get()
+	require.NoError(t, err)
+	defer sim.Close()
+
+	const (
+		handle = 0x81000000
+		pw     = ""
+		attr   = tpm2.FlagSign | tpm2.FlagUserWithAuth | tpm2.FlagSensitiveDataOrigin
+	)
+	_, err = GenRSAPrimaryKey(sim, handle, pw, pw, attr)
+	require.NoError(t, err)
+
+	dev := NewCommandCounter(sim)
+	key, err := NewRSAPrivateKey(dev, handle, pw)
+	require.NoError(t, err)
+	require.Equal(t, map[tpmutil.Command]int{cmdReadPublic: 1}, dev.Counts())
+
+	dev.Reset()
+	for i := 0; i < 3; i++ {
+		_, err = key.Sign(nil, make([]byte, 32), crypto.SHA256)
+		require.NoError(t, err)
+	}
+	require.Equal(t, map[tpmutil.Command]int{cmdSign: 3}, dev.Counts())
+}
@@ -0,0 +1,297 @@
+package tpmk
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	_ "crypto/sha1" // Needed for SHA1 names
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/google/go-tpm-tools/tpm2tools"
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpmutil"
+)
+
+// AKBinding links an Attestation Key (AK) to the Endorsement Key (EK) of a TPM. It is sent to
+// an enrollment server which uses MakeCredential to issue a challenge that the TPM can only
+// answer if both keys are resident in it.
+type AKBinding struct {
+	EKCert   []byte // DER-encoded EK certificate
+	EKPublic []byte // TPMT_PUBLIC of the EK
+	AKPublic []byte // TPMT_PUBLIC of the AK
+}
+
+// Credential is a challenge produced with MakeCredential. The secret in it can only be
+// recovered by the TPM holding the EK, and only for the AK it was made for.
+type Credential struct {
+	Blob   []byte // TPM2B_ID_OBJECT contents
+	Secret []byte // Encrypted seed
+}
+
+// NewAKBinding reads the public parts of the EK and AK from the TPM and combines them with the EK
+// certificate, typically read with ReadEKCertificate.
+func NewAKBinding(dev io.ReadWriteCloser, ekCert []byte, ek, ak tpmutil.Handle) (AKBinding, error) {
+	ekPub, _, _, err := tpm2.ReadPublic(dev, ek)
+	if err != nil {
+		return AKBinding{}, err
+	}
+	akPub, _, _, err := tpm2.ReadPublic(dev, ak)
+	if err != nil {
+		return AKBinding{}, err
+	}
+	ekPublic, err := ekPub.Encode()
+	if err != nil {
+		return AKBinding{}, err
+	}
+	akPublic, err := akPub.Encode()
+	if err != nil {
+		return AKBinding{}, err
+	}
+	return AKBinding{ekCert, ekPublic, akPublic}, nil
+}
+
+// MakeCredential is called by the verifier to produce a challenge for the TPM without needing a
+// TPM itself. It confirms the EK matches the certificate and that the AK is a restricted signing
+// key that can't leave the TPM, then encrypts the secret to the EK, bound to the name of the
+// AK. Validating the EK certificate against the manufacturer's CA is left to the caller.
+func (b AKBinding) MakeCredential(secret []byte) (Credential, error) {
+	ekPub, err := tpm2.DecodePublic(b.EKPublic)
+	if err != nil {
+		return Credential{}, err
+	}
+	akPub, err := tpm2.DecodePublic(b.AKPublic)
+	if err != nil {
+		return Credential{}, err
+	}
+
+	// The EK needs to match the certificate
+	cert, err := x509.ParseCertificate(b.EKCert)
+	if err != nil {
+		return Credential{}, err
+	}
+	ekKey, err := ekPub.Key()
+	if err != nil {
+		return Credential{}, err
+	}
+	rsaPub, ok := ekKey.(*rsa.PublicKey)
+	if !ok {
+		return Credential{}, fmt.Errorf("unsupported EK type %T", ekKey)
+	}
+	certPub, ok := cert.PublicKey.(*rsa.PublicKey)
+	if !ok || certPub.N.Cmp(rsaPub.N) != 0 || certPub.E != rsaPub.E {
+		return Credential{}, errors.New("EK doesn't match the certificate")
+	}
+
+	// Check the AK properties
+	const akAttr = tpm2.FlagRestricted | tpm2.FlagSign | tpm2.FlagFixedTPM | tpm2.FlagFixedParent
+	if akPub.Attributes&akAttr != akAttr || akPub.Attributes&tpm2.FlagDecrypt != 0 {
+		return Credential{}, errors.New("AK is not a restricted signing key fixed to the TPM")
+	}
+	akName, err := objectName(akPub.NameAlg, b.AKPublic)
+	if err != nil {
+		return Credential{}, err
+	}
+	return makeCredential(ekPub, rsaPub, akName, secret)
+}
+
+// ActivateCredential recovers the secret from a credential on the device. The AK is authorized
+// with its password; the EK with the endorsement hierarchy password as required by the default
+// EK policy.
+func ActivateCredential(dev io.ReadWriteCloser, ak tpmutil.Handle, akPW string, ek tpmutil.Handle, endorsementPW string, cred Credential) ([]byte, error) {
+	session, err := startPolicySession(dev, tpm2.SessionPolicy)
+	if err != nil {
+		return nil, err
+	}
+	defer tpm2.FlushContext(dev, session)
+	if _, err := tpm2.PolicySecret(dev, tpm2.HandleEndorsement, passwordAuth(endorsementPW), session, nil, nil, nil, 0); err != nil {
+		return nil, err
+	}
+	return tpm2.ActivateCredentialUsingAuth(dev, []tpm2.AuthCommand{
+		passwordAuth(akPW),
+		{Session: session, Attributes: tpm2.AttrContinueSession},
+	}, ak, ek, cred.Blob, cred.Secret)
+}
+
+// FakeEK is an in-memory software Endorsement Key to test the verifier side of credential
+// activation without a TPM. It uses the default RSA EK template and offers none of the protection
+// of a real EK.
+type FakeEK struct {
+	key    *rsa.PrivateKey
+	public tpm2.Public
+}
+
+// NewFakeEK generates an in-memory RSA 2048 Endorsement Key.
+func NewFakeEK() (FakeEK, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return FakeEK{}, err
+	}
+	public := tpm2tools.DefaultEKTemplateRSA()
+	public.RSAParameters.ModulusRaw = nil
+	public.RSAParameters.Modulus = key.N
+	public.RSAParameters.Exponent = uint32(key.E)
+	return FakeEK{key, public}, nil
+}
+
+// Public returns the public area of the EK, as it would be read from a TPM.
+func (k FakeEK) Public() tpm2.Public {
+	return k.public
+}
+
+// ActivateCredential recovers the secret in a credential made for the AK with the given TPMT_PUBLIC,
+// like TPM2_ActivateCredential does in a TPM.
+func (k FakeEK) ActivateCredential(akPublic []byte, cred Credential) ([]byte, error) {
+	akPub, err := tpm2.DecodePublic(akPublic)
+	if err != nil {
+		return nil, err
+	}
+	name, err := objectName(akPub.NameAlg, akPublic)
+	if err != nil {
+		return nil, err
+	}
+	return activateCredential(k.public, k.key, name, cred)
+}
+
+// makeCredential is the software implementation of TPM2_MakeCredential (TPM 2.0 Part 1, Section 24)
+// for RSA protectors.
+func makeCredential(protector tpm2.Public, pub *rsa.PublicKey, name, secret []byte) (Credential, error) {
+	hash, err := nameHash(protector.NameAlg)
+	if err != nil {
+		return Credential{}, err
+	}
+	sym := protector.RSAParameters.Symmetric
+	if sym == nil || sym.Alg != tpm2.AlgAES || sym.Mode != tpm2.AlgCFB {
+		return Credential{}, errors.New("protector needs to use AES-CFB")
+	}
+	if len(secret) > hash.Size() {
+		return Credential{}, fmt.Errorf("secret can't be larger than %d bytes", hash.Size())
+	}
+
+	// Generate a seed and encrypt it to the protector
+	seed := make([]byte, hash.Size())
+	if _, err := io.ReadFull(rand.Reader, seed); err != nil {
+		return Credential{}, err
+	}
+	encSeed, err := rsa.EncryptOAEP(hash.New(), rand.Reader, pub, seed, []byte("IDENTITY\x00"))
+	if err != nil {
+		return Credential{}, err
+	}
+
+	// Encrypt the secret (as TPM2B_DIGEST) with a key derived from the seed
+	plain, err := tpmutil.Pack(secret)
+	if err != nil {
+		return Credential{}, err
+	}
+	block, err := aes.NewCipher(kdfa(hash, seed, "STORAGE", name, nil, int(sym.KeyBits)))
+	if err != nil {
+		return Credential{}, err
+	}
+	encIdentity := make([]byte, len(plain))
+	cipher.NewCFBEncrypter(block, make([]byte, block.BlockSize())).XORKeyStream(encIdentity, plain)
+
+	// Protect the integrity with an HMAC over the encrypted secret and the name
+	mac := hmac.New(hash.New, kdfa(hash, seed, "INTEGRITY", nil, nil, hash.Size()*8))
+	mac.Write(encIdentity)
+	mac.Write(name)
+	blob, err := tpmutil.Pack(mac.Sum(nil), tpmutil.RawBytes(encIdentity))
+	if err != nil {
+		return Credential{}, err
+	}
+	return Credential{blob, encSeed}, nil
+}
+
+// activateCredential is the software implementation of TPM2_ActivateCredential for RSA protectors,
+// the reverse of makeCredential.
+func activateCredential(protector tpm2.Public, key *rsa.PrivateKey, name []byte, cred Credential) ([]byte, error) {
+	hash, err := nameHash(protector.NameAlg)
+	if err != nil {
+		return nil, err
+	}
+	sym := protector.RSAParameters.Symmetric
+	if sym == nil || sym.Alg != tpm2.AlgAES || sym.Mode != tpm2.AlgCFB {
+		return nil, errors.New("protector needs to use AES-CFB")
+	}
+	seed, err := rsa.DecryptOAEP(hash.New(), nil, key, cred.Secret, []byte("IDENTITY\x00"))
+	if err != nil {
+		return nil, err
+	}
+
+	// Check the integrity before decrypting
+	var integrity []byte
+	rest, err := tpmutil.Unpack(cred.Blob, &integrity)
+	if err != nil {
+		return nil, err
+	}
+	encIdentity := cred.Blob[rest:]
+	mac := hmac.New(hash.New, kdfa(hash, seed, "INTEGRITY", nil, nil, hash.Size()*8))
+	mac.Write(encIdentity)
+	mac.Write(name)
+	if !hmac.Equal(integrity, mac.Sum(nil)) {
+		return nil, errors.New("credential integrity check failed")
+	}
+
+	block, err := aes.NewCipher(kdfa(hash, seed, "STORAGE", name, nil, int(sym.KeyBits)))
+	if err != nil {
+		return nil, err
+	}
+	plain := make([]byte, len(encIdentity))
+	cipher.NewCFBDecrypter(block, make([]byte, block.BlockSize())).XORKeyStream(plain, encIdentity)
+	var secret []byte
+	if _, err := tpmutil.Unpack(plain, &secret); err != nil {
+		return nil, err
+	}
+	return secret, nil
+}
+
+// kdfa implements the KDFa key derivation function from TPM 2.0 Part 1, Section 11.4.9.2.
+func kdfa(hash crypto.Hash, key []byte, label string, contextU, contextV []byte, bits int) []byte {
+	var (
+		out  []byte
+		size = (bits + 7) / 8
+		buf  = make([]byte, 4)
+	)
+	for i := uint32(1); len(out) < size; i++ {
+		mac := hmac.New(hash.New, key)
+		binary.BigEndian.PutUint32(buf, i)
+		mac.Write(buf)
+		mac.Write([]byte(label))
+		mac.Write([]byte{0})
+		mac.Write(contextU)
+		mac.Write(contextV)
+		binary.BigEndian.PutUint32(buf, uint32(bits))
+		mac.Write(buf)
+		out = append(out, mac.Sum(nil)...)
+	}
+	return out[:size]
+}
+
+// objectName calculates the name of an object or NV index from its encoded public area.
+func objectName(alg tpm2.Algorithm, public []byte) ([]byte, error) {
+	hash, err := nameHash(alg)
+	if err != nil {
+		return nil, err
+	}
+	h := hash.New()
+	h.Write(public)
+	return bytes.Join([][]byte{{byte(alg >> 8), byte(alg)}, h.Sum(nil)}, nil), nil
+}
+
+// nameHash returns the hash function for a name algorithm.
+func nameHash(alg tpm2.Algorithm) (crypto.Hash, error) {
+	switch alg {
+	case tpm2.AlgSHA1:
+		return crypto.SHA1, nil
+	case tpm2.AlgSHA256:
+		return crypto.SHA256, nil
+	default:
+		return 0, fmt.Errorf("unsupported name algorithm 0x%x", alg)
+	}
+}
@@ -0,0 +1,161 @@
+package tpmk
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/google/go-tpm-tools/simulator"
+	"github.com/google/go-tpm-tools/tpm2tools"
+	"github.com/google/go-tpm/tpm2"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAKBinding(t *testing.T) {
+	dev, err := simulator.Get()
+	require.NoError(t, err)
+	defer dev.Close()
+
+	const pw = ""
+
+	// Create the EK and a restricted signing key as AK
+	ek, ekPub, err := tpm2.CreatePrimary(dev, tpm2.HandleEndorsement, tpm2.PCRSelection{}, pw, pw, tpm2tools.DefaultEKTemplateRSA())
+	require.NoError(t, err)
+	defer tpm2.FlushContext(dev, ek)
+	var nonce [256]byte
+	ak, _, err := tpm2.CreatePrimary(dev, tpm2.HandleOwner, tpm2.PCRSelection{}, pw, pw, tpm2tools.AIKTemplateRSA(nonce))
+	require.NoError(t, err)
+	defer tpm2.FlushContext(dev, ak)
+
+	// The simulator doesn't come with an EK certificate, provision one like a manufacturer would
+	caCrt, ekCert := provisionEKCert(t, dev, ekPub)
+
+	// Build the binding on the device
+	cert, err := ReadEKCertificate(dev, EKCertIndexRSA)
+	require.NoError(t, err)
+	require.Equal(t, ekCert, cert)
+	binding, err := NewAKBinding(dev, cert, ek, ak)
+	require.NoError(t, err)
+
+	// The verifier makes a challenge that only this TPM can answer
+	secret := []byte("challenge")
+	cred, err := binding.MakeCredential(secret)
+	require.NoError(t, err)
+
+	out, err := ActivateCredential(dev, ak, pw, ek, pw, cred)
+	require.NoError(t, err)
+	require.Equal(t, secret, out)
+
+	// A binding with a certificate for a different key is rejected
+	other := binding
+	other.EKCert = caCrt.Raw
+	_, err = other.MakeCredential(secret)
+	require.Error(t, err)
+
+	// As is an AK that isn't a restricted key
+	signer, _, err := tpm2.CreatePrimary(dev, tpm2.HandleOwner, tpm2.PCRSelection{}, pw, pw, tpm2.Public{
+		Type:       tpm2.AlgRSA,
+		NameAlg:    tpm2.AlgSHA256,
+		Attributes: tpm2.FlagSign | tpm2.FlagFixedTPM | tpm2.FlagFixedParent | tpm2.FlagSensitiveDataOrigin | tpm2.FlagUserWithAuth,
+		RSAParameters: &tpm2.RSAParams{
+			Sign:    &tpm2.SigScheme{Alg: tpm2.AlgNull, Hash: tpm2.AlgNull},
+			KeyBits: 2048,
+			Modulus: big.NewInt(0),
+		},
+	})
+	require.NoError(t, err)
+	defer tpm2.FlushContext(dev, signer)
+	unrestricted, err := NewAKBinding(dev, cert, ek, signer)
+	require.NoError(t, err)
+	_, err = unrestricted.MakeCredential(secret)
+	require.Error(t, err)
+}
+
+// provisionEKCert issues a certificate for the EK from the test CA and writes it into NV.
+func provisionEKCert(t *testing.T, dev io.ReadWriteCloser, ekPub crypto.PublicKey) (*x509.Certificate, []byte) {
+	const pw = ""
+	caCrt, caKey, err := LoadKeyPair("testdata/ca.crt", "testdata/ca.key")
+	require.NoError(t, err)
+	template := x509.Certificate{
+		Subject:      pkix.Name{CommonName: "EK"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().AddDate(0, 0, 1),
+		KeyUsage:     x509.KeyUsageKeyEncipherment,
+		SerialNumber: big.NewInt(1),
+	}
+	ekCert, err := x509.CreateCertificate(rand.Reader, &template, caCrt, ekPub, caKey)
+	require.NoError(t, err)
+	err = NVDefine(dev, tpm2.HandlePlatform, pw, EKCertIndexRSA, pw, tpm2.AttrPPWrite|tpm2.AttrPPRead|tpm2.AttrOwnerRead|tpm2.AttrAuthRead, uint16(len(ekCert)+16))
+	require.NoError(t, err)
+	for offset := 0; offset < len(ekCert); offset += 512 {
+		end := offset + 512
+		if end > len(ekCert) {
+			end = len(ekCert)
+		}
+		err = tpm2.NVWrite(dev, tpm2.HandlePlatform, EKCertIndexRSA, pw, ekCert[offset:end], uint16(offset))
+		require.NoError(t, err)
+	}
+	err = tpm2.NVWrite(dev, tpm2.HandlePlatform, EKCertIndexRSA, pw, make([]byte, 16), uint16(len(ekCert)))
+	require.NoError(t, err)
+
+	return caCrt, ekCert
+}
+
+func TestFakeEK(t *testing.T) {
+	ek, err := NewFakeEK()
+	require.NoError(t, err)
+	ekKey, err := ek.Public().Key()
+	require.NoError(t, err)
+	ekPublic, err := ek.Public().Encode()
+	require.NoError(t, err)
+
+	// Certificate for the EK from the test CA
+	caCrt, caKey, err := LoadKeyPair("testdata/ca.crt", "testdata/ca.key")
+	require.NoError(t, err)
+	template := x509.Certificate{
+		Subject:      pkix.Name{CommonName: "EK"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().AddDate(0, 0, 1),
+		KeyUsage:     x509.KeyUsageKeyEncipherment,
+		SerialNumber: big.NewInt(1),
+	}
+	ekCert, err := x509.CreateCertificate(rand.Reader, &template, caCrt, ekKey, caKey)
+	require.NoError(t, err)
+
+	// AKs only need a public area with the right attributes
+	akPublic := func() []byte {
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		require.NoError(t, err)
+		var nonce [256]byte
+		pub := tpm2tools.AIKTemplateRSA(nonce)
+		pub.RSAParameters.ModulusRaw = nil
+		pub.RSAParameters.Modulus = key.N
+		b, err := pub.Encode()
+		require.NoError(t, err)
+		return b
+	}
+	binding := AKBinding{EKCert: ekCert, EKPublic: ekPublic, AKPublic: akPublic()}
+
+	secret := []byte("challenge")
+	cred, err := binding.MakeCredential(secret)
+	require.NoError(t, err)
+	out, err := ek.ActivateCredential(binding.AKPublic, cred)
+	require.NoError(t, err)
+	require.Equal(t, secret, out)
+
+	// The credential is bound to the AK
+	_, err = ek.ActivateCredential(akPublic(), cred)
+	require.Error(t, err)
+
+	// And to the EK
+	other, err := NewFakeEK()
+	require.NoError(t, err)
+	_, err = other.ActivateCredential(binding.AKPublic, cred)
+	require.Error(t, err)
+}
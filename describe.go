@@ -0,0 +1,140 @@
+package tpmk
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpmutil"
+)
+
+// KeyInfo describes the public part of a key in the TPM, to help find out why it can't be used for
+// an operation.
+type KeyInfo struct {
+	Handle     tpmutil.Handle
+	Algorithm  tpm2.Algorithm     // tpm2.AlgRSA, tpm2.AlgECC or tpm2.AlgKeyedHash
+	NameAlg    tpm2.Algorithm     // Hash used for the name of the key and its policy
+	Bits       int                // Size of the key in bits, 0 for keyed-hash objects
+	Curve      tpm2.EllipticCurve // Curve of ECC keys
+	Attributes tpm2.KeyProp       // Raw attributes, see Flags for their names
+	Flags      []string           // Names of the set attributes, as in the TPM specification
+	Scheme     tpm2.Algorithm     // Fixed signing or decryption scheme, tpm2.AlgNull if any can be used
+	SchemeHash tpm2.Algorithm     // Hash of the scheme, if it has one
+	Symmetric  *tpm2.SymScheme    // Algorithm protecting the children of storage keys
+	HasPolicy  bool               // True if the key has an authorization policy
+}
+
+// Names of key attributes in the order they are defined, TPM 2.0 Part 2, Section 8.3.
+var keyFlagNames = []struct {
+	flag tpm2.KeyProp
+	name string
+}{
+	{tpm2.FlagFixedTPM, "fixedTPM"},
+	{tpm2.FlagFixedParent, "fixedParent"},
+	{tpm2.FlagSensitiveDataOrigin, "sensitiveDataOrigin"},
+	{tpm2.FlagUserWithAuth, "userWithAuth"},
+	{tpm2.FlagAdminWithPolicy, "adminWithPolicy"},
+	{tpm2.FlagNoDA, "noDA"},
+	{tpm2.FlagRestricted, "restricted"},
+	{tpm2.FlagDecrypt, "decrypt"},
+	{tpm2.FlagSign, "sign"},
+}
+
+// Names of the algorithms that can appear in keys.
+var algorithmNames = map[tpm2.Algorithm]string{
+	tpm2.AlgRSA:       "RSA",
+	tpm2.AlgECC:       "ECC",
+	tpm2.AlgKeyedHash: "KEYEDHASH",
+	tpm2.AlgSHA1:      "SHA1",
+	tpm2.AlgSHA256:    "SHA256",
+	tpm2.AlgSHA384:    "SHA384",
+	tpm2.AlgSHA512:    "SHA512",
+	tpm2.AlgNull:      "NULL",
+	tpm2.AlgRSASSA:    "RSASSA",
+	tpm2.AlgRSAES:     "RSAES",
+	tpm2.AlgRSAPSS:    "RSAPSS",
+	tpm2.AlgOAEP:      "OAEP",
+	tpm2.AlgECDSA:     "ECDSA",
+	tpm2.AlgECDH:      "ECDH",
+	tpm2.AlgECDAA:     "ECDAA",
+	tpm2.AlgAES:       "AES",
+	tpm2.AlgCFB:       "CFB",
+}
+
+// algorithmName returns the name of the algorithm, or its value if it's not known.
+func algorithmName(alg tpm2.Algorithm) string {
+	if name, ok := algorithmNames[alg]; ok {
+		return name
+	}
+	return fmt.Sprintf("0x%x", uint16(alg))
+}
+
+// DescribeKey reads the public part of a key and returns its algorithm, size, attributes and scheme.
+func DescribeKey(dev io.ReadWriter, handle tpmutil.Handle) (KeyInfo, error) {
+	pub, _, _, err := tpm2.ReadPublic(dev, handle)
+	if err != nil {
+		return KeyInfo{}, err
+	}
+	bits, err := keyBits(pub)
+	if err != nil {
+		return KeyInfo{}, err
+	}
+	info := KeyInfo{
+		Handle:     handle,
+		Algorithm:  pub.Type,
+		NameAlg:    pub.NameAlg,
+		Bits:       bits,
+		Attributes: pub.Attributes,
+		Scheme:     tpm2.AlgNull,
+		HasPolicy:  len(pub.AuthPolicy) > 0,
+	}
+	for _, f := range keyFlagNames {
+		if pub.Attributes&f.flag != 0 {
+			info.Flags = append(info.Flags, f.name)
+		}
+	}
+	var scheme *tpm2.SigScheme
+	switch pub.Type {
+	case tpm2.AlgRSA:
+		scheme = pub.RSAParameters.Sign
+		info.Symmetric = pub.RSAParameters.Symmetric
+	case tpm2.AlgECC:
+		scheme = pub.ECCParameters.Sign
+		info.Symmetric = pub.ECCParameters.Symmetric
+		info.Curve = pub.ECCParameters.CurveID
+	}
+	if scheme != nil {
+		info.Scheme = scheme.Alg
+		info.SchemeHash = scheme.Hash
+	}
+	if info.Symmetric != nil && info.Symmetric.Alg == tpm2.AlgNull {
+		info.Symmetric = nil
+	}
+	return info, nil
+}
+
+// String returns a one-line description of the key, for example
+// "0x81000000: RSA 2048 bits, scheme RSASSA-SHA256, attributes fixedTPM|sign".
+func (k KeyInfo) String() string {
+	s := fmt.Sprintf("0x%x: %s", uint32(k.Handle), algorithmName(k.Algorithm))
+	if k.Bits > 0 {
+		s += fmt.Sprintf(" %d bits", k.Bits)
+	}
+	scheme := "any"
+	if k.Scheme != tpm2.AlgNull {
+		scheme = algorithmName(k.Scheme)
+		if k.SchemeHash != 0 && k.SchemeHash != tpm2.AlgNull {
+			scheme += "-" + algorithmName(k.SchemeHash)
+		}
+	}
+	s += ", scheme " + scheme
+	if k.Symmetric != nil {
+		s += fmt.Sprintf(", symmetric %s-%d-%s", algorithmName(k.Symmetric.Alg), k.Symmetric.KeyBits, algorithmName(k.Symmetric.Mode))
+	}
+	s += ", attributes " + strings.Join(k.Flags, "|")
+	if k.HasPolicy {
+		s += ", with policy"
+	}
+	return s
+}
@@ -0,0 +1,63 @@
+package tpmk
+
+import (
+	"testing"
+
+	"github.com/google/go-tpm-tools/simulator"
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpmutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDescribeKey(t *testing.T) {
+	dev, err := simulator.Get()
+	require.NoError(t, err)
+	defer dev.Close()
+
+	const (
+		signer  tpmutil.Handle = 0x81000000
+		storage tpmutil.Handle = 0x81000001
+		ak      tpmutil.Handle = 0x81000002
+		pw                     = ""
+	)
+	_, err = GenRSAPrimaryKey(dev, signer, pw, pw, tpm2.FlagSign|tpm2.FlagUserWithAuth|tpm2.FlagSensitiveDataOrigin)
+	require.NoError(t, err)
+	_, err = GenRSAPrimaryKey(dev, storage, pw, pw, tpm2.FlagStorageDefault)
+	require.NoError(t, err)
+	_, err = GenAK(dev, ak, pw, pw)
+	require.NoError(t, err)
+
+	tests := map[string]struct {
+		handle tpmutil.Handle
+		flags  []string
+		scheme tpm2.Algorithm
+		str    string
+	}{
+		"signer": {
+			signer, []string{"sensitiveDataOrigin", "userWithAuth", "sign"}, tpm2.AlgNull,
+			"0x81000000: RSA 2048 bits, scheme any, attributes sensitiveDataOrigin|userWithAuth|sign",
+		},
+		"storage": {
+			storage, []string{"fixedTPM", "fixedParent", "sensitiveDataOrigin", "userWithAuth", "restricted", "decrypt"}, tpm2.AlgNull,
+			"0x81000001: RSA 2048 bits, scheme any, symmetric AES-128-CFB, attributes fixedTPM|fixedParent|sensitiveDataOrigin|userWithAuth|restricted|decrypt",
+		},
+		"AK": {
+			ak, []string{"fixedTPM", "fixedParent", "sensitiveDataOrigin", "userWithAuth", "restricted", "sign"}, tpm2.AlgRSASSA,
+			"0x81000002: RSA 2048 bits, scheme RSASSA-SHA256, attributes fixedTPM|fixedParent|sensitiveDataOrigin|userWithAuth|restricted|sign",
+		},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			info, err := DescribeKey(dev, test.handle)
+			require.NoError(t, err)
+			require.Equal(t, tpm2.AlgRSA, info.Algorithm)
+			require.Equal(t, 2048, info.Bits)
+			require.Equal(t, test.flags, info.Flags)
+			require.Equal(t, test.scheme, info.Scheme)
+			require.Equal(t, test.str, info.String())
+		})
+	}
+
+	_, err = DescribeKey(dev, 0x81000003)
+	require.Error(t, err)
+}
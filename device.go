@@ -1,7 +1,11 @@
 package tpmk
 
 import (
+	"errors"
 	"io"
+	"os"
+	"reflect"
+	"sync"
 
 	"github.com/google/go-tpm/tpm2"
 	"github.com/google/go-tpm/tpmutil/mssim"
@@ -12,18 +16,127 @@ import (
 // simltor, set SimDev, then call the command with "sim" as device name.
 var SimDev io.ReadWriteCloser
 
+// ErrTPMDisabled is returned when the TPM is present but can't be used, typically because it is
+// disabled in the firmware.
+var ErrTPMDisabled = errors.New("TPM is disabled or not started, check that it is enabled in the firmware (BIOS/UEFI) settings")
+
+// Linux TPM device paths, in order of preference. The resource manager allows several processes
+// to share the TPM and flushes their transient objects and sessions.
+var defaultDevices = []string{"/dev/tpmrm0", "/dev/tpm0"}
+
 // OpenDevice opens a TPM2. If device is 'sim', it'll connect to a simulator on localhost:2321.
-// The caller is responsible for calling Close().
+// An empty device opens the in-kernel resource manager /dev/tpmrm0, or /dev/tpm0 if the kernel
+// doesn't provide one. The caller is responsible for calling Close(). ErrTPMDisabled is returned
+// if the device can't be used.
 func OpenDevice(device string) (io.ReadWriteCloser, error) {
+	var (
+		dev io.ReadWriteCloser
+		err error
+	)
+	if device == "" {
+		device = findDevice(defaultDevices...)
+	}
 	switch device {
 	case "sim":
 		if SimDev != nil {
 			return SimDev, nil
 		}
-		return OpenSim()
+		dev, err = OpenSim()
 	default:
-		return tpm2.OpenTPM(device)
+		dev, err = tpm2.OpenTPM(device)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := CheckEnabled(dev); err != nil {
+		dev.Close()
+		return nil, err
+	}
+	return dev, nil
+}
+
+// findDevice returns the first of the paths that exists, or the last one if none do so the
+// error from opening it names a device.
+func findDevice(paths ...string) string {
+	for _, path := range paths {
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
 	}
+	return paths[len(paths)-1]
+}
+
+// deviceLock serializes the operations on a device. users counts the operations holding or
+// waiting for it, so it can be removed once there are none.
+type deviceLock struct {
+	sync.Mutex
+	users int
+}
+
+// Locks of the devices that are in use, by device. Devices that can't be used as map key share
+// one lock.
+var (
+	devLocksMu        sync.Mutex
+	devLocks          = make(map[io.ReadWriter]*deviceLock)
+	uncomparableDevMu sync.Mutex
+)
+
+// lockDevice locks the device for the sequence of commands of one operation, like signing with
+// a policy session, so that other goroutines using keys on the same device don't interleave
+// their commands with it. It returns the function to unlock it. The lock is only kept while
+// operations hold or wait for it, devices that are no longer used aren't referenced.
+func lockDevice(dev io.ReadWriter) func() {
+	if dev == nil || !reflect.TypeOf(dev).Comparable() {
+		uncomparableDevMu.Lock()
+		return uncomparableDevMu.Unlock
+	}
+	devLocksMu.Lock()
+	l := devLocks[dev]
+	if l == nil {
+		l = new(deviceLock)
+		devLocks[dev] = l
+	}
+	l.users++
+	devLocksMu.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+		devLocksMu.Lock()
+		if l.users--; l.users == 0 {
+			delete(devLocks, dev)
+		}
+		devLocksMu.Unlock()
+	}
+}
+
+// TPM_PT_STARTUP_CLEAR property and the bit indicating the owner hierarchy is enabled
+const (
+	ptStartupClear uint32 = 0x00000201
+	shEnable       uint32 = 0x00000002
+)
+
+// CheckEnabled returns ErrTPMDisabled if the TPM hasn't been started, is disabled, or if the owner
+// hierarchy is disabled.
+func CheckEnabled(dev io.ReadWriter) error {
+	cap, _, err := tpm2.GetCapability(dev, tpm2.CapabilityTPMProperties, 1, ptStartupClear)
+	if err != nil {
+		if e, ok := err.(tpm2.Error); ok && (e.Code == tpm2.RCInitialize || e.Code == tpm2.RCDisabled) {
+			return ErrTPMDisabled
+		}
+		return err
+	}
+	if len(cap) != 1 {
+		return errors.New("expected one property")
+	}
+	property, ok := cap[0].(tpm2.TaggedProperty)
+	if !ok {
+		return errors.New("property is of wrong type")
+	}
+	if property.Value&shEnable == 0 {
+		return ErrTPMDisabled
+	}
+	return nil
 }
 
 // Simulator is a wrapper around a simulator connection that ensures startup and shutdown are called on open/close.
@@ -50,5 +163,17 @@ func OpenSim() (Simulator, error) {
 	}
 
 	// Initialize the simulator
-	return Simulator{dev}, tpm2.Startup(dev, tpm2.StartupClear)
+	return Simulator{dev}, StartupIfNeeded(dev)
+}
+
+// StartupIfNeeded initializes the TPM with TPM2_Startup(CLEAR). It's not an error if the TPM has
+// already been started, so it's safe for several processes racing to start the TPM at boot to
+// call it. All but the first get TPM_RC_INITIALIZE back, which is treated as success.
+func StartupIfNeeded(dev io.ReadWriter) error {
+	// go-tpm's Startup drops transport errors, so the command is sent directly
+	_, err := runCommand(dev, tpm2.TagNoSessions, cmdStartup, tpm2.StartupClear)
+	if e, ok := err.(tpm2.Error); ok && e.Code == tpm2.RCInitialize {
+		return nil
+	}
+	return err
 }
@@ -0,0 +1,157 @@
+package tpmk
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/google/go-tpm-tools/simulator"
+	"github.com/google/go-tpm/tpmutil"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeTPM answers every command with the same response.
+type fakeTPM struct {
+	response []byte
+	buf      *bytes.Buffer
+}
+
+func (f *fakeTPM) Write(b []byte) (int, error) {
+	f.buf = bytes.NewBuffer(f.response)
+	return len(b), nil
+}
+
+func (f *fakeTPM) Read(b []byte) (int, error) {
+	return f.buf.Read(b)
+}
+
+// newFakeTPM returns a fake device responding with the given code and parameters.
+func newFakeTPM(t *testing.T, code tpmutil.ResponseCode, params ...interface{}) *fakeTPM {
+	body, err := tpmutil.Pack(params...)
+	require.NoError(t, err)
+	header, err := tpmutil.Pack(tpmutil.Tag(0x8001), uint32(10+len(body)), code)
+	require.NoError(t, err)
+	return &fakeTPM{response: append(header, body...)}
+}
+
+func TestCheckEnabled(t *testing.T) {
+	// TPMS_CAPABILITY_DATA with the hierarchy state
+	startupClear := func(value uint32) []interface{} {
+		return []interface{}{byte(0), uint32(6), uint32(1), ptStartupClear, value}
+	}
+
+	// Other failures should be passed through and not be reported as disabled
+	tests := map[string]struct {
+		dev      *fakeTPM
+		disabled bool
+		fail     bool
+	}{
+		"not started":       {newFakeTPM(t, 0x100), true, true},
+		"disabled":          {newFakeTPM(t, 0x120), true, true},
+		"owner disabled":    {newFakeTPM(t, 0, startupClear(0x80000005)...), true, true},
+		"enabled":           {newFakeTPM(t, 0, startupClear(0x80000007)...), false, false},
+		"failure mode":      {newFakeTPM(t, 0x101), false, true},
+		"transport failure": {&fakeTPM{}, false, true},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			err := CheckEnabled(test.dev)
+			if !test.fail {
+				require.NoError(t, err)
+				return
+			}
+			require.Error(t, err)
+			require.Equal(t, test.disabled, err == ErrTPMDisabled)
+		})
+	}
+
+	// The simulator is started and enabled
+	dev, err := simulator.Get()
+	require.NoError(t, err)
+	defer dev.Close()
+	require.NoError(t, CheckEnabled(dev))
+}
+
+// serialDev serializes commands sent to a device from several goroutines, like the kernel does for
+// processes sharing /dev/tpm0. The lock is held from writing a command until its response is read.
+type serialDev struct {
+	io.ReadWriter
+	mu sync.Mutex
+}
+
+func (d *serialDev) Write(b []byte) (int, error) {
+	d.mu.Lock()
+	return d.ReadWriter.Write(b)
+}
+
+func (d *serialDev) Read(b []byte) (int, error) {
+	defer d.mu.Unlock()
+	return d.ReadWriter.Read(b)
+}
+
+func TestStartupIfNeeded(t *testing.T) {
+	tests := map[string]struct {
+		dev  *fakeTPM
+		fail bool
+	}{
+		"started":           {newFakeTPM(t, 0), false},
+		"already started":   {newFakeTPM(t, 0x100), false},
+		"failure mode":      {newFakeTPM(t, 0x101), true},
+		"transport failure": {&fakeTPM{}, true},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			err := StartupIfNeeded(test.dev)
+			if test.fail {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+			}
+		})
+	}
+
+	// Several callers racing to start the simulator should all succeed
+	sim, err := simulator.Get()
+	require.NoError(t, err)
+	defer sim.Close()
+	dev := &serialDev{ReadWriter: sim}
+
+	var wg sync.WaitGroup
+	errs := make([]error, 8)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = StartupIfNeeded(dev)
+		}(i)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		require.NoError(t, err)
+	}
+	require.NoError(t, CheckEnabled(dev))
+}
+
+func TestFindDevice(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tpmk")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	tpmrm0 := filepath.Join(dir, "tpmrm0")
+	tpm0 := filepath.Join(dir, "tpm0")
+
+	// Without any devices, the last one is used to get a useful error
+	require.Equal(t, tpm0, findDevice(tpmrm0, tpm0))
+
+	// Only the raw device is present
+	require.NoError(t, ioutil.WriteFile(tpm0, nil, 0600))
+	require.Equal(t, tpm0, findDevice(tpmrm0, tpm0))
+
+	// The resource manager is preferred
+	require.NoError(t, ioutil.WriteFile(tpmrm0, nil, 0600))
+	require.Equal(t, tpmrm0, findDevice(tpmrm0, tpm0))
+}
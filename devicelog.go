@@ -0,0 +1,160 @@
+package tpmk
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpmutil"
+)
+
+// CommandHook is called by a device returned by NewLoggedDevice after every TPM command, with the
+// name of the command, like "TPM2_Sign", the time the TPM took to respond, and the error it
+// returned, if any. It's called from the goroutine running the command and needs to be safe for
+// concurrent use if the device is used concurrently.
+type CommandHook func(op string, dur time.Duration, err error)
+
+// Names of the commands used by tpmk and go-tpm, by command code
+var commandNames = map[tpmutil.Command]string{
+	cmdNVUndefineSpaceSpecial: "TPM2_NV_UndefineSpaceSpecial",
+	cmdEvictControl:           "TPM2_EvictControl",
+	cmdNVUndefineSpace:        "TPM2_NV_UndefineSpace",
+	cmdClear:                  "TPM2_Clear",
+	cmdClockSet:               "TPM2_ClockSet",
+	cmdHierarchyChangeAuth:    "TPM2_HierarchyChangeAuth",
+	cmdNVDefineSpace:          "TPM2_NV_DefineSpace",
+	cmdPCRAllocate:            "TPM2_PCR_Allocate",
+	cmdCreatePrimary:          "TPM2_CreatePrimary",
+	cmdNVIncrement:            "TPM2_NV_Increment",
+	cmdNVSetBits:              "TPM2_NV_SetBits",
+	cmdNVExtend:               "TPM2_NV_Extend",
+	cmdNVWrite:                "TPM2_NV_Write",
+	cmdNVWriteLock:            "TPM2_NV_WriteLock",
+	cmdPCREvent:               "TPM2_PCR_Event",
+	cmdPCRReset:               "TPM2_PCR_Reset",
+	cmdSequenceComplete:       "TPM2_SequenceComplete",
+	cmdStartup:                "TPM2_Startup",
+	cmdShutdown:               "TPM2_Shutdown",
+	cmdStirRandom:             "TPM2_StirRandom",
+	cmdActivateCredential:     "TPM2_ActivateCredential",
+	cmdCertify:                "TPM2_Certify",
+	cmdPolicyNV:               "TPM2_PolicyNV",
+	cmdCertifyCreation:        "TPM2_CertifyCreation",
+	cmdDuplicate:              "TPM2_Duplicate",
+	cmdGetSessionAuditDigest:  "TPM2_GetSessionAuditDigest",
+	cmdNVRead:                 "TPM2_NV_Read",
+	cmdObjectChangeAuth:       "TPM2_ObjectChangeAuth",
+	tpm2.CmdPolicySecret:      "TPM2_PolicySecret",
+	cmdCreate:                 "TPM2_Create",
+	cmdHMAC:                   "TPM2_HMAC",
+	cmdImport:                 "TPM2_Import",
+	cmdLoad:                   "TPM2_Load",
+	cmdQuote:                  "TPM2_Quote",
+	cmdRSADecrypt:             "TPM2_RSA_Decrypt",
+	cmdHMACStart:              "TPM2_HMAC_Start",
+	cmdSequenceUpdate:         "TPM2_SequenceUpdate",
+	cmdSign:                   "TPM2_Sign",
+	cmdUnseal:                 "TPM2_Unseal",
+	cmdContextLoad:            "TPM2_ContextLoad",
+	cmdContextSave:            "TPM2_ContextSave",
+	cmdEncryptDecrypt:         "TPM2_EncryptDecrypt",
+	cmdFlushContext:           "TPM2_FlushContext",
+	cmdLoadExternal:           "TPM2_LoadExternal",
+	cmdMakeCredential:         "TPM2_MakeCredential",
+	cmdNVReadPublic:           "TPM2_NV_ReadPublic",
+	cmdPolicyAuthValue:        "TPM2_PolicyAuthValue",
+	cmdPolicyCommandCode:      "TPM2_PolicyCommandCode",
+	cmdReadPublic:             "TPM2_ReadPublic",
+	cmdRSAEncrypt:             "TPM2_RSA_Encrypt",
+	cmdStartAuthSession:       "TPM2_StartAuthSession",
+	cmdVerifySig:              "TPM2_VerifySignature",
+	cmdGetCap:                 "TPM2_GetCapability",
+	cmdGetRandom:              "TPM2_GetRandom",
+	cmdHash:                   "TPM2_Hash",
+	cmdPCRRead:                "TPM2_PCR_Read",
+	tpm2.CmdPolicyPCR:         "TPM2_PolicyPCR",
+	cmdReadClock:              "TPM2_ReadClock",
+	cmdPCRExtend:              "TPM2_PCR_Extend",
+	cmdNVCertify:              "TPM2_NV_Certify",
+	cmdPolicyGetDigest:        "TPM2_PolicyGetDigest",
+	cmdTestParms:              "TPM2_TestParms",
+	cmdPolicyPassword:         "TPM2_PolicyPassword",
+	cmdSignSequenceComplete:   "TPM2_SignSequenceComplete",
+	cmdSignSequenceStart:      "TPM2_SignSequenceStart",
+}
+
+// commandName returns the name of a command, or its code if it's not known.
+func commandName(cmd tpmutil.Command) string {
+	if name, ok := commandNames[cmd]; ok {
+		return name
+	}
+	return fmt.Sprintf("TPM2_CC(0x%x)", uint32(cmd))
+}
+
+// Size of the header of commands and responses, the tag, size, and command or response code
+const tpmHeaderSize = 10
+
+// loggedDevice calls a hook for every command sent through it.
+type loggedDevice struct {
+	io.ReadWriteCloser
+	hook CommandHook
+
+	mu    sync.Mutex
+	cmd   tpmutil.Command
+	start time.Time
+}
+
+// NewLoggedDevice wraps a TPM device so hook is called for every command sent to it, to see
+// which commands tpmk issues and how long the TPM takes for them. Keys, key generation and NV
+// functions all report their commands when used with the returned device. Devices that aren't
+// wrapped have no overhead. The hook can't be nil. To log with log/slog for example:
+//
+//	dev, err = tpmk.NewLoggedDevice(dev, func(op string, dur time.Duration, err error) {
+//	    slog.Debug("tpm command", "op", op, "duration", dur, "err", err)
+//	})
+func NewLoggedDevice(dev io.ReadWriteCloser, hook CommandHook) (io.ReadWriteCloser, error) {
+	if hook == nil {
+		return nil, errors.New("no command hook")
+	}
+	return &loggedDevice{ReadWriteCloser: dev, hook: hook}, nil
+}
+
+// Write sends a command to the TPM. Commands are written in one piece.
+func (d *loggedDevice) Write(b []byte) (int, error) {
+	var cmd tpmutil.Command
+	if len(b) >= tpmHeaderSize {
+		cmd = tpmutil.Command(binary.BigEndian.Uint32(b[6:]))
+	}
+	d.mu.Lock()
+	d.cmd, d.start = cmd, time.Now()
+	d.mu.Unlock()
+	n, err := d.ReadWriteCloser.Write(b)
+	if err != nil {
+		d.done(err)
+	}
+	return n, err
+}
+
+// Read receives the response to the last command and calls the hook with its result.
+func (d *loggedDevice) Read(b []byte) (int, error) {
+	n, err := d.ReadWriteCloser.Read(b)
+	switch {
+	case err != nil:
+		d.done(err)
+	case n >= tpmHeaderSize:
+		d.done(decodeResponse(tpmutil.ResponseCode(binary.BigEndian.Uint32(b[6:]))))
+	}
+	return n, err
+}
+
+// done calls the hook for the command that was last written.
+func (d *loggedDevice) done(err error) {
+	d.mu.Lock()
+	cmd, start := d.cmd, d.start
+	d.mu.Unlock()
+	d.hook(commandName(cmd), time.Since(start), err)
+}
@@ -0,0 +1,93 @@
+package tpmk
+
+import (
+	"crypto"
+	"crypto/sha256"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-tpm-tools/simulator"
+	"github.com/google/go-tpm/tpm2"
+	"github.com/stretchr/testify/require"
+)
+
+// loggedCommand is a command reported to a CommandHook.
+type loggedCommand struct {
+	op  string
+	dur time.Duration
+	err error
+}
+
+func TestLoggedDevice(t *testing.T) {
+	sim, err := simulator.Get()
+	require.NoError(t, err)
+	defer sim.Close()
+
+	var (
+		mu   sync.Mutex
+		cmds []loggedCommand
+	)
+	dev, err := NewLoggedDevice(sim, func(op string, dur time.Duration, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		cmds = append(cmds, loggedCommand{op, dur, err})
+	})
+	require.NoError(t, err)
+	ops := func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		var ops []string
+		for _, c := range cmds {
+			ops = append(ops, c.op)
+		}
+		cmds = nil
+		return ops
+	}
+
+	// Key generation
+	const (
+		handle = 0x81000000
+		pw     = ""
+		attr   = tpm2.FlagSign | tpm2.FlagUserWithAuth | tpm2.FlagSensitiveDataOrigin
+	)
+	_, err = GenRSAPrimaryKey(dev, handle, pw, pw, attr)
+	require.NoError(t, err)
+	generated := ops()
+	require.Contains(t, generated, "TPM2_CreatePrimary")
+	require.Contains(t, generated, "TPM2_EvictControl")
+	require.Equal(t, "TPM2_FlushContext", generated[len(generated)-1])
+
+	// Signing
+	priv, err := NewRSAPrivateKey(dev, handle, pw)
+	require.NoError(t, err)
+	require.Equal(t, []string{"TPM2_ReadPublic"}, ops())
+	digest := sha256.Sum256([]byte("This is a test"))
+	_, err = priv.Sign(nil, digest[:], crypto.SHA256)
+	require.NoError(t, err)
+	require.Equal(t, []string{"TPM2_Sign"}, ops())
+
+	// NV
+	require.NoError(t, NVWrite(dev, 0x1000000, []byte("data"), pw, NVDefaultAttr))
+	written := ops()
+	require.Contains(t, written, "TPM2_NV_DefineSpace")
+	require.Contains(t, written, "TPM2_NV_Write")
+
+	// Failures are reported with the error the TPM returned
+	_, _, err = ReadPublicKey(dev, 0x81000001)
+	require.Error(t, err)
+	mu.Lock()
+	require.Len(t, cmds, 1)
+	require.Equal(t, "TPM2_ReadPublic", cmds[0].op)
+	require.Equal(t, err, cmds[0].err)
+	require.True(t, cmds[0].dur > 0)
+	mu.Unlock()
+
+	require.Equal(t, "TPM2_CC(0x1ff)", commandName(0x1ff))
+	require.Equal(t, "TPM2_NV_SetBits", commandName(cmdNVSetBits))
+	require.Equal(t, "TPM2_NV_Extend", commandName(cmdNVExtend))
+
+	// A hook is required
+	_, err = NewLoggedDevice(sim, nil)
+	require.Error(t, err)
+}
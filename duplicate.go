@@ -0,0 +1,198 @@
+package tpmk
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpmutil"
+)
+
+// DuplicatedKey is a copy of a key made with DuplicateKey for import under another parent. The
+// private part is encrypted with a random seed, which in turn is encrypted with the public key
+// of the new parent, so only the TPM holding the new parent can import it.
+type DuplicatedKey struct {
+	Public  []byte // Public area of the key (TPMT_PUBLIC), the same as returned by GenRSAChildKey
+	Private []byte // Encrypted private part of the key (TPM2B_PRIVATE contents)
+	Seed    []byte // Seed encrypted with the new parent's public key (TPM2B_ENCRYPTED_SECRET contents)
+}
+
+// duplicationPolicy returns the digest of the policy given to keys created with WithDuplication.
+func duplicationPolicy() []byte {
+	return commandPolicy(cmdDuplicate)
+}
+
+// DuplicateKey exports a loaded key for import under a new parent with ImportKey, typically a
+// storage key in another TPM, to back it up or migrate it. The key needs to have been created
+// with GenRSAChildKey and WithDuplication, password is the key's password. newParentPublic is
+// the public key of the new parent, which needs to be an RSA storage key using AES-128-CFB and
+// SHA256 like the ones created by GenRSAPrimaryKey with tpm2.FlagStorageDefault.
+func DuplicateKey(dev io.ReadWriteCloser, handle tpmutil.Handle, password string, newParentPublic crypto.PublicKey) (DuplicatedKey, error) {
+	pub, _, err := ReadPublicKey(dev, handle)
+	if err != nil {
+		return DuplicatedKey{}, err
+	}
+	if pub.Attributes&(tpm2.FlagFixedTPM|tpm2.FlagFixedParent) != 0 {
+		return DuplicatedKey{}, fmt.Errorf("key 0x%x can't be duplicated, tpm2.FlagFixedTPM or tpm2.FlagFixedParent is set", handle)
+	}
+	if !bytes.Equal(pub.AuthPolicy, duplicationPolicy()) {
+		return DuplicatedKey{}, fmt.Errorf("key 0x%x wasn't created with WithDuplication", handle)
+	}
+	public, err := pub.Encode()
+	if err != nil {
+		return DuplicatedKey{}, err
+	}
+	rsaPub, ok := newParentPublic.(*rsa.PublicKey)
+	if !ok {
+		return DuplicatedKey{}, UnsupportedKeyError{Key: newParentPublic}
+	}
+
+	// Only the public part of the new parent is needed to encrypt the seed
+	parent, _, err := tpm2.LoadExternal(dev, tpm2.Public{
+		Type:       tpm2.AlgRSA,
+		NameAlg:    tpm2.AlgSHA256,
+		Attributes: tpm2.FlagRestricted | tpm2.FlagDecrypt | tpm2.FlagUserWithAuth,
+		RSAParameters: &tpm2.RSAParams{
+			Symmetric: &tpm2.SymScheme{Alg: tpm2.AlgAES, KeyBits: 128, Mode: tpm2.AlgCFB},
+			Sign:      &tpm2.SigScheme{Alg: tpm2.AlgNull, Hash: tpm2.AlgNull},
+			KeyBits:   uint16(rsaPub.Size() * 8),
+			Exponent:  uint32(rsaPub.E),
+			Modulus:   rsaPub.N,
+		},
+	}, tpm2.Private{}, tpm2.HandleNull)
+	if err != nil {
+		return DuplicatedKey{}, err
+	}
+	defer tpm2.FlushContext(dev, parent)
+
+	defer lockDevice(dev)()
+	session, err := startSatisfiedSession(dev, func(dev io.ReadWriter, session tpmutil.Handle) error {
+		if err := policyCommandCode(dev, session, cmdDuplicate); err != nil {
+			return err
+		}
+		return tpm2.PolicyPassword(dev, session)
+	})
+	if err != nil {
+		return DuplicatedKey{}, err
+	}
+	defer tpm2.FlushContext(dev, session)
+
+	// No inner encryption key, the duplicate is only protected by the new parent's seed
+	cmd, err := encodeCommand(
+		[]interface{}{handle, parent},
+		[]tpm2.AuthCommand{{Session: session, Attributes: tpm2.AttrContinueSession, Auth: []byte(password)}},
+		[]byte(nil), tpm2.AlgNull,
+	)
+	if err != nil {
+		return DuplicatedKey{}, err
+	}
+	resp, err := runCommand(dev, tpm2.TagSessions, cmdDuplicate, cmd)
+	if err != nil {
+		return DuplicatedKey{}, err
+	}
+	var (
+		paramSize        uint32
+		encryptionKeyOut []byte
+		dup              DuplicatedKey
+	)
+	if _, err := tpmutil.Unpack(resp, &paramSize, &encryptionKeyOut, &dup.Private, &dup.Seed); err != nil {
+		return DuplicatedKey{}, err
+	}
+	dup.Public = public
+	return dup, nil
+}
+
+// ImportKey imports a key exported with DuplicateKey under a storage key, making the TPM of the
+// parent hold a copy of it. It returns the private part encrypted by the new parent, which is
+// loaded with LoadKey together with dup.Public, like keys created with GenRSAChildKey.
+func ImportKey(dev io.ReadWriteCloser, parent tpmutil.Handle, parentPW string, dup DuplicatedKey) ([]byte, error) {
+	if len(dup.Public) == 0 || len(dup.Private) == 0 || len(dup.Seed) == 0 {
+		return nil, errors.New("incomplete duplicated key")
+	}
+	return importObject(dev, parent, parentPW, dup)
+}
+
+// importObject runs TPM2_Import for a duplicate without inner wrapper. Without seed, the
+// duplicate has no outer wrapper either and is the plain sensitive area.
+func importObject(dev io.ReadWriter, parent tpmutil.Handle, parentPW string, dup DuplicatedKey) ([]byte, error) {
+	cmd, err := encodeCommand(
+		[]interface{}{parent},
+		[]tpm2.AuthCommand{passwordAuth(parentPW)},
+		[]byte(nil), dup.Public, dup.Private, dup.Seed, tpm2.AlgNull,
+	)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := runCommand(dev, tpm2.TagSessions, cmdImport, cmd)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		paramSize uint32
+		private   []byte
+	)
+	if _, err := tpmutil.Unpack(resp, &paramSize, &private); err != nil {
+		return nil, err
+	}
+	return private, nil
+}
+
+// ImportRSAKey imports a software RSA key under a storage key and loads it, returning the
+// transient handle which can be used with NewRSAPrivateKey and needs to be flushed with
+// tpm2.FlushContext. keyPW is the password of the imported key. It protects an existing key from
+// being copied from now on, but a key generated in the TPM, with GenRSAChildKey or
+// GenRSAPrimaryKey, should be preferred whenever possible. The imported key existed outside the
+// TPM and may have been copied before, so tpm2.FlagFixedTPM, tpm2.FlagFixedParent and
+// tpm2.FlagSensitiveDataOrigin can't be set, and the TPM can't vouch for it like for keys it
+// generated. Only signing and decryption keys can be imported, not storage keys. The key is sent
+// to the TPM unencrypted, so this should only be done where the connection to the TPM can't be
+// observed. To keep the key, make it persistent with PersistKey, or import it again.
+func ImportRSAKey(dev io.ReadWriteCloser, parent tpmutil.Handle, parentPW string, key *rsa.PrivateKey, keyPW string, attr tpm2.KeyProp) (tpmutil.Handle, error) {
+	if attr&(tpm2.FlagFixedTPM|tpm2.FlagFixedParent|tpm2.FlagSensitiveDataOrigin) != 0 {
+		return 0, errors.New("imported keys can't have tpm2.FlagFixedTPM, tpm2.FlagFixedParent or tpm2.FlagSensitiveDataOrigin set")
+	}
+	if isStorageKey(attr) {
+		return 0, errors.New("imported keys can't be storage keys")
+	}
+	if len(key.Primes) != 2 {
+		return 0, errors.New("only RSA keys with two primes are supported")
+	}
+	pub := tpm2.Public{
+		Type:       tpm2.AlgRSA,
+		NameAlg:    tpm2.AlgSHA256,
+		Attributes: attr,
+		RSAParameters: &tpm2.RSAParams{
+			Sign: &tpm2.SigScheme{
+				Alg:  tpm2.AlgNull,
+				Hash: tpm2.AlgNull,
+			},
+			KeyBits:  uint16(key.Size() * 8),
+			Exponent: uint32(key.E),
+			Modulus:  key.N,
+		},
+	}
+
+	public, err := pub.Encode()
+	if err != nil {
+		return 0, err
+	}
+
+	// TPMT_SENSITIVE with one of the primes, wrapped in TPM2B_SENSITIVE
+	sensitive, err := tpmutil.Pack(tpm2.AlgRSA, []byte(keyPW), []byte(nil), key.Primes[0].Bytes())
+	if err != nil {
+		return 0, err
+	}
+	duplicate, err := tpmutil.Pack(sensitive)
+	if err != nil {
+		return 0, err
+	}
+	private, err := importObject(dev, parent, parentPW, DuplicatedKey{Public: public, Private: duplicate})
+	if err != nil {
+		return 0, err
+	}
+	return LoadKey(dev, parent, parentPW, public, private)
+}
@@ -0,0 +1,124 @@
+package tpmk
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"testing"
+
+	"github.com/google/go-tpm-tools/simulator"
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpmutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDuplicateKey(t *testing.T) {
+	const (
+		oldParent tpmutil.Handle = 0x81000000
+		newParent tpmutil.Handle = 0x81000001
+		pw                       = ""
+		keyPW                    = "keypw"
+		attr                     = tpm2.FlagSign | tpm2.FlagSensitiveDataOrigin | tpm2.FlagUserWithAuth
+	)
+	dev, err := simulator.Get()
+	require.NoError(t, err)
+	defer dev.Close()
+
+	// Two storage keys stand in for the parents in the source and destination TPMs
+	_, err = GenRSAPrimaryKey(dev, oldParent, pw, pw, tpm2.FlagStorageDefault)
+	require.NoError(t, err)
+	newParentPub, err := GenRSAPrimaryKey(dev, newParent, pw, pw, tpm2.FlagStorageDefault, WithUnique([]byte("backup")))
+	require.NoError(t, err)
+
+	private, public, err := GenRSAChildKey(dev, oldParent, pw, keyPW, attr, WithDuplication())
+	require.NoError(t, err)
+	handle, err := LoadKey(dev, oldParent, pw, public, private)
+	require.NoError(t, err)
+	key, err := NewRSAPrivateKey(dev, handle, keyPW)
+	require.NoError(t, err)
+
+	// The password alone still allows signing, but not duplicating
+	digest := sha256.Sum256([]byte("backup"))
+	_, err = key.Sign(nil, digest[:], crypto.SHA256)
+	require.NoError(t, err)
+	_, err = DuplicateKey(dev, handle, "wrong", newParentPub)
+	require.Error(t, err)
+
+	dup, err := DuplicateKey(dev, handle, keyPW, newParentPub)
+	require.NoError(t, err)
+	require.Equal(t, public, dup.Public)
+
+	// The copy under the new parent signs like the original
+	imported, err := ImportKey(dev, newParent, pw, dup)
+	require.NoError(t, err)
+	copyHandle, err := LoadKey(dev, newParent, pw, dup.Public, imported)
+	require.NoError(t, err)
+	copyKey, err := NewRSAPrivateKey(dev, copyHandle, keyPW)
+	require.NoError(t, err)
+	sig, err := copyKey.Sign(nil, digest[:], crypto.SHA256)
+	require.NoError(t, err)
+	require.NoError(t, rsa.VerifyPKCS1v15(key.Public().(*rsa.PublicKey), crypto.SHA256, digest[:], sig))
+	require.NoError(t, tpm2.FlushContext(dev, copyHandle))
+	require.NoError(t, tpm2.FlushContext(dev, handle))
+
+	// It can't be imported under the old parent, the seed is encrypted to the new one
+	_, err = ImportKey(dev, oldParent, pw, dup)
+	require.Error(t, err)
+
+	// Keys that are fixed to their TPM are rejected before asking the TPM
+	fixedPriv, fixedPub, err := GenRSAChildKey(dev, oldParent, pw, keyPW, ChildKeyAttributes)
+	require.NoError(t, err)
+	fixed, err := LoadKey(dev, oldParent, pw, fixedPub, fixedPriv)
+	require.NoError(t, err)
+	defer tpm2.FlushContext(dev, fixed)
+	_, err = DuplicateKey(dev, fixed, keyPW, newParentPub)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "can't be duplicated")
+
+	_, _, err = GenRSAChildKey(dev, oldParent, pw, keyPW, ChildKeyAttributes, WithDuplication())
+	require.Error(t, err)
+}
+
+func TestImportRSAKey(t *testing.T) {
+	const (
+		parent tpmutil.Handle = 0x81000000
+		pw                    = ""
+		keyPW                 = "keypw"
+	)
+	dev, err := simulator.Get()
+	require.NoError(t, err)
+	defer dev.Close()
+	_, err = GenRSAPrimaryKey(dev, parent, pw, pw, tpm2.FlagStorageDefault)
+	require.NoError(t, err)
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	handle, err := ImportRSAKey(dev, parent, pw, key, keyPW, tpm2.FlagSign|tpm2.FlagUserWithAuth)
+	require.NoError(t, err)
+
+	// The TPM signs with the imported key
+	priv, err := NewRSAPrivateKey(dev, handle, keyPW)
+	require.NoError(t, err)
+	require.Equal(t, &key.PublicKey, priv.Public())
+	digest := sha256.Sum256([]byte("This is a test"))
+	for _, opts := range []crypto.SignerOpts{crypto.SHA256, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: crypto.SHA256}} {
+		sig, err := priv.Sign(nil, digest[:], opts)
+		require.NoError(t, err)
+		require.NoError(t, Verify(&key.PublicKey, digest[:], sig, opts))
+	}
+
+	// The password is set
+	wrong, err := NewRSAPrivateKey(dev, handle, "wrong")
+	require.NoError(t, err)
+	_, err = wrong.Sign(nil, digest[:], crypto.SHA256)
+	require.Error(t, err)
+	require.NoError(t, tpm2.FlushContext(dev, handle))
+	// Imported keys can't claim to have been generated in the TPM
+	_, err = ImportRSAKey(dev, parent, pw, key, keyPW, tpm2.FlagSign|tpm2.FlagUserWithAuth|tpm2.FlagFixedTPM)
+	require.Error(t, err)
+	_, err = ImportRSAKey(dev, parent, pw, key, keyPW, tpm2.FlagSign|tpm2.FlagUserWithAuth|tpm2.FlagSensitiveDataOrigin)
+	require.Error(t, err)
+	_, err = ImportRSAKey(dev, parent, pw, key, keyPW, tpm2.FlagStorageDefault&^(tpm2.FlagFixedTPM|tpm2.FlagFixedParent|tpm2.FlagSensitiveDataOrigin))
+	require.EqualError(t, err, "imported keys can't be storage keys")
+}
@@ -0,0 +1,214 @@
+package tpmk
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/asn1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpmutil"
+)
+
+// TPM_CAP_ECC_CURVES, not supported by tpm2.GetCapability.
+const capabilityECCCurves uint32 = 0x00000008
+
+// Curve25519 is TPM_ECC_CURVE_25519, the curve used by Ed25519. It's only implemented by TPMs
+// following version 1.59 or later of the specification. Use SupportedCurves to find out if a TPM
+// has it, and Ed25519PrivateKey to sign with keys on it.
+const Curve25519 tpm2.EllipticCurve = 0x0040
+
+// SupportedCurves returns the elliptic curves implemented by the TPM.
+func SupportedCurves(dev io.ReadWriter) ([]tpm2.EllipticCurve, error) {
+	var curves []tpm2.EllipticCurve
+	var first uint32
+	for {
+		resp, err := runCommand(dev, tpm2.TagNoSessions, cmdGetCap, capabilityECCCurves, first, uint32(64))
+		if err != nil {
+			return nil, err
+		}
+		var (
+			more   byte
+			capRep uint32
+			count  uint32
+		)
+		n, err := tpmutil.Unpack(resp, &more, &capRep, &count)
+		if err != nil {
+			return nil, err
+		}
+		rest := resp[n:]
+		if capRep != capabilityECCCurves {
+			return nil, fmt.Errorf("unexpected capability 0x%x", capRep)
+		}
+		if len(rest) < 2*int(count) {
+			return nil, errors.New("ECC curve list is truncated")
+		}
+		for i := 0; i < int(count); i++ {
+			curves = append(curves, tpm2.EllipticCurve(binary.BigEndian.Uint16(rest[2*i:])))
+		}
+		if more == 0 || count == 0 {
+			return curves, nil
+		}
+		first = uint32(curves[len(curves)-1]) + 1
+	}
+}
+
+// ECPrivateKey represents an ECC key in a TPM and implements the crypto.Signer interface which
+// allows it to be used in TLS connections, like RSAPrivateKey.
+type ECPrivateKey struct {
+	dev       io.ReadWriter
+	handle    tpmutil.Handle
+	pub       tpm2.Public
+	publicKey crypto.PublicKey
+	password  string
+	encoding  SignatureEncoding
+}
+
+// SignatureEncoding selects how ECDSA signatures are encoded.
+type SignatureEncoding int
+
+const (
+	// SignatureASN1 encodes signatures as ASN.1 DER sequence of r and s, as expected from a
+	// crypto.Signer and used in TLS and X.509.
+	SignatureASN1 SignatureEncoding = iota
+	// SignatureRaw encodes signatures as r followed by s, each padded with leading zeros to the
+	// size of the curve, as used in JWS (JWT) and COSE.
+	SignatureRaw
+)
+
+// WithSignatureEncoding returns a copy of the key that encodes signatures as selected. Keys
+// produce ASN.1 signatures by default. Note that only keys with SignatureASN1 satisfy the
+// crypto.Signer contract, so keys with raw encoding must not be used for TLS or certificates.
+// RSA signatures have only one encoding, there's no such option for RSAPrivateKey.
+func (k ECPrivateKey) WithSignatureEncoding(e SignatureEncoding) ECPrivateKey {
+	k.encoding = e
+	return k
+}
+
+// NewECPrivateKey initializes crypto.PrivateKey with an ECC private key that is held in the TPM.
+// The public key is an *ecdsa.PublicKey.
+func NewECPrivateKey(dev io.ReadWriteCloser, handle tpmutil.Handle, password string) (ECPrivateKey, error) {
+	pub, publicKey, err := ReadPublicKey(dev, handle)
+	if err != nil {
+		return ECPrivateKey{}, err
+	}
+	if pub.Type != tpm2.AlgECC {
+		return ECPrivateKey{}, UnsupportedKeyError{Key: publicKey}
+	}
+	return ECPrivateKey{dev: dev, handle: handle, pub: pub, publicKey: publicKey, password: password}, nil
+}
+
+// NewPrivateKey returns the key at the handle as RSAPrivateKey or ECPrivateKey, depending on its
+// type. This allows code that only signs to support both kinds of keys.
+func NewPrivateKey(dev io.ReadWriteCloser, handle tpmutil.Handle, password string) (Signer, error) {
+	pub, publicKey, err := ReadPublicKey(dev, handle)
+	if err != nil {
+		return nil, err
+	}
+	switch pub.Type {
+	case tpm2.AlgRSA:
+		return RSAPrivateKey{dev: dev, handle: handle, pub: pub, publicKey: publicKey, password: password}, nil
+	case tpm2.AlgECC:
+		return ECPrivateKey{dev: dev, handle: handle, pub: pub, publicKey: publicKey, password: password}, nil
+	default:
+		return nil, UnsupportedKeyError{Key: publicKey}
+	}
+}
+
+// Public returns the public part of the key.
+func (k ECPrivateKey) Public() crypto.PublicKey {
+	return k.publicKey
+}
+
+// Close releases the TPM resources held by the key. Like RSAPrivateKey.Close, it always returns
+// nil since the key doesn't hold any between signatures.
+func (k ECPrivateKey) Close() error {
+	return nil
+}
+
+// Handle returns the handle of the key in the TPM.
+func (k ECPrivateKey) Handle() tpmutil.Handle {
+	return k.handle
+}
+
+// Sign digests via a key in the TPM using ECDSA. Implements crypto.Signer. The signature is
+// returned ASN.1-encoded, like ecdsa.PrivateKey does, unless a different encoding was selected
+// with WithSignatureEncoding. To use this function, tpm2.FlagSign needs
+// to be set on the key, and tpm2.FlagRestricted needs to be clear. Like RSAPrivateKey.Sign, it's
+// safe to call concurrently.
+func (k ECPrivateKey) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	if _, ok := opts.(*rsa.PSSOptions); ok {
+		return nil, errors.New("PSS is not supported by ECC keys")
+	}
+	if err := checkDigestLength(opts.HashFunc(), digest); err != nil {
+		return nil, err
+	}
+	if k.pub.Attributes&tpm2.FlagUserWithAuth == 0 {
+		return nil, errors.New("key can only be used with a policy")
+	}
+	unlock := lockDevice(k.dev)
+	hash, err := hashAlgorithm(k.dev, opts.HashFunc())
+	if err != nil {
+		unlock()
+		return nil, err
+	}
+	sig, err := tpm2.Sign(k.dev, k.handle, k.password, digest, &tpm2.SigScheme{
+		Alg:  tpm2.AlgECDSA,
+		Hash: hash,
+	})
+	unlock()
+	if err != nil {
+		return nil, err
+	}
+	if sig.ECC == nil {
+		return nil, fmt.Errorf("unexpected signature algorithm 0x%x", sig.Alg)
+	}
+	switch k.encoding {
+	case SignatureASN1:
+		return asn1.Marshal(struct{ R, S *big.Int }{sig.ECC.R, sig.ECC.S})
+	case SignatureRaw:
+		return rawECDSASignature(k.publicKey.(*ecdsa.PublicKey).Curve, sig.ECC.R, sig.ECC.S)
+	default:
+		return nil, fmt.Errorf("unsupported signature encoding %d", k.encoding)
+	}
+}
+
+// rawECDSASignature encodes r and s as fixed-size big-endian integers of the curve's size.
+func rawECDSASignature(curve elliptic.Curve, r, s *big.Int) ([]byte, error) {
+	size := (curve.Params().BitSize + 7) / 8
+	rb, sb := r.Bytes(), s.Bytes()
+	if len(rb) > size || len(sb) > size {
+		return nil, errors.New("ECDSA signature is larger than the curve")
+	}
+	raw := make([]byte, 2*size)
+	copy(raw[size-len(rb):size], rb)
+	copy(raw[2*size-len(sb):], sb)
+	return raw, nil
+}
+
+// verifyPKCS1OrECDSA verifies a PKCS#1 v1.5 or ASN.1-encoded ECDSA signature, depending on the
+// type of the public key.
+func verifyPKCS1OrECDSA(pub crypto.PublicKey, hash crypto.Hash, digest, sig []byte) error {
+	switch pub := pub.(type) {
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(pub, hash, digest, sig)
+	case *ecdsa.PublicKey:
+		var rs struct{ R, S *big.Int }
+		rest, err := asn1.Unmarshal(sig, &rs)
+		if err != nil {
+			return err
+		}
+		if len(rest) > 0 || !ecdsa.Verify(pub, digest, rs.R, rs.S) {
+			return errors.New("invalid ECDSA signature")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported key type %T", pub)
+	}
+}
@@ -0,0 +1,177 @@
+package tpmk
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/asn1"
+	"io"
+	"math/big"
+	"testing"
+
+	"github.com/google/go-tpm-tools/simulator"
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpmutil"
+	"github.com/stretchr/testify/require"
+)
+
+const ecAttr = tpm2.FlagSign | tpm2.FlagFixedTPM | tpm2.FlagUserWithAuth | tpm2.FlagFixedParent | tpm2.FlagSensitiveDataOrigin
+
+// createECKey creates an ECC signing key under the owner hierarchy and returns its handle.
+func createECKey(t *testing.T, dev io.ReadWriter, curve tpm2.EllipticCurve, pw string) tpmutil.Handle {
+	handle, _, err := tpm2.CreatePrimary(dev, tpm2.HandleOwner, tpm2.PCRSelection{}, "", pw, tpm2.Public{
+		Type:       tpm2.AlgECC,
+		NameAlg:    tpm2.AlgSHA256,
+		Attributes: ecAttr,
+		ECCParameters: &tpm2.ECCParams{
+			Sign: &tpm2.SigScheme{
+				Alg:  tpm2.AlgNull,
+				Hash: tpm2.AlgNull,
+			},
+			CurveID: curve,
+			Point:   tpm2.ECPoint{X: big.NewInt(0), Y: big.NewInt(0)},
+		},
+	})
+	require.NoError(t, err)
+	return handle
+}
+
+func TestECSign(t *testing.T) {
+	dev, err := simulator.Get()
+	require.NoError(t, err)
+	defer dev.Close()
+
+	const pw = "password"
+
+	data := []byte("This is a test")
+	digestSHA256 := sha256.Sum256(data)
+	digestSHA384 := sha512.Sum384(data)
+
+	tests := map[string]struct {
+		curve   tpm2.EllipticCurve
+		goCurve elliptic.Curve
+		digest  []byte
+		hash    crypto.Hash
+	}{
+		"P-256 with SHA256": {tpm2.CurveNISTP256, elliptic.P256(), digestSHA256[:], crypto.SHA256},
+		"P-384 with SHA384": {tpm2.CurveNISTP384, elliptic.P384(), digestSHA384[:], crypto.SHA384},
+		"P-384 with SHA256": {tpm2.CurveNISTP384, elliptic.P384(), digestSHA256[:], crypto.SHA256},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			handle := createECKey(t, dev, test.curve, pw)
+			defer tpm2.FlushContext(dev, handle)
+
+			priv, err := NewECPrivateKey(dev, handle, pw)
+			require.NoError(t, err)
+			pub, ok := priv.Public().(*ecdsa.PublicKey)
+			require.True(t, ok)
+			require.Equal(t, test.goCurve, pub.Curve)
+
+			sig, err := priv.Sign(nil, test.digest, test.hash)
+			require.NoError(t, err)
+
+			var rs struct{ R, S *big.Int }
+			_, err = asn1.Unmarshal(sig, &rs)
+			require.NoError(t, err)
+			require.True(t, ecdsa.Verify(pub, test.digest, rs.R, rs.S))
+		})
+	}
+}
+
+func TestNewPrivateKey(t *testing.T) {
+	dev, err := simulator.Get()
+	require.NoError(t, err)
+	defer dev.Close()
+
+	const (
+		rsaHandle tpmutil.Handle = 0x81000000
+		pw                       = ""
+	)
+	_, err = GenRSAPrimaryKey(dev, rsaHandle, pw, pw, ecAttr)
+	require.NoError(t, err)
+	ecHandle := createECKey(t, dev, tpm2.CurveNISTP256, pw)
+
+	// The key type is chosen by the type of the key in the TPM
+	k, err := NewPrivateKey(dev, rsaHandle, pw)
+	require.NoError(t, err)
+	require.IsType(t, RSAPrivateKey{}, k)
+	require.IsType(t, &rsa.PublicKey{}, k.Public())
+	k, err = NewPrivateKey(dev, ecHandle, pw)
+	require.NoError(t, err)
+	require.IsType(t, ECPrivateKey{}, k)
+	require.IsType(t, &ecdsa.PublicKey{}, k.Public())
+
+	// The specific constructors reject the other type
+	_, err = NewRSAPrivateKey(dev, ecHandle, pw)
+	require.Error(t, err)
+	_, err = NewECPrivateKey(dev, rsaHandle, pw)
+	require.Error(t, err)
+
+	// ECC keys can't sign with PSS
+	_, err = k.Sign(nil, make([]byte, 32), &rsa.PSSOptions{Hash: crypto.SHA256})
+	require.Error(t, err)
+
+	// Use the ECC key as client and the RSA key as server in a TLS connection
+	server, err := NewPrivateKey(dev, rsaHandle, pw)
+	require.NoError(t, err)
+	testMutualTLS(t, k, server)
+}
+
+func TestSupportedCurves(t *testing.T) {
+	dev, err := simulator.Get()
+	require.NoError(t, err)
+	defer dev.Close()
+
+	curves, err := SupportedCurves(dev)
+	require.NoError(t, err)
+	require.Contains(t, curves, tpm2.CurveNISTP256)
+	require.Contains(t, curves, tpm2.CurveNISTP384)
+
+	// The simulator predates Ed25519 support
+	require.NotContains(t, curves, Curve25519)
+}
+
+func TestECSignRaw(t *testing.T) {
+	dev, err := simulator.Get()
+	require.NoError(t, err)
+	defer dev.Close()
+
+	digest := sha256.Sum256([]byte("This is a test"))
+	tests := map[string]struct {
+		curve tpm2.EllipticCurve
+		size  int
+	}{
+		"P-256": {tpm2.CurveNISTP256, 64},
+		"P-384": {tpm2.CurveNISTP384, 96},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			handle := createECKey(t, dev, test.curve, "")
+			defer tpm2.FlushContext(dev, handle)
+			priv, err := NewECPrivateKey(dev, handle, "")
+			require.NoError(t, err)
+			pub := priv.Public().(*ecdsa.PublicKey)
+
+			// Sign several times so signatures with leading zeros in r or s are likely
+			raw := priv.WithSignatureEncoding(SignatureRaw)
+			for i := 0; i < 10; i++ {
+				sig, err := raw.Sign(nil, digest[:], crypto.SHA256)
+				require.NoError(t, err)
+				require.Len(t, sig, test.size)
+				r := new(big.Int).SetBytes(sig[:test.size/2])
+				s := new(big.Int).SetBytes(sig[test.size/2:])
+				require.True(t, ecdsa.Verify(pub, digest[:], r, s))
+			}
+
+			// The default is still ASN.1
+			sig, err := priv.Sign(nil, digest[:], crypto.SHA256)
+			require.NoError(t, err)
+			require.NoError(t, verifyPKCS1OrECDSA(pub, crypto.SHA256, digest[:], sig))
+		})
+	}
+}
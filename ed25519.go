@@ -0,0 +1,162 @@
+package tpmk
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpmutil"
+)
+
+// algEdDSA is the EdDSA signature scheme (TPM_ALG_EDDSA).
+const algEdDSA tpm2.Algorithm = 0x0060
+
+// ErrNoEd25519 is returned by NewEd25519PrivateKey if the TPM doesn't implement Curve25519.
+var ErrNoEd25519 = errors.New("TPM doesn't implement Curve25519, which Ed25519 keys need")
+
+// Ed25519PrivateKey represents an Ed25519 key in a TPM and implements the crypto.Signer interface,
+// like ed25519.PrivateKey.
+type Ed25519PrivateKey struct {
+	dev       io.ReadWriter
+	handle    tpmutil.Handle
+	pub       tpm2.Public
+	publicKey ed25519.PublicKey
+	password  string
+}
+
+// NewEd25519PrivateKey initializes crypto.PrivateKey with an ECC key on Curve25519 that is held in
+// the TPM. The public key is an ed25519.PublicKey. ErrNoEd25519 is returned if the TPM doesn't
+// implement the curve.
+func NewEd25519PrivateKey(dev io.ReadWriteCloser, handle tpmutil.Handle, password string) (Ed25519PrivateKey, error) {
+	curves, err := SupportedCurves(dev)
+	if err != nil {
+		return Ed25519PrivateKey{}, err
+	}
+	if !hasCurve(curves, Curve25519) {
+		return Ed25519PrivateKey{}, ErrNoEd25519
+	}
+	// The key can't be read with ReadPublicKey since go-tpm doesn't know the curve
+	pub, _, _, err := tpm2.ReadPublic(dev, handle)
+	if err != nil {
+		return Ed25519PrivateKey{}, err
+	}
+	if pub.Type != tpm2.AlgECC || pub.ECCParameters == nil || pub.ECCParameters.CurveID != Curve25519 {
+		return Ed25519PrivateKey{}, fmt.Errorf("key at 0x%x is not an Ed25519 key", handle)
+	}
+	x := pub.ECCParameters.Point.X.Bytes()
+	if len(x) > ed25519.PublicKeySize {
+		return Ed25519PrivateKey{}, fmt.Errorf("invalid Ed25519 public key of %d bytes", len(x))
+	}
+	publicKey := make(ed25519.PublicKey, ed25519.PublicKeySize)
+	copy(publicKey[ed25519.PublicKeySize-len(x):], x)
+	return Ed25519PrivateKey{dev: dev, handle: handle, pub: pub, publicKey: publicKey, password: password}, nil
+}
+
+// hasCurve returns true if curve is in curves.
+func hasCurve(curves []tpm2.EllipticCurve, curve tpm2.EllipticCurve) bool {
+	for _, c := range curves {
+		if c == curve {
+			return true
+		}
+	}
+	return false
+}
+
+// Public returns the public part of the key.
+func (k Ed25519PrivateKey) Public() crypto.PublicKey {
+	return k.publicKey
+}
+
+// Close releases the TPM resources held by the key. Like RSAPrivateKey.Close, it always returns
+// nil since the key doesn't hold any between signatures.
+func (k Ed25519PrivateKey) Close() error {
+	return nil
+}
+
+// Handle returns the handle of the key in the TPM.
+func (k Ed25519PrivateKey) Handle() tpmutil.Handle {
+	return k.handle
+}
+
+// Sign signs the full message, not a digest, like ed25519.PrivateKey. Implements crypto.Signer.
+// opts.HashFunc() needs to be crypto.Hash(0), Ed25519ph isn't supported. The signature is 64
+// bytes long. The message is passed to the TPM in a signing sequence. Like RSAPrivateKey.Sign,
+// it's safe to call concurrently.
+func (k Ed25519PrivateKey) Sign(rand io.Reader, message []byte, opts crypto.SignerOpts) ([]byte, error) {
+	if opts.HashFunc() != crypto.Hash(0) {
+		return nil, errors.New("Ed25519 keys sign the message, opts need to be crypto.Hash(0)")
+	}
+	if k.pub.Attributes&tpm2.FlagUserWithAuth == 0 {
+		return nil, errors.New("key can only be used with a policy")
+	}
+	defer lockDevice(k.dev)()
+
+	// The sequence is started with an empty password, the key's password is only needed to
+	// complete it
+	resp, err := runCommand(k.dev, tpm2.TagNoSessions, cmdSignSequenceStart, k.handle, []byte(nil), []byte(nil), []byte(nil))
+	if err != nil {
+		return nil, err
+	}
+	var seq tpmutil.Handle
+	if _, err := tpmutil.Unpack(resp, &seq); err != nil {
+		return nil, err
+	}
+
+	// All but the last block are sent with SequenceUpdate. The sequence is flushed by the TPM
+	// once it's completed, it only needs to be flushed here if it fails before that.
+	for len(message) > maxDigestBuffer {
+		cmd, err := encodeCommand(
+			[]interface{}{seq},
+			[]tpm2.AuthCommand{passwordAuth("")},
+			message[:maxDigestBuffer],
+		)
+		if err != nil {
+			tpm2.FlushContext(k.dev, seq)
+			return nil, err
+		}
+		if _, err := runCommand(k.dev, tpm2.TagSessions, cmdSequenceUpdate, cmd); err != nil {
+			tpm2.FlushContext(k.dev, seq)
+			return nil, err
+		}
+		message = message[maxDigestBuffer:]
+	}
+	cmd, err := encodeCommand(
+		[]interface{}{seq, k.handle},
+		[]tpm2.AuthCommand{passwordAuth(""), passwordAuth(k.password)},
+		message,
+	)
+	if err != nil {
+		tpm2.FlushContext(k.dev, seq)
+		return nil, err
+	}
+	resp, err = runCommand(k.dev, tpm2.TagSessions, cmdSignSequenceComplete, cmd)
+	if err != nil {
+		tpm2.FlushContext(k.dev, seq)
+		return nil, err
+	}
+	return decodeEdDSASignature(resp)
+}
+
+// decodeEdDSASignature decodes the TPMT_SIGNATURE in the response of TPM2_SignSequenceComplete
+// and returns it in the encoding of RFC 8032, R followed by S.
+func decodeEdDSASignature(resp []byte) ([]byte, error) {
+	var (
+		paramSize uint32
+		alg, hash tpm2.Algorithm
+		r, s      []byte
+	)
+	if _, err := tpmutil.Unpack(resp, &paramSize, &alg, &hash, &r, &s); err != nil {
+		return nil, err
+	}
+	if alg != algEdDSA {
+		return nil, fmt.Errorf("unexpected signature algorithm 0x%x", alg)
+	}
+	const size = ed25519.SignatureSize / 2
+	if len(r) != size || len(s) != size {
+		return nil, fmt.Errorf("invalid Ed25519 signature with R of %d and S of %d bytes", len(r), len(s))
+	}
+	return append(r, s...), nil
+}
@@ -0,0 +1,123 @@
+package tpmk
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"io"
+	"math/big"
+	"testing"
+
+	"github.com/google/go-tpm-tools/simulator"
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpmutil"
+	"github.com/stretchr/testify/require"
+)
+
+// nopCloser turns a fake device into an io.ReadWriteCloser.
+type nopCloser struct {
+	io.ReadWriter
+}
+
+func (nopCloser) Close() error { return nil }
+
+func TestEd25519Sign(t *testing.T) {
+	dev, err := simulator.Get()
+	require.NoError(t, err)
+	defer dev.Close()
+
+	curves, err := SupportedCurves(dev)
+	require.NoError(t, err)
+	if !hasCurve(curves, Curve25519) {
+		t.Skip("simulator doesn't implement Curve25519")
+	}
+
+	const pw = "password"
+	handle := createECKey(t, dev, Curve25519, pw)
+	defer tpm2.FlushContext(dev, handle)
+	priv, err := NewEd25519PrivateKey(dev, handle, pw)
+	require.NoError(t, err)
+
+	for _, size := range []int{0, 100, 3000} {
+		message := make([]byte, size)
+		sig, err := priv.Sign(nil, message, crypto.Hash(0))
+		require.NoError(t, err)
+		require.True(t, ed25519.Verify(priv.Public().(ed25519.PublicKey), message, sig))
+	}
+}
+
+func TestEd25519Fake(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	// TPMS_CAPABILITY_DATA with the given curves
+	curves := func(c ...tpm2.EllipticCurve) *fakeTPM {
+		params := []interface{}{byte(0), capabilityECCCurves, uint32(len(c))}
+		for _, curve := range c {
+			params = append(params, curve)
+		}
+		return newFakeTPM(t, 0, params...)
+	}
+	// ReadPublic response of an ECC key on the given curve
+	readPublic := func(curve tpm2.EllipticCurve, x []byte) *fakeTPM {
+		public, err := tpm2.Public{
+			Type:       tpm2.AlgECC,
+			NameAlg:    tpm2.AlgSHA256,
+			Attributes: ecAttr,
+			ECCParameters: &tpm2.ECCParams{
+				Sign:    &tpm2.SigScheme{Alg: tpm2.AlgNull},
+				CurveID: curve,
+				KDF:     &tpm2.KDFScheme{Alg: tpm2.AlgNull},
+				Point:   tpm2.ECPoint{X: new(big.Int).SetBytes(x), Y: big.NewInt(0)},
+			},
+		}.Encode()
+		require.NoError(t, err)
+		return newFakeTPM(t, 0, public, []byte("name"), []byte("qualified name"))
+	}
+
+	// TPMs without the curve are rejected before reading the key
+	_, err = NewEd25519PrivateKey(nopCloser{curves(tpm2.CurveNISTP256)}, 0x81000000, "")
+	require.Equal(t, ErrNoEd25519, err)
+
+	// Only keys on Curve25519 are accepted
+	dev := &pagedTPM{responses: []*fakeTPM{curves(tpm2.CurveNISTP256, Curve25519), readPublic(tpm2.CurveNISTP256, publicKey)}}
+	_, err = NewEd25519PrivateKey(nopCloser{dev}, 0x81000000, "")
+	require.EqualError(t, err, "key at 0x81000000 is not an Ed25519 key")
+
+	dev = &pagedTPM{responses: []*fakeTPM{curves(Curve25519), readPublic(Curve25519, publicKey)}}
+	priv, err := NewEd25519PrivateKey(nopCloser{dev}, 0x81000000, "")
+	require.NoError(t, err)
+	require.Equal(t, publicKey, priv.Public())
+
+	// Digests can't be signed
+	_, err = priv.Sign(nil, make([]byte, 64), crypto.SHA512)
+	require.Error(t, err)
+
+	// Messages are passed in a signing sequence and the signature is returned as R || S. Messages
+	// larger than a single command are sent in blocks.
+	for _, size := range []int{0, 100, 3000} {
+		message := make([]byte, size)
+		expected := ed25519.Sign(privateKey, message)
+		responses := []*fakeTPM{newFakeTPM(t, 0, tpmutil.Handle(0x80000001))}
+		for i := 0; i < (size-1)/maxDigestBuffer; i++ {
+			responses = append(responses, newFakeTPM(t, 0))
+		}
+		responses = append(responses, newFakeTPM(t, 0, uint32(0), algEdDSA, tpm2.AlgSHA512, expected[:32], expected[32:]))
+		dev := &pagedTPM{responses: responses}
+		priv.dev = dev
+
+		sig, err := priv.Sign(nil, message, crypto.Hash(0))
+		require.NoError(t, err)
+		require.Equal(t, expected, sig)
+		require.True(t, ed25519.Verify(publicKey, message, sig))
+		require.Empty(t, dev.responses)
+	}
+
+	// Signatures of other schemes are rejected
+	priv.dev = &pagedTPM{responses: []*fakeTPM{
+		newFakeTPM(t, 0, tpmutil.Handle(0x80000001)),
+		newFakeTPM(t, 0, uint32(0), tpm2.AlgECDSA, tpm2.AlgSHA256, make([]byte, 32), make([]byte, 32)),
+	}}
+	_, err = priv.Sign(nil, []byte("message"), crypto.Hash(0))
+	require.EqualError(t, err, "unexpected signature algorithm 0x18")
+}
@@ -0,0 +1,79 @@
+package tpmk
+
+import (
+	"crypto"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"io"
+
+	"github.com/google/go-tpm-tools/tpm2tools"
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpmutil"
+)
+
+// EKCertIndexRSA is the NV index of the RSA 2048 Endorsement Key certificate, as defined in the
+// TCG EK Credential Profile.
+const EKCertIndexRSA tpmutil.Handle = 0x01c00002
+
+// EKCertIndexECC is the NV index of the ECC NIST P256 Endorsement Key certificate, as defined in
+// the TCG EK Credential Profile.
+const EKCertIndexECC tpmutil.Handle = 0x01c0000a
+
+// ReadEKCertificate reads the DER-encoded Endorsement Key certificate from NV, as provisioned by
+// the TPM manufacturer. Any padding after the certificate is removed.
+func ReadEKCertificate(dev io.ReadWriteCloser, index tpmutil.Handle) ([]byte, error) {
+	return nvReadDER(dev, index)
+}
+
+// ReadEKCertificates reads and parses the RSA and ECC Endorsement Key certificates, in that order.
+// Indexes that aren't defined are skipped, so the result is empty for TPMs that come without an
+// EK certificate, like simulators.
+func ReadEKCertificates(dev io.ReadWriteCloser) ([]*x509.Certificate, error) {
+	defined, err := NVList(dev)
+	if err != nil {
+		return nil, err
+	}
+	var certs []*x509.Certificate
+	for _, index := range []tpmutil.Handle{EKCertIndexRSA, EKCertIndexECC} {
+		if !containsHandle(defined, index) {
+			continue
+		}
+		der, err := ReadEKCertificate(dev, index)
+		if err != nil {
+			return nil, fmt.Errorf("reading EK certificate at 0x%x: %v", index, err)
+		}
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, fmt.Errorf("parsing EK certificate at 0x%x: %v", index, err)
+		}
+		certs = append(certs, cert)
+	}
+	return certs, nil
+}
+
+// EndorsementFingerprint returns a stable identifier of the TPM's endorsement hierarchy. It
+// derives the RSA EK from the default template of the TCG EK Credential Profile and returns
+// the fingerprint of its public key, see PublicKeyFingerprint. Since the EK certificate contains
+// the same key, an enrollment server can match the two without further access to the TPM. The
+// endorsement hierarchy is expected to have no password.
+func EndorsementFingerprint(dev io.ReadWriteCloser) (string, error) {
+	ek, pub, err := tpm2.CreatePrimary(dev, tpm2.HandleEndorsement, tpm2.PCRSelection{}, "", "", tpm2tools.DefaultEKTemplateRSA())
+	if err != nil {
+		return "", err
+	}
+	defer tpm2.FlushContext(dev, ek)
+	return PublicKeyFingerprint(pub)
+}
+
+// PublicKeyFingerprint returns the hex-encoded SHA256 hash of the DER-encoded public key,
+// truncated to 16 bytes.
+func PublicKeyFingerprint(pub crypto.PublicKey) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:16]), nil
+}
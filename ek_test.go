@@ -0,0 +1,59 @@
+package tpmk
+
+import (
+	"testing"
+
+	"github.com/google/go-tpm-tools/simulator"
+	"github.com/google/go-tpm-tools/tpm2tools"
+	"github.com/google/go-tpm/tpm2"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEndorsementFingerprint(t *testing.T) {
+	dev, err := simulator.Get()
+	require.NoError(t, err)
+	defer dev.Close()
+
+	fp1, err := EndorsementFingerprint(dev)
+	require.NoError(t, err)
+	require.Len(t, fp1, 32)
+
+	fp2, err := EndorsementFingerprint(dev)
+	require.NoError(t, err)
+	require.Equal(t, fp1, fp2)
+
+	// Should match the fingerprint of the EK public key, as found in the EK certificate
+	ek, pub, err := tpm2.CreatePrimary(dev, tpm2.HandleEndorsement, tpm2.PCRSelection{}, "", "", tpm2tools.DefaultEKTemplateRSA())
+	require.NoError(t, err)
+	defer tpm2.FlushContext(dev, ek)
+	fp3, err := PublicKeyFingerprint(pub)
+	require.NoError(t, err)
+	require.Equal(t, fp1, fp3)
+
+	// No transient objects should be left behind
+	handles, err := GetHandles(dev, tpm2.TransientFirst)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(handles))
+}
+
+func TestReadEKCertificates(t *testing.T) {
+	dev, err := simulator.Get()
+	require.NoError(t, err)
+	defer dev.Close()
+
+	// The simulator has no EK certificate
+	certs, err := ReadEKCertificates(dev)
+	require.NoError(t, err)
+	require.Empty(t, certs)
+
+	ek, ekPub, err := tpm2.CreatePrimary(dev, tpm2.HandleEndorsement, tpm2.PCRSelection{}, "", "", tpm2tools.DefaultEKTemplateRSA())
+	require.NoError(t, err)
+	defer tpm2.FlushContext(dev, ek)
+	_, ekCert := provisionEKCert(t, dev, ekPub)
+
+	certs, err = ReadEKCertificates(dev)
+	require.NoError(t, err)
+	require.Len(t, certs, 1)
+	require.Equal(t, ekCert, certs[0].Raw)
+	require.Equal(t, ekPub, certs[0].PublicKey)
+}
@@ -0,0 +1,182 @@
+package tpmk
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/google/go-tpm-tools/tpm2tools"
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpmutil"
+)
+
+// Enrollment is the data a device sends to an enrollment server to obtain a certificate for a
+// TLS key in its TPM. It contains a certificate request for the TLS key and the binding of an
+// attestation key (AK) to the endorsement key (EK). The AK certifies that the TLS key is
+// resident in the same TPM.
+type Enrollment struct {
+	CSR       []byte    // DER-encoded certificate request for the TLS key
+	Binding   AKBinding // AK to EK binding, including the EK certificate
+	TLSPublic []byte    // TPMT_PUBLIC of the TLS key
+	Attest    []byte    // TPMS_ATTEST of the TLS key, produced by the AK
+	Signature []byte    // RSASSA-SHA256 signature of Attest, by the AK
+}
+
+// EnrollmentBundle assembles an enrollment for the TLS key at the given handle. It reads the EK
+// certificate from NV and derives the EK and AK from their default templates in the endorsement
+// hierarchy, which is expected to have no password. Since the keys are deterministic,
+// ActivateEnrollment can re-create them later to answer the challenge of the enrollment server.
+func EnrollmentBundle(dev io.ReadWriteCloser, tlsHandle tpmutil.Handle, tlsPW string) (Enrollment, error) {
+	ekCert, err := ReadEKCertificate(dev, EKCertIndexRSA)
+	if err != nil {
+		return Enrollment{}, err
+	}
+	ek, ak, err := createEnrollmentKeys(dev)
+	if err != nil {
+		return Enrollment{}, err
+	}
+	defer tpm2.FlushContext(dev, ek)
+	defer tpm2.FlushContext(dev, ak)
+
+	binding, err := NewAKBinding(dev, ekCert, ek, ak)
+	if err != nil {
+		return Enrollment{}, err
+	}
+
+	// Build the CSR for the TLS key
+	key, err := NewRSAPrivateKey(dev, tlsHandle, tlsPW)
+	if err != nil {
+		return Enrollment{}, err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{}, key)
+	if err != nil {
+		return Enrollment{}, err
+	}
+	tlsPublic, err := key.pub.Encode()
+	if err != nil {
+		return Enrollment{}, err
+	}
+
+	// Have the AK certify the TLS key. The hash of the CSR is used as qualifying data to tie
+	// the two together.
+	qualifyingData := sha256.Sum256(csr)
+	attest, sig, err := tpm2.Certify(dev, tlsPW, "", tlsHandle, ak, qualifyingData[:])
+	if err != nil {
+		return Enrollment{}, err
+	}
+	return Enrollment{csr, binding, tlsPublic, attest, sig}, nil
+}
+
+// Verify is called by the enrollment server to check that the CSR is valid and for a key that is
+// in the same TPM as the AK. The binding between AK and EK still needs to be confirmed with
+// a challenge produced by e.Binding.MakeCredential. Validating the EK certificate is left to
+// the caller as well.
+func (e Enrollment) Verify() (*x509.CertificateRequest, error) {
+	akPub, err := tpm2.DecodePublic(e.Binding.AKPublic)
+	if err != nil {
+		return nil, err
+	}
+	akKey, err := akPub.Key()
+	if err != nil {
+		return nil, err
+	}
+	return VerifyCertifiedCSR(e.CSR, akKey, e.TLSPublic, e.Attest, e.Signature, tpm2.FlagFixedTPM)
+}
+
+// VerifyCertifiedCSR checks that a DER-encoded CSR is for a TPM key with the given attributes.
+// The key is identified by its TPMT_PUBLIC, and attest is a TPM2_Certify of it produced with the
+// hash of the CSR as qualifying data and signed with RSASSA-SHA256 by the AK, as done in
+// EnrollmentBundle. Requiring tpm2.FlagFixedTPM ensures the key can't exist outside the TPM,
+// provided the AK is known to be in a TPM.
+func VerifyCertifiedCSR(csrDER []byte, ak crypto.PublicKey, keyPublic, attest, signature []byte, attr tpm2.KeyProp) (*x509.CertificateRequest, error) {
+	csr, err := x509.ParseCertificateRequest(csrDER)
+	if err != nil {
+		return nil, err
+	}
+	if err := csr.CheckSignature(); err != nil {
+		return nil, err
+	}
+
+	// Check the AK's signature over the attestation
+	rsaPub, ok := ak.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("unsupported AK type %T", ak)
+	}
+	digest := sha256.Sum256(attest)
+	if err := rsa.VerifyPKCS1v15(rsaPub, crypto.SHA256, digest[:], signature); err != nil {
+		return nil, err
+	}
+
+	// The attestation needs to be for the key and this CSR
+	ad, err := tpm2.DecodeAttestationData(attest)
+	if err != nil {
+		return nil, err
+	}
+	if ad.Magic != attestMagic || ad.Type != tpm2.TagAttestCertify {
+		return nil, errors.New("not a TPM key certification")
+	}
+	qualifyingData := sha256.Sum256(csrDER)
+	if !bytes.Equal(ad.ExtraData, qualifyingData[:]) {
+		return nil, errors.New("key certification is not for this CSR")
+	}
+	pub, err := tpm2.DecodePublic(keyPublic)
+	if err != nil {
+		return nil, err
+	}
+	ok, err = ad.AttestedCertifyInfo.Name.MatchesPublic(pub)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, errors.New("certified key doesn't match the public key")
+	}
+	key, err := pub.Key()
+	if err != nil {
+		return nil, err
+	}
+	keyPub, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("unsupported key type %T", key)
+	}
+	csrKey, ok := csr.PublicKey.(*rsa.PublicKey)
+	if !ok || keyPub.N.Cmp(csrKey.N) != 0 || keyPub.E != csrKey.E {
+		return nil, errors.New("CSR is not for the certified key")
+	}
+	if pub.Attributes&attr != attr {
+		return nil, fmt.Errorf("certified key attributes 0x%x don't include 0x%x", pub.Attributes, attr)
+	}
+	return csr, nil
+}
+
+// ActivateEnrollment answers the challenge of an enrollment server by re-creating the EK and AK
+// used in EnrollmentBundle and returning the secret in the credential.
+func ActivateEnrollment(dev io.ReadWriteCloser, cred Credential) ([]byte, error) {
+	ek, ak, err := createEnrollmentKeys(dev)
+	if err != nil {
+		return nil, err
+	}
+	defer tpm2.FlushContext(dev, ek)
+	defer tpm2.FlushContext(dev, ak)
+	return ActivateCredential(dev, ak, "", ek, "", cred)
+}
+
+// createEnrollmentKeys creates the EK and AK in the endorsement hierarchy.
+func createEnrollmentKeys(dev io.ReadWriteCloser) (ek, ak tpmutil.Handle, err error) {
+	ek, _, err = tpm2.CreatePrimary(dev, tpm2.HandleEndorsement, tpm2.PCRSelection{}, "", "", tpm2tools.DefaultEKTemplateRSA())
+	if err != nil {
+		return 0, 0, err
+	}
+	var nonce [256]byte
+	ak, _, err = tpm2.CreatePrimary(dev, tpm2.HandleEndorsement, tpm2.PCRSelection{}, "", "", tpm2tools.AIKTemplateRSA(nonce))
+	if err != nil {
+		tpm2.FlushContext(dev, ek)
+		return 0, 0, err
+	}
+	return ek, ak, nil
+}
@@ -0,0 +1,128 @@
+package tpmk
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"testing"
+
+	"github.com/google/go-tpm-tools/simulator"
+	"github.com/google/go-tpm-tools/tpm2tools"
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpmutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEnrollmentBundle(t *testing.T) {
+	dev, err := simulator.Get()
+	require.NoError(t, err)
+	defer dev.Close()
+
+	const (
+		handle tpmutil.Handle = 0x81000000
+		pw                    = ""
+		attr                  = tpm2.FlagSign | tpm2.FlagFixedTPM | tpm2.FlagUserWithAuth | tpm2.FlagFixedParent | tpm2.FlagSensitiveDataOrigin
+	)
+
+	// Provision the EK certificate and the TLS key
+	ek, ekPub, err := tpm2.CreatePrimary(dev, tpm2.HandleEndorsement, tpm2.PCRSelection{}, pw, pw, tpm2tools.DefaultEKTemplateRSA())
+	require.NoError(t, err)
+	require.NoError(t, tpm2.FlushContext(dev, ek))
+	provisionEKCert(t, dev, ekPub)
+	pub, err := GenRSAPrimaryKey(dev, handle, pw, pw, attr)
+	require.NoError(t, err)
+
+	// Assemble the bundle on the device
+	bundle, err := EnrollmentBundle(dev, handle, pw)
+	require.NoError(t, err)
+
+	// The server checks the bundle and issues a challenge for the AK
+	csr, err := bundle.Verify()
+	require.NoError(t, err)
+	require.Equal(t, pub, csr.PublicKey)
+	secret := []byte("challenge")
+	cred, err := bundle.Binding.MakeCredential(secret)
+	require.NoError(t, err)
+
+	// Which the device answers
+	out, err := ActivateEnrollment(dev, cred)
+	require.NoError(t, err)
+	require.Equal(t, secret, out)
+
+	// Tampering with any of the components should fail verification
+	tampered := bundle
+	tampered.Attest = append([]byte{}, bundle.Attest...)
+	tampered.Attest[len(tampered.Attest)-1] ^= 1
+	_, err = tampered.Verify()
+	require.Error(t, err)
+
+	other, err := GenRSAPrimaryKey(dev, 0x81000001, pw, pw, attr|tpm2.FlagNoDA)
+	require.NoError(t, err)
+	require.NotEqual(t, pub, other)
+	otherBundle, err := EnrollmentBundle(dev, 0x81000001, pw)
+	require.NoError(t, err)
+	tampered = bundle
+	tampered.CSR = otherBundle.CSR
+	_, err = tampered.Verify()
+	require.Error(t, err)
+	tampered = bundle
+	tampered.TLSPublic = otherBundle.TLSPublic
+	_, err = tampered.Verify()
+	require.Error(t, err)
+}
+
+func TestVerifyCertifiedCSR(t *testing.T) {
+	dev, err := simulator.Get()
+	require.NoError(t, err)
+	defer dev.Close()
+
+	const (
+		handle tpmutil.Handle = 0x81000000
+		pw                    = ""
+		attr                  = tpm2.FlagSign | tpm2.FlagUserWithAuth | tpm2.FlagSensitiveDataOrigin
+	)
+
+	ek, ekPub, err := tpm2.CreatePrimary(dev, tpm2.HandleEndorsement, tpm2.PCRSelection{}, pw, pw, tpm2tools.DefaultEKTemplateRSA())
+	require.NoError(t, err)
+	require.NoError(t, tpm2.FlushContext(dev, ek))
+	provisionEKCert(t, dev, ekPub)
+
+	tests := map[string]struct {
+		attr  tpm2.KeyProp
+		valid bool
+		swCSR bool
+	}{
+		"fixed TPM key":  {attr | tpm2.FlagFixedTPM | tpm2.FlagFixedParent, true, false},
+		"duplicable key": {attr, false, false},
+		"software CSR":   {attr | tpm2.FlagFixedTPM | tpm2.FlagFixedParent, false, true},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := GenRSAPrimaryKey(dev, handle, pw, pw, test.attr)
+			require.NoError(t, err)
+			defer DeleteKey(dev, handle, pw)
+
+			bundle, err := EnrollmentBundle(dev, handle, pw)
+			require.NoError(t, err)
+			akPub, err := tpm2.DecodePublic(bundle.Binding.AKPublic)
+			require.NoError(t, err)
+			ak, err := akPub.Key()
+			require.NoError(t, err)
+
+			// Replace the CSR with one for a software key
+			if test.swCSR {
+				key, err := rsa.GenerateKey(rand.Reader, 2048)
+				require.NoError(t, err)
+				bundle.CSR, err = x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{}, key)
+				require.NoError(t, err)
+			}
+
+			_, err = VerifyCertifiedCSR(bundle.CSR, ak, bundle.TLSPublic, bundle.Attest, bundle.Signature, tpm2.FlagFixedTPM)
+			if test.valid {
+				require.NoError(t, err)
+			} else {
+				require.Error(t, err)
+			}
+		})
+	}
+}
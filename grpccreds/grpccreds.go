@@ -0,0 +1,31 @@
+// Package grpccreds provides gRPC credentials for keys in a TPM. It's kept apart from tpmk so
+// that only users of gRPC depend on it.
+package grpccreds
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+
+	"github.com/folbricht/tpmk"
+	"github.com/google/go-tpm/tpmutil"
+	"google.golang.org/grpc/credentials"
+)
+
+// TransportCredentials returns gRPC credentials for mutual TLS with a key in the TPM and its
+// DER-encoded certificate. The same credentials work for servers, with grpc.Creds, and clients,
+// with grpc.WithTransportCredentials. roots holds the CAs trusted to issue the certificates of
+// the other side. Servers require clients to present a certificate issued by one of them.
+func TransportCredentials(dev io.ReadWriteCloser, handle tpmutil.Handle, password string, certDER []byte, roots *x509.CertPool) (credentials.TransportCredentials, error) {
+	crt, err := tpmk.TLSCertificate(dev, handle, password, certDER)
+	if err != nil {
+		return nil, err
+	}
+	return credentials.NewTLS(&tls.Config{
+		Certificates: []tls.Certificate{crt},
+		RootCAs:      roots,
+		ClientCAs:    roots,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		MinVersion:   tls.VersionTLS12,
+	}), nil
+}
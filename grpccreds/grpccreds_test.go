@@ -0,0 +1,94 @@
+package grpccreds
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/folbricht/tpmk"
+	"github.com/google/go-tpm-tools/simulator"
+	"github.com/google/go-tpm/tpm2"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+func TestTransportCredentials(t *testing.T) {
+	dev, err := simulator.Get()
+	require.NoError(t, err)
+	defer dev.Close()
+
+	const (
+		clientHandle = 0x81000000
+		serverHandle = 0x81000001
+		pw           = ""
+		attr         = tpm2.FlagSign | tpm2.FlagFixedTPM | tpm2.FlagUserWithAuth | tpm2.FlagFixedParent | tpm2.FlagSensitiveDataOrigin
+	)
+	clientPub, err := tpmk.GenRSAPrimaryKey(dev, clientHandle, pw, pw, attr)
+	require.NoError(t, err)
+	serverPub, err := tpmk.GenRSAPrimaryKey(dev, serverHandle, pw, pw, attr, tpmk.WithUnique([]byte("server")))
+	require.NoError(t, err)
+
+	// Issue certificates for both from the test CA
+	caCrt, caKey, err := tpmk.LoadKeyPair("../testdata/ca.crt", "../testdata/ca.key")
+	require.NoError(t, err)
+	template := x509.Certificate{
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().AddDate(0, 0, 1),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
+		SerialNumber: big.NewInt(1),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	clientDER, err := x509.CreateCertificate(rand.Reader, &template, caCrt, clientPub, caKey)
+	require.NoError(t, err)
+	template.SerialNumber = big.NewInt(2)
+	serverDER, err := x509.CreateCertificate(rand.Reader, &template, caCrt, serverPub, caKey)
+	require.NoError(t, err)
+	roots := x509.NewCertPool()
+	roots.AddCert(caCrt)
+
+	// Serve the health service, which is part of grpc, over a local listener
+	serverCreds, err := TransportCredentials(dev, serverHandle, pw, serverDER, roots)
+	require.NoError(t, err)
+	server := grpc.NewServer(grpc.Creds(serverCreds))
+	healthpb.RegisterHealthServer(server, health.NewServer())
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go server.Serve(l)
+	defer server.Stop()
+
+	check := func(creds credentials.TransportCredentials, timeout time.Duration) error {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		conn, err := grpc.DialContext(ctx, l.Addr().String(), grpc.WithTransportCredentials(creds), grpc.WithBlock())
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		resp, err := healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{})
+		if err != nil {
+			return err
+		}
+		require.Equal(t, healthpb.HealthCheckResponse_SERVING, resp.Status)
+		return nil
+	}
+	clientCreds, err := TransportCredentials(dev, clientHandle, pw, clientDER, roots)
+	require.NoError(t, err)
+	require.NoError(t, check(clientCreds, 5*time.Second))
+
+	// Clients without a certificate are rejected
+	tlsOnly := credentials.NewTLS(&tls.Config{RootCAs: roots})
+	require.Error(t, check(tlsOnly, time.Second))
+
+	// The certificate needs to belong to the key
+	_, err = TransportCredentials(dev, clientHandle, pw, serverDER, roots)
+	require.Error(t, err)
+}
@@ -1,6 +1,7 @@
 package tpmk
 
 import (
+	"errors"
 	"fmt"
 	"io"
 
@@ -33,3 +34,41 @@ func GetHandles(dev io.ReadWriteCloser, start tpm2.TPMProp) ([]tpmutil.Handle, e
 	}
 	return handles, nil
 }
+
+// FlushTransient flushes all transient objects loaded in the TPM and returns their handles. It's
+// meant for provisioning and test teardown, where objects left behind by earlier, possibly
+// crashed, runs would otherwise use up the few object slots of the TPM, which makes loading
+// further keys fail with "out of memory for object contexts". It flushes objects of other
+// processes too when the TPM isn't accessed through a resource manager.
+func FlushTransient(dev io.ReadWriteCloser) ([]tpmutil.Handle, error) {
+	handles, err := GetHandles(dev, tpm2.TPMProp(tpm2.HandleTypeTransient)<<24)
+	if err != nil {
+		return nil, err
+	}
+	for i, h := range handles {
+		if err := tpm2.FlushContext(dev, h); err != nil {
+			return handles[:i], fmt.Errorf("flushing 0x%x: %v", h, err)
+		}
+	}
+	return handles, nil
+}
+
+// ClearOwner clears the owner hierarchy with TPM2_Clear, authorized with the lockout password.
+// This irrevocably deletes all persistent keys and NV indexes of the owner, changes the seed
+// so primary keys can't be recreated, and resets the owner, endorsement and lockout passwords
+// to empty. It's meant for provisioning a device from scratch, never call it on a TPM that
+// holds keys that are still needed. It fails if clearing was disabled with TPM2_ClearControl.
+func ClearOwner(dev io.ReadWriteCloser, lockoutPW string) error {
+	cmd, err := encodeCommand(
+		[]interface{}{tpm2.HandleLockout},
+		[]tpm2.AuthCommand{passwordAuth(lockoutPW)},
+	)
+	if err != nil {
+		return err
+	}
+	_, err = runCommand(dev, tpm2.TagSessions, cmdClear, cmd)
+	if e, ok := err.(tpm2.Error); ok && e.Code == tpm2.RCDisabled {
+		return errors.New("clearing the TPM is disabled, it has to be enabled with TPM2_ClearControl first")
+	}
+	return err
+}
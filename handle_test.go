@@ -0,0 +1,75 @@
+package tpmk
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/google/go-tpm-tools/simulator"
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpmutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFlushTransient(t *testing.T) {
+	dev, err := simulator.Get()
+	require.NoError(t, err)
+	defer dev.Close()
+
+	// Fill all object slots of the simulator
+	template := tpm2.Public{
+		Type:       tpm2.AlgRSA,
+		NameAlg:    tpm2.AlgSHA256,
+		Attributes: ChildKeyAttributes,
+		RSAParameters: &tpm2.RSAParams{
+			KeyBits: 2048,
+			Modulus: big.NewInt(0),
+		},
+	}
+	for i := 0; i < 3; i++ {
+		_, _, err := tpm2.CreatePrimary(dev, tpm2.HandleOwner, tpm2.PCRSelection{}, "", "", template)
+		require.NoError(t, err)
+	}
+	_, _, err = tpm2.CreatePrimary(dev, tpm2.HandleOwner, tpm2.PCRSelection{}, "", "", template)
+	require.Error(t, err)
+
+	flushed, err := FlushTransient(dev)
+	require.NoError(t, err)
+	require.Len(t, flushed, 3)
+	handles, err := GetHandles(dev, tpm2.TransientFirst)
+	require.NoError(t, err)
+	require.Empty(t, handles)
+
+	// Flushing nothing is fine
+	flushed, err = FlushTransient(dev)
+	require.NoError(t, err)
+	require.Empty(t, flushed)
+}
+
+func TestClearOwner(t *testing.T) {
+	dev, err := simulator.Get()
+	require.NoError(t, err)
+	defer dev.Close()
+
+	const (
+		handle = 0x81000000
+		index  = 0x1000000
+	)
+	_, err = GenRSAPrimaryKey(dev, handle, "", "", tpm2.FlagStorageDefault)
+	require.NoError(t, err)
+	require.NoError(t, NVWrite(dev, index, []byte("data"), "", tpm2.AttrOwnerWrite|tpm2.AttrOwnerRead))
+
+	keys, err := KeyList(dev)
+	require.NoError(t, err)
+	require.Equal(t, []tpmutil.Handle{handle}, keys)
+
+	require.NoError(t, ClearOwner(dev, ""))
+	keys, err = KeyList(dev)
+	require.NoError(t, err)
+	require.Empty(t, keys)
+	indexes, err := NVList(dev)
+	require.NoError(t, err)
+	require.Empty(t, indexes)
+
+	// A failed attempt locks out the lockout hierarchy, so it's tested last
+	require.Error(t, ClearOwner(dev, "wrong"))
+}
@@ -0,0 +1,174 @@
+package tpmk
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/google/go-tpm/tpm2"
+	_ "golang.org/x/crypto/sha3" // Registers the SHA3 hashes with crypto
+)
+
+// SHA3 hash algorithms (TPM_ALG_SHA3_*), which go-tpm doesn't define. Only some TPMs implement
+// them, keys can only sign with them if the TPM reports them in its list of algorithms.
+const (
+	AlgSHA3_256 tpm2.Algorithm = 0x0027
+	AlgSHA3_384 tpm2.Algorithm = 0x0028
+	AlgSHA3_512 tpm2.Algorithm = 0x0029
+)
+
+// Hash algorithms that can be used for signing, strongest first.
+var hashPreference = []crypto.Hash{
+	crypto.SHA512, crypto.SHA3_512, crypto.SHA384, crypto.SHA3_384, crypto.SHA256, crypto.SHA3_256, crypto.SHA1,
+}
+
+// Hash algorithms in tpmToHashFunc that are optional and need to be looked up in the TPM's list
+// of algorithms before use.
+var optionalHashes = map[tpm2.Algorithm]bool{
+	AlgSHA3_256: true,
+	AlgSHA3_384: true,
+	AlgSHA3_512: true,
+}
+
+// hashAlgorithm returns the TPM algorithm for a hash. Optional algorithms, like SHA3, are only
+// returned if the TPM implements them. UnsupportedHashError is returned otherwise.
+func hashAlgorithm(dev io.ReadWriter, h crypto.Hash) (tpm2.Algorithm, error) {
+	alg, ok := tpmToHashFunc[h]
+	if !ok {
+		return 0, UnsupportedHashError{Hash: h}
+	}
+	if !optionalHashes[alg] {
+		return alg, nil
+	}
+	algs, _, err := tpm2.GetCapability(dev, tpm2.CapabilityAlgs, 1, uint32(alg))
+	if err != nil {
+		return 0, err
+	}
+	if len(algs) == 0 {
+		return 0, UnsupportedHashError{Hash: h}
+	}
+	if a, ok := algs[0].(tpm2.AlgorithmDescription); !ok || a.ID != alg {
+		return 0, UnsupportedHashError{Hash: h}
+	}
+	return alg, nil
+}
+
+// checkDigestLength returns an error if digest isn't the size of the hash. The TPM would reject
+// such digests with an error that doesn't say what's wrong with them.
+func checkDigestLength(h crypto.Hash, digest []byte) error {
+	if _, ok := tpmToHashFunc[h]; !ok {
+		return UnsupportedHashError{Hash: h}
+	}
+	if len(digest) != h.Size() {
+		return fmt.Errorf("invalid digest length for %s, expected %d bytes, got %d", hashToName[h], h.Size(), len(digest))
+	}
+	return nil
+}
+
+// Hash algorithms every TPM 2.0 implements, assumed to be available if the TPM can't list its
+// algorithms.
+var mandatoryHashes = []crypto.Hash{crypto.SHA256}
+
+// SupportedHashes returns the hash algorithms supported by the TPM that can be used for signing,
+// strongest first. If the TPM doesn't support the query for its algorithms, only SHA256 is
+// returned, which all TPMs implement. Other errors, including failures of the TPM and the
+// communication with it, are returned as is.
+func SupportedHashes(dev io.ReadWriter) ([]crypto.Hash, error) {
+	algs, err := supportedAlgorithms(dev)
+	if capabilityUnsupported(err) {
+		return append([]crypto.Hash(nil), mandatoryHashes...), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return hashesIn(algs), nil
+}
+
+// capabilityUnsupported returns true if err is the TPM rejecting the capability requested with
+// GetCapability, TPM_RC_VALUE for its first parameter.
+func capabilityUnsupported(err error) bool {
+	e, ok := err.(tpm2.ParameterError)
+	return ok && e.Code == tpm2.RCValue && e.Parameter == tpm2.RC1
+}
+
+// hashesIn returns the hashes in hashPreference that are in the list of TPM algorithms.
+func hashesIn(algs []tpm2.Algorithm) []crypto.Hash {
+	available := make(map[tpm2.Algorithm]bool)
+	for _, alg := range algs {
+		available[alg] = true
+	}
+	var hashes []crypto.Hash
+	for _, h := range hashPreference {
+		if available[tpmToHashFunc[h]] {
+			hashes = append(hashes, h)
+		}
+	}
+	return hashes
+}
+
+// supportedAlgorithms returns all algorithms implemented by the TPM.
+func supportedAlgorithms(dev io.ReadWriter) ([]tpm2.Algorithm, error) {
+	var (
+		algs  []tpm2.Algorithm
+		first uint32
+	)
+	for {
+		caps, more, err := tpm2.GetCapability(dev, tpm2.CapabilityAlgs, 64, first)
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range caps {
+			alg, ok := c.(tpm2.AlgorithmDescription)
+			if !ok {
+				return nil, fmt.Errorf("expected tpm2.AlgorithmDescription, got %T", c)
+			}
+			algs = append(algs, alg.ID)
+		}
+		if !more || len(caps) == 0 {
+			return algs, nil
+		}
+		first = uint32(algs[len(algs)-1]) + 1
+	}
+}
+
+// SignMessageWithFallback hashes and signs a message like SignMessage. If the TPM doesn't support
+// the hash in opts, the message is hashed with the strongest one it does support instead. It
+// returns the hash that was actually used, which the caller should check and pass on to the
+// verifier. The device is locked for querying the hashes and signing.
+func (k RSAPrivateKey) SignMessageWithFallback(msg []byte, opts crypto.SignerOpts) ([]byte, crypto.Hash, error) {
+	defer lockDevice(k.dev)()
+	hashes, err := SupportedHashes(k.dev)
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(hashes) == 0 {
+		return nil, 0, errors.New("no supported hash algorithm")
+	}
+	hash := opts.HashFunc()
+	if !containsHash(hashes, hash) {
+		hash = hashes[0]
+		if pss, ok := opts.(*rsa.PSSOptions); ok {
+			opts = &rsa.PSSOptions{SaltLength: pss.SaltLength, Hash: hash}
+		} else {
+			opts = hash
+		}
+	}
+	digest, err := DomainDigest(hash, "", msg)
+	if err != nil {
+		return nil, 0, err
+	}
+	sig, err := k.sign(digest, opts, false)
+	return sig, hash, err
+}
+
+// containsHash returns true if h is in the list of hashes.
+func containsHash(hashes []crypto.Hash, h crypto.Hash) bool {
+	for _, v := range hashes {
+		if v == h {
+			return true
+		}
+	}
+	return false
+}
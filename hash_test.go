@@ -0,0 +1,147 @@
+package tpmk
+
+import (
+	"crypto"
+	"crypto/rsa"
+	_ "crypto/sha512"
+	"testing"
+
+	"github.com/google/go-tpm-tools/simulator"
+	"github.com/google/go-tpm/tpm2"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSignMessageWithFallback(t *testing.T) {
+	dev, err := simulator.Get()
+	require.NoError(t, err)
+	defer dev.Close()
+
+	const (
+		handle = 0x81000000
+		pw     = ""
+		attr   = tpm2.FlagSign | tpm2.FlagUserWithAuth | tpm2.FlagSensitiveDataOrigin
+	)
+
+	pub, err := GenRSAPrimaryKey(dev, handle, pw, pw, attr)
+	require.NoError(t, err)
+	priv, err := NewRSAPrivateKey(dev, handle, pw)
+	require.NoError(t, err)
+
+	hashes, err := SupportedHashes(dev)
+	require.NoError(t, err)
+	require.Contains(t, hashes, crypto.SHA256)
+	msg := []byte("This is a test")
+
+	tests := map[string]struct {
+		opts     crypto.SignerOpts
+		expected crypto.Hash
+	}{
+		"supported hash":       {crypto.SHA256, crypto.SHA256},
+		"unsupported hash":     {crypto.SHA3_256, hashes[0]},
+		"unsupported PSS hash": {&rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthAuto, Hash: crypto.SHA3_256}, hashes[0]},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			sig, used, err := priv.SignMessageWithFallback(msg, test.opts)
+			require.NoError(t, err)
+			require.Equal(t, test.expected, used)
+
+			digest, err := DomainDigest(used, "", msg)
+			require.NoError(t, err)
+			if _, ok := test.opts.(*rsa.PSSOptions); ok {
+				err = rsa.VerifyPSS(pub.(*rsa.PublicKey), used, digest, sig, nil)
+			} else {
+				err = rsa.VerifyPKCS1v15(pub.(*rsa.PublicKey), used, digest, sig)
+			}
+			require.NoError(t, err)
+		})
+	}
+}
+
+// pagedTPM answers each command with the next response in the list.
+type pagedTPM struct {
+	responses []*fakeTPM
+	current   *fakeTPM
+}
+
+func (p *pagedTPM) Write(b []byte) (int, error) {
+	p.current, p.responses = p.responses[0], p.responses[1:]
+	return p.current.Write(b)
+}
+
+func (p *pagedTPM) Read(b []byte) (int, error) {
+	return p.current.Read(b)
+}
+
+func TestSupportedHashes(t *testing.T) {
+	// TPMS_CAPABILITY_DATA with one TPMS_ALG_PROPERTY per page
+	page := func(more byte, alg tpm2.Algorithm) *fakeTPM {
+		return newFakeTPM(t, 0, more, uint32(tpm2.CapabilityAlgs), uint32(1), alg, uint32(0x4))
+	}
+
+	// All pages are read when the TPM reports more algorithms
+	dev := &pagedTPM{responses: []*fakeTPM{page(1, tpm2.AlgSHA1), page(1, tpm2.AlgSHA256), page(0, tpm2.AlgSHA384)}}
+	hashes, err := SupportedHashes(dev)
+	require.NoError(t, err)
+	require.Equal(t, []crypto.Hash{crypto.SHA384, crypto.SHA256, crypto.SHA1}, hashes)
+	require.Empty(t, dev.responses)
+
+	// SHA256 is assumed if the TPM doesn't support the query, TPM_RC_VALUE for the capability
+	hashes, err = SupportedHashes(newFakeTPM(t, 0x1c4))
+	require.NoError(t, err)
+	require.Equal(t, []crypto.Hash{crypto.SHA256}, hashes)
+
+	// The list can be changed by the caller without affecting later calls
+	hashes[0] = crypto.MD5
+	hashes, err = SupportedHashes(newFakeTPM(t, 0x1c4))
+	require.NoError(t, err)
+	require.Equal(t, []crypto.Hash{crypto.SHA256}, hashes)
+
+	// Other errors, like failure mode or transport errors, are returned
+	_, err = SupportedHashes(newFakeTPM(t, 0x101))
+	require.Error(t, err)
+	_, err = SupportedHashes(&fakeTPM{})
+	require.Error(t, err)
+}
+
+func TestHashAlgorithmSHA3(t *testing.T) {
+	// TPMS_CAPABILITY_DATA with one TPMS_ALG_PROPERTY, a hash algorithm
+	algs := func(alg tpm2.Algorithm) []interface{} {
+		return []interface{}{byte(1), uint32(tpm2.CapabilityAlgs), uint32(1), alg, uint32(0x4)}
+	}
+
+	alg, err := hashAlgorithm(newFakeTPM(t, 0, algs(AlgSHA3_256)...), crypto.SHA3_256)
+	require.NoError(t, err)
+	require.Equal(t, AlgSHA3_256, alg)
+
+	// The TPM reports the next algorithm it has, not the one asked for
+	_, err = hashAlgorithm(newFakeTPM(t, 0, algs(tpm2.AlgNull)...), crypto.SHA3_256)
+	require.Equal(t, UnsupportedHashError{Hash: crypto.SHA3_256}, err)
+
+	// SHA2 hashes are assumed to be available without asking
+	alg, err = hashAlgorithm(&fakeTPM{}, crypto.SHA256)
+	require.NoError(t, err)
+	require.Equal(t, tpm2.AlgSHA256, alg)
+
+	// The simulator doesn't implement SHA3, so signing with it fails before reaching the TPM
+	dev, err := simulator.Get()
+	require.NoError(t, err)
+	defer dev.Close()
+
+	const (
+		handle = 0x81000000
+		pw     = ""
+		attr   = tpm2.FlagSign | tpm2.FlagUserWithAuth | tpm2.FlagSensitiveDataOrigin
+	)
+	_, err = GenRSAPrimaryKey(dev, handle, pw, pw, attr)
+	require.NoError(t, err)
+	priv, err := NewRSAPrivateKey(dev, handle, pw)
+	require.NoError(t, err)
+
+	hashes, err := SupportedHashes(dev)
+	require.NoError(t, err)
+	require.NotContains(t, hashes, crypto.SHA3_256)
+	digest := make([]byte, crypto.SHA3_256.Size())
+	_, err = priv.Sign(nil, digest, crypto.SHA3_256)
+	require.Equal(t, UnsupportedHashError{Hash: crypto.SHA3_256}, err)
+}
@@ -0,0 +1,163 @@
+package tpmk
+
+import (
+	"crypto"
+	"fmt"
+	"io"
+
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpmutil"
+)
+
+// algHMAC is the keyed-hash scheme of HMAC keys (TPM_ALG_HMAC).
+const algHMAC tpm2.Algorithm = 0x0005
+
+// maxDigestBuffer is the largest amount of data that can be passed to the TPM in one command
+// (MAX_DIGEST_BUFFER). Larger inputs are processed with HMAC sequences. 1024 is the value
+// required by the PC Client profile.
+const maxDigestBuffer = 1024
+
+// CreateHMACKey generates a primary keyed-hash key for computing HMACs with the given hash and
+// makes it persistent under the handle. The key is generated by the TPM and can't be read from
+// it. parentPW authorizes the owner hierarchy, ownerPW is the password of the new key.
+func CreateHMACKey(dev io.ReadWriteCloser, handle tpmutil.Handle, parentPW, ownerPW string, hash crypto.Hash) error {
+	return createHMACKey(dev, handle, parentPW, ownerPW, hash, nil)
+}
+
+// createHMACKey creates an HMAC key, either generated by the TPM or, if key is set, with a
+// known value.
+func createHMACKey(dev io.ReadWriteCloser, handle tpmutil.Handle, parentPW, ownerPW string, hash crypto.Hash, key []byte) error {
+	alg, ok := tpmToHashFunc[hash]
+	if !ok {
+		return fmt.Errorf("unsupported hash algorithm %v", hash)
+	}
+	attr := tpm2.FlagSign | tpm2.FlagFixedTPM | tpm2.FlagFixedParent | tpm2.FlagUserWithAuth
+	if key == nil {
+		attr |= tpm2.FlagSensitiveDataOrigin
+	}
+
+	// go-tpm can only encode keyed-hash objects used for sealing, so encode the template here
+	public, err := tpmutil.Pack(tpm2.AlgKeyedHash, tpm2.AlgSHA256, attr, []byte(nil), algHMAC, alg, []byte(nil))
+	if err != nil {
+		return err
+	}
+	sensitive, err := tpmutil.Pack([]byte(ownerPW), key)
+	if err != nil {
+		return err
+	}
+	cmd, err := encodeCommand(
+		[]interface{}{tpm2.HandleOwner},
+		[]tpm2.AuthCommand{passwordAuth(parentPW)},
+		sensitive, public, []byte(nil), uint32(0),
+	)
+	if err != nil {
+		return err
+	}
+	resp, err := runCommand(dev, tpm2.TagSessions, cmdCreatePrimary, cmd)
+	if err != nil {
+		return err
+	}
+	var transient tpmutil.Handle
+	if _, err := tpmutil.Unpack(resp, &transient); err != nil {
+		return err
+	}
+	defer tpm2.FlushContext(dev, transient)
+
+	return tpm2.EvictControl(dev, parentPW, tpm2.HandleOwner, transient, handle)
+}
+
+// HMAC computes the HMAC of data with a keyed-hash key in the TPM. The hash needs to match the
+// one the key was created with.
+func HMAC(dev io.ReadWriteCloser, handle tpmutil.Handle, password string, data []byte, hash crypto.Hash) ([]byte, error) {
+	alg, ok := tpmToHashFunc[hash]
+	if !ok {
+		return nil, fmt.Errorf("unsupported hash algorithm %v", hash)
+	}
+	if len(data) > maxDigestBuffer {
+		return hmacSequence(dev, handle, password, data, alg)
+	}
+	cmd, err := encodeCommand(
+		[]interface{}{handle},
+		[]tpm2.AuthCommand{passwordAuth(password)},
+		data, alg,
+	)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := runCommand(dev, tpm2.TagSessions, cmdHMAC, cmd)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		paramSize uint32
+		mac       []byte
+	)
+	if _, err := tpmutil.Unpack(resp, &paramSize, &mac); err != nil {
+		return nil, err
+	}
+	return mac, nil
+}
+
+// hmacSequence computes an HMAC over data that is too large for a single command, by passing it
+// to the TPM in blocks.
+func hmacSequence(dev io.ReadWriter, handle tpmutil.Handle, password string, data []byte, alg tpm2.Algorithm) ([]byte, error) {
+	// Start the sequence with the key's password, giving the sequence object an empty password
+	// for the commands that follow
+	cmd, err := encodeCommand(
+		[]interface{}{handle},
+		[]tpm2.AuthCommand{passwordAuth(password)},
+		[]byte(nil), alg,
+	)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := runCommand(dev, tpm2.TagSessions, cmdHMACStart, cmd)
+	if err != nil {
+		return nil, err
+	}
+	var seq tpmutil.Handle
+	if _, err := tpmutil.Unpack(resp, &seq); err != nil {
+		return nil, err
+	}
+
+	// All but the last block are sent with SequenceUpdate. The sequence is flushed by the TPM
+	// once it's completed, it only needs to be flushed here if it fails before that.
+	for len(data) > maxDigestBuffer {
+		cmd, err := encodeCommand(
+			[]interface{}{seq},
+			[]tpm2.AuthCommand{passwordAuth("")},
+			data[:maxDigestBuffer],
+		)
+		if err != nil {
+			tpm2.FlushContext(dev, seq)
+			return nil, err
+		}
+		if _, err := runCommand(dev, tpm2.TagSessions, cmdSequenceUpdate, cmd); err != nil {
+			tpm2.FlushContext(dev, seq)
+			return nil, err
+		}
+		data = data[maxDigestBuffer:]
+	}
+	cmd, err = encodeCommand(
+		[]interface{}{seq},
+		[]tpm2.AuthCommand{passwordAuth("")},
+		data, tpm2.HandleNull,
+	)
+	if err != nil {
+		tpm2.FlushContext(dev, seq)
+		return nil, err
+	}
+	resp, err = runCommand(dev, tpm2.TagSessions, cmdSequenceComplete, cmd)
+	if err != nil {
+		tpm2.FlushContext(dev, seq)
+		return nil, err
+	}
+	var (
+		paramSize uint32
+		mac       []byte
+	)
+	if _, err := tpmutil.Unpack(resp, &paramSize, &mac); err != nil {
+		return nil, err
+	}
+	return mac, nil
+}
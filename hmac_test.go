@@ -0,0 +1,71 @@
+package tpmk
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"testing"
+
+	"github.com/google/go-tpm-tools/simulator"
+	"github.com/google/go-tpm/tpmutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHMAC(t *testing.T) {
+	dev, err := simulator.Get()
+	require.NoError(t, err)
+	defer dev.Close()
+
+	const (
+		handle tpmutil.Handle = 0x81000000
+		pw                    = "secret"
+	)
+
+	// Use a known key to be able to compare the results against a software HMAC
+	key := make([]byte, 32)
+	_, err = rand.Read(key)
+	require.NoError(t, err)
+	require.NoError(t, createHMACKey(dev, handle, "", pw, crypto.SHA256, key))
+
+	tests := map[string]int{
+		"empty":     0,
+		"small":     100,
+		"one block": maxDigestBuffer,
+		"sequence":  3*maxDigestBuffer + 10,
+	}
+	for name, size := range tests {
+		t.Run(name, func(t *testing.T) {
+			data := make([]byte, size)
+			_, err := rand.Read(data)
+			require.NoError(t, err)
+
+			mac, err := HMAC(dev, handle, pw, data, crypto.SHA256)
+			require.NoError(t, err)
+
+			h := hmac.New(crypto.SHA256.New, key)
+			h.Write(data)
+			require.Equal(t, h.Sum(nil), mac)
+		})
+	}
+
+	// Wrong password
+	_, err = HMAC(dev, handle, "wrong", []byte("data"), crypto.SHA256)
+	require.Error(t, err)
+}
+
+func TestCreateHMACKey(t *testing.T) {
+	dev, err := simulator.Get()
+	require.NoError(t, err)
+	defer dev.Close()
+
+	const handle tpmutil.Handle = 0x81000000
+
+	require.NoError(t, CreateHMACKey(dev, handle, "", "", crypto.SHA1))
+	mac, err := HMAC(dev, handle, "", []byte("data"), crypto.SHA1)
+	require.NoError(t, err)
+	require.Len(t, mac, crypto.SHA1.Size())
+
+	handles, err := KeyList(dev)
+	require.NoError(t, err)
+	require.Contains(t, handles, handle)
+}
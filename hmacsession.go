@@ -0,0 +1,216 @@
+package tpmk
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpmutil"
+)
+
+// Size of the nonces used in HMAC sessions, the size of the session hash SHA256
+const hmacNonceSize = sha256.Size
+
+// WithHMACSession returns a copy of the key that authorizes signing with a salted HMAC session
+// instead of sending the password to the TPM in the clear. This protects the password, as well as
+// the digest which is encrypted with AES-CFB, from anyone able to observe the bus to a discrete
+// TPM, and it detects tampering with the response. saltKey is an RSA decryption key in the TPM,
+// typically a storage key or the EK, the salt the session keys are derived from is encrypted
+// with. To be protected against an active attacker, its public key should be verified, for
+// example with NewRSAPrivateKeyPinned or by checking the EK certificate. A new session is used
+// for every signature. It can't be combined with WithPolicySession or WithSignOnlyPolicy.
+func (k RSAPrivateKey) WithHMACSession(saltKey tpmutil.Handle) RSAPrivateKey {
+	k.saltKey = saltKey
+	return k
+}
+
+// hmacSession is the state of a salted HMAC session while a command is run in it.
+type hmacSession struct {
+	handle     tpmutil.Handle
+	sessionKey []byte
+	nonceTPM   []byte
+}
+
+// startHMACSession starts an unbound HMAC session salted with the RSA key, using SHA256 and
+// AES-128 in CFB mode for parameter encryption. The caller needs to flush the session.
+func startHMACSession(dev io.ReadWriter, saltKey tpmutil.Handle) (hmacSession, error) {
+	pub, _, _, err := tpm2.ReadPublic(dev, saltKey)
+	if err != nil {
+		return hmacSession{}, err
+	}
+	if pub.Type != tpm2.AlgRSA || pub.Attributes&tpm2.FlagDecrypt == 0 {
+		return hmacSession{}, errors.New("salt key needs to be an RSA decryption key")
+	}
+	saltPub, err := pub.Key()
+	if err != nil {
+		return hmacSession{}, err
+	}
+
+	// The salt is encrypted with OAEP, using the name algorithm of the key and the label "SECRET"
+	// (TPM 2.0 Part 1, Annex B.10.2)
+	salt := make([]byte, sha256.Size)
+	nonceCaller := make([]byte, hmacNonceSize)
+	for _, b := range [][]byte{salt, nonceCaller} {
+		if _, err := io.ReadFull(rand.Reader, b); err != nil {
+			return hmacSession{}, err
+		}
+	}
+	if pub.NameAlg != tpm2.AlgSHA256 {
+		return hmacSession{}, fmt.Errorf("unsupported name algorithm 0x%x of the salt key", pub.NameAlg)
+	}
+	encryptedSalt, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, saltPub.(*rsa.PublicKey), salt, []byte("SECRET\x00"))
+	if err != nil {
+		return hmacSession{}, err
+	}
+
+	// go-tpm can only start sessions without parameter encryption
+	cmd, err := encodeCommand(
+		[]interface{}{saltKey, tpm2.HandleNull},
+		nil,
+		nonceCaller, encryptedSalt, tpm2.SessionHMAC, tpm2.AlgAES, uint16(128), tpm2.AlgCFB, tpm2.AlgSHA256,
+	)
+	if err != nil {
+		return hmacSession{}, err
+	}
+	resp, err := runCommand(dev, tpm2.TagNoSessions, cmdStartAuthSession, cmd)
+	if err != nil {
+		return hmacSession{}, err
+	}
+	var s hmacSession
+	if _, err := tpmutil.Unpack(resp, &s.handle, &s.nonceTPM); err != nil {
+		return hmacSession{}, err
+	}
+	if s.sessionKey, err = tpm2.KDFa(tpm2.AlgSHA256, salt, "ATH", s.nonceTPM, nonceCaller, 8*sha256.Size); err != nil {
+		tpm2.FlushContext(dev, s.handle)
+		return hmacSession{}, err
+	}
+	return s, nil
+}
+
+// run executes a command with one handle in the session. The first command parameter, which
+// must be a TPM2B, is encrypted and the HMAC of the response verified. It returns the response
+// parameters. The command can't have response handles.
+func (s *hmacSession) run(dev io.ReadWriter, cc tpmutil.Command, handle tpmutil.Handle, password string, params []byte) ([]byte, error) {
+	_, name, _, err := tpm2.ReadPublic(dev, handle)
+	if err != nil {
+		return nil, err
+	}
+	nonceCaller := make([]byte, hmacNonceSize)
+	if _, err := io.ReadFull(rand.Reader, nonceCaller); err != nil {
+		return nil, err
+	}
+
+	// The HMAC and encryption keys are the session key followed by the password, without
+	// trailing zeros (TPM 2.0 Part 1, Section 19.6.8 and 21.3)
+	key := append(append([]byte(nil), s.sessionKey...), bytes.TrimRight([]byte(password), "\x00")...)
+
+	// Encrypt the contents of the first parameter
+	if len(params) < 2 {
+		return nil, errors.New("command has no parameter to encrypt")
+	}
+	size := int(params[0])<<8 | int(params[1])
+	if len(params) < 2+size {
+		return nil, errors.New("first command parameter is truncated")
+	}
+	params = append([]byte(nil), params...)
+	if err := cfbEncrypt(key, nonceCaller, s.nonceTPM, params[2:2+size]); err != nil {
+		return nil, err
+	}
+
+	ccBytes, err := tpmutil.Pack(cc)
+	if err != nil {
+		return nil, err
+	}
+	attr := tpm2.AttrContinueSession | tpm2.AttrDecrypt
+	cpHash := hashConcat(ccBytes, name, params)
+	mac := hmac.New(sha256.New, key)
+	mac.Write(cpHash)
+	mac.Write(nonceCaller)
+	mac.Write(s.nonceTPM)
+	mac.Write([]byte{byte(attr)})
+
+	cmd, err := encodeCommand(
+		[]interface{}{handle},
+		[]tpm2.AuthCommand{{Session: s.handle, Nonce: nonceCaller, Attributes: attr, Auth: mac.Sum(nil)}},
+		tpmutil.RawBytes(params),
+	)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := runCommand(dev, tpm2.TagSessions, cc, cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	// Split the response into parameters and the auth area, and check its HMAC
+	var paramSize uint32
+	if _, err := tpmutil.Unpack(resp, &paramSize); err != nil {
+		return nil, err
+	}
+	if len(resp) < 4+int(paramSize) {
+		return nil, errors.New("response parameters are truncated")
+	}
+	rp := resp[4 : 4+paramSize]
+	var (
+		nonceTPM, respHMAC []byte
+		respAttr           byte
+	)
+	if _, err := tpmutil.Unpack(resp[4+paramSize:], &nonceTPM, &respAttr, &respHMAC); err != nil {
+		return nil, err
+	}
+	s.nonceTPM = nonceTPM
+	rpHash := hashConcat([]byte{0, 0, 0, 0}, ccBytes, rp)
+	mac = hmac.New(sha256.New, key)
+	mac.Write(rpHash)
+	mac.Write(nonceTPM)
+	mac.Write(nonceCaller)
+	mac.Write([]byte{respAttr})
+	if !hmac.Equal(mac.Sum(nil), respHMAC) {
+		return nil, errors.New("invalid HMAC in the TPM response")
+	}
+	return rp, nil
+}
+
+// cfbEncrypt encrypts a command parameter in place with AES-128 in CFB mode. The key and IV are
+// derived from the session key and the nonces (TPM 2.0 Part 1, Section 21.3).
+func cfbEncrypt(key, nonceNewer, nonceOlder, b []byte) error {
+	keyIV, err := tpm2.KDFa(tpm2.AlgSHA256, key, "CFB", nonceNewer, nonceOlder, 8*(16+aes.BlockSize))
+	if err != nil {
+		return err
+	}
+	block, err := aes.NewCipher(keyIV[:16])
+	if err != nil {
+		return err
+	}
+	cipher.NewCFBEncrypter(block, keyIV[16:]).XORKeyStream(b, b)
+	return nil
+}
+
+// sign signs a digest with a key, authorized with the password in the session.
+func (s *hmacSession) sign(dev io.ReadWriter, handle tpmutil.Handle, password string, digest []byte, scheme *tpm2.SigScheme) ([]byte, error) {
+	params, err := tpmutil.Pack(digest, scheme.Alg, scheme.Hash, tpm2.TagHashCheck, tpm2.HandleNull, []byte(nil))
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.run(dev, cmdSign, handle, password, params)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		sigAlg tpm2.Algorithm
+		hash   tpm2.Algorithm
+		sig    []byte
+	)
+	if _, err := tpmutil.Unpack(resp, &sigAlg, &hash, &sig); err != nil {
+		return nil, err
+	}
+	return sig, nil
+}
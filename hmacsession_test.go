@@ -0,0 +1,86 @@
+package tpmk
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"io"
+	"testing"
+
+	"github.com/google/go-tpm-tools/simulator"
+	"github.com/google/go-tpm/tpm2"
+	"github.com/stretchr/testify/require"
+)
+
+// recordingDev keeps a copy of everything written to the TPM.
+type recordingDev struct {
+	io.ReadWriteCloser
+	written bytes.Buffer
+}
+
+func (d *recordingDev) Write(b []byte) (int, error) {
+	d.written.Write(b)
+	return d.ReadWriteCloser.Write(b)
+}
+
+func TestSignHMACSession(t *testing.T) {
+	sim, err := simulator.Get()
+	require.NoError(t, err)
+	defer sim.Close()
+
+	const (
+		saltKey = 0x81000000
+		handle  = 0x81000001
+		pw      = "secret-password"
+		attr    = tpm2.FlagSign | tpm2.FlagFixedTPM | tpm2.FlagUserWithAuth | tpm2.FlagFixedParent | tpm2.FlagSensitiveDataOrigin
+	)
+	_, err = GenRSAPrimaryKey(sim, saltKey, "", "", tpm2.FlagStorageDefault)
+	require.NoError(t, err)
+	pub, err := GenRSAPrimaryKey(sim, handle, "", pw, attr)
+	require.NoError(t, err)
+
+	dev := &recordingDev{ReadWriteCloser: sim}
+	priv, err := NewRSAPrivateKey(dev, handle, pw)
+	require.NoError(t, err)
+	priv = priv.WithHMACSession(saltKey)
+
+	digest := sha256.Sum256([]byte("This is a test"))
+	tests := map[string]crypto.SignerOpts{
+		"PKCS#1 v1.5": crypto.SHA256,
+		"PSS":         &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthAuto, Hash: crypto.SHA256},
+	}
+	for name, opts := range tests {
+		t.Run(name, func(t *testing.T) {
+			dev.written.Reset()
+			signature, err := priv.Sign(nil, digest[:], opts)
+			require.NoError(t, err)
+			if pss, ok := opts.(*rsa.PSSOptions); ok {
+				require.NoError(t, rsa.VerifyPSS(pub.(*rsa.PublicKey), crypto.SHA256, digest[:], signature, pss))
+			} else {
+				require.NoError(t, rsa.VerifyPKCS1v15(pub.(*rsa.PublicKey), crypto.SHA256, digest[:], signature))
+			}
+
+			// Neither the password nor the digest were sent in the clear
+			require.False(t, bytes.Contains(dev.written.Bytes(), []byte(pw)))
+			require.False(t, bytes.Contains(dev.written.Bytes(), digest[:]))
+		})
+	}
+
+	// The session is flushed after signing
+	sessions, err := GetHandles(sim, tpm2.TPMProp(tpm2.HandleTypeLoadedSession)<<24)
+	require.NoError(t, err)
+	require.Empty(t, sessions)
+
+	// The wrong password fails the HMAC check
+	priv, err = NewRSAPrivateKey(sim, handle, "wrong")
+	require.NoError(t, err)
+	_, err = priv.WithHMACSession(saltKey).Sign(nil, digest[:], crypto.SHA256)
+	require.Equal(t, tpm2.SessionError{Code: tpm2.RCAuthFail, Session: tpm2.RC1}, err)
+
+	// The salt key needs to be able to decrypt
+	priv, err = NewRSAPrivateKey(sim, handle, pw)
+	require.NoError(t, err)
+	_, err = priv.WithHMACSession(handle).Sign(nil, digest[:], crypto.SHA256)
+	require.EqualError(t, err, "salt key needs to be an RSA decryption key")
+}
@@ -0,0 +1,210 @@
+package tpmk
+
+import (
+	"bufio"
+	"bytes"
+	"crypto"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// IMAPCR is the PCR Linux IMA extends its measurements into by default.
+const IMAPCR = 10
+
+// Name of the original IMA template, which is encoded differently in the binary log
+const imaTemplateIMA = "ima"
+
+// IMAEvent is an entry of the Linux IMA runtime measurement list.
+type IMAEvent struct {
+	PCR            int
+	TemplateDigest []byte   // SHA1 digest of the template data, all zeros for a violation
+	TemplateName   string   // For example "ima-ng"
+	TemplateData   []byte   // Raw template data, only available in the binary list
+	Fields         []string // Template fields, only available in the ASCII list
+}
+
+// ParseIMALog parses the binary IMA runtime measurement list, as found in
+// /sys/kernel/security/ima/binary_runtime_measurements. Integers are expected in little-endian
+// byte order, which is the case on most platforms.
+func ParseIMALog(b []byte) ([]IMAEvent, error) {
+	r := bytes.NewReader(b)
+	var events []IMAEvent
+	for r.Len() > 0 {
+		var (
+			e   IMAEvent
+			pcr uint32
+		)
+		if err := binary.Read(r, binary.LittleEndian, &pcr); err != nil {
+			return nil, err
+		}
+		e.PCR = int(pcr)
+		e.TemplateDigest = make([]byte, sha1.Size)
+		if _, err := io.ReadFull(r, e.TemplateDigest); err != nil {
+			return nil, err
+		}
+		name, err := readIMAField(r)
+		if err != nil {
+			return nil, err
+		}
+		e.TemplateName = string(name)
+
+		// The data of the original template isn't preceded by its size, it's a SHA1 digest
+		// followed by the size and the file name. It's kept as it is in the log.
+		if e.TemplateName == imaTemplateIMA {
+			start := len(b) - r.Len()
+			if _, err := r.Seek(sha1.Size, io.SeekCurrent); err != nil {
+				return nil, err
+			}
+			if _, err := readIMAField(r); err != nil {
+				return nil, err
+			}
+			e.TemplateData = append([]byte(nil), b[start:len(b)-r.Len()]...)
+		} else if e.TemplateData, err = readIMAField(r); err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	return events, nil
+}
+
+// readIMAField reads data preceded by its size in the binary IMA list.
+func readIMAField(r *bytes.Reader) ([]byte, error) {
+	var size uint32
+	if err := binary.Read(r, binary.LittleEndian, &size); err != nil {
+		return nil, err
+	}
+	if int64(size) > int64(r.Len()) {
+		return nil, errors.New("IMA log is truncated")
+	}
+	b := make([]byte, size)
+	_, err := io.ReadFull(r, b)
+	return b, err
+}
+
+// ParseIMAASCIILog parses the ASCII IMA runtime measurement list, as found in
+// /sys/kernel/security/ima/ascii_runtime_measurements. Each line holds the PCR, the template
+// digest, the template name and the template fields, separated by spaces.
+func ParseIMAASCIILog(b []byte) ([]IMAEvent, error) {
+	var events []IMAEvent
+	s := bufio.NewScanner(bytes.NewReader(b))
+	for line := 1; s.Scan(); line++ {
+		fields := strings.Fields(s.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) < 3 {
+			return nil, fmt.Errorf("invalid IMA entry in line %d", line)
+		}
+		pcr, err := strconv.Atoi(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid PCR in line %d: %v", line, err)
+		}
+		digest, err := hex.DecodeString(fields[1])
+		if err != nil || len(digest) != sha1.Size {
+			return nil, fmt.Errorf("invalid template digest in line %d", line)
+		}
+		events = append(events, IMAEvent{
+			PCR:            pcr,
+			TemplateDigest: digest,
+			TemplateName:   fields[2],
+			Fields:         fields[3:],
+		})
+	}
+	return events, s.Err()
+}
+
+// Size the file name is padded to in the template digest of the original ima template
+// (IMA_EVENT_NAME_LEN_MAX + 1)
+const imaNameSize = 256
+
+// ReplayIMA recomputes the value of a PCR from the IMA events extended into it, so it can be
+// compared with the value in a quote. Violations, entries with a template digest of all zeros,
+// are extended as all ones like the kernel does. The template digest of events with template
+// data, those from the binary list, is checked against the data, so the fields can be trusted
+// once the PCR value is. Events of the ASCII list have no data and their fields aren't checked.
+// For banks other than SHA1, the template data is hashed with the hash of the bank, which is
+// what kernels 5.8 and later do, so the events need to come from the binary list. Use
+// ReplayIMALegacy for older kernels.
+func ReplayIMA(events []IMAEvent, pcr int, hash crypto.Hash) ([]byte, error) {
+	return replayIMA(events, pcr, hash, false)
+}
+
+// ReplayIMALegacy is like ReplayIMA, but extends the SHA1 template digest padded with zeros into
+// banks other than SHA1, which is what kernels before 5.8 do.
+func ReplayIMALegacy(events []IMAEvent, pcr int, hash crypto.Hash) ([]byte, error) {
+	return replayIMA(events, pcr, hash, true)
+}
+
+// replayIMA implements ReplayIMA and ReplayIMALegacy, padding the SHA1 template digests if
+// padded is set.
+func replayIMA(events []IMAEvent, pcr int, hash crypto.Hash, padded bool) ([]byte, error) {
+	if !hash.Available() || hash.Size() < sha1.Size {
+		return nil, fmt.Errorf("unsupported hash algorithm %v", hash)
+	}
+	value := make([]byte, hash.Size())
+	violation := make([]byte, sha1.Size)
+	for i, e := range events {
+		if e.PCR != pcr {
+			continue
+		}
+		if len(e.TemplateDigest) != sha1.Size {
+			return nil, fmt.Errorf("invalid template digest of %d bytes", len(e.TemplateDigest))
+		}
+		digest := make([]byte, hash.Size())
+		switch {
+		case bytes.Equal(e.TemplateDigest, violation):
+			for j := range digest {
+				digest[j] = 0xff
+			}
+		case e.TemplateData != nil:
+			d, err := imaTemplateDigest(e, crypto.SHA1)
+			if err != nil {
+				return nil, err
+			}
+			if !bytes.Equal(d, e.TemplateDigest) {
+				return nil, fmt.Errorf("template digest of IMA event %d doesn't match its data", i)
+			}
+			if !padded && hash != crypto.SHA1 {
+				if digest, err = imaTemplateDigest(e, hash); err != nil {
+					return nil, err
+				}
+				break
+			}
+			copy(digest, e.TemplateDigest)
+		case padded || hash == crypto.SHA1:
+			copy(digest, e.TemplateDigest)
+		default:
+			return nil, fmt.Errorf("IMA event %d has no template data to compute its %v digest", i, hash)
+		}
+		h := hash.New()
+		h.Write(value)
+		h.Write(digest)
+		value = h.Sum(nil)
+	}
+	return value, nil
+}
+
+// imaTemplateDigest computes the template digest of an event from its data. Fields are hashed
+// with their size, which is how they appear in the data, except for the original ima template
+// which hashes the file digest followed by the file name padded with zeros.
+func imaTemplateDigest(e IMAEvent, hash crypto.Hash) ([]byte, error) {
+	h := hash.New()
+	if e.TemplateName != imaTemplateIMA {
+		h.Write(e.TemplateData)
+		return h.Sum(nil), nil
+	}
+	if len(e.TemplateData) < sha1.Size+4 || len(e.TemplateData)-sha1.Size-4 > imaNameSize {
+		return nil, errors.New("invalid data of ima template")
+	}
+	name := make([]byte, imaNameSize)
+	copy(name, e.TemplateData[sha1.Size+4:])
+	h.Write(e.TemplateData[:sha1.Size])
+	h.Write(name)
+	return h.Sum(nil), nil
+}
@@ -0,0 +1,142 @@
+package tpmk
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"testing"
+
+	"github.com/google/go-tpm-tools/simulator"
+	"github.com/google/go-tpm/tpm2"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIMALog(t *testing.T) {
+	// Build a log with an ima-ng entry, a violation, an entry of the original ima template, and
+	// one for a different PCR
+	field := func(b []byte) []byte {
+		size := make([]byte, 4)
+		binary.LittleEndian.PutUint32(size, uint32(len(b)))
+		return append(size, b...)
+	}
+	fileDigest := sha1.Sum([]byte("file"))
+	ngData := append(field(append([]byte("sha1:\x00"), fileDigest[:]...)), field([]byte("boot_aggregate\x00"))...)
+	imaData := append(fileDigest[:], field([]byte("/bin/sh"))...)
+	events := []IMAEvent{
+		{PCR: 10, TemplateName: "ima-ng", TemplateData: ngData},
+		{PCR: 10, TemplateName: "ima-ng", TemplateData: ngData},
+		{PCR: 10, TemplateName: "ima", TemplateData: imaData},
+		{PCR: 11, TemplateName: "ima-ng", TemplateData: ngData},
+	}
+	// Fields are hashed with their size, except in the original template which hashes the file
+	// digest and the name padded to 256 bytes
+	templateDigest := func(e IMAEvent, h crypto.Hash) []byte {
+		data := e.TemplateData
+		if e.TemplateName == "ima" {
+			name := make([]byte, 256)
+			copy(name, "/bin/sh")
+			data = append(append([]byte(nil), fileDigest[:]...), name...)
+		}
+		hh := h.New()
+		hh.Write(data)
+		return hh.Sum(nil)
+	}
+	for i := range events {
+		events[i].TemplateDigest = templateDigest(events[i], crypto.SHA1)
+	}
+	events[1].TemplateDigest = make([]byte, sha1.Size)
+
+	var binaryLog, asciiLog bytes.Buffer
+	for _, e := range events {
+		binary.Write(&binaryLog, binary.LittleEndian, uint32(e.PCR))
+		binaryLog.Write(e.TemplateDigest)
+		binaryLog.Write(field([]byte(e.TemplateName)))
+		if e.TemplateName == "ima" {
+			binaryLog.Write(e.TemplateData)
+		} else {
+			binaryLog.Write(field(e.TemplateData))
+		}
+		fmt.Fprintf(&asciiLog, "%d %x %s sha1:%x boot_aggregate\n", e.PCR, e.TemplateDigest, e.TemplateName, fileDigest)
+	}
+
+	parsed, err := ParseIMALog(binaryLog.Bytes())
+	require.NoError(t, err)
+	require.Equal(t, events, parsed)
+	parsedASCII, err := ParseIMAASCIILog(asciiLog.Bytes())
+	require.NoError(t, err)
+	require.Len(t, parsedASCII, len(events))
+	require.Equal(t, []string{"sha1:" + hex.EncodeToString(fileDigest[:]), "boot_aggregate"}, parsedASCII[0].Fields)
+
+	// A truncated log fails to parse
+	_, err = ParseIMALog(binaryLog.Bytes()[:binaryLog.Len()-1])
+	require.Error(t, err)
+
+	// Extend the PCR of the simulator like kernels 5.8 and later do, and the debug PCR like older
+	// ones, which pad the SHA1 template digest for the SHA256 bank
+	const legacyPCR = 16
+	dev, err := simulator.Get()
+	require.NoError(t, err)
+	defer dev.Close()
+	for _, e := range events[:3] {
+		sha1Digest := e.TemplateDigest
+		sha256Digest := templateDigest(e, crypto.SHA256)
+		paddedDigest := make([]byte, 32)
+		copy(paddedDigest, e.TemplateDigest)
+		if bytes.Equal(e.TemplateDigest, make([]byte, sha1.Size)) {
+			sha1Digest = bytes.Repeat([]byte{0xff}, sha1.Size)
+			sha256Digest = bytes.Repeat([]byte{0xff}, 32)
+			paddedDigest = sha256Digest
+		}
+		require.NoError(t, tpm2.PCRExtend(dev, IMAPCR, tpm2.AlgSHA1, sha1Digest, ""))
+		require.NoError(t, tpm2.PCRExtend(dev, IMAPCR, tpm2.AlgSHA256, sha256Digest, ""))
+		require.NoError(t, tpm2.PCRExtend(dev, legacyPCR, tpm2.AlgSHA256, paddedDigest, ""))
+	}
+
+	// Replaying the legacy PCR needs the events moved there
+	legacy := make([]IMAEvent, 3)
+	copy(legacy, parsed)
+	legacyASCII := make([]IMAEvent, 3)
+	copy(legacyASCII, parsedASCII)
+	for i := range legacy {
+		legacy[i].PCR, legacyASCII[i].PCR = legacyPCR, legacyPCR
+	}
+
+	tests := map[string]struct {
+		events []IMAEvent
+		pcr    int
+		hash   crypto.Hash
+		alg    tpm2.Algorithm
+		replay func([]IMAEvent, int, crypto.Hash) ([]byte, error)
+	}{
+		"binary SHA1":          {parsed, IMAPCR, crypto.SHA1, tpm2.AlgSHA1, ReplayIMA},
+		"binary SHA256":        {parsed, IMAPCR, crypto.SHA256, tpm2.AlgSHA256, ReplayIMA},
+		"ascii SHA1":           {parsedASCII, IMAPCR, crypto.SHA1, tpm2.AlgSHA1, ReplayIMA},
+		"legacy binary SHA256": {legacy, legacyPCR, crypto.SHA256, tpm2.AlgSHA256, ReplayIMALegacy},
+		"legacy ascii SHA256":  {legacyASCII, legacyPCR, crypto.SHA256, tpm2.AlgSHA256, ReplayIMALegacy},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			expected, err := tpm2.ReadPCR(dev, test.pcr, test.alg)
+			require.NoError(t, err)
+			value, err := test.replay(test.events, test.pcr, test.hash)
+			require.NoError(t, err)
+			require.Equal(t, expected, value)
+		})
+	}
+
+	// The ASCII list doesn't have the data to compute SHA256 template digests
+	_, err = ReplayIMA(parsedASCII, IMAPCR, crypto.SHA256)
+	require.Error(t, err)
+
+	// Events whose data was changed are rejected, even if the digest is the original one
+	tampered := make([]IMAEvent, len(parsed))
+	copy(tampered, parsed)
+	tampered[0].TemplateData = bytes.Replace(tampered[0].TemplateData, []byte("boot_aggregate"), []byte("boot_aggregatf"), 1)
+	_, err = ReplayIMA(tampered, IMAPCR, crypto.SHA1)
+	require.EqualError(t, err, "template digest of IMA event 0 doesn't match its data")
+	_, err = ReplayIMALegacy(tampered, IMAPCR, crypto.SHA256)
+	require.Error(t, err)
+}
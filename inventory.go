@@ -0,0 +1,127 @@
+package tpmk
+
+import (
+	"crypto/ecdsa"
+	"fmt"
+	"io"
+
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpmutil"
+)
+
+// Variable TPM properties for the dictionary attack protection, TPM 2.0 Part 2, Section 6.13.
+const (
+	ptPermanent      uint32 = ptVar + 0
+	ptLockoutCounter uint32 = ptVar + 14
+	ptMaxAuthFail    uint32 = ptVar + 15
+	inLockout        uint32 = 0x00000004 // Bit in TPM_PT_PERMANENT
+)
+
+// Inventory summarizes the keys, NV indexes and lockout state of a TPM, for example to report it
+// to a central system periodically.
+type Inventory struct {
+	Keys           []KeySummary
+	NVIndexes      []NVSummary
+	NVUsed         int    // Total size of all NV indexes in bytes
+	InLockout      bool   // True if DA-protected objects are locked out
+	LockoutCounter uint32 // Number of authorization failures counted towards the lockout
+	MaxAuthFail    uint32 // Number of authorization failures before the lockout is triggered
+}
+
+// KeySummary describes a persistent key.
+type KeySummary struct {
+	Handle     tpmutil.Handle
+	Type       tpm2.Algorithm
+	Bits       int // Size of the key in bits, 0 for keyed-hash objects
+	Attributes tpm2.KeyProp
+}
+
+// NVSummary describes an NV index.
+type NVSummary struct {
+	Index      tpmutil.Handle
+	Size       int
+	Attributes tpm2.NVAttr
+}
+
+// DeviceInventory reads the persistent keys, NV indexes and lockout state of the TPM.
+func DeviceInventory(dev io.ReadWriteCloser) (Inventory, error) {
+	var inv Inventory
+
+	keys, err := KeyList(dev)
+	if err != nil {
+		return Inventory{}, err
+	}
+	for _, handle := range keys {
+		pub, _, _, err := tpm2.ReadPublic(dev, handle)
+		if err != nil {
+			return Inventory{}, err
+		}
+		bits, err := keyBits(pub)
+		if err != nil {
+			return Inventory{}, err
+		}
+		inv.Keys = append(inv.Keys, KeySummary{handle, pub.Type, bits, pub.Attributes})
+	}
+
+	indexes, err := NVList(dev)
+	if err != nil {
+		return Inventory{}, err
+	}
+	for _, index := range indexes {
+		pub, err := tpm2.NVReadPublic(dev, index)
+		if err != nil {
+			return Inventory{}, err
+		}
+		inv.NVIndexes = append(inv.NVIndexes, NVSummary{index, int(pub.DataSize), tpm2.NVAttr(pub.Attributes)})
+		inv.NVUsed += int(pub.DataSize)
+	}
+
+	permanent, err := getProperty(dev, ptPermanent)
+	if err != nil {
+		return Inventory{}, err
+	}
+	inv.InLockout = permanent&inLockout != 0
+	if inv.LockoutCounter, err = getProperty(dev, ptLockoutCounter); err != nil {
+		return Inventory{}, err
+	}
+	if inv.MaxAuthFail, err = getProperty(dev, ptMaxAuthFail); err != nil {
+		return Inventory{}, err
+	}
+	return inv, nil
+}
+
+// keyBits returns the size of an asymmetric key in bits.
+func keyBits(pub tpm2.Public) (int, error) {
+	switch pub.Type {
+	case tpm2.AlgRSA:
+		return int(pub.RSAParameters.KeyBits), nil
+	case tpm2.AlgECC:
+		key, err := pub.Key()
+		if err != nil {
+			return 0, err
+		}
+		ecKey, ok := key.(*ecdsa.PublicKey)
+		if !ok {
+			return 0, fmt.Errorf("unexpected ECC key type %T", key)
+		}
+		return ecKey.Params().BitSize, nil
+	default:
+		return 0, nil
+	}
+}
+
+// getProperty reads a single TPM property.
+func getProperty(dev io.ReadWriter, property uint32) (uint32, error) {
+	caps, _, err := tpm2.GetCapability(dev, tpm2.CapabilityTPMProperties, 1, property)
+	if err != nil {
+		return 0, err
+	}
+	if len(caps) != 1 {
+		return 0, fmt.Errorf("expected property 0x%x", property)
+	}
+	p, ok := caps[0].(tpm2.TaggedProperty)
+	if !ok || uint32(p.Tag) != property {
+		return 0, fmt.Errorf("expected property 0x%x, got %v", property, caps[0])
+	}
+	return p.Value, nil
+}
@@ -0,0 +1,39 @@
+package tpmk
+
+import (
+	"testing"
+
+	"github.com/google/go-tpm-tools/simulator"
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpmutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDeviceInventory(t *testing.T) {
+	dev, err := simulator.Get()
+	require.NoError(t, err)
+	defer dev.Close()
+
+	const (
+		pw     = ""
+		attr   = tpm2.FlagSign | tpm2.FlagFixedTPM | tpm2.FlagUserWithAuth | tpm2.FlagFixedParent | tpm2.FlagSensitiveDataOrigin
+		index  = 0x1000000
+		nvAttr = tpm2.AttrOwnerWrite | tpm2.AttrOwnerRead | tpm2.AttrAuthRead | tpm2.AttrPPRead
+	)
+	_, err = GenRSAPrimaryKey(dev, 0x81000000, pw, pw, attr)
+	require.NoError(t, err)
+	_, err = GenRSAPrimaryKey(dev, 0x81000001, pw, pw, tpm2.FlagStorageDefault)
+	require.NoError(t, err)
+	require.NoError(t, NVWrite(dev, index, []byte("data"), pw, nvAttr))
+
+	inv, err := DeviceInventory(dev)
+	require.NoError(t, err)
+	require.Equal(t, []KeySummary{
+		{0x81000000, tpm2.AlgRSA, 2048, attr},
+		{0x81000001, tpm2.AlgRSA, 2048, tpm2.FlagStorageDefault},
+	}, inv.Keys)
+	require.Equal(t, []NVSummary{{tpmutil.Handle(index), 4, nvAttr | tpm2.AttrWritten}}, inv.NVIndexes)
+	require.Equal(t, 4, inv.NVUsed)
+	require.False(t, inv.InLockout)
+	require.NotZero(t, inv.MaxAuthFail)
+}
@@ -0,0 +1,173 @@
+package tpmk
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/asn1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/google/go-tpm/tpm2"
+)
+
+// jwtAlgorithms maps the JOSE algorithm names (RFC 7518) to the hash and signature scheme.
+var jwtAlgorithms = map[string]struct {
+	hash  crypto.Hash
+	pss   bool
+	curve elliptic.Curve // nil for RSA
+}{
+	"RS256": {hash: crypto.SHA256},
+	"RS384": {hash: crypto.SHA384},
+	"RS512": {hash: crypto.SHA512},
+	"PS256": {hash: crypto.SHA256, pss: true},
+	"PS384": {hash: crypto.SHA384, pss: true},
+	"PS512": {hash: crypto.SHA512, pss: true},
+	"ES256": {hash: crypto.SHA256, curve: elliptic.P256()},
+	"ES384": {hash: crypto.SHA384, curve: elliptic.P384()},
+	"ES512": {hash: crypto.SHA512, curve: elliptic.P521()},
+}
+
+// JWTSigningMethod signs JSON Web Tokens with a key in the TPM, or any other crypto.Signer. It
+// implements the SigningMethod interface of github.com/dgrijalva/jwt-go and
+// github.com/golang-jwt/jwt (v4), so it can be registered with jwt.RegisterSigningMethod or used
+// in jwt.NewWithClaims directly.
+type JWTSigningMethod struct {
+	alg  string
+	key  crypto.Signer
+	hash crypto.Hash
+	opts crypto.SignerOpts
+}
+
+// NewJWTSigningMethod returns a signing method for the JOSE algorithm alg (RS256, PS256, ES256,
+// etc) that signs with key. The algorithm needs to match the key, RSA keys can be used with the
+// RS* and PS* algorithms, ECDSA keys only with the ES* algorithm of their curve.
+func NewJWTSigningMethod(alg string, key crypto.Signer) (*JWTSigningMethod, error) {
+	a, ok := jwtAlgorithms[alg]
+	if !ok {
+		return nil, fmt.Errorf("unsupported JWT algorithm %q", alg)
+	}
+	if err := checkJWTKey(alg, key.Public()); err != nil {
+		return nil, err
+	}
+	m := &JWTSigningMethod{alg: alg, key: key, hash: a.hash, opts: a.hash}
+	if a.pss {
+		m.opts = &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: a.hash}
+	}
+	// Let the TPM produce the JOSE encoding directly rather than converting it from ASN.1, and
+	// don't let a scheme set on the key override the one of the algorithm
+	switch k := key.(type) {
+	case ECPrivateKey:
+		m.key = k.WithSignatureEncoding(SignatureRaw)
+	case RSAPrivateKey:
+		if a.pss {
+			m.key = k.WithSignScheme(tpm2.AlgRSAPSS)
+		} else {
+			m.key = k.WithSignScheme(tpm2.AlgRSASSA)
+		}
+	}
+	return m, nil
+}
+
+// checkJWTKey returns an error if the public key can't be used with the JOSE algorithm alg.
+func checkJWTKey(alg string, key interface{}) error {
+	a := jwtAlgorithms[alg]
+	switch pub := key.(type) {
+	case *rsa.PublicKey:
+		if a.curve != nil {
+			return fmt.Errorf("JWT algorithm %s requires an ECDSA key", alg)
+		}
+	case *ecdsa.PublicKey:
+		if a.curve == nil {
+			return fmt.Errorf("JWT algorithm %s requires an RSA key", alg)
+		}
+		if pub.Curve != a.curve {
+			return fmt.Errorf("JWT algorithm %s requires a %s key, not %s", alg, a.curve.Params().Name, pub.Curve.Params().Name)
+		}
+	default:
+		return UnsupportedKeyError{Key: pub}
+	}
+	return nil
+}
+
+// Alg returns the JOSE algorithm name used in the "alg" header of the token.
+func (m *JWTSigningMethod) Alg() string {
+	return m.alg
+}
+
+// Sign signs the signing string (the encoded header and claims separated by a dot) and returns
+// the base64url-encoded signature. The key argument is ignored, the key given to
+// NewJWTSigningMethod is always used, so nil can be passed to SignedString.
+func (m *JWTSigningMethod) Sign(signingString string, key interface{}) (string, error) {
+	h := m.hash.New()
+	h.Write([]byte(signingString))
+	sig, err := m.key.Sign(rand.Reader, h.Sum(nil), m.opts)
+	if err != nil {
+		return "", err
+	}
+	if pub, ok := m.key.Public().(*ecdsa.PublicKey); ok {
+		if _, ok := m.key.(ECPrivateKey); !ok {
+			if sig, err = ecdsaRaw(pub, sig); err != nil {
+				return "", err
+			}
+		}
+	}
+	return base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+// Verify checks the base64url-encoded signature over the signing string. The key needs to be
+// the *rsa.PublicKey or *ecdsa.PublicKey to verify with, and match the algorithm like the key
+// given to NewJWTSigningMethod. If it's nil, the public key of the signing key is used.
+func (m *JWTSigningMethod) Verify(signingString, signature string, key interface{}) error {
+	if key == nil {
+		key = m.key.Public()
+	}
+	if err := checkJWTKey(m.alg, key); err != nil {
+		return err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil {
+		return err
+	}
+	h := m.hash.New()
+	h.Write([]byte(signingString))
+	digest := h.Sum(nil)
+
+	switch pub := key.(type) {
+	case *rsa.PublicKey:
+		if opts, ok := m.opts.(*rsa.PSSOptions); ok {
+			return rsa.VerifyPSS(pub, m.hash, digest, sig, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthAuto, Hash: opts.Hash})
+		}
+		return rsa.VerifyPKCS1v15(pub, m.hash, digest, sig)
+	case *ecdsa.PublicKey:
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		if len(sig) != 2*size {
+			return errors.New("invalid ECDSA signature size")
+		}
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(pub, digest, r, s) {
+			return errors.New("invalid ECDSA signature")
+		}
+		return nil
+	default:
+		return UnsupportedKeyError{Key: key}
+	}
+}
+
+// ecdsaRaw converts an ASN.1 encoded ECDSA signature into the fixed-size r||s form used by JOSE.
+func ecdsaRaw(pub *ecdsa.PublicKey, sig []byte) ([]byte, error) {
+	var rs struct{ R, S *big.Int }
+	rest, err := asn1.Unmarshal(sig, &rs)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) > 0 {
+		return nil, errors.New("invalid ECDSA signature")
+	}
+	return rawECDSASignature(pub.Curve, rs.R, rs.S)
+}
@@ -0,0 +1,133 @@
+package tpmk
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/google/go-tpm-tools/simulator"
+	"github.com/google/go-tpm/tpm2"
+	"github.com/stretchr/testify/require"
+)
+
+func TestJWTSigningMethod(t *testing.T) {
+	dev, err := simulator.Get()
+	require.NoError(t, err)
+	defer dev.Close()
+
+	const rsaHandle = 0x81000000
+	_, err = GenRSAPrimaryKey(dev, rsaHandle, "", "", tpm2.FlagSign|tpm2.FlagUserWithAuth|tpm2.FlagSensitiveDataOrigin)
+	require.NoError(t, err)
+	rsaKey, err := NewRSAPrivateKey(dev, rsaHandle, "")
+	require.NoError(t, err)
+
+	ecHandle := createECKey(t, dev, tpm2.CurveNISTP256, "")
+	defer tpm2.FlushContext(dev, ecHandle)
+	ecKey, err := NewECPrivateKey(dev, ecHandle, "")
+	require.NoError(t, err)
+
+	// A software ECDSA key produces ASN.1 signatures which need converting
+	fake, err := NewFakeSigner(2048)
+	require.NoError(t, err)
+
+	tests := []struct {
+		alg  string
+		key  crypto.Signer
+		size int
+	}{
+		{"RS256", rsaKey, 256},
+		{"RS384", rsaKey, 256},
+		{"PS256", rsaKey, 256},
+		{"PS384", rsaKey, 256},
+		{"ES256", ecKey, 64},
+		{"RS256", fake, 256},
+		{"PS256", fake, 256},
+	}
+	const signingString = "eyJhbGciOiJSUzI1NiJ9.eyJzdWIiOiJ0cG1rIn0"
+	for _, test := range tests {
+		t.Run(fmt.Sprintf("%s %T", test.alg, test.key), func(t *testing.T) {
+			m, err := NewJWTSigningMethod(test.alg, test.key)
+			require.NoError(t, err)
+			require.Equal(t, test.alg, m.Alg())
+
+			sig, err := m.Sign(signingString, nil)
+			require.NoError(t, err)
+			raw, err := base64.RawURLEncoding.DecodeString(sig)
+			require.NoError(t, err)
+			require.Len(t, raw, test.size)
+
+			require.NoError(t, m.Verify(signingString, sig, test.key.Public()))
+			require.NoError(t, m.Verify(signingString, sig, nil))
+			require.Error(t, m.Verify(signingString+"x", sig, nil))
+		})
+	}
+
+	// Algorithms that don't match the key
+	for alg, key := range map[string]crypto.Signer{
+		"ES256": rsaKey,
+		"RS256": ecKey,
+		"PS256": ecKey,
+		"ES384": ecKey,
+		"HS256": rsaKey,
+		"none":  rsaKey,
+	} {
+		_, err := NewJWTSigningMethod(alg, key)
+		require.Error(t, err, alg)
+	}
+
+	// Verification is bound to the algorithm, not the type of key passed in
+	es256, err := NewJWTSigningMethod("ES256", ecKey)
+	require.NoError(t, err)
+	ecSig, err := es256.Sign(signingString, nil)
+	require.NoError(t, err)
+	rs256, err := NewJWTSigningMethod("RS256", rsaKey)
+	require.NoError(t, err)
+	require.EqualError(t, rs256.Verify(signingString, ecSig, ecKey.Public()), "JWT algorithm RS256 requires an RSA key")
+	p384, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	require.NoError(t, err)
+	require.EqualError(t, es256.Verify(signingString, ecSig, &p384.PublicKey), "JWT algorithm ES256 requires a P-256 key, not P-384")
+}
+
+func ExampleJWTSigningMethod() {
+	dev, err := simulator.Get()
+	if err != nil {
+		panic(err)
+	}
+	defer dev.Close()
+
+	// Create a signing key in the TPM
+	const handle = 0x81000000
+	if _, err := GenRSAPrimaryKey(dev, handle, "", "", tpm2.FlagSign|tpm2.FlagUserWithAuth|tpm2.FlagSensitiveDataOrigin); err != nil {
+		panic(err)
+	}
+	key, err := NewRSAPrivateKey(dev, handle, "")
+	if err != nil {
+		panic(err)
+	}
+
+	// With github.com/golang-jwt/jwt, the method is passed to jwt.NewWithClaims and the token
+	// signed with token.SignedString(nil). Here the token is assembled by hand.
+	method, err := NewJWTSigningMethod("PS256", key)
+	if err != nil {
+		panic(err)
+	}
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"` + method.Alg() + `","typ":"JWT"}`))
+	claims := base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"service-a","aud":"service-b"}`))
+	signingString := header + "." + claims
+	sig, err := method.Sign(signingString, nil)
+	if err != nil {
+		panic(err)
+	}
+	token := signingString + "." + sig
+
+	// The receiver verifies the token with the public key
+	parts := strings.Split(token, ".")
+	err = method.Verify(parts[0]+"."+parts[1], parts[2], key.Public())
+	fmt.Println("valid:", err == nil)
+	// Output: valid: true
+}
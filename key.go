@@ -1,21 +1,130 @@
 package tpmk
 
 import (
+	"bytes"
 	"crypto"
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
 	"errors"
 	"fmt"
 	"io"
+	"math"
 	"math/big"
 
 	"github.com/google/go-tpm/tpm2"
 	"github.com/google/go-tpm/tpmutil"
 )
 
-// GenRSAPrimaryKey generates a primary RSA key and makes it persistent under the given handle.
-func GenRSAPrimaryKey(dev io.ReadWriteCloser, handle tpmutil.Handle, parentPW, ownerPW string, attr tpm2.KeyProp) (crypto.PublicKey, error) {
+// KeyOption configures optional behavior when generating keys.
+type KeyOption func(*keyOptions)
+
+type keyOptions struct {
+	selfTest   bool
+	signOnly   bool
+	policy     []byte
+	unique     []byte
+	keyBits    int
+	rand       io.Reader
+	duplicable bool
+}
+
+// WithSelfTest signs and verifies a test digest after the key was generated and persisted. If
+// that fails, the key is evicted again and an error returned. Only use this with unrestricted
+// signing keys.
+func WithSelfTest() KeyOption {
+	return func(o *keyOptions) { o.selfTest = true }
+}
+
+// WithSignOnlyPolicy restricts the key to be used with TPM2_Sign only, so it can't be used to
+// certify other objects or to quote PCRs, even by someone who knows the password. The key gets a
+// policy that requires the command to be TPM2_Sign as well as the password, and
+// tpm2.FlagUserWithAuth is cleared so the password alone isn't sufficient. RSAPrivateKey satisfies
+// the policy automatically.
+func WithSignOnlyPolicy() KeyOption {
+	return func(o *keyOptions) { o.signOnly = true }
+}
+
+// WithPolicy requires the policy with the given digest, see PolicyDigest, to be satisfied for
+// every use of the key. tpm2.FlagUserWithAuth is cleared so the password alone isn't sufficient,
+// and tpm2.FlagAdminWithPolicy is set so administrative operations, such as changing the
+// password, require the policy as well. Use RSAPrivateKey.WithPolicySession to sign with the key.
+func WithPolicy(policy []byte) KeyOption {
+	return func(o *keyOptions) { o.policy = policy }
+}
+
+// WithUnique sets the unique field of the key template. Primary keys are derived from the
+// hierarchy seed and the template, so different unique values produce independent keys with
+// otherwise identical attributes, and the same value always produces the same key. For RSA
+// keys, the unique field takes the place of the modulus and can be as long as the key size in
+// bytes, 256 for 2048-bit keys. For ECC keys it takes the place of the X coordinate and can be as
+// long as the curve's key size.
+func WithUnique(unique []byte) KeyOption {
+	return func(o *keyOptions) { o.unique = unique }
+}
+
+// WithKeyBits sets the size of RSA keys, 2048 bits by default. The TPM is asked whether it
+// supports the size before generating the key, many only support 2048 bits and some also 3072 or
+// 4096.
+func WithKeyBits(bits int) KeyOption {
+	return func(o *keyOptions) { o.keyBits = bits }
+}
+
+// WithRand sets the source of the random digest signed by WithSelfTest, crypto/rand.Reader by
+// default. The keys themselves are always generated from the TPM's own entropy. Use RandReader to
+// draw from the TPM's random number generator instead.
+func WithRand(r io.Reader) KeyOption {
+	return func(o *keyOptions) { o.rand = r }
+}
+
+// WithDuplication allows a child key created with GenRSAChildKey to be copied to another parent,
+// possibly in another TPM, with DuplicateKey. The key gets a policy that allows TPM2_Duplicate
+// with the key's password, while the password alone still authorizes everything else.
+// tpm2.FlagFixedTPM and tpm2.FlagFixedParent need to be clear. Use it only for keys that need to
+// be backed up or migrated, anyone with the password can export a duplicable key.
+func WithDuplication() KeyOption {
+	return func(o *keyOptions) { o.duplicable = true }
+}
+
+// GenRSAPrimaryKey generates a primary RSA key and makes it persistent under the given handle. With
+// tpm2.FlagRestricted and tpm2.FlagDecrypt set, the key is a storage key that can be used as parent.
+// It's safe to call again after an interrupted attempt. Orphaned transient copies of the key are
+// flushed, and it's not an error if the same key is already persisted under the handle.
+//
+// parentPW authorizes the owner hierarchy, both to create the key and to make it persistent,
+// ownerPW is the password of the new key. Unless tpm2.FlagNoDA is set, failed authorizations
+// with the key count towards the TPM's dictionary attack lockout, which blocks all DA-protected
+// keys once triggered. Setting it avoids being locked out by repeated failures in automated use,
+// at the cost of allowing unlimited attempts to guess the key password. It should only be set
+// for keys with strong or no passwords.
+func GenRSAPrimaryKey(dev io.ReadWriteCloser, handle tpmutil.Handle, parentPW, ownerPW string, attr tpm2.KeyProp, opts ...KeyOption) (crypto.PublicKey, error) {
+	return GenRSAPrimaryKeyInHierarchy(dev, tpm2.HandleOwner, handle, parentPW, ownerPW, attr, opts...)
+}
+
+// GenRSAPrimaryKeyInHierarchy generates a primary RSA key like GenRSAPrimaryKey, but in the given
+// hierarchy, tpm2.HandleOwner, tpm2.HandleEndorsement or tpm2.HandlePlatform. Keys that need to be
+// certified against the EK, like attestation keys, belong in the endorsement hierarchy. parentPW
+// authorizes the hierarchy. Keys in the endorsement hierarchy are made persistent with the owner
+// authorization, so parentPW needs to be valid for the owner hierarchy too. Keys in the platform
+// hierarchy need a handle in the platform range 0x81800000-0x81ffffff. The null hierarchy isn't
+// supported since its keys can't be made persistent.
+func GenRSAPrimaryKeyInHierarchy(dev io.ReadWriteCloser, hierarchy, handle tpmutil.Handle, parentPW, ownerPW string, attr tpm2.KeyProp, opts ...KeyOption) (crypto.PublicKey, error) {
+	o := keyOptions{keyBits: 2048}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.keyBits != 2048 {
+		if err := checkRSAKeyBits(dev, o.keyBits); err != nil {
+			return nil, err
+		}
+	}
+	if o.duplicable {
+		return nil, errors.New("only child keys can be duplicated")
+	}
+
 	// Define the TPM key template
 	pub := tpm2.Public{
 		Type:       tpm2.AlgRSA,
@@ -26,25 +135,244 @@ func GenRSAPrimaryKey(dev io.ReadWriteCloser, handle tpmutil.Handle, parentPW, o
 				Alg:  tpm2.AlgNull,
 				Hash: tpm2.AlgNull,
 			},
+			KeyBits: uint16(o.keyBits),
+			Modulus: big.NewInt(0),
+		},
+	}
+
+	if len(o.unique) > o.keyBits/8 {
+		return nil, fmt.Errorf("unique value of %d bytes is longer than the modulus of a %d-bit key", len(o.unique), o.keyBits)
+	}
+	if len(o.unique) > 0 {
+		pub.RSAParameters.Modulus = nil
+		pub.RSAParameters.ModulusRaw = o.unique
+	}
+	if o.signOnly {
+		pub.AuthPolicy = signOnlyPolicy()
+		pub.Attributes &^= tpm2.FlagUserWithAuth
+	}
+	if o.policy != nil {
+		pub.AuthPolicy = o.policy
+		pub.Attributes &^= tpm2.FlagUserWithAuth
+		pub.Attributes |= tpm2.FlagAdminWithPolicy
+	}
+
+	// Storage keys (restricted decryption keys) require a symmetric algorithm to protect their children
+	if isStorageKey(attr) {
+		pub.RSAParameters.Symmetric = &tpm2.SymScheme{Alg: tpm2.AlgAES, KeyBits: 128, Mode: tpm2.AlgCFB}
+	}
+	return genPrimaryKey(dev, hierarchy, handle, parentPW, ownerPW, pub, o)
+}
+
+// AKAttributes are the attributes of Attestation Keys created with GenAK.
+const AKAttributes = tpm2.FlagRestricted | tpm2.FlagSign | tpm2.FlagFixedTPM | tpm2.FlagFixedParent | tpm2.FlagSensitiveDataOrigin | tpm2.FlagUserWithAuth
+
+// GenAK generates an RSA Attestation Key (AK) in the owner hierarchy and makes it persistent under
+// the given handle. It's a restricted signing key with the RSASSA-SHA256 scheme, which the TPM
+// only uses to sign structures it generated itself, like quotes with Quote or certifications of
+// other keys. Like GenRSAPrimaryKey, it's safe to call again after an interrupted attempt.
+// parentPW authorizes the owner hierarchy, keyPW is the password of the new key.
+func GenAK(dev io.ReadWriteCloser, handle tpmutil.Handle, parentPW, keyPW string) (crypto.PublicKey, error) {
+	pub := tpm2.Public{
+		Type:       tpm2.AlgRSA,
+		NameAlg:    tpm2.AlgSHA256,
+		Attributes: AKAttributes,
+		RSAParameters: &tpm2.RSAParams{
+			Sign: &tpm2.SigScheme{
+				Alg:  tpm2.AlgRSASSA,
+				Hash: tpm2.AlgSHA256,
+			},
 			KeyBits: uint16(2048),
 			Modulus: big.NewInt(0),
 		},
 	}
+	return genPrimaryKey(dev, tpm2.HandleOwner, handle, parentPW, keyPW, pub, keyOptions{})
+}
+
+// Hash algorithms matching the strength of the curves, used for the signature scheme of
+// restricted ECC signing keys
+var curveToHash = map[tpm2.EllipticCurve]tpm2.Algorithm{
+	tpm2.CurveNISTP256: tpm2.AlgSHA256,
+	tpm2.CurveNISTP384: tpm2.AlgSHA384,
+	tpm2.CurveNISTP521: tpm2.AlgSHA512,
+}
+
+// GenECPrimaryKey generates a primary ECC key on the given curve, typically tpm2.CurveNISTP256 or
+// tpm2.CurveNISTP384, and makes it persistent under the given handle. It behaves like
+// GenRSAPrimaryKey and returns an *ecdsa.PublicKey. Unrestricted signing keys can sign with any
+// hash, restricted ones are limited to ECDSA with the hash matching the curve. ECPrivateKey can't
+// satisfy policies, so WithSignOnlyPolicy and WithPolicy are not supported.
+func GenECPrimaryKey(dev io.ReadWriteCloser, handle tpmutil.Handle, parentPW, ownerPW string, attr tpm2.KeyProp, curve tpm2.EllipticCurve, opts ...KeyOption) (crypto.PublicKey, error) {
+	var o keyOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.signOnly || o.policy != nil {
+		return nil, errors.New("policies are not supported for ECC keys")
+	}
+	if o.keyBits != 0 {
+		return nil, errors.New("the key size of ECC keys is defined by the curve")
+	}
+
+	// Define the TPM key template
+	pub := tpm2.Public{
+		Type:       tpm2.AlgECC,
+		NameAlg:    tpm2.AlgSHA256,
+		Attributes: attr,
+		ECCParameters: &tpm2.ECCParams{
+			Sign: &tpm2.SigScheme{
+				Alg:  tpm2.AlgNull,
+				Hash: tpm2.AlgNull,
+			},
+			CurveID: curve,
+			Point:   tpm2.ECPoint{X: big.NewInt(0), Y: big.NewInt(0)},
+		},
+	}
+	if len(o.unique) > 0 {
+		pub.ECCParameters.Point.X = new(big.Int).SetBytes(o.unique)
+	}
+	switch {
+	case isStorageKey(attr):
+		pub.ECCParameters.Symmetric = &tpm2.SymScheme{Alg: tpm2.AlgAES, KeyBits: 128, Mode: tpm2.AlgCFB}
+	case attr&(tpm2.FlagRestricted|tpm2.FlagSign) == tpm2.FlagRestricted|tpm2.FlagSign:
+		hash, ok := curveToHash[curve]
+		if !ok {
+			return nil, fmt.Errorf("unsupported curve 0x%x for restricted signing keys", curve)
+		}
+		pub.ECCParameters.Sign = &tpm2.SigScheme{Alg: tpm2.AlgECDSA, Hash: hash}
+	}
+	return genPrimaryKey(dev, tpm2.HandleOwner, handle, parentPW, ownerPW, pub, o)
+}
+
+// checkRSAKeyBits asks the TPM with TPM2_TestParms whether it supports RSA keys of the size.
+func checkRSAKeyBits(dev io.ReadWriter, bits int) error {
+	if bits <= 0 || bits > math.MaxUint16 {
+		return fmt.Errorf("invalid RSA key size %d", bits)
+	}
+	// TPMT_PUBLIC_PARMS for RSA without symmetric algorithm or scheme, and the default exponent
+	_, err := runCommand(dev, tpm2.TagNoSessions, cmdTestParms, tpm2.AlgRSA, tpm2.AlgNull, tpm2.AlgNull, uint16(bits), uint32(0))
+	if _, ok := err.(tpm2.ParameterError); ok {
+		return fmt.Errorf("TPM doesn't support %d-bit RSA keys", bits)
+	}
+	return err
+}
+
+// isStorageKey returns true if the attributes are those of a restricted decryption key.
+func isStorageKey(attr tpm2.KeyProp) bool {
+	return attr&(tpm2.FlagRestricted|tpm2.FlagDecrypt) == tpm2.FlagRestricted|tpm2.FlagDecrypt
+}
+
+// genPrimaryKey creates a primary key from the template and makes it persistent.
+func genPrimaryKey(dev io.ReadWriteCloser, hierarchy, handle tpmutil.Handle, parentPW, ownerPW string, pub tpm2.Public, o keyOptions) (crypto.PublicKey, error) {
+	// Platform keys are persisted with the platform authorization, all others with the owner's
+	var persistAuth tpmutil.Handle
+	switch hierarchy {
+	case tpm2.HandleOwner, tpm2.HandleEndorsement:
+		persistAuth = tpm2.HandleOwner
+	case tpm2.HandlePlatform:
+		persistAuth = tpm2.HandlePlatform
+	case tpm2.HandleNull:
+		return nil, errors.New("keys in the null hierarchy can't be made persistent")
+	default:
+		return nil, fmt.Errorf("invalid hierarchy 0x%x", hierarchy)
+	}
 
 	// Generate the Key
 	pcrSelection := tpm2.PCRSelection{}
-	signerHandle, pubKey, err := tpm2.CreatePrimary(dev, tpm2.HandleOwner, pcrSelection, parentPW, ownerPW, pub)
+	signerHandle, pubKey, err := tpm2.CreatePrimary(dev, hierarchy, pcrSelection, parentPW, ownerPW, pub)
 	if err != nil {
 		return nil, err
 	}
 	defer tpm2.FlushContext(dev, signerHandle)
 
+	// Primary keys are derived from the hierarchy seed, so an earlier, interrupted, attempt with the
+	// same template produced the same key. Flush any such orphaned objects and don't fail if
+	// the key was already made persistent.
+	_, name, _, err := tpm2.ReadPublic(dev, signerHandle)
+	if err != nil {
+		return nil, err
+	}
+	if err := flushMatchingTransients(dev, signerHandle, name); err != nil {
+		return nil, err
+	}
+	persisted, err := KeyList(dev)
+	if err != nil {
+		return nil, err
+	}
+	if containsHandle(persisted, handle) {
+		_, existing, _, err := tpm2.ReadPublic(dev, handle)
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(name, existing) {
+			return nil, fmt.Errorf("handle 0x%x is already used by a different key", handle)
+		}
+		if o.selfTest {
+			return pubKey, selfTest(dev, handle, ownerPW, o.rand)
+		}
+		return pubKey, nil
+	}
+
 	// Make the key persistent
-	return pubKey, tpm2.EvictControl(dev, ownerPW, tpm2.HandleOwner, signerHandle, handle)
+	if err := tpm2.EvictControl(dev, parentPW, persistAuth, signerHandle, handle); err != nil {
+		return nil, err
+	}
+	if o.selfTest {
+		if err := selfTest(dev, handle, ownerPW, o.rand); err != nil {
+			tpm2.EvictControl(dev, parentPW, persistAuth, handle, handle)
+			return nil, err
+		}
+	}
+	return pubKey, nil
+}
+
+// selfTest signs a random digest with a key and verifies the signature.
+func selfTest(dev io.ReadWriteCloser, handle tpmutil.Handle, password string, rand io.Reader) error {
+	key, err := NewPrivateKey(dev, handle, password)
+	if err != nil {
+		return err
+	}
+	digest := make([]byte, sha256.Size)
+	if _, err := io.ReadFull(randOrDefault(rand), digest); err != nil {
+		return err
+	}
+	sig, err := key.Sign(nil, digest, crypto.SHA256)
+	if err != nil {
+		return fmt.Errorf("key self-test failed: %v", err)
+	}
+	if err := verifyPKCS1OrECDSA(key.Public(), crypto.SHA256, digest, sig); err != nil {
+		return fmt.Errorf("key self-test failed: %v", err)
+	}
+	return nil
+}
+
+// flushMatchingTransients flushes all transient objects other than the given one that have the
+// same name, meaning they hold the same key.
+func flushMatchingTransients(dev io.ReadWriteCloser, keep tpmutil.Handle, name []byte) error {
+	transients, err := GetHandles(dev, tpm2.TPMProp(tpm2.HandleTypeTransient)<<24)
+	if err != nil {
+		return err
+	}
+	for _, h := range transients {
+		if h == keep {
+			continue
+		}
+		_, n, _, err := tpm2.ReadPublic(dev, h)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(name, n) {
+			continue
+		}
+		if err := tpm2.FlushContext(dev, h); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // LoadExternal loads an existing key-pair into the TPM and returns the key handle. The key is loaded
-/// into the Null hierarchy and not persistent.
+// into the Null hierarchy and not persistent.
 func LoadExternal(dev io.ReadWriteCloser, handle tpmutil.Handle, pk crypto.PrivateKey, password string, attr tpm2.KeyProp) (tpmutil.Handle, error) {
 	var (
 		tpm2Pub  tpm2.Public
@@ -98,11 +426,35 @@ func LoadExternal(dev io.ReadWriteCloser, handle tpmutil.Handle, pk crypto.Priva
 	return h, err
 }
 
-// DeleteKey removes a persistent key.
+// DeleteKey removes a persistent key, such as one made persistent with PersistKey.
 func DeleteKey(dev io.ReadWriteCloser, handle tpmutil.Handle, password string) error {
 	return tpm2.EvictControl(dev, password, tpm2.HandleOwner, handle, handle)
 }
 
+// PersistKey makes a transient key, for example one created with tpm2.CreatePrimary, persistent
+// at a handle in the range 0x81000000-0x817fffff. The transient key remains loaded and needs to
+// be flushed by the caller. If allowExisting is true, it's not an error if the handle already
+// holds the same key, which makes it safe to repeat after an interrupted run. A different key at
+// the handle is never replaced, it has to be removed with DeleteKey first.
+func PersistKey(dev io.ReadWriteCloser, transient, persistent tpmutil.Handle, ownerPW string, allowExisting bool) error {
+	err := tpm2.EvictControl(dev, ownerPW, tpm2.HandleOwner, transient, persistent)
+	if e, ok := err.(tpm2.Error); !ok || e.Code != tpm2.RCNVDefined || !allowExisting {
+		return err
+	}
+	_, name, _, err := tpm2.ReadPublic(dev, transient)
+	if err != nil {
+		return err
+	}
+	_, existing, _, err := tpm2.ReadPublic(dev, persistent)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(name, existing) {
+		return fmt.Errorf("handle 0x%x is already used by a different key", persistent)
+	}
+	return nil
+}
+
 // ReadPublicKey reads the public part of a key stored in the TPM. It returns the whole public part
 // as well as the public key from it
 func ReadPublicKey(dev io.ReadWriteCloser, handle tpmutil.Handle) (tpm2.Public, crypto.PublicKey, error) {
@@ -114,6 +466,21 @@ func ReadPublicKey(dev io.ReadWriteCloser, handle tpmutil.Handle) (tpm2.Public,
 	return pub, publicKey, err
 }
 
+// ReadPublicKeyPEM reads the public key of a key stored in the TPM and returns it as PKIX
+// SubjectPublicKeyInfo in a "PUBLIC KEY" PEM block, the format commonly expected by CAs and tools
+// like openssl. It supports RSA as well as ECC keys.
+func ReadPublicKeyPEM(dev io.ReadWriteCloser, handle tpmutil.Handle) ([]byte, error) {
+	_, pub, err := ReadPublicKey(dev, handle)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), nil
+}
+
 // KeyList returns a list of persistent key handles.
 func KeyList(dev io.ReadWriteCloser) ([]tpmutil.Handle, error) {
 	return GetHandles(dev, tpm2.PersistentFirst)
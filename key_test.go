@@ -1,6 +1,14 @@
 package tpmk
 
 import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"math/big"
 	"testing"
 
 	"github.com/google/go-tpm/tpmutil"
@@ -31,6 +39,121 @@ func TestPrimaryKeyGenerate(t *testing.T) {
 	require.Exactly(t, pub1, pub2)
 }
 
+func TestECPrimaryKeyGenerate(t *testing.T) {
+	const (
+		clientHandle = 0x81000000
+		serverHandle = 0x81000001
+		pw           = ""
+		attr         = tpm2.FlagSign | tpm2.FlagFixedTPM | tpm2.FlagUserWithAuth | tpm2.FlagFixedParent | tpm2.FlagSensitiveDataOrigin
+	)
+
+	tests := map[string]struct {
+		curve   tpm2.EllipticCurve
+		goCurve elliptic.Curve
+	}{
+		"P-256": {tpm2.CurveNISTP256, elliptic.P256()},
+		"P-384": {tpm2.CurveNISTP384, elliptic.P384()},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			dev, err := simulator.Get()
+			require.NoError(t, err)
+			defer dev.Close()
+
+			pub1, err := GenECPrimaryKey(dev, clientHandle, pw, pw, attr, test.curve, WithSelfTest())
+			require.NoError(t, err)
+			require.Equal(t, test.goCurve, pub1.(*ecdsa.PublicKey).Curve)
+			_, pub2, err := ReadPublicKey(dev, clientHandle)
+			require.NoError(t, err)
+			require.Exactly(t, pub1, pub2)
+
+			// Use the keys as client and server certificates in a TLS connection
+			_, err = GenECPrimaryKey(dev, serverHandle, pw, pw, attr, test.curve)
+			require.NoError(t, err)
+			clientPriv, err := NewECPrivateKey(dev, clientHandle, pw)
+			require.NoError(t, err)
+			serverPriv, err := NewECPrivateKey(dev, serverHandle, pw)
+			require.NoError(t, err)
+			testMutualTLS(t, clientPriv, serverPriv)
+		})
+	}
+}
+
+func TestECPrimaryKeyScheme(t *testing.T) {
+	dev, err := simulator.Get()
+	require.NoError(t, err)
+	defer dev.Close()
+
+	const (
+		handle tpmutil.Handle = 0x81000000
+		pw                    = ""
+	)
+
+	// Restricted signing keys get the scheme matching the curve, others can sign with any (nil)
+	tests := map[string]struct {
+		attr   tpm2.KeyProp
+		curve  tpm2.EllipticCurve
+		scheme *tpm2.SigScheme
+	}{
+		"unrestricted":     {tpm2.FlagSign | tpm2.FlagUserWithAuth | tpm2.FlagSensitiveDataOrigin, tpm2.CurveNISTP384, nil},
+		"restricted P-256": {tpm2.FlagSign | tpm2.FlagRestricted | tpm2.FlagUserWithAuth | tpm2.FlagSensitiveDataOrigin, tpm2.CurveNISTP256, &tpm2.SigScheme{Alg: tpm2.AlgECDSA, Hash: tpm2.AlgSHA256}},
+		"restricted P-384": {tpm2.FlagSign | tpm2.FlagRestricted | tpm2.FlagUserWithAuth | tpm2.FlagSensitiveDataOrigin, tpm2.CurveNISTP384, &tpm2.SigScheme{Alg: tpm2.AlgECDSA, Hash: tpm2.AlgSHA384}},
+		"storage key":      {tpm2.FlagStorageDefault, tpm2.CurveNISTP256, nil},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := GenECPrimaryKey(dev, handle, pw, pw, test.attr, test.curve)
+			require.NoError(t, err)
+			defer DeleteKey(dev, handle, pw)
+			pub, _, err := ReadPublicKey(dev, handle)
+			require.NoError(t, err)
+			require.Equal(t, test.scheme, pub.ECCParameters.Sign)
+		})
+	}
+
+	// Policies are rejected since ECPrivateKey can't satisfy them
+	_, err = GenECPrimaryKey(dev, handle, pw, pw, tpm2.FlagSign|tpm2.FlagSensitiveDataOrigin, tpm2.CurveNISTP256, WithSignOnlyPolicy())
+	require.Error(t, err)
+}
+
+func TestReadPublicKeyPEM(t *testing.T) {
+	dev, err := simulator.Get()
+	require.NoError(t, err)
+	defer dev.Close()
+
+	const (
+		rsaHandle = 0x81000000
+		ecHandle  = 0x81000001
+		pw        = ""
+		attr      = tpm2.FlagSign | tpm2.FlagFixedTPM | tpm2.FlagUserWithAuth | tpm2.FlagFixedParent | tpm2.FlagSensitiveDataOrigin
+	)
+	rsaPub, err := GenRSAPrimaryKey(dev, rsaHandle, pw, pw, attr)
+	require.NoError(t, err)
+	ecPub, err := GenECPrimaryKey(dev, ecHandle, pw, pw, attr, tpm2.CurveNISTP256)
+	require.NoError(t, err)
+
+	tests := map[string]struct {
+		handle tpmutil.Handle
+		pub    crypto.PublicKey
+	}{
+		"RSA": {rsaHandle, rsaPub},
+		"EC":  {ecHandle, ecPub},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			b, err := ReadPublicKeyPEM(dev, test.handle)
+			require.NoError(t, err)
+			blk, rest := pem.Decode(b)
+			require.NotNil(t, blk)
+			require.Empty(t, rest)
+			require.Equal(t, "PUBLIC KEY", blk.Type)
+			pub, err := x509.ParsePKIXPublicKey(blk.Bytes)
+			require.NoError(t, err)
+			require.Equal(t, test.pub, pub)
+		})
+	}
+}
+
 func TestKeyDelete(t *testing.T) {
 	dev, err := simulator.Get()
 	require.NoError(t, err)
@@ -57,6 +180,325 @@ func TestKeyDelete(t *testing.T) {
 	require.NotContains(t, handles, handle)
 }
 
+func TestPersistKey(t *testing.T) {
+	dev, err := simulator.Get()
+	require.NoError(t, err)
+	defer dev.Close()
+
+	const (
+		handle tpmutil.Handle = 0x81000000
+		pw                    = ""
+	)
+
+	// Two different transient keys
+	var transient []tpmutil.Handle
+	for _, attr := range []tpm2.KeyProp{tpm2.FlagSign | tpm2.FlagUserWithAuth | tpm2.FlagSensitiveDataOrigin, tpm2.FlagSign | tpm2.FlagUserWithAuth | tpm2.FlagSensitiveDataOrigin | tpm2.FlagNoDA} {
+		h, _, err := tpm2.CreatePrimary(dev, tpm2.HandleOwner, tpm2.PCRSelection{}, pw, pw, tpm2.Public{
+			Type:       tpm2.AlgRSA,
+			NameAlg:    tpm2.AlgSHA256,
+			Attributes: attr,
+			RSAParameters: &tpm2.RSAParams{
+				Symmetric: &tpm2.SymScheme{Alg: tpm2.AlgNull},
+				KeyBits:   2048,
+				Modulus:   big.NewInt(0),
+			},
+		})
+		require.NoError(t, err)
+		defer tpm2.FlushContext(dev, h)
+		transient = append(transient, h)
+	}
+
+	require.NoError(t, PersistKey(dev, transient[0], handle, pw, false))
+	defer DeleteKey(dev, handle, pw)
+	handles, err := KeyList(dev)
+	require.NoError(t, err)
+	require.Equal(t, []tpmutil.Handle{handle}, handles)
+
+	// Persisting the same key again only succeeds if it's allowed
+	require.Equal(t, tpm2.Error{Code: tpm2.RCNVDefined}, PersistKey(dev, transient[0], handle, pw, false))
+	require.NoError(t, PersistKey(dev, transient[0], handle, pw, true))
+
+	// A different key is never replaced
+	require.EqualError(t, PersistKey(dev, transient[1], handle, pw, true), "handle 0x81000000 is already used by a different key")
+}
+
+func TestPrimaryKeyGenerateRetry(t *testing.T) {
+	dev, err := simulator.Get()
+	require.NoError(t, err)
+	defer dev.Close()
+
+	const (
+		handle tpmutil.Handle = 0x81000000
+		pw                    = ""
+		attr                  = tpm2.FlagSign | tpm2.FlagFixedTPM | tpm2.FlagUserWithAuth | tpm2.FlagFixedParent | tpm2.FlagSensitiveDataOrigin
+	)
+
+	// Simulate an interrupted attempt by creating the key without flushing or persisting it
+	_, pub, err := tpm2.CreatePrimary(dev, tpm2.HandleOwner, tpm2.PCRSelection{}, pw, pw, tpm2.Public{
+		Type:       tpm2.AlgRSA,
+		NameAlg:    tpm2.AlgSHA256,
+		Attributes: attr,
+		RSAParameters: &tpm2.RSAParams{
+			Sign:    &tpm2.SigScheme{Alg: tpm2.AlgNull, Hash: tpm2.AlgNull},
+			KeyBits: 2048,
+			Modulus: big.NewInt(0),
+		},
+	})
+	require.NoError(t, err)
+
+	// Re-run, the orphan should be gone and the key persisted
+	pub1, err := GenRSAPrimaryKey(dev, handle, pw, pw, attr)
+	require.NoError(t, err)
+	require.Equal(t, pub, pub1)
+	transients, err := GetHandles(dev, tpm2.TPMProp(tpm2.HandleTypeTransient)<<24)
+	require.NoError(t, err)
+	require.Empty(t, transients)
+
+	// Running it again after the key was persisted is not an error
+	pub2, err := GenRSAPrimaryKey(dev, handle, pw, pw, attr)
+	require.NoError(t, err)
+	require.Equal(t, pub1, pub2)
+	handles, err := KeyList(dev)
+	require.NoError(t, err)
+	require.Equal(t, []tpmutil.Handle{handle}, handles)
+
+	// Generating a different key under the same handle fails
+	_, err = GenRSAPrimaryKey(dev, handle, pw, pw, attr|tpm2.FlagNoDA)
+	require.Error(t, err)
+}
+
+// errReader fails every read.
+type errReader struct{}
+
+func (errReader) Read([]byte) (int, error) { return 0, errors.New("no randomness") }
+
+func TestPrimaryKeySelfTest(t *testing.T) {
+	dev, err := simulator.Get()
+	require.NoError(t, err)
+	defer dev.Close()
+
+	const (
+		handle tpmutil.Handle = 0x81000000
+		pw                    = ""
+		attr                  = tpm2.FlagFixedTPM | tpm2.FlagUserWithAuth | tpm2.FlagFixedParent | tpm2.FlagSensitiveDataOrigin
+	)
+
+	// Without FlagSign the self-test fails and no key should be left behind
+	_, err = GenRSAPrimaryKey(dev, handle, pw, pw, attr|tpm2.FlagDecrypt, WithSelfTest())
+	require.Error(t, err)
+	handles, err := KeyList(dev)
+	require.NoError(t, err)
+	require.Empty(t, handles)
+
+	// The digest comes from the given source of randomness
+	_, err = GenRSAPrimaryKey(dev, handle, pw, pw, attr|tpm2.FlagSign, WithSelfTest(), WithRand(errReader{}))
+	require.EqualError(t, err, "no randomness")
+	handles, err = KeyList(dev)
+	require.NoError(t, err)
+	require.Empty(t, handles)
+
+	// A signing key passes
+	_, err = GenRSAPrimaryKey(dev, handle, pw, pw, attr|tpm2.FlagSign, WithSelfTest(), WithRand(RandReader(dev)))
+	require.NoError(t, err)
+	handles, err = KeyList(dev)
+	require.NoError(t, err)
+	require.Equal(t, []tpmutil.Handle{handle}, handles)
+}
+
+func TestPrimaryKeyNoDA(t *testing.T) {
+	dev, err := simulator.Get()
+	require.NoError(t, err)
+	defer dev.Close()
+
+	const (
+		noDAHandle tpmutil.Handle = 0x81000000
+		daHandle   tpmutil.Handle = 0x81000001
+		pw                        = "secret"
+		attr                      = tpm2.FlagSign | tpm2.FlagFixedTPM | tpm2.FlagUserWithAuth | tpm2.FlagFixedParent | tpm2.FlagSensitiveDataOrigin
+	)
+
+	_, err = GenRSAPrimaryKey(dev, noDAHandle, "", pw, attr|tpm2.FlagNoDA)
+	require.NoError(t, err)
+	_, err = GenRSAPrimaryKey(dev, daHandle, "", pw, attr)
+	require.NoError(t, err)
+
+	// Try the wrong password repeatedly on both keys
+	digest := make([]byte, 32)
+	sign := func(handle tpmutil.Handle, password string) error {
+		key, err := NewRSAPrivateKey(dev, handle, password)
+		require.NoError(t, err)
+		_, err = key.Sign(nil, digest, crypto.SHA256)
+		return err
+	}
+	for i := 0; i < 10; i++ {
+		require.Error(t, sign(noDAHandle, "wrong"))
+		require.Error(t, sign(daHandle, "wrong"))
+	}
+
+	// The key with noDA can still be used, the other one is locked out
+	require.NoError(t, sign(noDAHandle, pw))
+	err = sign(daHandle, pw)
+	require.Error(t, err)
+	require.Equal(t, tpm2.Warning{Code: tpm2.RCLockout}, err)
+}
+
+func TestPrimaryKeyOwnerPassword(t *testing.T) {
+	dev, err := simulator.Get()
+	require.NoError(t, err)
+	defer dev.Close()
+
+	const (
+		handle  tpmutil.Handle = 0x81000000
+		ownerPW                = "owner-password"
+		keyPW                  = "key-password"
+		attr                   = tpm2.FlagSign | tpm2.FlagFixedTPM | tpm2.FlagUserWithAuth | tpm2.FlagFixedParent | tpm2.FlagSensitiveDataOrigin
+	)
+
+	// Give the owner hierarchy a password that differs from the key's
+	cmd, err := encodeCommand([]interface{}{tpm2.HandleOwner}, []tpm2.AuthCommand{passwordAuth("")}, []byte(ownerPW))
+	require.NoError(t, err)
+	_, err = runCommand(dev, tpm2.TagSessions, cmdHierarchyChangeAuth, cmd)
+	require.NoError(t, err)
+
+	// Creating and persisting the key is authorized with the owner password, using the key
+	// requires the key password
+	_, err = GenRSAPrimaryKey(dev, handle, ownerPW, keyPW, attr)
+	require.NoError(t, err)
+	key, err := NewRSAPrivateKey(dev, handle, keyPW)
+	require.NoError(t, err)
+	_, err = key.Sign(nil, make([]byte, 32), crypto.SHA256)
+	require.NoError(t, err)
+	require.NoError(t, DeleteKey(dev, handle, ownerPW))
+
+	// The key password doesn't authorize the owner hierarchy
+	_, err = GenRSAPrimaryKey(dev, handle, keyPW, keyPW, attr)
+	require.Error(t, err)
+}
+
+func TestPrimaryKeySignOnlyPolicy(t *testing.T) {
+	dev, err := simulator.Get()
+	require.NoError(t, err)
+	defer dev.Close()
+
+	const (
+		handle tpmutil.Handle = 0x81000000
+		pw                    = "secret"
+		attr                  = tpm2.FlagSign | tpm2.FlagFixedTPM | tpm2.FlagUserWithAuth | tpm2.FlagFixedParent | tpm2.FlagSensitiveDataOrigin
+	)
+
+	// The policy calculated in software matches a trial session
+	trial, err := startPolicySession(dev, tpm2.SessionTrial)
+	require.NoError(t, err)
+	require.NoError(t, policyCommandCode(dev, trial, cmdSign))
+	require.NoError(t, tpm2.PolicyPassword(dev, trial))
+	digest, err := tpm2.PolicyGetDigest(dev, trial)
+	require.NoError(t, err)
+	require.NoError(t, tpm2.FlushContext(dev, trial))
+	require.Equal(t, digest, signOnlyPolicy())
+
+	_, err = GenRSAPrimaryKey(dev, handle, "", pw, attr, WithSignOnlyPolicy(), WithSelfTest())
+	require.NoError(t, err)
+
+	// Signing works with the right password only
+	key, err := NewRSAPrivateKey(dev, handle, pw)
+	require.NoError(t, err)
+	_, err = key.Sign(nil, make([]byte, 32), crypto.SHA256)
+	require.NoError(t, err)
+	wrong, err := NewRSAPrivateKey(dev, handle, "wrong")
+	require.NoError(t, err)
+	_, err = wrong.Sign(nil, make([]byte, 32), crypto.SHA256)
+	require.Error(t, err)
+
+	// Quote with the password is rejected since it requires a policy session
+	_, _, err = tpm2.Quote(dev, handle, pw, "", nil, tpm2.PCRSelection{}, tpm2.AlgNull)
+	require.Error(t, err)
+
+	// Quote with the satisfied policy is rejected because of the command code
+	session, err := startSignOnlySession(dev)
+	require.NoError(t, err)
+	defer tpm2.FlushContext(dev, session)
+	cmd, err := encodeCommand(
+		[]interface{}{handle},
+		[]tpm2.AuthCommand{{Session: session, Attributes: tpm2.AttrContinueSession, Auth: []byte(pw)}},
+		[]byte(nil), tpm2.AlgNull, uint32(0),
+	)
+	require.NoError(t, err)
+	_, err = runCommand(dev, tpm2.TagSessions, cmdQuote, cmd)
+	require.Equal(t, tpm2.SessionError{Code: tpm2.RCPolicyCC, Session: 1}, err)
+}
+
+func TestPrimaryKeyPolicy(t *testing.T) {
+	dev, err := simulator.Get()
+	require.NoError(t, err)
+	defer dev.Close()
+
+	const (
+		handle = 0x81000000
+		pcr    = 16
+		pw     = "password"
+		attr   = tpm2.FlagSign | tpm2.FlagFixedTPM | tpm2.FlagUserWithAuth | tpm2.FlagFixedParent | tpm2.FlagSensitiveDataOrigin
+	)
+
+	// Create a key that can only be used while a PCR has its current value
+	policy := PCRPolicy(tpm2.PCRSelection{Hash: tpm2.AlgSHA256, PCRs: []int{pcr}}, nil)
+	digest, err := PolicyDigest(dev, policy)
+	require.NoError(t, err)
+	_, err = GenRSAPrimaryKey(dev, handle, "", pw, attr, WithPolicy(digest))
+	require.NoError(t, err)
+	pub, _, err := ReadPublicKey(dev, handle)
+	require.NoError(t, err)
+	require.Equal(t, attr&^tpm2.FlagUserWithAuth|tpm2.FlagAdminWithPolicy, pub.Attributes)
+
+	// Signing with the password alone is rejected, by the key and by the TPM
+	key, err := NewRSAPrivateKey(dev, handle, pw)
+	require.NoError(t, err)
+	_, err = key.Sign(nil, make([]byte, 32), crypto.SHA256)
+	require.Error(t, err)
+	_, err = tpm2.Sign(dev, handle, pw, make([]byte, 32), &tpm2.SigScheme{Alg: tpm2.AlgRSASSA, Hash: tpm2.AlgSHA256})
+	require.Error(t, err)
+
+	// With the policy satisfied it succeeds, the password isn't part of the policy
+	key, err = NewRSAPrivateKey(dev, handle, "")
+	require.NoError(t, err)
+	key = key.WithPolicySession(policy)
+	_, err = key.Sign(nil, make([]byte, 32), crypto.SHA256)
+	require.NoError(t, err)
+
+	// But not once the PCR changed
+	require.NoError(t, tpm2.PCRExtend(dev, pcr, tpm2.AlgSHA256, make([]byte, 32), ""))
+	_, err = key.Sign(nil, make([]byte, 32), crypto.SHA256)
+	require.Error(t, err)
+}
+
+func TestPrimaryKeyUnique(t *testing.T) {
+	dev, err := simulator.Get()
+	require.NoError(t, err)
+	defer dev.Close()
+
+	const (
+		pw   = ""
+		attr = tpm2.FlagSign | tpm2.FlagFixedTPM | tpm2.FlagUserWithAuth | tpm2.FlagFixedParent | tpm2.FlagSensitiveDataOrigin
+	)
+
+	pubA, err := GenRSAPrimaryKey(dev, 0x81000000, pw, pw, attr, WithUnique([]byte("key-a")))
+	require.NoError(t, err)
+	pubB, err := GenRSAPrimaryKey(dev, 0x81000001, pw, pw, attr, WithUnique([]byte("key-b")))
+	require.NoError(t, err)
+	pubDefault, err := GenRSAPrimaryKey(dev, 0x81000002, pw, pw, attr)
+	require.NoError(t, err)
+	require.NotEqual(t, pubA, pubB)
+	require.NotEqual(t, pubA, pubDefault)
+
+	// The same unique value derives the same key again
+	pubA2, err := GenRSAPrimaryKey(dev, 0x81000003, pw, pw, attr, WithUnique([]byte("key-a")))
+	require.NoError(t, err)
+	require.Equal(t, pubA, pubA2)
+
+	// The value can't be longer than the modulus
+	_, err = GenRSAPrimaryKey(dev, 0x81000004, pw, pw, attr, WithUnique(make([]byte, 257)))
+	require.EqualError(t, err, "unique value of 257 bytes is longer than the modulus of a 2048-bit key")
+}
+
 // func TestRSAKeyImport(t *testing.T) {
 // 	dev, err := simulator.Get()
 // 	require.NoError(t, err)
@@ -74,3 +516,94 @@ func TestKeyDelete(t *testing.T) {
 // 	err = ImportKey(dev, handle, key, pw, attr)
 // 	require.NoError(t, err)
 // }
+
+func TestPrimaryKeyBits(t *testing.T) {
+	dev, err := simulator.Get()
+	require.NoError(t, err)
+	defer dev.Close()
+
+	const (
+		handle tpmutil.Handle = 0x81000000
+		pw                    = ""
+		attr                  = tpm2.FlagSign | tpm2.FlagUserWithAuth | tpm2.FlagSensitiveDataOrigin
+	)
+
+	// The simulator supports 1024 and 2048 bits
+	tests := map[string]struct {
+		opts []KeyOption
+		bits int
+	}{
+		"default":   {nil, 2048},
+		"2048 bits": {[]KeyOption{WithKeyBits(2048)}, 2048},
+		"1024 bits": {[]KeyOption{WithKeyBits(1024)}, 1024},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			pub, err := GenRSAPrimaryKey(dev, handle, pw, pw, attr, test.opts...)
+			require.NoError(t, err)
+			defer DeleteKey(dev, handle, pw)
+			require.Equal(t, test.bits, pub.(*rsa.PublicKey).N.BitLen())
+		})
+	}
+
+	// Larger keys are rejected before trying to generate them
+	_, err = GenRSAPrimaryKey(dev, handle, pw, pw, attr, WithKeyBits(3072))
+	require.EqualError(t, err, "TPM doesn't support 3072-bit RSA keys")
+	_, err = GenECPrimaryKey(dev, handle, pw, pw, attr, tpm2.CurveNISTP256, WithKeyBits(2048))
+	require.Error(t, err)
+}
+
+func TestPrimaryKeyInHierarchy(t *testing.T) {
+	dev, err := simulator.Get()
+	require.NoError(t, err)
+	defer dev.Close()
+
+	const (
+		pw   = ""
+		attr = tpm2.FlagSign | tpm2.FlagFixedTPM | tpm2.FlagFixedParent | tpm2.FlagSensitiveDataOrigin | tpm2.FlagUserWithAuth
+	)
+	tests := map[string]struct {
+		hierarchy tpmutil.Handle
+		handle    tpmutil.Handle
+	}{
+		"owner":       {tpm2.HandleOwner, 0x81000000},
+		"endorsement": {tpm2.HandleEndorsement, 0x81010001},
+		"platform":    {tpm2.HandlePlatform, 0x81800000},
+	}
+	keys := make(map[string]crypto.PublicKey)
+	for name, test := range tests {
+		pub, err := GenRSAPrimaryKeyInHierarchy(dev, test.hierarchy, test.handle, pw, pw, attr)
+		require.NoError(t, err, name)
+		keys[name] = pub
+
+		// The key is derived from the seed of the hierarchy, so creating it again there yields the same key
+		h, expected, err := tpm2.CreatePrimary(dev, test.hierarchy, tpm2.PCRSelection{}, pw, pw, tpm2.Public{
+			Type:       tpm2.AlgRSA,
+			NameAlg:    tpm2.AlgSHA256,
+			Attributes: attr,
+			RSAParameters: &tpm2.RSAParams{
+				Sign:    &tpm2.SigScheme{Alg: tpm2.AlgNull, Hash: tpm2.AlgNull},
+				KeyBits: 2048,
+				Modulus: big.NewInt(0),
+			},
+		})
+		require.NoError(t, err, name)
+		require.NoError(t, tpm2.FlushContext(dev, h))
+		require.Equal(t, expected, pub, name)
+
+		// The persisted key can sign
+		require.NoError(t, selfTest(dev, test.handle, pw, nil), name)
+	}
+	require.NotEqual(t, keys["owner"], keys["endorsement"])
+	require.NotEqual(t, keys["owner"], keys["platform"])
+
+	// The default is the owner hierarchy
+	pub, err := GenRSAPrimaryKey(dev, 0x81000002, pw, pw, attr)
+	require.NoError(t, err)
+	require.Equal(t, keys["owner"], pub)
+
+	_, err = GenRSAPrimaryKeyInHierarchy(dev, tpm2.HandleNull, 0x81000003, pw, pw, attr)
+	require.EqualError(t, err, "keys in the null hierarchy can't be made persistent")
+	_, err = GenRSAPrimaryKeyInHierarchy(dev, 0x81000000, 0x81000003, pw, pw, attr)
+	require.EqualError(t, err, "invalid hierarchy 0x81000000")
+}
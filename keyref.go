@@ -0,0 +1,73 @@
+package tpmk
+
+import (
+	"crypto"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/google/go-tpm/tpmutil"
+)
+
+// PEM block type of TPM key references
+const keyReferencePEMType = "TPM KEY REFERENCE"
+
+// keyReference is the ASN.1 structure of a key reference. Rather than key material, it holds the
+// handle of a persistent key in the TPM, and the public key expected at that handle.
+//
+//	TPMKeyReference ::= SEQUENCE {
+//	  version   INTEGER,     -- 0
+//	  handle    INTEGER,
+//	  publicKey OCTET STRING -- DER-encoded SubjectPublicKeyInfo
+//	}
+type keyReference struct {
+	Version   int
+	Handle    int64
+	PublicKey []byte
+}
+
+// MarshalKeyReference encodes a reference to a persistent key in the TPM in PEM format. It can be
+// stored in place of a private key file and loaded with LoadKeyReference. The public key is
+// included to ensure the handle still holds the same key when it's loaded.
+func MarshalKeyReference(handle tpmutil.Handle, pub crypto.PublicKey) ([]byte, error) {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return nil, err
+	}
+	b, err := asn1.Marshal(keyReference{Handle: int64(handle), PublicKey: der})
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: keyReferencePEMType, Bytes: b}), nil
+}
+
+// LoadKeyReference decodes a key reference produced by MarshalKeyReference and initializes the
+// referenced private key in the TPM. It fails if the key in the TPM doesn't match the reference.
+func LoadKeyReference(dev io.ReadWriteCloser, b []byte, password string) (RSAPrivateKey, error) {
+	blk, _ := pem.Decode(b)
+	if blk == nil || blk.Type != keyReferencePEMType {
+		return RSAPrivateKey{}, errors.New("failed to decode PEM block containing key reference")
+	}
+	var ref keyReference
+	rest, err := asn1.Unmarshal(blk.Bytes, &ref)
+	if err != nil {
+		return RSAPrivateKey{}, err
+	}
+	if len(rest) > 0 {
+		return RSAPrivateKey{}, errors.New("trailing data after key reference")
+	}
+	if ref.Version != 0 {
+		return RSAPrivateKey{}, fmt.Errorf("unsupported key reference version %d", ref.Version)
+	}
+	if ref.Handle < 0 || ref.Handle > 0xffffffff {
+		return RSAPrivateKey{}, fmt.Errorf("invalid handle %d", ref.Handle)
+	}
+	pub, err := x509.ParsePKIXPublicKey(ref.PublicKey)
+	if err != nil {
+		return RSAPrivateKey{}, err
+	}
+	return NewRSAPrivateKeyPinned(dev, tpmutil.Handle(ref.Handle), password, pub)
+}
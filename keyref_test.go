@@ -0,0 +1,52 @@
+package tpmk
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"testing"
+
+	"github.com/google/go-tpm-tools/simulator"
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpmutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeyReference(t *testing.T) {
+	dev, err := simulator.Get()
+	require.NoError(t, err)
+	defer dev.Close()
+
+	const (
+		handle tpmutil.Handle = 0x81000000
+		pw                    = ""
+		attr                  = tpm2.FlagSign | tpm2.FlagUserWithAuth | tpm2.FlagSensitiveDataOrigin
+	)
+
+	pub, err := GenRSAPrimaryKey(dev, handle, pw, pw, attr)
+	require.NoError(t, err)
+
+	ref, err := MarshalKeyReference(handle, pub)
+	require.NoError(t, err)
+	require.Contains(t, string(ref), "-----BEGIN TPM KEY REFERENCE-----")
+
+	// Load a signer from the reference and use it
+	priv, err := LoadKeyReference(dev, ref, pw)
+	require.NoError(t, err)
+	require.Equal(t, pub, priv.Public())
+	digest := sha256.Sum256([]byte("This is a test"))
+	sig, err := priv.Sign(nil, digest[:], crypto.SHA256)
+	require.NoError(t, err)
+	require.NoError(t, rsa.VerifyPKCS1v15(pub.(*rsa.PublicKey), crypto.SHA256, digest[:], sig))
+
+	// Replace the key at the handle, the reference should no longer load
+	require.NoError(t, DeleteKey(dev, handle, pw))
+	_, err = GenRSAPrimaryKey(dev, handle, pw, pw, attr|tpm2.FlagNoDA)
+	require.NoError(t, err)
+	_, err = LoadKeyReference(dev, ref, pw)
+	require.Error(t, err)
+
+	// Not a key reference
+	_, err = LoadKeyReference(dev, []byte("invalid"), pw)
+	require.Error(t, err)
+}
@@ -1,16 +1,43 @@
 package tpmk
 
 import (
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
+	"io/ioutil"
 
 	"github.com/google/go-tpm/tpm2"
 	"github.com/google/go-tpm/tpmutil"
 )
 
-// NVWrite reserves space in an NV index and writes to it starting at offset 0. It automatically
-// determines the max buffer size prior to writing blocks to the index.
+// NVWrite reserves space in an NV index in the owner hierarchy and writes to it starting at
+// offset 0. It automatically determines the max buffer size prior to writing blocks to the index.
+// The index is always defined with NVDefaultAttr, attr is ignored. Use NVDefine and tpm2.NVWrite
+// for indexes with other attributes.
 func NVWrite(dev io.ReadWriteCloser, index tpmutil.Handle, b []byte, password string, attr tpm2.NVAttr) error {
+	return nvWrite(dev, index, b, password, NVDefaultAttr, nil)
+}
+
+// NVWriteStream reads all data from r, reserves space for it in an NV index in the owner hierarchy
+// and writes it in blocks of the max buffer size. After every block, progress is called with the
+// number of bytes written so far and the total. The index is defined with the default attributes
+// ownerwrite|ownerread|authread|ppread.
+func NVWriteStream(dev io.ReadWriteCloser, index tpmutil.Handle, password string, r io.Reader, progress func(written, total int)) error {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	return nvWrite(dev, index, b, password, NVDefaultAttr, progress)
+}
+
+// NVDefaultAttr are the attributes used for NV indexes unless otherwise specified.
+const NVDefaultAttr = tpm2.AttrOwnerWrite | tpm2.AttrOwnerRead | tpm2.AttrAuthRead | tpm2.AttrPPRead
+
+// nvWrite defines an NV index and writes b into it, optionally reporting progress after each block.
+func nvWrite(dev io.ReadWriteCloser, index tpmutil.Handle, b []byte, password string, attr tpm2.NVAttr, progress func(written, total int)) error {
 	// Determine MAX_NV_BUFFER_SIZE from the TPM capabilities. Needed to batch writes to NV storage.
 	cap, _, err := tpm2.GetCapability(dev, tpm2.CapabilityTPMProperties, 1, uint32(tpm2.NVMaxBufferSize))
 	if err != nil {
@@ -26,15 +53,8 @@ func NVWrite(dev io.ReadWriteCloser, index tpmutil.Handle, b []byte, password st
 	maxBuffer := int(property.Value)
 
 	// Reserve the required space
-	if err := tpm2.NVDefineSpace(dev,
-		tpm2.HandleOwner,
-		index,
-		password,
-		password,
-		nil,
-		tpm2.AttrOwnerWrite|tpm2.AttrOwnerRead|tpm2.AttrAuthRead|tpm2.AttrPPRead,
-		uint16(len(b)),
-	); err != nil {
+	total := len(b)
+	if err := NVDefine(dev, tpm2.HandleOwner, password, index, password, attr, uint16(total)); err != nil {
 		return err
 	}
 
@@ -50,9 +70,116 @@ func NVWrite(dev io.ReadWriteCloser, index tpmutil.Handle, b []byte, password st
 		}
 		offset += uint16(length)
 		b = b[length:]
+		if progress != nil {
+			progress(int(offset), total)
+		}
 	}
 	return nil
+}
+
+// NVDefine reserves space in an NV index under the owner or platform hierarchy, authorized with
+// the hierarchy password. Indexes in the platform hierarchy are typically used for firmware-managed
+// data and can only be undefined with platform authorization. tpm2.AttrPlatformCreate is set
+// automatically for them.
+func NVDefine(dev io.ReadWriteCloser, hierarchy tpmutil.Handle, hierarchyPW string, index tpmutil.Handle, password string, attr tpm2.NVAttr, size uint16) error {
+	switch hierarchy {
+	case tpm2.HandleOwner:
+	case tpm2.HandlePlatform:
+		attr |= tpm2.AttrPlatformCreate
+	default:
+		return fmt.Errorf("unsupported NV hierarchy 0x%x", hierarchy)
+	}
+	return tpm2.NVDefineSpace(dev, hierarchy, index, hierarchyPW, password, nil, attr, size)
+}
+
+// NVUndefine deletes an NV index in the owner or platform hierarchy. It needs to be the same
+// hierarchy the index was defined in.
+func NVUndefine(dev io.ReadWriteCloser, hierarchy tpmutil.Handle, hierarchyPW string, index tpmutil.Handle) error {
+	return tpm2.NVUndefineSpace(dev, hierarchyPW, hierarchy, index)
+}
+
+// NVWriteLock prevents further writes to an NV index. The index needs to have tpm2.AttrWriteDefine
+// set, in which case the lock is permanent, or tpm2.AttrWriteSTClear to lock it until the next
+// TPM reset.
+func NVWriteLock(dev io.ReadWriteCloser, index tpmutil.Handle, password string) error {
+	cmd, err := encodeCommand(
+		[]interface{}{tpm2.HandleOwner, index},
+		[]tpm2.AuthCommand{passwordAuth(password)},
+	)
+	if err != nil {
+		return err
+	}
+	_, err = runCommand(dev, tpm2.TagSessions, cmdNVWriteLock, cmd)
+	return err
+}
+
+// TPM_NT field in the NV index attributes for monotonic counters and bit fields
+const (
+	nvCounter tpm2.NVAttr = 0x00000010
+	nvBits    tpm2.NVAttr = 0x00000020
+)
+
+// NVDefineCounter defines a monotonic 64-bit counter in an NV index and increments it once, which
+// is needed before it can be read. The counter starts at a value no lower than any other counter
+// in the TPM has ever reached. It can be incremented with the password, but never decremented.
+func NVDefineCounter(dev io.ReadWriteCloser, index tpmutil.Handle, password string) error {
+	if err := NVDefine(dev, tpm2.HandleOwner, password, index, password, nvCounter|tpm2.AttrOwnerRead|tpm2.AttrAuthRead|tpm2.AttrAuthWrite, 8); err != nil {
+		return err
+	}
+	return tpm2.NVIncrement(dev, index, password)
+}
+
+// NVIncrementCounter increments a counter defined with NVDefineCounter by one.
+func NVIncrementCounter(dev io.ReadWriteCloser, index tpmutil.Handle, password string) error {
+	return tpm2.NVIncrement(dev, index, password)
+}
+
+// NVReadCounter returns the value of a counter defined with NVDefineCounter.
+func NVReadCounter(dev io.ReadWriteCloser, index tpmutil.Handle, password string) (uint64, error) {
+	return nvReadUint64(dev, index, password)
+}
+
+// NVDefineBits defines a 64-bit bit field in an NV index and sets it to 0, which is needed before
+// it can be read. Bits can be set with NVSetBits and the password, but never cleared, which
+// makes them suitable for flags that must not be reverted, like a device having been
+// decommissioned.
+func NVDefineBits(dev io.ReadWriteCloser, index tpmutil.Handle, password string) error {
+	if err := NVDefine(dev, tpm2.HandleOwner, password, index, password, nvBits|tpm2.AttrOwnerRead|tpm2.AttrAuthRead|tpm2.AttrAuthWrite, 8); err != nil {
+		return err
+	}
+	return NVSetBits(dev, index, password, 0)
+}
+
+// NVSetBits sets the bits in a bit field defined with NVDefineBits. The new value is the old one
+// ORed with bits, bits that are already set remain set.
+func NVSetBits(dev io.ReadWriteCloser, index tpmutil.Handle, password string, bits uint64) error {
+	cmd, err := encodeCommand(
+		[]interface{}{index, index},
+		[]tpm2.AuthCommand{passwordAuth(password)},
+		bits,
+	)
+	if err != nil {
+		return err
+	}
+	_, err = runCommand(dev, tpm2.TagSessions, cmdNVSetBits, cmd)
+	return err
+}
 
+// NVReadBits returns the value of a bit field defined with NVDefineBits.
+func NVReadBits(dev io.ReadWriteCloser, index tpmutil.Handle, password string) (uint64, error) {
+	return nvReadUint64(dev, index, password)
+}
+
+// nvReadUint64 reads the big-endian 64-bit value of a counter or bit field.
+func nvReadUint64(dev io.ReadWriteCloser, index tpmutil.Handle, password string) (uint64, error) {
+	b, err := tpm2.NVReadEx(dev, index, tpm2.HandleOwner, password, 0)
+	if err != nil {
+		return 0, err
+	}
+	if len(b) != 8 {
+		return 0, fmt.Errorf("NV index 0x%x holds %d bytes, not the 8 of a counter or bit field", index, len(b))
+	}
+	return binary.BigEndian.Uint64(b), nil
 }
 
 // NVRead returns the raw data stored in an NV index.
@@ -60,9 +187,53 @@ func NVRead(dev io.ReadWriteCloser, index tpmutil.Handle, password string) ([]by
 	return tpm2.NVReadEx(dev, index, tpm2.HandleOwner, password, 0)
 }
 
+// nvReadDER reads a DER-encoded value from an NV index in the owner hierarchy, which is expected
+// to have no password, and removes any padding after it.
+func nvReadDER(dev io.ReadWriteCloser, index tpmutil.Handle) ([]byte, error) {
+	b, err := tpm2.NVReadEx(dev, index, tpm2.HandleOwner, "", 0)
+	if err != nil {
+		return nil, err
+	}
+	var v asn1.RawValue
+	rest, err := asn1.Unmarshal(b, &v)
+	if err != nil {
+		return nil, err
+	}
+	return b[:len(b)-len(rest)], nil
+}
+
+// StoreCertificate writes the DER-encoded certificate to an NV index in the owner hierarchy, to
+// keep it together with its key in the TPM. The index is defined with NVDefaultAttr and the size
+// of the certificate, authorized with the owner password, which also becomes the password of the
+// index. If the index already exists, it's replaced, so a renewed certificate can be stored in
+// the same place.
+func StoreCertificate(dev io.ReadWriteCloser, index tpmutil.Handle, ownerPW string, cert *x509.Certificate) error {
+	defined, err := NVList(dev)
+	if err != nil {
+		return err
+	}
+	if containsHandle(defined, index) {
+		if err := NVDelete(dev, index, ownerPW); err != nil {
+			return err
+		}
+	}
+	return NVWrite(dev, index, cert.Raw, ownerPW, NVDefaultAttr)
+}
+
+// LoadCertificate reads and parses a certificate from an NV index, such as one written with
+// StoreCertificate. The owner hierarchy is expected to have no password. Any padding after the
+// certificate is ignored.
+func LoadCertificate(dev io.ReadWriteCloser, index tpmutil.Handle) (*x509.Certificate, error) {
+	der, err := nvReadDER(dev, index)
+	if err != nil {
+		return nil, err
+	}
+	return x509.ParseCertificate(der)
+}
+
 // NVDelete undefines the space used by an NV index, effectively deleting the data in it.
 func NVDelete(dev io.ReadWriteCloser, index tpmutil.Handle, password string) error {
-	return tpm2.NVUndefineSpace(dev, password, tpm2.HandleOwner, index)
+	return NVUndefine(dev, tpm2.HandleOwner, password, index)
 }
 
 // NVList returns a list of handles for defined NV indexes.
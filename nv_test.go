@@ -1,7 +1,14 @@
 package tpmk
 
 import (
+	"bytes"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"sort"
 	"testing"
+	"time"
 
 	"github.com/google/go-tpm-tools/simulator"
 	"github.com/google/go-tpm/tpm2"
@@ -30,6 +37,46 @@ func TestNVWriteRead(t *testing.T) {
 	require.Exactly(t, data, out)
 }
 
+func TestNVWriteDefaultAttr(t *testing.T) {
+	dev, err := simulator.Get()
+	require.NoError(t, err)
+	defer dev.Close()
+
+	const index tpmutil.Handle = 0x1000000
+
+	// The attributes passed to NVWrite are ignored, indexes always get the default ones
+	err = NVWrite(dev, index, []byte("testdata"), "", tpm2.AttrOwnerWrite|tpm2.AttrOwnerRead|tpm2.AttrWriteDefine)
+	require.NoError(t, err)
+	public, err := tpm2.NVReadPublic(dev, index)
+	require.NoError(t, err)
+	require.Equal(t, NVDefaultAttr|tpm2.AttrWritten, tpm2.NVAttr(public.Attributes))
+}
+
+func TestNVWriteReadCertificate(t *testing.T) {
+	dev, err := simulator.Get()
+	require.NoError(t, err)
+	defer dev.Close()
+
+	const (
+		index tpmutil.Handle = 0x1000000
+		pw                   = ""
+	)
+
+	// Certificates are larger than the max NV buffer and written in several blocks
+	crt, err := LoadX509CertificateFile("testdata/ca.crt")
+	require.NoError(t, err)
+	require.True(t, len(crt.Raw) > 1024)
+
+	err = NVWrite(dev, index, crt.Raw, pw, NVDefaultAttr)
+	require.NoError(t, err)
+
+	out, err := NVRead(dev, index, pw)
+	require.NoError(t, err)
+	parsed, err := x509.ParseCertificate(out)
+	require.NoError(t, err)
+	require.True(t, crt.Equal(parsed))
+}
+
 func TestNVDelete(t *testing.T) {
 	dev, err := simulator.Get()
 	require.NoError(t, err)
@@ -56,3 +103,182 @@ func TestNVDelete(t *testing.T) {
 	require.NoError(t, err)
 	require.NotContains(t, indexes, index)
 }
+
+func TestNVDefineHierarchy(t *testing.T) {
+	dev, err := simulator.Get()
+	require.NoError(t, err)
+	defer dev.Close()
+
+	const (
+		pw   = ""
+		attr = tpm2.AttrAuthWrite | tpm2.AttrAuthRead
+	)
+
+	// The platform can remove indexes of the owner, but not the other way around
+	tests := map[string]struct {
+		index     tpmutil.Handle
+		hierarchy tpmutil.Handle
+		denied    []tpmutil.Handle
+	}{
+		"owner":    {0x1000000, tpm2.HandleOwner, nil},
+		"platform": {0x1000001, tpm2.HandlePlatform, []tpmutil.Handle{tpm2.HandleOwner}},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			err := NVDefine(dev, test.hierarchy, pw, test.index, pw, attr, 8)
+			require.NoError(t, err)
+
+			// Undefining with the wrong password or hierarchy should fail
+			err = NVUndefine(dev, test.hierarchy, "wrong", test.index)
+			require.Error(t, err)
+			for _, h := range test.denied {
+				err = NVUndefine(dev, h, pw, test.index)
+				require.Error(t, err)
+			}
+
+			err = NVUndefine(dev, test.hierarchy, pw, test.index)
+			require.NoError(t, err)
+
+			indexes, err := NVList(dev)
+			require.NoError(t, err)
+			require.NotContains(t, indexes, test.index)
+		})
+	}
+}
+
+func TestNVWriteStream(t *testing.T) {
+	dev, err := simulator.Get()
+	require.NoError(t, err)
+	defer dev.Close()
+
+	const (
+		index tpmutil.Handle = 0x1000000
+		pw                   = ""
+	)
+	data := make([]byte, 2000)
+	for i := range data {
+		data[i] = byte(i)
+	}
+
+	var calls []int
+	err = NVWriteStream(dev, index, pw, bytes.NewReader(data), func(written, total int) {
+		require.Equal(t, len(data), total)
+		calls = append(calls, written)
+	})
+	require.NoError(t, err)
+
+	// Expect several blocks to be written, ending with all of the data
+	require.True(t, len(calls) > 1)
+	require.True(t, sort.IntsAreSorted(calls))
+	require.Equal(t, len(data), calls[len(calls)-1])
+
+	out, err := NVRead(dev, index, pw)
+	require.NoError(t, err)
+	require.Exactly(t, data, out)
+}
+
+func TestStoreLoadCertificate(t *testing.T) {
+	dev, err := simulator.Get()
+	require.NoError(t, err)
+	defer dev.Close()
+
+	const (
+		index tpmutil.Handle = 0x1000000
+		pw                   = ""
+	)
+
+	// The CA certificate is larger than one NV buffer
+	ca, caKey, err := LoadKeyPair("testdata/ca.crt", "testdata/ca.key")
+	require.NoError(t, err)
+	require.NoError(t, StoreCertificate(dev, index, pw, ca))
+	loaded, err := LoadCertificate(dev, index)
+	require.NoError(t, err)
+	require.True(t, ca.Equal(loaded))
+
+	// Storing another certificate replaces it
+	template := x509.Certificate{
+		Subject:      pkix.Name{CommonName: "device"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().AddDate(0, 0, 1),
+		SerialNumber: big.NewInt(2),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, ca, ca.PublicKey, caKey)
+	require.NoError(t, err)
+	crt, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	require.NoError(t, StoreCertificate(dev, index, pw, crt))
+	loaded, err = LoadCertificate(dev, index)
+	require.NoError(t, err)
+	require.True(t, crt.Equal(loaded))
+
+	// Nothing stored
+	_, err = LoadCertificate(dev, 0x1000001)
+	require.Error(t, err)
+}
+
+func TestNVCounter(t *testing.T) {
+	dev, err := simulator.Get()
+	require.NoError(t, err)
+	defer dev.Close()
+
+	const (
+		index tpmutil.Handle = 0x1000000
+		pw                   = ""
+	)
+	require.NoError(t, NVDefineCounter(dev, index, pw))
+	start, err := NVReadCounter(dev, index, pw)
+	require.NoError(t, err)
+	for i := uint64(1); i <= 3; i++ {
+		require.NoError(t, NVIncrementCounter(dev, index, pw))
+		value, err := NVReadCounter(dev, index, pw)
+		require.NoError(t, err)
+		require.Equal(t, start+i, value)
+	}
+
+	// Counters can't be written directly
+	require.Error(t, tpm2.NVWrite(dev, tpm2.HandleOwner, index, pw, make([]byte, 8), 0))
+
+	// Ordinary indexes aren't counters
+	const data tpmutil.Handle = 0x1000001
+	require.NoError(t, NVWrite(dev, data, []byte("data"), pw, NVDefaultAttr))
+	require.Error(t, NVIncrementCounter(dev, data, pw))
+	_, err = NVReadCounter(dev, data, pw)
+	require.EqualError(t, err, "NV index 0x1000001 holds 4 bytes, not the 8 of a counter or bit field")
+}
+
+func TestNVBits(t *testing.T) {
+	dev, err := simulator.Get()
+	require.NoError(t, err)
+	defer dev.Close()
+
+	const (
+		index tpmutil.Handle = 0x1000000
+		pw                   = ""
+	)
+	require.NoError(t, NVDefineBits(dev, index, pw))
+	bits, err := NVReadBits(dev, index, pw)
+	require.NoError(t, err)
+	require.Zero(t, bits)
+
+	// Bits accumulate and can't be cleared
+	for _, test := range []struct{ set, expected uint64 }{
+		{0x1, 0x1},
+		{0x8000000000000000, 0x8000000000000001},
+		{0x0, 0x8000000000000001},
+		{0x1, 0x8000000000000001},
+		{0xf0, 0x80000000000000f1},
+	} {
+		require.NoError(t, NVSetBits(dev, index, pw, test.set))
+		bits, err := NVReadBits(dev, index, pw)
+		require.NoError(t, err)
+		require.Equal(t, test.expected, bits)
+	}
+
+	// The password is required
+	require.Error(t, NVSetBits(dev, index, "wrong", 0x2))
+
+	// Counters aren't bit fields
+	const counter tpmutil.Handle = 0x1000001
+	require.NoError(t, NVDefineCounter(dev, counter, ""))
+	require.Error(t, NVSetBits(dev, counter, "", 0x2))
+}
@@ -0,0 +1,37 @@
+package tpmk
+
+import (
+	"crypto"
+	"crypto/x509"
+	"fmt"
+	"math/big"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// OCSPResponse creates a DER-encoded OCSP response for the certificate with the given serial
+// number. It is signed directly by the CA that issued the certificate, which can be a key in the
+// TPM, so no separate responder certificate is needed. status is one of ocsp.Good, ocsp.Revoked
+// or ocsp.Unknown, revokedAt is only used for revoked certificates. Clients may cache the
+// response until nextUpdate.
+func OCSPResponse(ca crypto.Signer, caCert *x509.Certificate, serial *big.Int, status int, revokedAt, nextUpdate time.Time) ([]byte, error) {
+	switch status {
+	case ocsp.Good, ocsp.Unknown:
+		revokedAt = time.Time{}
+	case ocsp.Revoked:
+		if revokedAt.IsZero() {
+			return nil, fmt.Errorf("revoked certificate %s needs a revocation time", serial)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported OCSP status %d", status)
+	}
+	now := time.Now()
+	return ocsp.CreateResponse(caCert, caCert, ocsp.Response{
+		Status:       status,
+		SerialNumber: serial,
+		ThisUpdate:   now,
+		NextUpdate:   nextUpdate,
+		RevokedAt:    revokedAt,
+	}, ca)
+}
@@ -0,0 +1,46 @@
+package tpmk
+
+import (
+	"crypto/x509"
+	"testing"
+	"time"
+
+	"github.com/google/go-tpm-tools/simulator"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ocsp"
+)
+
+func TestOCSPResponse(t *testing.T) {
+	dev, err := simulator.Get()
+	require.NoError(t, err)
+	defer dev.Close()
+
+	ca, caCrt, requests := setupTPMCA(t, dev, 1)
+	certs, err := IssueCertificates(nil, ca, caCrt, requests)
+	require.NoError(t, err)
+	crt, err := x509.ParseCertificate(certs[0])
+	require.NoError(t, err)
+
+	revokedAt := time.Now().Add(-time.Hour).UTC().Truncate(time.Second)
+	nextUpdate := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	for _, status := range []int{ocsp.Good, ocsp.Revoked, ocsp.Unknown} {
+		der, err := OCSPResponse(ca, caCrt, crt.SerialNumber, status, revokedAt, nextUpdate)
+		require.NoError(t, err)
+
+		// Parsing verifies the signature against the CA
+		resp, err := ocsp.ParseResponseForCert(der, crt, caCrt)
+		require.NoError(t, err)
+		require.Equal(t, status, resp.Status)
+		require.Equal(t, crt.SerialNumber, resp.SerialNumber)
+		require.Equal(t, nextUpdate, resp.NextUpdate)
+		if status == ocsp.Revoked {
+			require.Equal(t, revokedAt, resp.RevokedAt)
+		}
+	}
+
+	// Revoked without a time and invalid statuses fail
+	_, err = OCSPResponse(ca, caCrt, crt.SerialNumber, ocsp.Revoked, time.Time{}, nextUpdate)
+	require.Error(t, err)
+	_, err = OCSPResponse(ca, caCrt, crt.SerialNumber, 5, revokedAt, nextUpdate)
+	require.Error(t, err)
+}
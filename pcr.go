@@ -0,0 +1,146 @@
+package tpmk
+
+import (
+	"crypto"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpmutil"
+)
+
+// TPM_CAP_PCR_PROPERTIES and TPM_PT_PCR_RESET_L0, used to find PCRs that can be reset. Not
+// supported by tpm2.GetCapability.
+const (
+	capabilityPCRProperties uint32 = 0x00000007
+	ptPCRResetL0            uint32 = 0x00000008
+)
+
+// ResetPCR resets a PCR to all zeros in all banks. Only some PCRs can be reset, 16 and 23 on
+// platforms that follow the PC Client profile. An error is returned if the PCR isn't resettable.
+func ResetPCR(dev io.ReadWriter, index int) error {
+	resettable, err := ResettablePCRs(dev)
+	if err != nil {
+		return err
+	}
+	if !containsInt(resettable, index) {
+		return fmt.Errorf("PCR %d can not be reset, resettable PCRs are %v", index, resettable)
+	}
+	cmd, err := encodeCommand(
+		[]interface{}{tpmutil.Handle(index)},
+		[]tpm2.AuthCommand{passwordAuth("")},
+	)
+	if err != nil {
+		return err
+	}
+	_, err = runCommand(dev, tpm2.TagSessions, cmdPCRReset, cmd)
+	return err
+}
+
+// ResettablePCRs returns the PCRs that can be reset from locality 0.
+func ResettablePCRs(dev io.ReadWriter) ([]int, error) {
+	resp, err := runCommand(dev, tpm2.TagNoSessions, cmdGetCap, capabilityPCRProperties, ptPCRResetL0, uint32(1))
+	if err != nil {
+		return nil, err
+	}
+	var (
+		more   byte
+		capRep uint32
+		count  uint32
+		tag    uint32
+	)
+	if _, err := tpmutil.Unpack(resp, &more, &capRep, &count, &tag); err != nil {
+		return nil, err
+	}
+	if capRep != capabilityPCRProperties || count != 1 || tag != ptPCRResetL0 {
+		return nil, fmt.Errorf("unexpected PCR property 0x%x", tag)
+	}
+	// The selection is a bitmap preceded by its size in a single byte
+	const offset = 1 + 4 + 4 + 4
+	if len(resp) <= offset || len(resp) < offset+1+int(resp[offset]) {
+		return nil, errors.New("invalid PCR selection")
+	}
+	selected := resp[offset+1 : offset+1+int(resp[offset])]
+	var pcrs []int
+	for i, b := range selected {
+		for bit := 0; bit < 8; bit++ {
+			if b&(1<<uint(bit)) != 0 {
+				pcrs = append(pcrs, i*8+bit)
+			}
+		}
+	}
+	return pcrs, nil
+}
+
+// ReadPCRs returns the values of the selected PCRs in one bank. The TPM may return fewer PCRs
+// than requested in a single command, typically at most 8, so it's repeated until all are read.
+func ReadPCRs(dev io.ReadWriter, sel tpm2.PCRSelection) (map[int][]byte, error) {
+	pcrs := make(map[int][]byte)
+	remaining := sel.PCRs
+	for len(remaining) > 0 {
+		vals, err := tpm2.ReadPCRs(dev, tpm2.PCRSelection{Hash: sel.Hash, PCRs: remaining})
+		if err != nil {
+			return nil, err
+		}
+		if len(vals) == 0 {
+			return nil, fmt.Errorf("unable to read PCRs %v", remaining)
+		}
+		var next []int
+		for _, pcr := range remaining {
+			if v, ok := vals[pcr]; ok {
+				pcrs[pcr] = v
+				continue
+			}
+			next = append(next, pcr)
+		}
+		remaining = next
+	}
+	return pcrs, nil
+}
+
+// ExtendPCR hashes data with the algorithm of the bank and extends the PCR with the digest,
+// recording a measurement of data. The new value is the hash of the old value and the digest.
+func ExtendPCR(dev io.ReadWriter, index int, hashAlg tpm2.Algorithm, data []byte) error {
+	newHash, err := hashAlg.HashConstructor()
+	if err != nil {
+		return err
+	}
+	h := newHash()
+	h.Write(data)
+	return tpm2.PCRExtend(dev, tpmutil.Handle(index), hashAlg, h.Sum(nil), "")
+}
+
+// PCRDigest returns the SHA256 digest over the values of the given PCRs, as used in quotes and PCR
+// policies. The values are hashed in ascending order of the PCR index. It can be used to seal data
+// to PCR values that are expected after an update.
+func PCRDigest(values map[int][]byte, pcrs []int) ([]byte, error) {
+	return pcrDigest(crypto.SHA256, values, pcrs)
+}
+
+// pcrDigest returns the digest over the values of the given PCRs with the hash function. Quotes
+// use the hash of the AK's signature scheme.
+func pcrDigest(hash crypto.Hash, values map[int][]byte, pcrs []int) ([]byte, error) {
+	selected := append([]int(nil), pcrs...)
+	sort.Ints(selected)
+	h := hash.New()
+	for _, pcr := range selected {
+		v, ok := values[pcr]
+		if !ok {
+			return nil, fmt.Errorf("value of PCR %d is missing", pcr)
+		}
+		h.Write(v)
+	}
+	return h.Sum(nil), nil
+}
+
+// containsInt returns true if v is in the list.
+func containsInt(list []int, v int) bool {
+	for _, i := range list {
+		if i == v {
+			return true
+		}
+	}
+	return false
+}
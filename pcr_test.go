@@ -0,0 +1,80 @@
+package tpmk
+
+import (
+	"crypto/sha256"
+	"testing"
+
+	"github.com/google/go-tpm-tools/simulator"
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpmutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResetPCR(t *testing.T) {
+	dev, err := simulator.Get()
+	require.NoError(t, err)
+	defer dev.Close()
+
+	resettable, err := ResettablePCRs(dev)
+	require.NoError(t, err)
+	require.Contains(t, resettable, 16)
+	require.Contains(t, resettable, 23)
+	require.NotContains(t, resettable, 0)
+
+	// Extend PCR 16, it should no longer be all zeros
+	zero := make([]byte, sha256.Size)
+	digest := sha256.Sum256([]byte("measurement"))
+	err = tpm2.PCRExtend(dev, tpmutil.Handle(16), tpm2.AlgSHA256, digest[:], "")
+	require.NoError(t, err)
+	value, err := tpm2.ReadPCR(dev, 16, tpm2.AlgSHA256)
+	require.NoError(t, err)
+	require.NotEqual(t, zero, value)
+
+	// Reset it and read it again
+	err = ResetPCR(dev, 16)
+	require.NoError(t, err)
+	value, err = tpm2.ReadPCR(dev, 16, tpm2.AlgSHA256)
+	require.NoError(t, err)
+	require.Equal(t, zero, value)
+
+	// PCR 0 isn't resettable
+	err = ResetPCR(dev, 0)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "PCR 0 can not be reset")
+}
+
+func TestReadExtendPCRs(t *testing.T) {
+	dev, err := simulator.Get()
+	require.NoError(t, err)
+	defer dev.Close()
+
+	// More PCRs than can be read with one command
+	sel := tpm2.PCRSelection{Hash: tpm2.AlgSHA256}
+	for i := 0; i < 24; i++ {
+		sel.PCRs = append(sel.PCRs, i)
+	}
+	before, err := ReadPCRs(dev, sel)
+	require.NoError(t, err)
+	require.Len(t, before, 24)
+
+	// Extending changes the value to H(old || H(data))
+	data := []byte("measurement")
+	require.NoError(t, ExtendPCR(dev, 16, tpm2.AlgSHA256, data))
+	after, err := ReadPCRs(dev, sel)
+	require.NoError(t, err)
+	digest := sha256.Sum256(data)
+	expected := sha256.Sum256(append(append([]byte(nil), before[16]...), digest[:]...))
+	require.Equal(t, expected[:], after[16])
+	for i := 0; i < 24; i++ {
+		if i != 16 {
+			require.Equal(t, before[i], after[i])
+		}
+	}
+
+	// The SHA1 bank is separate
+	sha1Values, err := ReadPCRs(dev, tpm2.PCRSelection{Hash: tpm2.AlgSHA1, PCRs: []int{16}})
+	require.NoError(t, err)
+	require.Len(t, sha1Values[16], 20)
+
+	require.Error(t, ExtendPCR(dev, 16, tpm2.AlgNull, data))
+}
@@ -10,15 +10,45 @@ import (
 	"io/ioutil"
 )
 
-// LoadKeyPair reads and parses a key and certificate file in PEM format.
+// LoadKeyPair reads and parses a key and certificate file in PEM format, see LoadKeyPairPEM.
 func LoadKeyPair(crtFilePEM, keyFilePEM string) (*x509.Certificate, crypto.PrivateKey, error) {
-	crt, err := LoadX509CertificateFile(crtFilePEM)
+	crtPEM, err := ioutil.ReadFile(crtFilePEM)
 	if err != nil {
 		return nil, nil, err
 	}
+	keyPEM, err := ioutil.ReadFile(keyFilePEM)
+	if err != nil {
+		return nil, nil, err
+	}
+	return LoadKeyPairPEM(crtPEM, keyPEM)
+}
 
-	key, err := LoadRSAKeyFile(keyFilePEM)
-	return crt, key, err
+// LoadKeyPairPEM parses a certificate and private key in PEM format. The key can be an RSA key in
+// PKCS#1 format, an EC key in SEC 1 format, or either in PKCS#8 format.
+func LoadKeyPairPEM(crtPEM, keyPEM []byte) (*x509.Certificate, crypto.PrivateKey, error) {
+	crt, err := PEMToCert(crtPEM)
+	if err != nil {
+		return nil, nil, err
+	}
+	blk, _ := pem.Decode(keyPEM)
+	if blk == nil {
+		return nil, nil, errors.New("failed to decode PEM block containing private key")
+	}
+	var key crypto.PrivateKey
+	switch blk.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(blk.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(blk.Bytes)
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(blk.Bytes)
+	default:
+		return nil, nil, fmt.Errorf("unsupported private key type %q", blk.Type)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return crt, key, nil
 }
 
 // LoadX509CertificateFile reads a certificate in PEM format from a file.
@@ -27,7 +57,12 @@ func LoadX509CertificateFile(crtFilePEM string) (*x509.Certificate, error) {
 	if err != nil {
 		return nil, err
 	}
-	crtBlk, _ := pem.Decode(crtRaw)
+	return PEMToCert(crtRaw)
+}
+
+// PEMToCert decodes a certificate in PEM format.
+func PEMToCert(b []byte) (*x509.Certificate, error) {
+	crtBlk, _ := pem.Decode(b)
 	if crtBlk == nil || crtBlk.Type != "CERTIFICATE" {
 		return nil, errors.New("failed to decode PEM block containing public key")
 	}
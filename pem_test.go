@@ -0,0 +1,65 @@
+package tpmk
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadKeyPairPEM(t *testing.T) {
+	crtPEM, err := ioutil.ReadFile("testdata/ca.crt")
+	require.NoError(t, err)
+	keyPEM, err := ioutil.ReadFile("testdata/ca.key")
+	require.NoError(t, err)
+
+	// Same as reading the files
+	crt, key, err := LoadKeyPairPEM(crtPEM, keyPEM)
+	require.NoError(t, err)
+	fileCrt, fileKey, err := LoadKeyPair("testdata/ca.crt", "testdata/ca.key")
+	require.NoError(t, err)
+	require.True(t, fileCrt.Equal(crt))
+	require.Equal(t, fileKey, key)
+
+	// Other key formats
+	rsaKey := key.(*rsa.PrivateKey)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	ecDER, err := x509.MarshalECPrivateKey(ecKey)
+	require.NoError(t, err)
+	pkcs8RSA, err := x509.MarshalPKCS8PrivateKey(rsaKey)
+	require.NoError(t, err)
+	pkcs8EC, err := x509.MarshalPKCS8PrivateKey(ecKey)
+	require.NoError(t, err)
+
+	tests := map[string]struct {
+		block *pem.Block
+		key   crypto.PrivateKey
+	}{
+		"EC":          {&pem.Block{Type: "EC PRIVATE KEY", Bytes: ecDER}, ecKey},
+		"PKCS#8 RSA":  {&pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8RSA}, rsaKey},
+		"PKCS#8 EC":   {&pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8EC}, ecKey},
+		"unsupported": {&pem.Block{Type: "OPENSSH PRIVATE KEY", Bytes: []byte("key")}, nil},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, key, err := LoadKeyPairPEM(crtPEM, pem.EncodeToMemory(test.block))
+			if test.key == nil {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, test.key, key)
+		})
+	}
+
+	_, _, err = LoadKeyPairPEM(keyPEM, keyPEM)
+	require.Error(t, err)
+}
@@ -0,0 +1,143 @@
+package tpmk
+
+import (
+	"crypto/sha256"
+	"io"
+
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpmutil"
+)
+
+// Operations used to compare NV index contents in PolicyNV (TPM_EO).
+const (
+	eoUnsignedGE uint16 = 0x0007
+)
+
+// startPolicySession starts a policy session, or a trial session which can be used to calculate
+// a policy digest without satisfying it. The caller needs to flush the returned handle.
+func startPolicySession(dev io.ReadWriter, typ tpm2.SessionType) (tpmutil.Handle, error) {
+	session, _, err := tpm2.StartAuthSession(dev,
+		tpm2.HandleNull,
+		tpm2.HandleNull,
+		make([]byte, 16),
+		nil,
+		typ,
+		tpm2.AlgNull,
+		tpm2.AlgSHA256,
+	)
+	return session, err
+}
+
+// policyNV extends a policy session with a comparison of operandB to the contents of an NV index
+// at the given offset. Reading the index is authorized with a password.
+func policyNV(dev io.ReadWriter, session, index tpmutil.Handle, password string, operandB []byte, offset, operation uint16) error {
+	cmd, err := encodeCommand(
+		[]interface{}{index, index, session},
+		[]tpm2.AuthCommand{passwordAuth(password)},
+		operandB, offset, operation,
+	)
+	if err != nil {
+		return err
+	}
+	_, err = runCommand(dev, tpm2.TagSessions, cmdPolicyNV, cmd)
+	return err
+}
+
+// policyCommandCode extends a policy session with the condition that the authorized command is
+// the given one.
+func policyCommandCode(dev io.ReadWriter, session tpmutil.Handle, code tpmutil.Command) error {
+	cmd, err := encodeCommand([]interface{}{session}, nil, code)
+	if err != nil {
+		return err
+	}
+	_, err = runCommand(dev, tpm2.TagNoSessions, cmdPolicyCommandCode, cmd)
+	return err
+}
+
+// signOnlyPolicy returns the digest of a policy that only allows TPM2_Sign, authorized with the
+// password of the key (PolicyCommandCode followed by PolicyPassword). It's calculated in software
+// following the policy digest updates in Part 3 of the specification, rather than with a trial
+// session, so keys can be recognized without additional TPM commands.
+func signOnlyPolicy() []byte {
+	return commandPolicy(cmdSign)
+}
+
+// commandPolicy returns the digest of a policy that only allows the given command, authorized
+// with the password of the key.
+func commandPolicy(code tpmutil.Command) []byte {
+	digest := make([]byte, sha256.Size)
+	extend := func(data ...interface{}) {
+		b, _ := tpmutil.Pack(data...)
+		h := sha256.New()
+		h.Write(digest)
+		h.Write(b)
+		digest = h.Sum(nil)
+	}
+	extend(cmdPolicyCommandCode, code)
+	extend(cmdPolicyAuthValue)
+	return digest
+}
+
+// startSignOnlySession starts a policy session that satisfies signOnlyPolicy. The caller needs to
+// flush the returned handle.
+func startSignOnlySession(dev io.ReadWriter) (tpmutil.Handle, error) {
+	return startSatisfiedSession(dev, satisfySignOnlyPolicy)
+}
+
+// satisfySignOnlyPolicy is the PolicyFunc of signOnlyPolicy.
+func satisfySignOnlyPolicy(dev io.ReadWriter, session tpmutil.Handle) error {
+	if err := policyCommandCode(dev, session, cmdSign); err != nil {
+		return err
+	}
+	return tpm2.PolicyPassword(dev, session)
+}
+
+// PolicyFunc executes the policy commands of a policy in a session. Called with a policy session
+// it satisfies the policy so the session can authorize the use of an object, called with a
+// trial session it calculates the policy digest.
+type PolicyFunc func(dev io.ReadWriter, session tpmutil.Handle) error
+
+// PCRPolicy returns a policy that requires the selected PCRs to have their current values, or
+// the values the expected digest was calculated from, see PCRDigest.
+func PCRPolicy(sel tpm2.PCRSelection, expectedDigest []byte) PolicyFunc {
+	return func(dev io.ReadWriter, session tpmutil.Handle) error {
+		return tpm2.PolicyPCR(dev, session, expectedDigest, sel)
+	}
+}
+
+// PolicyDigest calculates the digest of a policy with a trial session. It can be used with
+// WithPolicy to create a key that can only be used when the policy is satisfied.
+func PolicyDigest(dev io.ReadWriter, policy PolicyFunc) ([]byte, error) {
+	session, err := startPolicySession(dev, tpm2.SessionTrial)
+	if err != nil {
+		return nil, err
+	}
+	defer tpm2.FlushContext(dev, session)
+	if err := policy(dev, session); err != nil {
+		return nil, err
+	}
+	return tpm2.PolicyGetDigest(dev, session)
+}
+
+// startSatisfiedSession starts a policy session and satisfies the policy in it. The caller needs
+// to flush the returned handle.
+func startSatisfiedSession(dev io.ReadWriter, policy PolicyFunc) (tpmutil.Handle, error) {
+	session, err := startPolicySession(dev, tpm2.SessionPolicy)
+	if err != nil {
+		return 0, err
+	}
+	if err := policy(dev, session); err != nil {
+		tpm2.FlushContext(dev, session)
+		return 0, err
+	}
+	return session, nil
+}
+
+// WithPolicySession returns a copy of the key that authorizes signing with a policy session in
+// which the policy is satisfied, rather than with the password alone. This is required for keys
+// created with WithPolicy. The password the key was initialized with is passed in the session and
+// needs to be empty, unless the policy includes TPM2_PolicyPassword.
+func (k RSAPrivateKey) WithPolicySession(policy PolicyFunc) RSAPrivateKey {
+	k.policy = policy
+	return k
+}
@@ -0,0 +1,166 @@
+package tpmk
+
+import (
+	"crypto"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/google/go-tpm/tpm2"
+)
+
+// Fixed TPM properties (TPM_PT) in TPM 2.0 Part 2, Section 6.13. They start at PT_FIXED and
+// are followed by the variable properties at PT_VAR.
+const (
+	ptFixed             uint32 = 0x00000100
+	ptFamilyIndicator   uint32 = ptFixed + 0
+	ptLevel             uint32 = ptFixed + 1
+	ptRevision          uint32 = ptFixed + 2
+	ptDayOfYear         uint32 = ptFixed + 3
+	ptYear              uint32 = ptFixed + 4
+	ptManufacturer      uint32 = ptFixed + 5
+	ptVendorString1     uint32 = ptFixed + 6
+	ptVendorString4     uint32 = ptFixed + 9
+	ptVendorTPMType     uint32 = ptFixed + 10
+	ptFirmwareVersion1  uint32 = ptFixed + 11
+	ptFirmwareVersion2  uint32 = ptFixed + 12
+	ptInputBuffer       uint32 = ptFixed + 13
+	ptPCRCount          uint32 = ptFixed + 18
+	ptNVIndexMax        uint32 = ptFixed + 23
+	ptMaxCommandSize    uint32 = ptFixed + 30
+	ptMaxResponseSize   uint32 = ptFixed + 31
+	ptMaxDigest         uint32 = ptFixed + 32
+	ptNVBufferMax       uint32 = ptFixed + 44
+	ptVar               uint32 = 0x00000200
+	ptHRPersistent      uint32 = ptVar + 8
+	ptHRPersistentAvail uint32 = ptVar + 9
+)
+
+// FixedProperties are properties of a TPM that don't change, such as the manufacturer, firmware
+// version and implementation limits.
+type FixedProperties struct {
+	FamilyIndicator string // TPM family, "2.0"
+	Level           uint32 // Level of the specification
+	Revision        uint32 // Revision of the specification multiplied by 100
+	Year            uint32 // Year of the specification
+	DayOfYear       uint32 // Day of the year of the specification
+	Manufacturer    string // Vendor ID as registered with the TCG, e.g. "IFX"
+	VendorString    string // Vendor-specific description of the TPM
+	VendorTPMType   uint32 // Vendor-defined TPM model
+	FirmwareVersion uint64 // Vendor-defined firmware version, the most significant 32 bits first
+	InputBuffer     uint32 // Maximum size of a parameter, for example data to HMAC or hash
+	PCRCount        uint32 // Number of PCRs
+	NVIndexMax      uint32 // Maximum size of an NV index
+	NVBufferMax     uint32 // Maximum size of an NV read or write
+	MaxCommandSize  uint32 // Maximum size of a command
+	MaxResponseSize uint32 // Maximum size of a response
+	MaxDigest       uint32 // Size of the largest digest the TPM supports
+}
+
+// PermanentProperties reads the fixed properties of the TPM.
+func PermanentProperties(dev io.ReadWriter) (FixedProperties, error) {
+	values, err := properties(dev, ptFixed, ptVar)
+	if err != nil {
+		return FixedProperties{}, err
+	}
+
+	var vendor []string
+	for p := ptVendorString1; p <= ptVendorString4; p++ {
+		vendor = append(vendor, propertyString(values[p]))
+	}
+	return FixedProperties{
+		FamilyIndicator: propertyString(values[ptFamilyIndicator]),
+		Level:           values[ptLevel],
+		Revision:        values[ptRevision],
+		Year:            values[ptYear],
+		DayOfYear:       values[ptDayOfYear],
+		Manufacturer:    strings.TrimSpace(propertyString(values[ptManufacturer])),
+		VendorString:    strings.Join(vendor, ""),
+		VendorTPMType:   values[ptVendorTPMType],
+		FirmwareVersion: uint64(values[ptFirmwareVersion1])<<32 | uint64(values[ptFirmwareVersion2]),
+		InputBuffer:     values[ptInputBuffer],
+		PCRCount:        values[ptPCRCount],
+		NVIndexMax:      values[ptNVIndexMax],
+		NVBufferMax:     values[ptNVBufferMax],
+		MaxCommandSize:  values[ptMaxCommandSize],
+		MaxResponseSize: values[ptMaxResponseSize],
+		MaxDigest:       values[ptMaxDigest],
+	}, nil
+}
+
+// properties reads the TPM properties from first up to, but not including, end. The TPM may
+// return fewer than requested per call, so it's queried until it reports no more.
+func properties(dev io.ReadWriter, first, end uint32) (map[uint32]uint32, error) {
+	values := make(map[uint32]uint32)
+	for property := first; property < end; {
+		caps, more, err := tpm2.GetCapability(dev, tpm2.CapabilityTPMProperties, end-property, property)
+		if err != nil {
+			return nil, err
+		}
+		if len(caps) == 0 {
+			break
+		}
+		for _, c := range caps {
+			p, ok := c.(tpm2.TaggedProperty)
+			if !ok {
+				return nil, fmt.Errorf("unexpected property type %T", c)
+			}
+			if uint32(p.Tag) >= end {
+				return values, nil
+			}
+			values[uint32(p.Tag)] = p.Value
+			property = uint32(p.Tag) + 1
+		}
+		if !more {
+			break
+		}
+	}
+	return values, nil
+}
+
+// propertyString decodes a property that holds up to 4 characters, padded with zeros.
+func propertyString(v uint32) string {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, v)
+	return strings.TrimRight(string(b), "\x00")
+}
+
+// Caps lists what a TPM supports, so callers can check before attempting operations that would
+// otherwise fail inside the TPM.
+type Caps struct {
+	Algorithms          []tpm2.Algorithm     // All implemented algorithms (TPM_ALG_ID)
+	Hashes              []crypto.Hash        // Hashes that can be used for signing, strongest first
+	Curves              []tpm2.EllipticCurve // Implemented ECC curves
+	NVBufferMax         uint32               // Maximum size of an NV read or write
+	PersistentUsed      uint32               // Number of persistent objects
+	PersistentAvailable uint32               // Estimated number of persistent objects that can still be added
+}
+
+// Capabilities queries the algorithms, curves and limits of the TPM.
+func Capabilities(dev io.ReadWriter) (Caps, error) {
+	algs, err := supportedAlgorithms(dev)
+	if err != nil {
+		return Caps{}, err
+	}
+	curves, err := SupportedCurves(dev)
+	if err != nil {
+		return Caps{}, err
+	}
+	props, err := PermanentProperties(dev)
+	if err != nil {
+		return Caps{}, err
+	}
+	values, err := properties(dev, ptHRPersistent, ptHRPersistentAvail+1)
+	if err != nil {
+		return Caps{}, err
+	}
+	return Caps{
+		Algorithms:          algs,
+		Hashes:              hashesIn(algs),
+		Curves:              curves,
+		NVBufferMax:         props.NVBufferMax,
+		PersistentUsed:      values[ptHRPersistent],
+		PersistentAvailable: values[ptHRPersistentAvail],
+	}, nil
+}
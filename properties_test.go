@@ -0,0 +1,74 @@
+package tpmk
+
+import (
+	"crypto"
+	"testing"
+
+	"github.com/google/go-tpm-tools/simulator"
+	"github.com/google/go-tpm/tpm2"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPermanentProperties(t *testing.T) {
+	dev, err := simulator.Get()
+	require.NoError(t, err)
+	defer dev.Close()
+
+	props, err := PermanentProperties(dev)
+	require.NoError(t, err)
+
+	require.Equal(t, "2.0", props.FamilyIndicator)
+	require.Equal(t, "IBM", props.Manufacturer)
+	require.NotEmpty(t, props.VendorString)
+	require.NotZero(t, props.Revision)
+	require.NotZero(t, props.Year)
+	require.EqualValues(t, 24, props.PCRCount)
+	require.EqualValues(t, 64, props.MaxDigest)
+	require.NotZero(t, props.NVIndexMax)
+	require.NotZero(t, props.NVBufferMax)
+	require.True(t, props.MaxCommandSize >= props.InputBuffer)
+}
+
+func TestCapabilities(t *testing.T) {
+	dev, err := simulator.Get()
+	require.NoError(t, err)
+	defer dev.Close()
+
+	caps, err := Capabilities(dev)
+	require.NoError(t, err)
+	require.Contains(t, caps.Algorithms, tpm2.AlgRSA)
+	require.Contains(t, caps.Algorithms, tpm2.AlgSHA256)
+	require.Contains(t, caps.Hashes, crypto.SHA256)
+	require.Contains(t, caps.Curves, tpm2.CurveNISTP256)
+	require.NotZero(t, caps.NVBufferMax)
+	require.Zero(t, caps.PersistentUsed)
+	require.NotZero(t, caps.PersistentAvailable)
+
+	// Persisting a key uses up a slot
+	_, err = GenRSAPrimaryKey(dev, 0x81000000, "", "", tpm2.FlagStorageDefault)
+	require.NoError(t, err)
+	after, err := Capabilities(dev)
+	require.NoError(t, err)
+	require.EqualValues(t, 1, after.PersistentUsed)
+	require.True(t, after.PersistentAvailable < caps.PersistentAvailable)
+}
+
+func TestPropertiesPaged(t *testing.T) {
+	// TPMS_CAPABILITY_DATA with one TPMS_TAGGED_PROPERTY per page
+	page := func(more byte, tag, value uint32) *fakeTPM {
+		return newFakeTPM(t, 0, more, uint32(tpm2.CapabilityTPMProperties), uint32(1), tag, value)
+	}
+
+	// The second persistent handle property is read even if the TPM only returns one at a time
+	dev := &pagedTPM{responses: []*fakeTPM{page(1, ptHRPersistent, 3), page(1, ptHRPersistentAvail, 5)}}
+	values, err := properties(dev, ptHRPersistent, ptHRPersistentAvail+1)
+	require.NoError(t, err)
+	require.Equal(t, map[uint32]uint32{ptHRPersistent: 3, ptHRPersistentAvail: 5}, values)
+	require.Empty(t, dev.responses)
+
+	// Properties past the end aren't included
+	dev = &pagedTPM{responses: []*fakeTPM{page(1, ptHRPersistent, 3), page(1, ptHRPersistentAvail+1, 7)}}
+	values, err = properties(dev, ptHRPersistent, ptHRPersistentAvail+1)
+	require.NoError(t, err)
+	require.Equal(t, map[uint32]uint32{ptHRPersistent: 3}, values)
+}
@@ -0,0 +1,90 @@
+package tpmk
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+// VerifyWebCryptoPSS verifies a PSS signature with the parameters a browser uses in
+// crypto.subtle.verify({name: "RSA-PSS", saltLength: <digest size>}, ...), which is also what JWS
+// requires for PS256, PS384 and PS512. If the signature is valid but uses a different salt length,
+// the error reports it.
+//
+// The salt length can't be chosen when signing with a TPM, RSAPrivateKey.Sign fails if the one in
+// *rsa.PSSOptions doesn't match what the TPM uses. Most TPMs, including the reference
+// implementation, use a salt as long as the digest. Some older ones use the largest salt that
+// fits, which Go accepts with PSSSaltLengthAuto but browsers reject. Checking one signature of a
+// TPM with this function before relying on its signatures in a browser detects that.
+func VerifyWebCryptoPSS(pub *rsa.PublicKey, hash crypto.Hash, digest, sig []byte) error {
+	err := rsa.VerifyPSS(pub, hash, digest, sig, &rsa.PSSOptions{SaltLength: hash.Size(), Hash: hash})
+	if err == nil {
+		return nil
+	}
+	if n, e := PSSSaltLength(pub, hash, sig); e == nil && n != hash.Size() {
+		return fmt.Errorf("signature uses a salt of %d bytes, browsers expect %d", n, hash.Size())
+	}
+	return err
+}
+
+// PSSSaltLength returns the length of the salt used in a PSS signature. It doesn't check that the
+// signature is valid for any particular digest.
+func PSSSaltLength(pub *rsa.PublicKey, hash crypto.Hash, sig []byte) (int, error) {
+	if !hash.Available() {
+		return 0, fmt.Errorf("unsupported hash algorithm %v", hash)
+	}
+	// Recover the encoded message EM = maskedDB || H || 0xbc (RFC 8017, Section 9.1.2)
+	emBits := pub.N.BitLen() - 1
+	emLen := (emBits + 7) / 8
+	hLen := hash.Size()
+	s := new(big.Int).SetBytes(sig)
+	if s.Cmp(pub.N) >= 0 {
+		return 0, errors.New("invalid signature")
+	}
+	m := new(big.Int).Exp(s, big.NewInt(int64(pub.E)), pub.N).Bytes()
+	if len(m) > emLen || emLen < hLen+2 {
+		return 0, errors.New("invalid signature")
+	}
+	em := make([]byte, emLen)
+	copy(em[emLen-len(m):], m)
+	if em[emLen-1] != 0xbc {
+		return 0, errors.New("invalid signature")
+	}
+
+	// Unmask DB = PS || 0x01 || salt, where PS are zeros
+	db := em[:emLen-hLen-1]
+	mgf1XOR(db, hash, em[emLen-hLen-1:emLen-1])
+	db[0] &= 0xff >> uint(8*emLen-emBits)
+	for i, b := range db {
+		if b == 0 {
+			continue
+		}
+		if b == 1 {
+			return len(db) - i - 1, nil
+		}
+		break
+	}
+	return 0, errors.New("invalid signature")
+}
+
+// mgf1XOR XORs out with the MGF1 mask generated from seed.
+func mgf1XOR(out []byte, hash crypto.Hash, seed []byte) {
+	var counter [4]byte
+	h := hash.New()
+	for done := 0; done < len(out); {
+		h.Reset()
+		h.Write(seed)
+		h.Write(counter[:])
+		for _, b := range h.Sum(nil) {
+			if done == len(out) {
+				break
+			}
+			out[done] ^= b
+			done++
+		}
+		binary.BigEndian.PutUint32(counter[:], binary.BigEndian.Uint32(counter[:])+1)
+	}
+}
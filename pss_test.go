@@ -0,0 +1,57 @@
+package tpmk
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"testing"
+
+	"github.com/google/go-tpm-tools/simulator"
+	"github.com/google/go-tpm/tpm2"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerifyWebCryptoPSS(t *testing.T) {
+	dev, err := simulator.Get()
+	require.NoError(t, err)
+	defer dev.Close()
+
+	const (
+		handle = 0x81000000
+		pw     = ""
+		attr   = tpm2.FlagSign | tpm2.FlagFixedTPM | tpm2.FlagUserWithAuth | tpm2.FlagFixedParent | tpm2.FlagSensitiveDataOrigin
+	)
+	_, err = GenRSAPrimaryKey(dev, handle, pw, pw, attr)
+	require.NoError(t, err)
+	priv, err := NewRSAPrivateKey(dev, handle, pw)
+	require.NoError(t, err)
+	pub := priv.Public().(*rsa.PublicKey)
+	digest := sha256.Sum256([]byte("data"))
+
+	// A PS256 signature of the TPM verifies with the browser's parameters
+	for _, saltLength := range []int{rsa.PSSSaltLengthAuto, rsa.PSSSaltLengthEqualsHash, sha256.Size} {
+		sig, err := priv.Sign(nil, digest[:], &rsa.PSSOptions{SaltLength: saltLength, Hash: crypto.SHA256})
+		require.NoError(t, err)
+		require.NoError(t, VerifyWebCryptoPSS(pub, crypto.SHA256, digest[:], sig))
+		n, err := PSSSaltLength(pub, crypto.SHA256, sig)
+		require.NoError(t, err)
+		require.Equal(t, sha256.Size, n)
+	}
+
+	// A signature with the maximum salt length, as produced by some TPMs, doesn't
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	sig, err := rsa.SignPSS(rand.Reader, key, crypto.SHA256, digest[:], &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthAuto})
+	require.NoError(t, err)
+	n, err := PSSSaltLength(&key.PublicKey, crypto.SHA256, sig)
+	require.NoError(t, err)
+	require.Equal(t, 256-sha256.Size-2, n)
+	require.EqualError(t, VerifyWebCryptoPSS(&key.PublicKey, crypto.SHA256, digest[:], sig), "signature uses a salt of 222 bytes, browsers expect 32")
+
+	// Nor does a signature of a different digest
+	other := sha256.Sum256([]byte("other"))
+	sig, err = priv.Sign(nil, other[:], &rsa.PSSOptions{Hash: crypto.SHA256})
+	require.NoError(t, err)
+	require.Error(t, VerifyWebCryptoPSS(pub, crypto.SHA256, digest[:], sig))
+}
@@ -0,0 +1,156 @@
+package tpmk
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpmutil"
+)
+
+// eventLogPath is the location of the TCG event log of the firmware on Linux. It's a variable so
+// tests can provide a log.
+var eventLogPath = "/sys/kernel/security/tpm0/binary_bios_measurements"
+
+// Attestation holds everything a remote verifier needs to check the boot state of a device: a
+// quote over PCRs signed by an Attestation Key (AK), the quoted PCR values, and the event log
+// that can be replayed to reproduce them.
+type Attestation struct {
+	Quote     []byte         // TPMS_ATTEST structure
+	Signature []byte         // Signature of the AK over Quote
+	Scheme    tpm2.SigScheme // Scheme and hash of Signature, RSASSA-SHA256 if empty
+	PCRs      map[int][]byte // PCR values at the time of the quote
+	EventLog  []byte         // Raw TCG event log, nil if not available
+}
+
+// Quote signs the selected PCRs and the nonce with an Attestation Key. It returns the TPMS_ATTEST
+// structure and the RSA signature over it. Together with the PCR values in an Attestation, they
+// can be checked with VerifyQuote. The AK needs to be a restricted RSA signing key, such as one
+// created from tpm2tools.AIKTemplateRSA, which guarantees that the TPM only signs structures it
+// generated itself.
+func Quote(dev io.ReadWriteCloser, akHandle tpmutil.Handle, akPassword string, nonce []byte, sel tpm2.PCRSelection) ([]byte, []byte, error) {
+	quote, sig, err := quoteWithScheme(dev, akHandle, akPassword, nonce, sel)
+	if err != nil {
+		return nil, nil, err
+	}
+	return quote, sig.RSA.Signature, nil
+}
+
+// quoteWithScheme produces a quote like Quote, and returns the signature with its scheme and hash.
+func quoteWithScheme(dev io.ReadWriteCloser, akHandle tpmutil.Handle, akPassword string, nonce []byte, sel tpm2.PCRSelection) ([]byte, *tpm2.Signature, error) {
+	pub, _, _, err := tpm2.ReadPublic(dev, akHandle)
+	if err != nil {
+		return nil, nil, err
+	}
+	if pub.Type != tpm2.AlgRSA {
+		return nil, nil, fmt.Errorf("unsupported AK algorithm 0x%x", pub.Type)
+	}
+	if pub.Attributes&(tpm2.FlagRestricted|tpm2.FlagSign|tpm2.FlagDecrypt) != tpm2.FlagRestricted|tpm2.FlagSign {
+		return nil, nil, errors.New("AK needs to be a restricted signing key")
+	}
+	quote, sig, err := tpm2.Quote(dev, akHandle, akPassword, "", nonce, sel, tpm2.AlgNull)
+	if err != nil {
+		return nil, nil, err
+	}
+	if sig.RSA == nil {
+		return nil, nil, fmt.Errorf("unsupported signature algorithm 0x%x", sig.Alg)
+	}
+	return quote, sig, nil
+}
+
+// DeviceAttestation quotes the selected PCRs with an AK that has no password, and combines the
+// quote with the PCR values and the event log of the firmware. The nonce is provided by the
+// verifier to prove freshness. A missing event log isn't an error, EventLog is empty in that case.
+func DeviceAttestation(dev io.ReadWriteCloser, akHandle tpmutil.Handle, sel tpm2.PCRSelection, nonce []byte) (Attestation, error) {
+	quote, sig, err := quoteWithScheme(dev, akHandle, "", nonce, sel)
+	if err != nil {
+		return Attestation{}, err
+	}
+	pcrs, err := ReadPCRs(dev, sel)
+	if err != nil {
+		return Attestation{}, err
+	}
+	eventLog, err := ioutil.ReadFile(eventLogPath)
+	if err != nil && !os.IsNotExist(err) {
+		return Attestation{}, err
+	}
+	return Attestation{
+		Quote:     quote,
+		Signature: sig.RSA.Signature,
+		Scheme:    tpm2.SigScheme{Alg: sig.Alg, Hash: sig.RSA.HashAlg},
+		PCRs:      pcrs,
+		EventLog:  eventLog,
+	}, nil
+}
+
+// VerifyQuote checks that the quote in an attestation was signed by pub with the scheme in it,
+// includes the nonce, and covers the PCR values in it. Attestations without scheme, such as
+// those assembled from the results of Quote with an AK from GenAK, are expected to be signed
+// with RSASSA-SHA256. The event log isn't verified, replaying it against the PCRs is left to the
+// caller.
+func VerifyQuote(pub crypto.PublicKey, att Attestation, nonce []byte) error {
+	if _, ok := pub.(*rsa.PublicKey); !ok {
+		return fmt.Errorf("unsupported key type %T", pub)
+	}
+	scheme := att.Scheme
+	if scheme.Alg == 0 {
+		scheme = tpm2.SigScheme{Alg: tpm2.AlgRSASSA, Hash: tpm2.AlgSHA256}
+	}
+	hash, err := schemeHash(scheme.Hash)
+	if err != nil {
+		return err
+	}
+	h := hash.New()
+	h.Write(att.Quote)
+	var opts crypto.SignerOpts
+	switch scheme.Alg {
+	case tpm2.AlgRSASSA:
+		opts = hash
+	case tpm2.AlgRSAPSS:
+		opts = &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthAuto, Hash: hash}
+	default:
+		return fmt.Errorf("unsupported signature algorithm 0x%x", scheme.Alg)
+	}
+	if err := Verify(pub, h.Sum(nil), att.Signature, opts); err != nil {
+		return err
+	}
+	data, err := tpm2.DecodeAttestationData(att.Quote)
+	if err != nil {
+		return err
+	}
+	if data.Magic != attestMagic {
+		return errors.New("attestation not generated by a TPM")
+	}
+	if data.Type != tpm2.TagAttestQuote {
+		return fmt.Errorf("not a quote, type 0x%x", data.Type)
+	}
+	if !bytes.Equal(data.ExtraData, nonce) {
+		return errors.New("attestation nonce mismatch")
+	}
+
+	// The quote signs the hash over the selected PCR values, made with the hash of the scheme
+	digest, err := pcrDigest(hash, att.PCRs, data.AttestedQuoteInfo.PCRSelection.PCRs)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(digest, data.AttestedQuoteInfo.PCRDigest) {
+		return errors.New("PCR values don't match the quote")
+	}
+	return nil
+}
+
+// schemeHash returns the hash function for the hash algorithm of a signature scheme.
+func schemeHash(alg tpm2.Algorithm) (crypto.Hash, error) {
+	for h, a := range tpmToHashFunc {
+		if a == alg {
+			return h, nil
+		}
+	}
+	return 0, fmt.Errorf("unsupported hash algorithm 0x%x", alg)
+}
@@ -0,0 +1,146 @@
+package tpmk
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-tpm-tools/simulator"
+	"github.com/google/go-tpm-tools/tpm2tools"
+	"github.com/google/go-tpm/tpm2"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDeviceAttestation(t *testing.T) {
+	dev, err := simulator.Get()
+	require.NoError(t, err)
+	defer dev.Close()
+
+	var akNonce [256]byte
+	ak, akPub, err := tpm2.CreatePrimary(dev, tpm2.HandleEndorsement, tpm2.PCRSelection{}, "", "", tpm2tools.AIKTemplateRSA(akNonce))
+	require.NoError(t, err)
+	defer tpm2.FlushContext(dev, ak)
+
+	// Measure something
+	digest := sha256.Sum256([]byte("bootloader"))
+	require.NoError(t, tpm2.PCRExtend(dev, 4, tpm2.AlgSHA256, digest[:], ""))
+
+	// Provide an event log
+	dir, err := ioutil.TempDir("", "tpmk")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	defer func(path string) { eventLogPath = path }(eventLogPath)
+	eventLogPath = filepath.Join(dir, "binary_bios_measurements")
+	eventLog := []byte("event log")
+	require.NoError(t, ioutil.WriteFile(eventLogPath, eventLog, 0644))
+
+	nonce := []byte("nonce")
+	sel := tpm2.PCRSelection{Hash: tpm2.AlgSHA256, PCRs: []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10}}
+	att, err := DeviceAttestation(dev, ak, sel, nonce)
+	require.NoError(t, err)
+	require.Equal(t, eventLog, att.EventLog)
+	require.Len(t, att.PCRs, len(sel.PCRs))
+	require.Equal(t, tpm2.SigScheme{Alg: tpm2.AlgRSASSA, Hash: tpm2.AlgSHA256}, att.Scheme)
+	require.NoError(t, VerifyQuote(akPub, att, nonce))
+
+	// Verification fails with the wrong nonce or modified PCR values
+	require.Error(t, VerifyQuote(akPub, att, []byte("other")))
+	modified := att
+	modified.PCRs = map[int][]byte{}
+	for pcr, v := range att.PCRs {
+		modified.PCRs[pcr] = v
+	}
+	modified.PCRs[4] = make([]byte, crypto.SHA256.Size())
+	require.Error(t, VerifyQuote(akPub, modified, nonce))
+
+	// Without an event log the attestation still works
+	require.NoError(t, os.Remove(eventLogPath))
+	att, err = DeviceAttestation(dev, ak, sel, nonce)
+	require.NoError(t, err)
+	require.Nil(t, att.EventLog)
+	require.NoError(t, VerifyQuote(akPub, att, nonce))
+
+	// The quote is verified with the scheme of the AK
+	template := tpm2tools.AIKTemplateRSA(akNonce)
+	template.RSAParameters.Sign = &tpm2.SigScheme{Alg: tpm2.AlgRSAPSS, Hash: tpm2.AlgSHA384}
+	pssAK, pssPub, err := tpm2.CreatePrimary(dev, tpm2.HandleEndorsement, tpm2.PCRSelection{}, "", "", template)
+	require.NoError(t, err)
+	defer tpm2.FlushContext(dev, pssAK)
+	att, err = DeviceAttestation(dev, pssAK, sel, nonce)
+	require.NoError(t, err)
+	require.Equal(t, tpm2.SigScheme{Alg: tpm2.AlgRSAPSS, Hash: tpm2.AlgSHA384}, att.Scheme)
+	require.NoError(t, VerifyQuote(pssPub, att, nonce))
+	att.Scheme = tpm2.SigScheme{}
+	require.Error(t, VerifyQuote(pssPub, att, nonce))
+}
+
+func TestQuote(t *testing.T) {
+	dev, err := simulator.Get()
+	require.NoError(t, err)
+	defer dev.Close()
+
+	const pw = "ak-password"
+	var akNonce [256]byte
+	ak, akPub, err := tpm2.CreatePrimary(dev, tpm2.HandleEndorsement, tpm2.PCRSelection{}, "", pw, tpm2tools.AIKTemplateRSA(akNonce))
+	require.NoError(t, err)
+	defer tpm2.FlushContext(dev, ak)
+
+	nonce, err := GetRandom(dev, 16)
+	require.NoError(t, err)
+	sel := tpm2.PCRSelection{Hash: tpm2.AlgSHA256, PCRs: []int{7}}
+	quote, sig, err := Quote(dev, ak, pw, nonce, sel)
+	require.NoError(t, err)
+
+	digest := sha256.Sum256(quote)
+	require.NoError(t, rsa.VerifyPKCS1v15(akPub.(*rsa.PublicKey), crypto.SHA256, digest[:], sig))
+	data, err := tpm2.DecodeAttestationData(quote)
+	require.NoError(t, err)
+	require.Equal(t, nonce, []byte(data.ExtraData))
+	require.Equal(t, sel.PCRs, data.AttestedQuoteInfo.PCRSelection.PCRs)
+
+	// Keys that aren't restricted can't be used as AK
+	const (
+		handle = 0x81000000
+		attr   = tpm2.FlagSign | tpm2.FlagUserWithAuth | tpm2.FlagSensitiveDataOrigin
+	)
+	_, err = GenRSAPrimaryKey(dev, handle, "", "", attr)
+	require.NoError(t, err)
+	_, _, err = Quote(dev, handle, "", nonce, sel)
+	require.EqualError(t, err, "AK needs to be a restricted signing key")
+}
+
+func TestGenAK(t *testing.T) {
+	dev, err := simulator.Get()
+	require.NoError(t, err)
+	defer dev.Close()
+
+	const (
+		handle = 0x81000000
+		pw     = "ak-password"
+	)
+	akPub, err := GenAK(dev, handle, "", pw)
+	require.NoError(t, err)
+
+	pub, _, err := ReadPublicKey(dev, handle)
+	require.NoError(t, err)
+	require.Equal(t, AKAttributes, pub.Attributes)
+	require.Equal(t, &tpm2.SigScheme{Alg: tpm2.AlgRSASSA, Hash: tpm2.AlgSHA256}, pub.RSAParameters.Sign)
+
+	// The AK can be used for quotes
+	nonce := []byte("nonce")
+	sel := tpm2.PCRSelection{Hash: tpm2.AlgSHA256, PCRs: []int{7}}
+	quote, sig, err := Quote(dev, handle, pw, nonce, sel)
+	require.NoError(t, err)
+	digest := sha256.Sum256(quote)
+	require.NoError(t, rsa.VerifyPKCS1v15(akPub.(*rsa.PublicKey), crypto.SHA256, digest[:], sig))
+
+	// But not to sign arbitrary digests
+	priv, err := NewRSAPrivateKey(dev, handle, pw)
+	require.NoError(t, err)
+	_, err = priv.Sign(nil, digest[:], crypto.SHA256)
+	require.Error(t, err)
+}
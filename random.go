@@ -0,0 +1,68 @@
+package tpmk
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/google/go-tpm/tpm2"
+)
+
+// Largest number of bytes requested from the TPM at once. TPMs return at most as many as the
+// size of their largest digest, typically 32 or 48.
+const maxRandomRequest = 64
+
+// GetRandom returns n bytes from the random number generator of the TPM. It sends as many
+// requests as necessary since the TPM limits how many it returns at once. n must not be negative.
+func GetRandom(dev io.ReadWriter, n int) ([]byte, error) {
+	if n < 0 {
+		return nil, fmt.Errorf("invalid number of random bytes %d", n)
+	}
+	b := make([]byte, 0, n)
+	for len(b) < n {
+		size := n - len(b)
+		if size > maxRandomRequest {
+			size = maxRandomRequest
+		}
+		r, err := tpm2.GetRandom(dev, uint16(size))
+		if err != nil {
+			return nil, err
+		}
+		if len(r) == 0 {
+			return nil, errors.New("TPM returned no random bytes")
+		}
+		if len(r) > size {
+			r = r[:size]
+		}
+		b = append(b, r...)
+	}
+	return b, nil
+}
+
+// RandReader returns a reader of random bytes from the TPM. It can be passed as rand to functions
+// like x509.CreateCertificate or rsa.GenerateKey to use the TPM as entropy source.
+func RandReader(dev io.ReadWriter) io.Reader {
+	return randReader{dev}
+}
+
+type randReader struct {
+	dev io.ReadWriter
+}
+
+// Read fills b completely with random bytes from the TPM.
+func (r randReader) Read(b []byte) (int, error) {
+	random, err := GetRandom(r.dev, len(b))
+	if err != nil {
+		return 0, err
+	}
+	return copy(b, random), nil
+}
+
+// randOrDefault returns r, or crypto/rand.Reader if r is nil.
+func randOrDefault(r io.Reader) io.Reader {
+	if r == nil {
+		return rand.Reader
+	}
+	return r
+}
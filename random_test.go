@@ -0,0 +1,61 @@
+package tpmk
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/google/go-tpm-tools/simulator"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetRandom(t *testing.T) {
+	dev, err := simulator.Get()
+	require.NoError(t, err)
+	defer dev.Close()
+
+	b1, err := GetRandom(dev, 1000)
+	require.NoError(t, err)
+	require.Len(t, b1, 1000)
+	b2, err := GetRandom(dev, 1000)
+	require.NoError(t, err)
+	require.Len(t, b2, 1000)
+	require.NotEqual(t, b1, b2)
+
+	b, err := GetRandom(dev, 0)
+	require.NoError(t, err)
+	require.Empty(t, b)
+
+	_, err = GetRandom(dev, -1)
+	require.EqualError(t, err, "invalid number of random bytes -1")
+}
+
+func TestRandReader(t *testing.T) {
+	dev, err := simulator.Get()
+	require.NoError(t, err)
+	defer dev.Close()
+
+	r := RandReader(dev)
+	b := make([]byte, 100)
+	_, err = io.ReadFull(r, b)
+	require.NoError(t, err)
+	require.NotEqual(t, make([]byte, 100), b)
+
+	// Usable as entropy source when creating certificates
+	caCrt, caKey, err := LoadKeyPair("testdata/ca.crt", "testdata/ca.key")
+	require.NoError(t, err)
+	template := x509.Certificate{
+		Subject:      pkix.Name{CommonName: "test"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().AddDate(0, 0, 1),
+		SerialNumber: big.NewInt(1),
+	}
+	der, err := x509.CreateCertificate(r, &template, caCrt, caCrt.PublicKey, caKey)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	require.NoError(t, cert.CheckSignatureFrom(caCrt))
+}
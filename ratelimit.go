@@ -0,0 +1,79 @@
+package tpmk
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/google/go-tpm/tpmutil"
+)
+
+// ErrRateLimited is returned by key operations that exceed the rate of a RateLimiter.
+var ErrRateLimited = errors.New("rate limited")
+
+// RateLimiter limits the rate of operations per key handle with a token bucket. Every handle
+// starts with a full bucket of burst tokens, which is refilled at rate tokens per second. A
+// limiter can be shared between keys and is safe for concurrent use.
+type RateLimiter struct {
+	rate  float64
+	burst float64
+	now   func() time.Time
+
+	mu      sync.Mutex
+	buckets map[tpmutil.Handle]*tokenBucket
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter returns a limiter that allows rate operations per second for each handle, with
+// bursts of up to burst operations.
+func NewRateLimiter(rate float64, burst int) *RateLimiter {
+	return &RateLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		now:     time.Now,
+		buckets: make(map[tpmutil.Handle]*tokenBucket),
+	}
+}
+
+// Allow takes a token from the bucket of the handle and returns false if there was none left.
+func (l *RateLimiter) Allow(handle tpmutil.Handle) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	b, ok := l.buckets[handle]
+	if !ok {
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[handle] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * l.rate
+	if b.tokens > l.burst {
+		b.tokens = l.burst
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// WithRateLimit returns a copy of the key that fails signing and decryption with ErrRateLimited,
+// without sending a command to the TPM, when the limiter doesn't allow them. This prevents one
+// client from monopolizing the TPM, or from triggering the dictionary attack lockout by
+// repeatedly using the key with a wrong password.
+func (k RSAPrivateKey) WithRateLimit(l *RateLimiter) RSAPrivateKey {
+	k.limiter = l
+	return k
+}
+
+// allow returns ErrRateLimited if the key has a limiter that doesn't allow another operation.
+func (k RSAPrivateKey) allow() error {
+	if k.limiter != nil && !k.limiter.Allow(k.handle) {
+		return ErrRateLimited
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+package tpmk
+
+import (
+	"crypto"
+	"testing"
+	"time"
+
+	"github.com/google/go-tpm-tools/simulator"
+	"github.com/google/go-tpm/tpm2"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRateLimit(t *testing.T) {
+	dev, err := simulator.Get()
+	require.NoError(t, err)
+	defer dev.Close()
+
+	const (
+		handle = 0x81000000
+		pw     = ""
+		attr   = tpm2.FlagSign | tpm2.FlagUserWithAuth | tpm2.FlagSensitiveDataOrigin
+	)
+	_, err = GenRSAPrimaryKey(dev, handle, pw, pw, attr)
+	require.NoError(t, err)
+
+	// Use a fake clock, allowing 2 signatures per second
+	now := time.Now()
+	limiter := NewRateLimiter(2, 2)
+	limiter.now = func() time.Time { return now }
+
+	key, err := NewRSAPrivateKey(dev, handle, pw)
+	require.NoError(t, err)
+	key = key.WithRateLimit(limiter)
+	sign := func() error {
+		_, err := key.Sign(nil, make([]byte, 32), crypto.SHA256)
+		return err
+	}
+
+	// The burst is allowed, then the limiter kicks in
+	require.NoError(t, sign())
+	require.NoError(t, sign())
+	require.Equal(t, ErrRateLimited, sign())
+
+	// Keys sharing the limiter and handle are limited too
+	other, err := NewRSAPrivateKey(dev, handle, pw)
+	require.NoError(t, err)
+	_, err = other.WithRateLimit(limiter).Sign(nil, make([]byte, 32), crypto.SHA256)
+	require.Equal(t, ErrRateLimited, err)
+
+	// Half a second later there's a new token
+	now = now.Add(500 * time.Millisecond)
+	require.NoError(t, sign())
+	require.Equal(t, ErrRateLimited, sign())
+
+	// After a longer break, the bucket is full again but not beyond the burst
+	now = now.Add(time.Minute)
+	require.NoError(t, sign())
+	require.NoError(t, sign())
+	require.Equal(t, ErrRateLimited, sign())
+}
@@ -0,0 +1,218 @@
+package tpmk
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+)
+
+// Operations and status codes of the remote signer protocol. Every request and response is a
+// message preceded by its length as big-endian uint32. Requests start with the operation,
+// responses with the status, followed by the PKIX-encoded public key, the signature, or an error
+// message. Sign requests contain the hash (crypto.Hash as uint32), a byte that is 1 for PSS and 0
+// for PKCS#1 v1.5, the PSS salt length (as in rsa.PSSOptions, int32), and the digest.
+const (
+	remoteOpPublic byte = 1
+	remoteOpSign   byte = 2
+
+	remoteStatusOK    byte = 0
+	remoteStatusError byte = 1
+
+	// Size of the fields preceding the digest in sign requests
+	remoteSignHeader = 1 + 4 + 1 + 4
+
+	// Upper limit for the size of a message, larger ones are rejected before reading them
+	remoteMaxMessage = 64 * 1024
+)
+
+// SignerServer exposes a Signer to other processes, typically over a unix socket. This allows a
+// privileged helper to own the TPM while sandboxed processes that can't open it sign with
+// RemoteSigner. Requests from all connections are serialized.
+type SignerServer struct {
+	signer Signer
+	mu     sync.Mutex
+}
+
+// NewSignerServer returns a server for the signer.
+func NewSignerServer(k Signer) *SignerServer {
+	return &SignerServer{signer: k}
+}
+
+// Serve accepts connections on the listener and handles each one in a goroutine. It returns
+// when the listener fails, for example after it was closed.
+func (s *SignerServer) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			defer conn.Close()
+			s.ServeConn(conn)
+		}()
+	}
+}
+
+// ServeConn handles requests on a single connection until the client disconnects. Failures of
+// the signer are returned to the client, only errors reading or writing the connection end it.
+func (s *SignerServer) ServeConn(conn io.ReadWriter) error {
+	for {
+		req, err := readRemoteMessage(conn)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		resp, err := s.handle(req)
+		if err != nil {
+			resp = append([]byte{remoteStatusError}, err.Error()...)
+		} else {
+			resp = append([]byte{remoteStatusOK}, resp...)
+		}
+		if err := writeRemoteMessage(conn, resp); err != nil {
+			return err
+		}
+	}
+}
+
+// handle executes a single request and returns the response data.
+func (s *SignerServer) handle(req []byte) ([]byte, error) {
+	if len(req) == 0 {
+		return nil, errors.New("empty request")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch req[0] {
+	case remoteOpPublic:
+		return x509.MarshalPKIXPublicKey(s.signer.Public())
+	case remoteOpSign:
+		if len(req) < remoteSignHeader {
+			return nil, errors.New("invalid sign request")
+		}
+		hash := crypto.Hash(binary.BigEndian.Uint32(req[1:5]))
+		if _, ok := tpmToHashFunc[hash]; !ok {
+			return nil, UnsupportedHashError{Hash: hash}
+		}
+		var opts crypto.SignerOpts = hash
+		if req[5] == 1 {
+			saltLength := int32(binary.BigEndian.Uint32(req[6:10]))
+			opts = &rsa.PSSOptions{SaltLength: int(saltLength), Hash: hash}
+		}
+		return s.signer.Sign(nil, req[remoteSignHeader:], opts)
+	default:
+		return nil, fmt.Errorf("unsupported operation %d", req[0])
+	}
+}
+
+// RemoteSigner is a Signer that uses a key exposed by a SignerServer. It can be used concurrently.
+type RemoteSigner struct {
+	conn io.ReadWriteCloser
+	pub  crypto.PublicKey
+	mu   sync.Mutex
+}
+
+// DialSigner connects to a SignerServer listening on a unix socket.
+func DialSigner(path string) (*RemoteSigner, error) {
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	k, err := NewRemoteSigner(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return k, nil
+}
+
+// NewRemoteSigner returns a signer using a connection to a SignerServer. It requests the public
+// key from the server. The connection is closed with Close.
+func NewRemoteSigner(conn io.ReadWriteCloser) (*RemoteSigner, error) {
+	k := &RemoteSigner{conn: conn}
+	der, err := k.call([]byte{remoteOpPublic})
+	if err != nil {
+		return nil, err
+	}
+	if k.pub, err = x509.ParsePKIXPublicKey(der); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// Public returns the public part of the key.
+func (k *RemoteSigner) Public() crypto.PublicKey {
+	return k.pub
+}
+
+// Sign digests with the remote key. Like RSAPrivateKey, the PSS signature algorithm is used if
+// opts are *rsa.PSSOptions, PKCS#1 1.5 otherwise. The rand argument is ignored.
+func (k *RemoteSigner) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	req := make([]byte, remoteSignHeader, remoteSignHeader+len(digest))
+	req[0] = remoteOpSign
+	binary.BigEndian.PutUint32(req[1:5], uint32(opts.HashFunc()))
+	if pss, ok := opts.(*rsa.PSSOptions); ok {
+		req[5] = 1
+		binary.BigEndian.PutUint32(req[6:10], uint32(int32(pss.SaltLength)))
+	}
+	return k.call(append(req, digest...))
+}
+
+// Close closes the connection to the server.
+func (k *RemoteSigner) Close() error {
+	return k.conn.Close()
+}
+
+// call sends a request and returns the data of the response, or the error reported by the server.
+func (k *RemoteSigner) call(req []byte) ([]byte, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if err := writeRemoteMessage(k.conn, req); err != nil {
+		return nil, err
+	}
+	resp, err := readRemoteMessage(k.conn)
+	if err != nil {
+		return nil, err
+	}
+	if len(resp) == 0 {
+		return nil, errors.New("empty response")
+	}
+	if resp[0] != remoteStatusOK {
+		return nil, fmt.Errorf("remote signer: %s", resp[1:])
+	}
+	return resp[1:], nil
+}
+
+// readRemoteMessage reads a length-prefixed message. io.EOF is returned if the connection was
+// closed before the message started.
+func readRemoteMessage(r io.Reader) ([]byte, error) {
+	var size uint32
+	if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+		return nil, err
+	}
+	if size > remoteMaxMessage {
+		return nil, fmt.Errorf("message of %d bytes exceeds the limit of %d", size, remoteMaxMessage)
+	}
+	b := make([]byte, size)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// writeRemoteMessage writes a message, preceded by its length.
+func writeRemoteMessage(w io.Writer, b []byte) error {
+	if len(b) > remoteMaxMessage {
+		return fmt.Errorf("message of %d bytes exceeds the limit of %d", len(b), remoteMaxMessage)
+	}
+	msg := make([]byte, 4, 4+len(b))
+	binary.BigEndian.PutUint32(msg, uint32(len(b)))
+	_, err := w.Write(append(msg, b...))
+	return err
+}
@@ -0,0 +1,91 @@
+package tpmk
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/google/go-tpm-tools/simulator"
+	"github.com/google/go-tpm/tpm2"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRemoteSigner(t *testing.T) {
+	dev, err := simulator.Get()
+	require.NoError(t, err)
+	defer dev.Close()
+
+	const (
+		handle = 0x81000000
+		pw     = ""
+		attr   = tpm2.FlagSign | tpm2.FlagFixedTPM | tpm2.FlagUserWithAuth | tpm2.FlagFixedParent | tpm2.FlagSensitiveDataOrigin
+	)
+	pub, err := GenRSAPrimaryKey(dev, handle, pw, pw, attr)
+	require.NoError(t, err)
+	priv, err := NewRSAPrivateKey(dev, handle, pw)
+	require.NoError(t, err)
+	server := NewSignerServer(priv)
+
+	// Run the server on one end of a socket pair and the client on the other
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	require.NoError(t, err)
+	serverConn := socketConn(t, fds[0])
+	clientConn := socketConn(t, fds[1])
+	done := make(chan error)
+	go func() { done <- server.ServeConn(serverConn) }()
+
+	client, err := NewRemoteSigner(clientConn)
+	require.NoError(t, err)
+	require.Equal(t, pub, client.Public())
+
+	digest := sha256.Sum256([]byte("data"))
+	sig, err := client.Sign(nil, digest[:], crypto.SHA256)
+	require.NoError(t, err)
+	require.NoError(t, rsa.VerifyPKCS1v15(pub.(*rsa.PublicKey), crypto.SHA256, digest[:], sig))
+	sig, err = client.Sign(nil, digest[:], &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: crypto.SHA256})
+	require.NoError(t, err)
+	require.NoError(t, rsa.VerifyPSS(pub.(*rsa.PublicKey), crypto.SHA256, digest[:], sig, nil))
+
+	// Errors of the signer are passed to the client without ending the connection
+	_, err = client.Sign(nil, digest[:], crypto.MD5)
+	require.Error(t, err)
+	_, err = client.Sign(nil, digest[:], crypto.SHA256)
+	require.NoError(t, err)
+
+	// The server returns once the client disconnects
+	require.NoError(t, client.Close())
+	require.NoError(t, <-done)
+	serverConn.Close()
+
+	// Serve on a unix socket
+	dir, err := ioutil.TempDir("", "tpmk")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "signer.sock")
+	l, err := net.Listen("unix", path)
+	require.NoError(t, err)
+	defer l.Close()
+	go server.Serve(l)
+
+	client, err = DialSigner(path)
+	require.NoError(t, err)
+	defer client.Close()
+	sig, err = client.Sign(nil, digest[:], crypto.SHA256)
+	require.NoError(t, err)
+	require.NoError(t, rsa.VerifyPKCS1v15(pub.(*rsa.PublicKey), crypto.SHA256, digest[:], sig))
+}
+
+// socketConn turns a socket file descriptor into a connection.
+func socketConn(t *testing.T, fd int) net.Conn {
+	f := os.NewFile(uintptr(fd), "socket")
+	defer f.Close()
+	conn, err := net.FileConn(f)
+	require.NoError(t, err)
+	return conn
+}
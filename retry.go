@@ -0,0 +1,68 @@
+package tpmk
+
+import (
+	"encoding/binary"
+	"io"
+	"time"
+
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpmutil"
+)
+
+// retryDevice resends commands the TPM answered with a transient warning.
+type retryDevice struct {
+	io.ReadWriteCloser
+	attempts int
+	backoff  time.Duration
+	cmd      []byte
+}
+
+// NewRetryDevice wraps a TPM device so commands the TPM didn't run because it was busy are sent
+// again. Discrete TPMs answer with TPM_RC_RETRY, TPM_RC_YIELDED or TPM_RC_TESTING under load or
+// while testing themselves, these are retried up to attempts times in total, waiting backoff
+// before the first retry and twice as long before each further one. If the TPM is still busy
+// after the last attempt, the warning is returned as tpm2.Warning. All other responses, including
+// errors, are returned right away. Since every command is retried, keys, key generation and NV
+// functions all benefit from it when used with the returned device.
+func NewRetryDevice(dev io.ReadWriteCloser, attempts int, backoff time.Duration) io.ReadWriteCloser {
+	return &retryDevice{ReadWriteCloser: dev, attempts: attempts, backoff: backoff}
+}
+
+// Write sends a command to the TPM and keeps a copy of it to send it again if needed. Commands
+// are written in one piece.
+func (d *retryDevice) Write(b []byte) (int, error) {
+	d.cmd = append(d.cmd[:0], b...)
+	return d.ReadWriteCloser.Write(b)
+}
+
+// Read receives the response to the last command, resending it while the TPM is busy.
+func (d *retryDevice) Read(b []byte) (int, error) {
+	n, err := d.ReadWriteCloser.Read(b)
+	delay := d.backoff
+	for attempt := 1; attempt < d.attempts && err == nil && isTransient(b[:n]); attempt++ {
+		time.Sleep(delay)
+		delay *= 2
+		if _, err := d.ReadWriteCloser.Write(d.cmd); err != nil {
+			return 0, err
+		}
+		n, err = d.ReadWriteCloser.Read(b)
+	}
+	return n, err
+}
+
+// isTransient returns true if a response is a warning that the command wasn't run and can be
+// sent again as is.
+func isTransient(resp []byte) bool {
+	if len(resp) < tpmHeaderSize {
+		return false
+	}
+	w, ok := decodeResponse(tpmutil.ResponseCode(binary.BigEndian.Uint32(resp[6:]))).(tpm2.Warning)
+	if !ok {
+		return false
+	}
+	switch w.Code {
+	case tpm2.RCRetry, tpm2.RCYielded, tpm2.RCTesting:
+		return true
+	}
+	return false
+}
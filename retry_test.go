@@ -0,0 +1,96 @@
+package tpmk
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/google/go-tpm-tools/simulator"
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpmutil"
+	"github.com/stretchr/testify/require"
+)
+
+// busyDev answers the first commands with a warning instead of passing them to the TPM.
+type busyDev struct {
+	io.ReadWriteCloser
+	busy    int // Number of commands to answer with the warning
+	warning tpmutil.ResponseCode
+	writes  int
+	pending []byte
+}
+
+func (d *busyDev) Write(b []byte) (int, error) {
+	d.writes++
+	if d.busy > 0 {
+		d.busy--
+		d.pending = make([]byte, tpmHeaderSize)
+		binary.BigEndian.PutUint16(d.pending, 0x8001)
+		binary.BigEndian.PutUint32(d.pending[2:], tpmHeaderSize)
+		binary.BigEndian.PutUint32(d.pending[6:], uint32(d.warning))
+		return len(b), nil
+	}
+	return d.ReadWriteCloser.Write(b)
+}
+
+func (d *busyDev) Read(b []byte) (int, error) {
+	if d.pending != nil {
+		n := copy(b, d.pending)
+		d.pending = nil
+		return n, nil
+	}
+	return d.ReadWriteCloser.Read(b)
+}
+
+func TestRetryDevice(t *testing.T) {
+	sim, err := simulator.Get()
+	require.NoError(t, err)
+	defer sim.Close()
+
+	const (
+		handle = 0x81000000
+		pw     = ""
+		attr   = tpm2.FlagSign | tpm2.FlagUserWithAuth | tpm2.FlagSensitiveDataOrigin
+	)
+	pub, err := GenRSAPrimaryKey(sim, handle, pw, pw, attr)
+	require.NoError(t, err)
+	digest := sha256.Sum256([]byte("This is a test"))
+
+	// Transient warnings are retried until the TPM runs the command
+	for name, warning := range map[string]tpmutil.ResponseCode{
+		"retry":   0x922,
+		"yielded": 0x908,
+		"testing": 0x90A,
+	} {
+		t.Run(name, func(t *testing.T) {
+			busy := &busyDev{ReadWriteCloser: sim, warning: warning}
+			priv, err := NewRSAPrivateKey(NewRetryDevice(busy, 3, time.Millisecond), handle, pw)
+			require.NoError(t, err)
+			busy.busy, busy.writes = 2, 0
+			sig, err := priv.Sign(nil, digest[:], crypto.SHA256)
+			require.NoError(t, err)
+			require.NoError(t, rsa.VerifyPKCS1v15(pub.(*rsa.PublicKey), crypto.SHA256, digest[:], sig))
+			require.Equal(t, 3, busy.writes)
+		})
+	}
+
+	// The warning is returned once the attempts are used up
+	busy := &busyDev{ReadWriteCloser: sim, warning: 0x922, busy: 3}
+	_, _, err = ReadPublicKey(NewRetryDevice(busy, 3, time.Millisecond), handle)
+	require.Equal(t, tpm2.Warning{Code: tpm2.RCRetry}, err)
+	require.Equal(t, 3, busy.writes)
+
+	// Other warnings and errors aren't retried
+	busy = &busyDev{ReadWriteCloser: sim, warning: 0x920, busy: 1} // TPM_RC_NV_RATE
+	_, _, err = ReadPublicKey(NewRetryDevice(busy, 3, time.Millisecond), handle)
+	require.Equal(t, tpm2.Warning{Code: tpm2.RCNVRate}, err)
+	require.Equal(t, 1, busy.writes)
+	busy = &busyDev{ReadWriteCloser: sim}
+	_, _, err = ReadPublicKey(NewRetryDevice(busy, 3, time.Millisecond), handle+1)
+	require.Error(t, err)
+	require.Equal(t, 1, busy.writes)
+}
@@ -0,0 +1,144 @@
+package tpmk
+
+import (
+	"encoding/binary"
+	"io"
+
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpmutil"
+)
+
+// RollbackSealed holds data sealed with AntiRollbackSeal as well as the counter and version it
+// is bound to.
+type RollbackSealed struct {
+	Counter tpmutil.Handle
+	Version uint64
+	Public  []byte
+	Private []byte
+}
+
+// AntiRollbackSeal seals data under a parent storage key. The data can only be unsealed while the
+// monotonic counter in the given NV index is at or above version. Since counters can't be
+// decremented, this prevents older firmware from accessing secrets sealed for a newer one. The
+// counter is defined if it doesn't exist yet.
+func AntiRollbackSeal(dev io.ReadWriteCloser, parent tpmutil.Handle, parentPW string, counter tpmutil.Handle, counterPW string, version uint64, data []byte) (RollbackSealed, error) {
+	indexes, err := NVList(dev)
+	if err != nil {
+		return RollbackSealed{}, err
+	}
+	if !containsHandle(indexes, counter) {
+		if err := NVDefineCounter(dev, counter, counterPW); err != nil {
+			return RollbackSealed{}, err
+		}
+	}
+
+	// Calculate the policy digest with a trial session
+	session, err := startPolicySession(dev, tpm2.SessionTrial)
+	if err != nil {
+		return RollbackSealed{}, err
+	}
+	defer tpm2.FlushContext(dev, session)
+	if err := policyCounterGE(dev, session, counter, counterPW, version); err != nil {
+		return RollbackSealed{}, err
+	}
+	policy, err := tpm2.PolicyGetDigest(dev, session)
+	if err != nil {
+		return RollbackSealed{}, err
+	}
+
+	private, public, err := tpm2.Seal(dev, parent, parentPW, "", policy, data)
+	if err != nil {
+		return RollbackSealed{}, err
+	}
+	return RollbackSealed{counter, version, public, private}, nil
+}
+
+// AntiRollbackUnseal returns data sealed with AntiRollbackSeal. It fails if the counter is lower
+// than the version the data was sealed for, and returns ErrForeignKey if the data was sealed with
+// a different TPM.
+func AntiRollbackUnseal(dev io.ReadWriteCloser, parent tpmutil.Handle, parentPW, counterPW string, sealed RollbackSealed) ([]byte, error) {
+	handle, _, err := tpm2.Load(dev, parent, parentPW, sealed.Public, sealed.Private)
+	if err != nil {
+		return nil, foreignKeyError(err)
+	}
+	defer tpm2.FlushContext(dev, handle)
+
+	session, err := startPolicySession(dev, tpm2.SessionPolicy)
+	if err != nil {
+		return nil, err
+	}
+	defer tpm2.FlushContext(dev, session)
+	if err := policyCounterGE(dev, session, sealed.Counter, counterPW, sealed.Version); err != nil {
+		return nil, err
+	}
+	return tpm2.UnsealWithSession(dev, session, handle, "")
+}
+
+// PCRSealed holds data sealed with SealPCRs and the PCRs it is bound to.
+type PCRSealed struct {
+	Selection tpm2.PCRSelection
+	Public    []byte
+	Private   []byte
+}
+
+// SealPCRs seals data under a parent storage key so it can only be unsealed while the selected
+// PCRs have the values the expected digest was calculated from, see PCRDigest. If expectedDigest
+// is empty, the data is sealed to the current values of the PCRs.
+func SealPCRs(dev io.ReadWriteCloser, parent tpmutil.Handle, parentPW string, sel tpm2.PCRSelection, expectedDigest, data []byte) (PCRSealed, error) {
+	policy, err := PolicyDigest(dev, PCRPolicy(sel, expectedDigest))
+	if err != nil {
+		return PCRSealed{}, err
+	}
+
+	private, public, err := tpm2.Seal(dev, parent, parentPW, "", policy, data)
+	if err != nil {
+		return PCRSealed{}, err
+	}
+	return PCRSealed{sel, public, private}, nil
+}
+
+// UnsealPCRs returns data sealed with SealPCRs. It fails if the PCRs don't have the values the
+// data was sealed to, and returns ErrForeignKey if the data was sealed with a different TPM.
+func UnsealPCRs(dev io.ReadWriteCloser, parent tpmutil.Handle, parentPW string, sealed PCRSealed) ([]byte, error) {
+	handle, _, err := tpm2.Load(dev, parent, parentPW, sealed.Public, sealed.Private)
+	if err != nil {
+		return nil, foreignKeyError(err)
+	}
+	defer tpm2.FlushContext(dev, handle)
+
+	session, err := startSatisfiedSession(dev, PCRPolicy(sealed.Selection, nil))
+	if err != nil {
+		return nil, err
+	}
+	defer tpm2.FlushContext(dev, session)
+	return tpm2.UnsealWithSession(dev, session, handle, "")
+}
+
+// Reseal unseals data sealed with SealPCRs and seals it again to new PCR values, typically the
+// values expected after a firmware update. It needs to be called while the PCRs still have the
+// values the data was originally sealed to.
+func Reseal(dev io.ReadWriteCloser, parent tpmutil.Handle, parentPW string, sealed PCRSealed, sel tpm2.PCRSelection, expectedDigest []byte) (PCRSealed, error) {
+	data, err := UnsealPCRs(dev, parent, parentPW, sealed)
+	if err != nil {
+		return PCRSealed{}, err
+	}
+	return SealPCRs(dev, parent, parentPW, sel, expectedDigest, data)
+}
+
+// policyCounterGE extends a policy session with the condition that the counter in an NV index is
+// at or above a value.
+func policyCounterGE(dev io.ReadWriter, session, counter tpmutil.Handle, password string, value uint64) error {
+	operand := make([]byte, 8)
+	binary.BigEndian.PutUint64(operand, value)
+	return policyNV(dev, session, counter, password, operand, 0, eoUnsignedGE)
+}
+
+// containsHandle returns true if h is in the list of handles.
+func containsHandle(handles []tpmutil.Handle, h tpmutil.Handle) bool {
+	for _, v := range handles {
+		if v == h {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,113 @@
+package tpmk
+
+import (
+	"crypto/sha256"
+	"testing"
+
+	"github.com/google/go-tpm-tools/simulator"
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpmutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAntiRollbackSeal(t *testing.T) {
+	dev, err := simulator.Get()
+	require.NoError(t, err)
+	defer dev.Close()
+
+	const (
+		parent  tpmutil.Handle = 0x81000000
+		counter tpmutil.Handle = 0x1000000
+		pw                     = ""
+	)
+	data := []byte("secret")
+
+	_, err = GenRSAPrimaryKey(dev, parent, pw, pw, tpm2.FlagStorageDefault)
+	require.NoError(t, err)
+
+	// Define the counter and read its initial value
+	err = NVDefineCounter(dev, counter, pw)
+	require.NoError(t, err)
+	version := readCounter(t, dev, counter)
+
+	// Seal for the next version, which should not be accessible yet
+	sealed, err := AntiRollbackSeal(dev, parent, pw, counter, pw, version+1, data)
+	require.NoError(t, err)
+	_, err = AntiRollbackUnseal(dev, parent, pw, pw, sealed)
+	require.Error(t, err)
+
+	// Move the counter to the version the data was sealed for
+	err = tpm2.NVIncrement(dev, counter, pw)
+	require.NoError(t, err)
+	out, err := AntiRollbackUnseal(dev, parent, pw, pw, sealed)
+	require.NoError(t, err)
+	require.Equal(t, data, out)
+
+	// Data sealed for an older version remains accessible
+	sealed, err = AntiRollbackSeal(dev, parent, pw, counter, pw, version, data)
+	require.NoError(t, err)
+	out, err = AntiRollbackUnseal(dev, parent, pw, pw, sealed)
+	require.NoError(t, err)
+	require.Equal(t, data, out)
+}
+
+func TestReseal(t *testing.T) {
+	dev, err := simulator.Get()
+	require.NoError(t, err)
+	defer dev.Close()
+
+	const (
+		parent tpmutil.Handle = 0x81000000
+		pcr                   = 16
+		pw                    = ""
+	)
+	data := []byte("secret")
+	sel := tpm2.PCRSelection{Hash: tpm2.AlgSHA256, PCRs: []int{pcr}}
+
+	_, err = GenRSAPrimaryKey(dev, parent, pw, pw, tpm2.FlagStorageDefault)
+	require.NoError(t, err)
+
+	// Seal to the current value of the PCR
+	sealed, err := SealPCRs(dev, parent, pw, sel, nil, data)
+	require.NoError(t, err)
+	out, err := UnsealPCRs(dev, parent, pw, sealed)
+	require.NoError(t, err)
+	require.Equal(t, data, out)
+
+	// Predict the value of the PCR after an update extends it, and reseal to that
+	current, err := tpm2.ReadPCR(dev, pcr, tpm2.AlgSHA256)
+	require.NoError(t, err)
+	measurement := sha256.Sum256([]byte("new firmware"))
+	next := sha256.Sum256(append(current, measurement[:]...))
+	expected, err := PCRDigest(map[int][]byte{pcr: next[:]}, sel.PCRs)
+	require.NoError(t, err)
+	resealed, err := Reseal(dev, parent, pw, sealed, sel, expected)
+	require.NoError(t, err)
+
+	// The new blob isn't accessible until the update is applied
+	_, err = UnsealPCRs(dev, parent, pw, resealed)
+	require.Error(t, err)
+
+	// After the update, only the resealed data can be unsealed
+	require.NoError(t, tpm2.PCRExtend(dev, pcr, tpm2.AlgSHA256, measurement[:], ""))
+	_, err = UnsealPCRs(dev, parent, pw, sealed)
+	require.Error(t, err)
+	out, err = UnsealPCRs(dev, parent, pw, resealed)
+	require.NoError(t, err)
+	require.Equal(t, data, out)
+
+	// Resealing fails once the original PCR state is gone
+	_, err = Reseal(dev, parent, pw, sealed, sel, expected)
+	require.Error(t, err)
+}
+
+func readCounter(t *testing.T, dev *simulator.Simulator, index tpmutil.Handle) uint64 {
+	b, err := NVRead(dev, index, "")
+	require.NoError(t, err)
+	require.Len(t, b, 8)
+	var v uint64
+	for _, c := range b {
+		v = v<<8 | uint64(c)
+	}
+	return v
+}
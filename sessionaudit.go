@@ -0,0 +1,231 @@
+package tpmk
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpmutil"
+)
+
+// Structure tag of session audit attestations, missing in go-tpm
+const tagAttestSessionAudit tpmutil.Tag = 0x8016
+
+// AuditSession is an HMAC session that audits the commands executed in it. The TPM maintains a
+// digest over all audited commands and their responses, which can be signed with
+// GetSessionAuditDigest to prove to a relying party exactly which commands ran. The same digest
+// is calculated locally to compare against.
+type AuditSession struct {
+	dev      io.ReadWriter
+	handle   tpmutil.Handle
+	nonceTPM []byte
+	digest   []byte
+}
+
+// SessionAudit is a signed session audit digest.
+type SessionAudit struct {
+	Attest    []byte // TPMS_ATTEST structure
+	Signature []byte // RSASSA-SHA256 signature of Attest
+}
+
+// StartAuditSession starts an unbound and unsalted HMAC session for auditing. Close needs to be
+// called when done with it.
+func StartAuditSession(dev io.ReadWriter) (*AuditSession, error) {
+	handle, nonceTPM, err := tpm2.StartAuthSession(dev,
+		tpm2.HandleNull,
+		tpm2.HandleNull,
+		make([]byte, 16),
+		nil,
+		tpm2.SessionHMAC,
+		tpm2.AlgNull,
+		tpm2.AlgSHA256,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &AuditSession{dev: dev, handle: handle, nonceTPM: nonceTPM, digest: make([]byte, sha256.Size)}, nil
+}
+
+// Close flushes the session.
+func (s *AuditSession) Close() error {
+	return tpm2.FlushContext(s.dev, s.handle)
+}
+
+// Handle returns the handle of the session in the TPM.
+func (s *AuditSession) Handle() tpmutil.Handle {
+	return s.handle
+}
+
+// Digest returns the audit digest over the commands executed so far, as calculated locally.
+func (s *AuditSession) Digest() []byte {
+	return append([]byte(nil), s.digest...)
+}
+
+// Sign signs a digest with RSASSA-SHA256 using an unrestricted signing key, auditing the command
+// in the session.
+func (s *AuditSession) Sign(key tpmutil.Handle, password string, digest []byte) ([]byte, error) {
+	_, name, _, err := tpm2.ReadPublic(s.dev, key)
+	if err != nil {
+		return nil, err
+	}
+	params, err := tpmutil.Pack(digest, tpm2.AlgRSASSA, tpm2.AlgSHA256, tpm2.TagHashCheck, tpm2.HandleNull, []byte(nil))
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.run(cmdSign, key, name, password, params)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		sigAlg tpm2.Algorithm
+		hash   tpm2.Algorithm
+		sig    []byte
+	)
+	if _, err := tpmutil.Unpack(resp, &sigAlg, &hash, &sig); err != nil {
+		return nil, err
+	}
+	return sig, nil
+}
+
+// run executes a command with one handle, authorized with a password, and with the session
+// attached for audit only. The command can't have response handles. The audit digest is extended
+// with the command and the returned response parameters.
+func (s *AuditSession) run(cc tpmutil.Command, handle tpmutil.Handle, name []byte, password string, params []byte) ([]byte, error) {
+	// The HMAC of an audit session that doesn't authorize anything, and is neither bound nor
+	// salted, uses an empty key (TPM 2.0 Part 1, Section 19.6)
+	ccBytes, err := tpmutil.Pack(cc)
+	if err != nil {
+		return nil, err
+	}
+	cpHash := hashConcat(ccBytes, name, params)
+	nonceCaller := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, nonceCaller); err != nil {
+		return nil, err
+	}
+	attr := tpm2.AttrContinueSession | tpm2.AttrAudit
+	mac := hmac.New(sha256.New, nil)
+	mac.Write(cpHash)
+	mac.Write(nonceCaller)
+	mac.Write(s.nonceTPM)
+	mac.Write([]byte{byte(attr)})
+
+	cmd, err := encodeCommand(
+		[]interface{}{handle},
+		[]tpm2.AuthCommand{
+			passwordAuth(password),
+			{Session: s.handle, Nonce: nonceCaller, Attributes: attr, Auth: mac.Sum(nil)},
+		},
+		tpmutil.RawBytes(params),
+	)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := runCommand(s.dev, tpm2.TagSessions, cc, cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	// Split the response into parameters and the auth area with the new TPM nonce
+	var size uint32
+	if _, err := tpmutil.Unpack(resp, &size); err != nil {
+		return nil, err
+	}
+	if len(resp) < 4+int(size) {
+		return nil, errors.New("response parameters are truncated")
+	}
+	rp := resp[4 : 4+size]
+	var (
+		pwNonce, pwHMAC, nonceTPM, respHMAC []byte
+		pwAttr, respAttr                    byte
+	)
+	if _, err := tpmutil.Unpack(resp[4+size:], &pwNonce, &pwAttr, &pwHMAC, &nonceTPM, &respAttr, &respHMAC); err != nil {
+		return nil, err
+	}
+	s.nonceTPM = nonceTPM
+
+	rpHash := hashConcat([]byte{0, 0, 0, 0}, ccBytes, rp)
+	s.digest = hashConcat(s.digest, cpHash, rpHash)
+	return rp, nil
+}
+
+// GetSessionAuditDigest has the TPM sign the audit digest of the session with an RSA signing key
+// using RSASSA-SHA256. The nonce is included in the signed data and should be provided by the
+// relying party. Access to the digest is authorized with the endorsement hierarchy password.
+func GetSessionAuditDigest(dev io.ReadWriter, session tpmutil.Handle, endorsementPW string, signer tpmutil.Handle, signerPW string, nonce []byte) (SessionAudit, error) {
+	cmd, err := encodeCommand(
+		[]interface{}{tpm2.HandleEndorsement, signer, session},
+		[]tpm2.AuthCommand{passwordAuth(endorsementPW), passwordAuth(signerPW)},
+		nonce, tpm2.AlgRSASSA, tpm2.AlgSHA256,
+	)
+	if err != nil {
+		return SessionAudit{}, err
+	}
+	resp, err := runCommand(dev, tpm2.TagSessions, cmdGetSessionAuditDigest, cmd)
+	if err != nil {
+		return SessionAudit{}, err
+	}
+	var (
+		paramSize uint32
+		attest    []byte
+		sigAlg    tpm2.Algorithm
+		hashAlg   tpm2.Algorithm
+		signature []byte
+	)
+	if _, err := tpmutil.Unpack(resp, &paramSize, &attest, &sigAlg, &hashAlg, &signature); err != nil {
+		return SessionAudit{}, err
+	}
+	return SessionAudit{attest, signature}, nil
+}
+
+// VerifySessionAudit checks that a session audit was signed by pub and includes the nonce. It
+// returns the attested audit digest, which the relying party needs to compare with the digest
+// over the commands it expects to have run.
+func VerifySessionAudit(pub crypto.PublicKey, audit SessionAudit, nonce []byte) ([]byte, error) {
+	rsaPub, ok := pub.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("unsupported key type %T", pub)
+	}
+	digest := sha256.Sum256(audit.Attest)
+	if err := rsa.VerifyPKCS1v15(rsaPub, crypto.SHA256, digest[:], audit.Signature); err != nil {
+		return nil, err
+	}
+	var (
+		magic         uint32
+		typ           tpmutil.Tag
+		signer        []byte
+		extraData     []byte
+		clock         tpm2.ClockInfo
+		firmware      uint64
+		exclusive     byte
+		sessionDigest []byte
+	)
+	if _, err := tpmutil.Unpack(audit.Attest, &magic, &typ, &signer, &extraData, &clock, &firmware, &exclusive, &sessionDigest); err != nil {
+		return nil, err
+	}
+	if magic != attestMagic {
+		return nil, errors.New("attestation not generated by a TPM")
+	}
+	if typ != tagAttestSessionAudit {
+		return nil, fmt.Errorf("not a session audit, type 0x%x", typ)
+	}
+	if !bytes.Equal(extraData, nonce) {
+		return nil, errors.New("attestation nonce mismatch")
+	}
+	return sessionDigest, nil
+}
+
+// hashConcat returns the SHA256 hash of the concatenated inputs.
+func hashConcat(b ...[]byte) []byte {
+	h := sha256.New()
+	for _, v := range b {
+		h.Write(v)
+	}
+	return h.Sum(nil)
+}
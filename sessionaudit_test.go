@@ -0,0 +1,53 @@
+package tpmk
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"testing"
+
+	"github.com/google/go-tpm-tools/simulator"
+	"github.com/google/go-tpm/tpm2"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSessionAudit(t *testing.T) {
+	dev, err := simulator.Get()
+	require.NoError(t, err)
+	defer dev.Close()
+
+	const (
+		handle = 0x81000000
+		pw     = ""
+		attr   = tpm2.FlagSign | tpm2.FlagFixedTPM | tpm2.FlagUserWithAuth | tpm2.FlagFixedParent | tpm2.FlagSensitiveDataOrigin
+	)
+	pub, err := GenRSAPrimaryKey(dev, handle, pw, pw, attr)
+	require.NoError(t, err)
+
+	session, err := StartAuditSession(dev)
+	require.NoError(t, err)
+	defer session.Close()
+
+	// Sign twice in the audited session
+	for i := 0; i < 2; i++ {
+		digest := make([]byte, 32)
+		digest[0] = byte(i)
+		sig, err := session.Sign(handle, pw, digest)
+		require.NoError(t, err)
+		require.NoError(t, rsa.VerifyPKCS1v15(pub.(*rsa.PublicKey), crypto.SHA256, digest, sig))
+	}
+
+	// Have the TPM sign the audit digest, with the same key for simplicity
+	nonce := []byte("nonce")
+	audit, err := GetSessionAuditDigest(dev, session.Handle(), "", handle, pw, nonce)
+	require.NoError(t, err)
+	digest, err := VerifySessionAudit(pub, audit, nonce)
+	require.NoError(t, err)
+	require.Equal(t, session.Digest(), digest)
+
+	// Verification fails with the wrong nonce or a modified attestation
+	_, err = VerifySessionAudit(pub, audit, []byte("other"))
+	require.Error(t, err)
+	audit.Attest[len(audit.Attest)-1] ^= 1
+	_, err = VerifySessionAudit(pub, audit, nonce)
+	require.Error(t, err)
+}
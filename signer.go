@@ -0,0 +1,197 @@
+package tpmk
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"sync"
+
+	"github.com/google/go-tpm/tpmutil"
+)
+
+// Signer is implemented by keys in the TPM and is compatible with crypto.Signer. Application code
+// can depend on it rather than a concrete key type and use a FakeSigner in tests that don't have
+// access to a TPM.
+type Signer interface {
+	Public() crypto.PublicKey
+	Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) (signature []byte, err error)
+}
+
+var (
+	_ Signer = RSAPrivateKey{}
+	_ Signer = ECPrivateKey{}
+	_ Signer = ContextSigner{}
+	_ Signer = &RemoteSigner{}
+	_ Signer = FakeSigner{}
+
+	_ io.Closer = RSAPrivateKey{}
+	_ io.Closer = ECPrivateKey{}
+	_ io.Closer = ContextSigner{}
+	_ io.Closer = &RemoteSigner{}
+)
+
+// SignMessage hashes a message with the hash function in opts and signs the digest. It's the
+// same as SignMessageInDomain with an empty domain, so the digest isn't the plain hash of msg.
+func SignMessage(k Signer, msg []byte, opts crypto.SignerOpts) ([]byte, error) {
+	return SignMessageInDomain(k, "", msg, opts)
+}
+
+// SignMessageInDomain signs a message in a specific domain, such as the name of a protocol. The
+// signature is only valid within that domain, preventing a signature produced for one purpose to
+// be replayed for another when the same key is used for both, or by SignMessage. An empty domain
+// is the same as calling SignMessage. Use DomainDigest to verify the signature.
+func SignMessageInDomain(k Signer, domain string, msg []byte, opts crypto.SignerOpts) ([]byte, error) {
+	digest, err := DomainDigest(opts.HashFunc(), domain, msg)
+	if err != nil {
+		return nil, err
+	}
+	return k.Sign(rand.Reader, digest, opts)
+}
+
+// ChallengeDomain is the domain of signatures produced by SignChallenge.
+const ChallengeDomain = "tpmk challenge"
+
+// MinChallengeSize is the minimum size of a nonce accepted by SignChallenge.
+const MinChallengeSize = 16
+
+// SignChallenge signs a nonce sent by a server to prove possession of the key, with RSASSA-PSS if
+// pss is set and PKCS#1 v1.5 otherwise. The signature is produced in ChallengeDomain, so a
+// server can't use the challenge to obtain signatures over arbitrary data. Nonces need to be
+// random and at least MinChallengeSize bytes long. Use VerifyChallenge to check the signature.
+func SignChallenge(k Signer, nonce []byte, hash crypto.Hash, pss bool) ([]byte, error) {
+	if len(nonce) < MinChallengeSize {
+		return nil, fmt.Errorf("challenge nonce needs to be at least %d bytes", MinChallengeSize)
+	}
+	return SignMessageInDomain(k, ChallengeDomain, nonce, challengeOpts(hash, pss))
+}
+
+// VerifyChallenge checks a signature produced by SignChallenge for the nonce.
+func VerifyChallenge(pub crypto.PublicKey, nonce, sig []byte, hash crypto.Hash, pss bool) error {
+	if _, ok := pub.(*rsa.PublicKey); !ok {
+		return fmt.Errorf("unsupported key type %T", pub)
+	}
+	digest, err := DomainDigest(hash, ChallengeDomain, nonce)
+	if err != nil {
+		return err
+	}
+	if pss {
+		return Verify(pub, digest, sig, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthAuto, Hash: hash})
+	}
+	return Verify(pub, digest, sig, hash)
+}
+
+// challengeOpts returns the signer options for a challenge signature.
+func challengeOpts(hash crypto.Hash, pss bool) crypto.SignerOpts {
+	if pss {
+		return &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: hash}
+	}
+	return hash
+}
+
+// DomainDigest returns the digest that's signed by SignMessageInDomain. The domain is prefixed
+// to the message together with its length before hashing, even if it's empty, so a message can't
+// be crafted to produce the digest of another domain.
+func DomainDigest(hash crypto.Hash, domain string, msg []byte) ([]byte, error) {
+	if !hash.Available() {
+		return nil, UnsupportedHashError{Hash: hash}
+	}
+	if len(domain) > math.MaxUint16 {
+		return nil, errors.New("domain too long")
+	}
+	h := hash.New()
+	length := make([]byte, 2)
+	binary.BigEndian.PutUint16(length, uint16(len(domain)))
+	h.Write(length)
+	h.Write([]byte(domain))
+	h.Write(msg)
+	return h.Sum(nil), nil
+}
+
+// FakeSigner is an in-memory software key that implements Signer. It's meant to be used in tests
+// in place of a key in the TPM and offers none of its protection.
+type FakeSigner struct {
+	key *rsa.PrivateKey
+}
+
+// NewFakeSigner generates an in-memory RSA key of the given size.
+func NewFakeSigner(bits int) (FakeSigner, error) {
+	key, err := rsa.GenerateKey(rand.Reader, bits)
+	if err != nil {
+		return FakeSigner{}, err
+	}
+	return FakeSigner{key}, nil
+}
+
+// Public returns the public part of the key.
+func (k FakeSigner) Public() crypto.PublicKey {
+	return k.key.Public()
+}
+
+// Sign digests with the in-memory key. Like RSAPrivateKey, the PSS signature algorithm is used if
+// opts are *rsa.PSSOptions, PKCS#1 1.5 otherwise. The rand argument is ignored.
+func (k FakeSigner) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	return k.key.Sign(rand.Reader, digest, opts)
+}
+
+// Decrypt decrypts ciphertext with the in-memory key. Like RSAPrivateKey, PKCS#1 v1.5 is used
+// if opts is nil or *rsa.PKCS1v15DecryptOptions, OAEP if it's *rsa.OAEPOptions.
+func (k FakeSigner) Decrypt(_ io.Reader, msg []byte, opts crypto.DecrypterOpts) ([]byte, error) {
+	return k.key.Decrypt(rand.Reader, msg, opts)
+}
+
+// SignerOption configures how NewSigner obtains a key.
+type SignerOption func(*signerOptions)
+
+type signerOptions struct {
+	insecureDevKey bool
+}
+
+// WithInsecureDevKey lets NewSigner fall back to an in-memory software key when no TPM device is
+// given. It's meant for development and CI machines without a TPM or simulator, and must never be
+// used in production since the key has none of the protection of a TPM.
+func WithInsecureDevKey() SignerOption {
+	return func(o *signerOptions) { o.insecureDevKey = true }
+}
+
+// Software keys handed out by NewSigner, by handle, so the same handle returns the same key
+// within a process like a persistent key would.
+var (
+	devKeysMu sync.Mutex
+	devKeys   = make(map[tpmutil.Handle]FakeSigner)
+)
+
+// NewSigner returns the key at the handle in the TPM, like NewPrivateKey. If dev is nil and
+// WithInsecureDevKey is given, a software key is returned instead and a warning is logged. The
+// key is generated on first use of the handle and lives until the process exits, the password
+// is ignored. This allows application code to run unchanged without a TPM.
+func NewSigner(dev io.ReadWriteCloser, handle tpmutil.Handle, password string, opts ...SignerOption) (Signer, error) {
+	var o signerOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if dev != nil {
+		return NewPrivateKey(dev, handle, password)
+	}
+	if !o.insecureDevKey {
+		return nil, errors.New("no TPM device")
+	}
+
+	log.Printf("WARNING: using an INSECURE in-memory software key for handle 0x%x instead of the TPM, for development only", handle)
+	devKeysMu.Lock()
+	defer devKeysMu.Unlock()
+	if k, ok := devKeys[handle]; ok {
+		return k, nil
+	}
+	k, err := NewFakeSigner(2048)
+	if err != nil {
+		return nil, err
+	}
+	devKeys[handle] = k
+	return k, nil
+}
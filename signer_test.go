@@ -0,0 +1,142 @@
+package tpmk
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"log"
+	"os"
+	"testing"
+
+	"github.com/google/go-tpm-tools/simulator"
+	"github.com/google/go-tpm/tpm2"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewSignerInsecureDevKey(t *testing.T) {
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	// Without the option, a TPM is required
+	_, err := NewSigner(nil, 0x81000000, "")
+	require.Error(t, err)
+	require.Empty(t, logs.String())
+
+	// With it, software keys are used, and the same handle returns the same key
+	clientPriv, err := NewSigner(nil, 0x81000000, "", WithInsecureDevKey())
+	require.NoError(t, err)
+	require.Contains(t, logs.String(), "WARNING: using an INSECURE in-memory software key for handle 0x81000000")
+	serverPriv, err := NewSigner(nil, 0x81000001, "", WithInsecureDevKey())
+	require.NoError(t, err)
+	require.NotEqual(t, clientPriv.Public(), serverPriv.Public())
+	again, err := NewSigner(nil, 0x81000000, "", WithInsecureDevKey())
+	require.NoError(t, err)
+	require.Equal(t, clientPriv.Public(), again.Public())
+
+	testMutualTLS(t, clientPriv, serverPriv)
+}
+
+func TestFakeSignerMutualTLS(t *testing.T) {
+	clientPriv, err := NewFakeSigner(2048)
+	require.NoError(t, err)
+	serverPriv, err := NewFakeSigner(2048)
+	require.NoError(t, err)
+
+	testMutualTLS(t, clientPriv, serverPriv)
+}
+
+func TestSignMessageInDomain(t *testing.T) {
+	dev, err := simulator.Get()
+	require.NoError(t, err)
+	defer dev.Close()
+
+	const (
+		handle = 0x81000000
+		pw     = ""
+		attr   = tpm2.FlagSign | tpm2.FlagUserWithAuth | tpm2.FlagSensitiveDataOrigin
+	)
+
+	pub, err := GenRSAPrimaryKey(dev, handle, pw, pw, attr)
+	require.NoError(t, err)
+	priv, err := NewRSAPrivateKey(dev, handle, pw)
+	require.NoError(t, err)
+
+	msg := []byte("This is a test")
+
+	// PKCS#1 v1.5 signatures are deterministic, so signing in another domain has to produce
+	// a different signature
+	plain, err := SignMessage(priv, msg, crypto.SHA256)
+	require.NoError(t, err)
+	sigA, err := SignMessageInDomain(priv, "protocol-a", msg, crypto.SHA256)
+	require.NoError(t, err)
+	sigB, err := SignMessageInDomain(priv, "protocol-b", msg, crypto.SHA256)
+	require.NoError(t, err)
+	require.NotEqual(t, plain, sigA)
+	require.NotEqual(t, sigA, sigB)
+
+	// The signature only verifies in its own domain
+	digestA, err := DomainDigest(crypto.SHA256, "protocol-a", msg)
+	require.NoError(t, err)
+	digestB, err := DomainDigest(crypto.SHA256, "protocol-b", msg)
+	require.NoError(t, err)
+	require.NoError(t, rsa.VerifyPKCS1v15(pub.(*rsa.PublicKey), crypto.SHA256, digestA, sigA))
+	require.Error(t, rsa.VerifyPKCS1v15(pub.(*rsa.PublicKey), crypto.SHA256, digestB, sigA))
+
+	// Without a domain, it's a signature in the empty domain, not of the plain message hash
+	digest, err := DomainDigest(crypto.SHA256, "", msg)
+	require.NoError(t, err)
+	require.NoError(t, rsa.VerifyPKCS1v15(pub.(*rsa.PublicKey), crypto.SHA256, digest, plain))
+	hashed := sha256.Sum256(msg)
+	require.Error(t, rsa.VerifyPKCS1v15(pub.(*rsa.PublicKey), crypto.SHA256, hashed[:], plain))
+
+	// A message without a domain can't be made to look like one in a domain
+	crafted, err := DomainDigest(crypto.SHA256, "", append([]byte("\x00\x0aprotocol-a"), msg...))
+	require.NoError(t, err)
+	require.NotEqual(t, digestA, crafted)
+}
+
+func TestSignChallenge(t *testing.T) {
+	dev, err := simulator.Get()
+	require.NoError(t, err)
+	defer dev.Close()
+
+	const (
+		handle = 0x81000000
+		pw     = ""
+		attr   = tpm2.FlagSign | tpm2.FlagUserWithAuth | tpm2.FlagSensitiveDataOrigin
+	)
+	pub, err := GenRSAPrimaryKey(dev, handle, pw, pw, attr)
+	require.NoError(t, err)
+	priv, err := NewRSAPrivateKey(dev, handle, pw)
+	require.NoError(t, err)
+
+	for _, pss := range []bool{false, true} {
+		// The server sends a random nonce
+		nonce := make([]byte, 32)
+		_, err = rand.Read(nonce)
+		require.NoError(t, err)
+
+		// The device signs it, and the server verifies the response
+		sig, err := SignChallenge(priv, nonce, crypto.SHA256, pss)
+		require.NoError(t, err)
+		require.NoError(t, VerifyChallenge(pub, nonce, sig, crypto.SHA256, pss))
+
+		// It's not valid for other nonces, or as plain signature
+		other := append([]byte{}, nonce...)
+		other[0] ^= 1
+		require.Error(t, VerifyChallenge(pub, other, sig, crypto.SHA256, pss))
+		digest := sha256.Sum256(nonce)
+		if pss {
+			require.Error(t, rsa.VerifyPSS(pub.(*rsa.PublicKey), crypto.SHA256, digest[:], sig, nil))
+		} else {
+			require.Error(t, rsa.VerifyPKCS1v15(pub.(*rsa.PublicKey), crypto.SHA256, digest[:], sig))
+		}
+	}
+
+	// Short nonces are rejected
+	_, err = SignChallenge(priv, []byte("short"), crypto.SHA256, false)
+	require.Error(t, err)
+}
@@ -2,9 +2,13 @@ package tpmk
 
 import (
 	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
 	"encoding/base64"
 	"errors"
 
+	"github.com/google/go-tpm/tpm2"
 	"golang.org/x/crypto/ssh"
 )
 
@@ -29,3 +33,31 @@ func ParseOpenSSHPublicKey(encoded []byte) (ssh.PublicKey, error) {
 
 	return ssh.ParsePublicKey(decoded)
 }
+
+// SSHSigner wraps a key in the TPM, or any other Signer, into an ssh.Signer for public key
+// authentication or as host key. It also implements ssh.AlgorithmSigner, so RSA keys can produce
+// rsa-sha2-256 and rsa-sha2-512 signatures when those are negotiated, which current versions of
+// OpenSSH require since they reject SHA-1 signatures (ssh-rsa). Only RSA and ECDSA keys are
+// supported, and RSA keys restricted to the PSS scheme can't be used since SSH only knows
+// PKCS#1 v1.5 signatures.
+func SSHSigner(key crypto.Signer) (ssh.AlgorithmSigner, error) {
+	switch key.Public().(type) {
+	case *rsa.PublicKey, *ecdsa.PublicKey:
+	default:
+		return nil, UnsupportedKeyError{Key: key.Public()}
+	}
+	if k, ok := key.(RSAPrivateKey); ok {
+		if fixed := k.pub.RSAParameters.Sign; (fixed != nil && fixed.Alg == tpm2.AlgRSAPSS) || k.scheme == tpm2.AlgRSAPSS {
+			return nil, errors.New("key is restricted to PSS signatures, which SSH doesn't support")
+		}
+	}
+	signer, err := ssh.NewSignerFromSigner(key)
+	if err != nil {
+		return nil, err
+	}
+	algSigner, ok := signer.(ssh.AlgorithmSigner)
+	if !ok {
+		return nil, errors.New("ssh signer doesn't support signature algorithms")
+	}
+	return algSigner, nil
+}
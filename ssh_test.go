@@ -1,8 +1,10 @@
 package tpmk
 
 import (
+	"bytes"
 	"crypto/rand"
 	"crypto/rsa"
+	"errors"
 	"math"
 	"net"
 	"testing"
@@ -44,9 +46,18 @@ func TestSSHClient(t *testing.T) {
 	hostKey, err := ssh.NewSignerFromSigner(serverPriv)
 	require.NoError(t, err)
 
+	testSSHHandshake(t, clientKey, hostKey)
+}
+
+// testSSHHandshake connects an SSH client to an in-process server, authenticating the client
+// with its key.
+func testSSHHandshake(t *testing.T, clientKey, hostKey ssh.Signer) {
 	// SSH server and client configs
 	serverConfig := &ssh.ServerConfig{
 		PublicKeyCallback: func(c ssh.ConnMetadata, pubKey ssh.PublicKey) (*ssh.Permissions, error) {
+			if !bytes.Equal(pubKey.Marshal(), clientKey.PublicKey().Marshal()) {
+				return nil, errors.New("unknown key")
+			}
 			return &ssh.Permissions{}, nil
 		},
 	}
@@ -91,6 +102,45 @@ func TestSSHClient(t *testing.T) {
 	ssh.NewClient(c, chans, reqs)
 }
 
+func TestSSHSigner(t *testing.T) {
+	dev, err := simulator.Get()
+	require.NoError(t, err)
+	defer dev.Close()
+
+	const (
+		clientHandle = 0x81000000
+		pw           = ""
+		attr         = tpm2.FlagSign | tpm2.FlagFixedTPM | tpm2.FlagUserWithAuth | tpm2.FlagFixedParent | tpm2.FlagSensitiveDataOrigin
+	)
+	_, err = GenRSAPrimaryKey(dev, clientHandle, pw, pw, attr)
+	require.NoError(t, err)
+	clientPriv, err := NewRSAPrivateKey(dev, clientHandle, pw)
+	require.NoError(t, err)
+	clientKey, err := SSHSigner(clientPriv)
+	require.NoError(t, err)
+	hostPriv, err := NewFakeSigner(2048)
+	require.NoError(t, err)
+	hostKey, err := SSHSigner(hostPriv)
+	require.NoError(t, err)
+
+	testSSHHandshake(t, clientKey, hostKey)
+
+	// SHA-2 signatures are produced by the TPM when asked for
+	data := []byte("session data")
+	for _, alg := range []string{ssh.SigAlgoRSA, ssh.SigAlgoRSASHA2256, ssh.SigAlgoRSASHA2512} {
+		sig, err := clientKey.SignWithAlgorithm(rand.Reader, data, alg)
+		require.NoError(t, err)
+		require.Equal(t, alg, sig.Format)
+		require.NoError(t, clientKey.PublicKey().Verify(data, sig))
+	}
+
+	// SSH has no PSS signatures
+	pss := clientPriv
+	pss.pub.RSAParameters = &tpm2.RSAParams{Sign: &tpm2.SigScheme{Alg: tpm2.AlgRSAPSS, Hash: tpm2.AlgSHA256}}
+	_, err = SSHSigner(pss)
+	require.Error(t, err)
+}
+
 func TestUnmarshalSSHCertificate(t *testing.T) {
 	// Generate am SSH CA
 	ca, err := rsa.GenerateKey(rand.Reader, 2048)
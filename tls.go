@@ -1,8 +1,10 @@
 package tpmk
 
 import (
+	"bytes"
 	"crypto"
 	"crypto/rsa"
+	"crypto/x509"
 	"errors"
 	"fmt"
 	"io"
@@ -12,25 +14,85 @@ import (
 )
 
 // RSAPrivateKey represents an RSA key in a TPM and implements the crypto.PrivateKey interface which
-// allows it to be used in TLS connections.
+// allows it to be used in TLS connections. Signing and decrypting are serialized with other keys
+// on the same device, so one key can be shared in a concurrent TLS server. Other functions using
+// the device, like key generation or the NV functions, aren't serialized with them and must not
+// run at the same time.
 type RSAPrivateKey struct {
 	dev       io.ReadWriter
 	handle    tpmutil.Handle
 	pub       tpm2.Public
 	publicKey crypto.PublicKey
 	password  string
+	audit     AuditSink
+	limiter   *RateLimiter
+	policy    PolicyFunc
+	saltKey   tpmutil.Handle
+	scheme    tpm2.Algorithm
 }
 
 // NewRSAPrivateKey initializes crypto.PrivateKey with a private key that is held in the TPM.
 func NewRSAPrivateKey(dev io.ReadWriteCloser, handle tpmutil.Handle, password string) (RSAPrivateKey, error) {
-	pub, publicKey, err := ReadPublicKey(dev, handle)
+	pub, _, _, err := tpm2.ReadPublic(dev, handle)
 	if err != nil {
 		return RSAPrivateKey{}, err
 	}
+	return NewRSAPrivateKeyFromPublic(dev, handle, password, pub)
+}
+
+// NewRSAPrivateKeyFromPublic initializes a private key in the TPM like NewRSAPrivateKey, but uses
+// the given public area instead of reading it from the TPM. This saves a TPM command when the
+// public area is already known, for example from ReadPublicKey or GenRSAChildKey, and keys are
+// initialized frequently. The public area is trusted, if it doesn't belong to the key at the
+// handle, signatures fail or don't match the public key.
+func NewRSAPrivateKeyFromPublic(dev io.ReadWriteCloser, handle tpmutil.Handle, password string, pub tpm2.Public) (RSAPrivateKey, error) {
 	if pub.Type != tpm2.AlgRSA {
-		return RSAPrivateKey{}, fmt.Errorf("unsupported algorithm %T", publicKey)
+		publicKey, _ := pub.Key()
+		return RSAPrivateKey{}, UnsupportedKeyError{Key: publicKey}
+	}
+	if pub.RSAParameters == nil {
+		return RSAPrivateKey{}, errors.New("public area has no RSA parameters")
+	}
+	publicKey, err := pub.Key()
+	if err != nil {
+		return RSAPrivateKey{}, err
+	}
+	return RSAPrivateKey{dev: dev, handle: handle, pub: pub, publicKey: publicKey, password: password}, nil
+}
+
+// NewRSAPrivateKeyPinned initializes a private key in the TPM like NewRSAPrivateKey, and fails
+// if its public key doesn't match the expected one. This detects a key at the handle having
+// been replaced.
+func NewRSAPrivateKeyPinned(dev io.ReadWriteCloser, handle tpmutil.Handle, password string, expectedPub crypto.PublicKey) (RSAPrivateKey, error) {
+	key, err := NewRSAPrivateKey(dev, handle, password)
+	if err != nil {
+		return RSAPrivateKey{}, err
+	}
+	expected, err := x509.MarshalPKIXPublicKey(expectedPub)
+	if err != nil {
+		return RSAPrivateKey{}, err
+	}
+	actual, err := x509.MarshalPKIXPublicKey(key.Public())
+	if err != nil {
+		return RSAPrivateKey{}, err
+	}
+	if !bytes.Equal(expected, actual) {
+		return RSAPrivateKey{}, fmt.Errorf("key at handle 0x%x doesn't match the pinned public key", handle)
 	}
-	return RSAPrivateKey{dev, handle, pub, publicKey, password}, nil
+	return key, nil
+}
+
+// NewRSAPrivateKeyWithPolicy initializes a private key in the TPM that can only be used while the
+// selected PCRs have the values they had when the key was created with
+// WithPolicy(PolicyDigest(dev, PCRPolicy(sel, nil))). Every signature is authorized with a new
+// policy session, which is flushed afterwards. It's the same as
+// NewRSAPrivateKey(dev, handle, "") followed by WithPolicySession(PCRPolicy(sel, nil)).
+func NewRSAPrivateKeyWithPolicy(dev io.ReadWriteCloser, handle tpmutil.Handle, sel tpm2.PCRSelection) (RSAPrivateKey, error) {
+	key, err := NewRSAPrivateKey(dev, handle, "")
+	if err != nil {
+		return RSAPrivateKey{}, err
+	}
+	return key.WithPolicySession(PCRPolicy(sel, nil)), nil
 }
 
 // Public returns the public part of the key.
@@ -38,12 +100,29 @@ func (k RSAPrivateKey) Public() crypto.PublicKey {
 	return k.publicKey
 }
 
+// Close releases the TPM resources held by the key. Policy and HMAC sessions are started for each
+// signature, or batch with SignBatch, and flushed when it's done, so the key doesn't hold any
+// between calls and Close always returns nil. It makes all key types io.Closers, so callers can
+// release keys uniformly, including RemoteSigner which does hold a connection.
+func (k RSAPrivateKey) Close() error {
+	return nil
+}
+
+// Handle returns the handle of the key in the TPM.
+func (k RSAPrivateKey) Handle() tpmutil.Handle {
+	return k.handle
+}
+
 // Map a crypto.Hash algorithm to a tpm2 constant
 var tpmToHashFunc = map[crypto.Hash]tpm2.Algorithm{
 	crypto.SHA1:   tpm2.AlgSHA1,
 	crypto.SHA384: tpm2.AlgSHA384,
 	crypto.SHA256: tpm2.AlgSHA256,
 	crypto.SHA512: tpm2.AlgSHA512,
+
+	crypto.SHA3_256: AlgSHA3_256,
+	crypto.SHA3_384: AlgSHA3_384,
+	crypto.SHA3_512: AlgSHA3_512,
 }
 
 // Map the crypto.Hash values to strings. Used to report errors
@@ -70,40 +149,234 @@ var hashToName = map[crypto.Hash]string{
 	crypto.BLAKE2b_512: "BLAKE2b_512",
 }
 
-// Sign digests via a key in the TPM. Implements crypto.Signer. If opts are *rsa.PSSOptions,
-// the PSS signature algorithm is used, PKCS#1 1.5 otherwise. To use this function, tpm2.FlagSign
-// needs to be set on the key, and tpm2.FlagRestricted needs to be clear.
+// UnsupportedHashError is returned when a key is asked to sign with, or decrypt using, a hash
+// algorithm the TPM doesn't support. Unlike errors from the TPM, nothing was sent to it, so
+// callers like TLS stacks can fall back to another key or algorithm.
+type UnsupportedHashError struct {
+	Hash crypto.Hash
+}
+
+func (e UnsupportedHashError) Error() string {
+	return fmt.Sprintf("unsupported hash algorithm: %d (%s)", e.Hash, hashToName[e.Hash])
+}
+
+// UnsupportedKeyError is returned when the key at a handle isn't of the type that's expected,
+// like an ECC key passed to NewRSAPrivateKey.
+type UnsupportedKeyError struct {
+	Key crypto.PublicKey
+}
+
+func (e UnsupportedKeyError) Error() string {
+	return fmt.Sprintf("unsupported algorithm %T", e.Key)
+}
+
+// Map RSA signature schemes to strings. Used to report errors.
+var schemeToName = map[tpm2.Algorithm]string{
+	tpm2.AlgRSASSA: "PKCS#1 v1.5",
+	tpm2.AlgRSAPSS: "PSS",
+}
+
+// Sign digests via a key in the TPM. Implements crypto.Signer. PSS is used if opts are
+// *rsa.PSSOptions, PKCS#1 v1.5 otherwise, unless set with WithSignScheme. The key needs
+// tpm2.FlagSign set and tpm2.FlagRestricted clear. It's safe to call concurrently.
 func (k RSAPrivateKey) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) (signature []byte, err error) {
-	hash, ok := tpmToHashFunc[opts.HashFunc()]
-	if !ok {
-		return nil, fmt.Errorf("unsupported hash algorithm: %d (%s)", opts.HashFunc(), hashToName[opts.HashFunc()])
+	return k.sign(digest, opts, true)
+}
+
+// sign implements Sign. The device is only locked for the TPM commands if lock is set, callers
+// passing false must hold the lock already.
+func (k RSAPrivateKey) sign(digest []byte, opts crypto.SignerOpts, lock bool) (signature []byte, err error) {
+	alg := k.signatureAlgorithm(opts)
+	defer func() { k.record(opts.HashFunc(), alg, err) }()
+	if err := checkDigestLength(opts.HashFunc(), digest); err != nil {
+		return nil, err
+	}
+	if err := k.allow(); err != nil {
+		return nil, err
+	}
+	if lock {
+		defer lockDevice(k.dev)()
+	}
+	scheme, err := k.sigScheme(opts)
+	if err != nil {
+		return nil, err
+	}
+	sign, done, err := k.startSigning(scheme)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+	if signature, err = sign(digest); err != nil {
+		return nil, err
+	}
+	if err := k.checkSaltLength(opts, signature); err != nil {
+		return nil, err
+	}
+	return signature, nil
+}
+
+// WithSignScheme returns a copy of the key that signs with the given scheme, tpm2.AlgRSASSA for
+// PKCS#1 v1.5 or tpm2.AlgRSAPSS, whatever the type of opts. This makes it possible to sign with
+// PSS where only a crypto.Hash can be passed, and to pin the scheme of keys whose signatures are
+// expected in one scheme. The hash is still taken from opts. Signing fails if the key is
+// restricted to another scheme in the TPM. tpm2.AlgNull selects the scheme by opts again.
+//
+// The PSS salt length is chosen by the TPM, see VerifyWebCryptoPSS. A SaltLength of
+// rsa.PSSSaltLengthAuto in *rsa.PSSOptions accepts whatever the TPM uses, other values need to
+// match it, which is only possible for rsa.PSSSaltLengthEqualsHash or the hash size.
+func (k RSAPrivateKey) WithSignScheme(alg tpm2.Algorithm) RSAPrivateKey {
+	k.scheme = alg
+	return k
+}
+
+// signatureAlgorithm returns the RSA signature scheme set with WithSignScheme, or the one
+// selected by opts.
+func (k RSAPrivateKey) signatureAlgorithm(opts crypto.SignerOpts) tpm2.Algorithm {
+	if k.scheme != 0 && k.scheme != tpm2.AlgNull {
+		return k.scheme
 	}
-	alg := tpm2.AlgRSASSA
 	if _, ok := opts.(*rsa.PSSOptions); ok {
-		alg = tpm2.AlgRSAPSS
+		return tpm2.AlgRSAPSS
 	}
-	scheme := &tpm2.SigScheme{
-		Alg:  alg,
-		Hash: hash,
+	return tpm2.AlgRSASSA
+}
+
+// sigScheme returns the TPM signature scheme for opts, and checks that the key and the TPM
+// support it.
+func (k RSAPrivateKey) sigScheme(opts crypto.SignerOpts) (*tpm2.SigScheme, error) {
+	alg := k.signatureAlgorithm(opts)
+	if _, ok := schemeToName[alg]; !ok {
+		return nil, fmt.Errorf("unsupported RSA signature scheme 0x%x", alg)
 	}
-	sig, err := tpm2.Sign(k.dev, k.handle, k.password, digest, scheme)
+	hash, err := hashAlgorithm(k.dev, opts.HashFunc())
 	if err != nil {
 		return nil, err
 	}
-	return sig.RSA.Signature, err
+	if fixed := k.pub.RSAParameters.Sign; fixed != nil && fixed.Alg != tpm2.AlgNull && fixed.Alg != alg {
+		return nil, fmt.Errorf("key is restricted to the %s signature scheme, can't sign with %s", schemeToName[fixed.Alg], schemeToName[alg])
+	}
+	pss, _ := opts.(*rsa.PSSOptions)
+	if alg == tpm2.AlgRSAPSS && pss != nil && pss.SaltLength > 0 && pss.SaltLength != opts.HashFunc().Size() {
+		return nil, fmt.Errorf("the TPM can't sign with a salt of %d bytes, only %d (rsa.PSSSaltLengthEqualsHash) or rsa.PSSSaltLengthAuto are supported", pss.SaltLength, opts.HashFunc().Size())
+	}
+	return &tpm2.SigScheme{Alg: alg, Hash: hash}, nil
+}
+
+// startSigning starts the session the key needs for signing, if any, and returns a function that
+// signs one digest at a time with the scheme in it. done flushes the session and needs to be
+// called once all digests are signed.
+func (k RSAPrivateKey) startSigning(scheme *tpm2.SigScheme) (sign func(digest []byte) ([]byte, error), done func(), err error) {
+	policy := k.policy
+	if policy == nil && k.signOnly() {
+		policy = satisfySignOnlyPolicy
+	}
+	switch {
+	case policy != nil:
+		session, err := startPolicySession(k.dev, tpm2.SessionPolicy)
+		if err != nil {
+			return nil, nil, err
+		}
+		sign = func(digest []byte) ([]byte, error) {
+			// The policy is reset by every command the session authorizes, so it's satisfied again
+			if err := policy(k.dev, session); err != nil {
+				return nil, err
+			}
+			return signInPolicySession(k.dev, session, k.handle, k.password, digest, scheme)
+		}
+		return sign, func() { tpm2.FlushContext(k.dev, session) }, nil
+	case k.pub.Attributes&tpm2.FlagUserWithAuth == 0:
+		return nil, nil, errors.New("key can only be used with a policy, see WithPolicySession")
+	case k.saltKey != 0:
+		s, err := startHMACSession(k.dev, k.saltKey)
+		if err != nil {
+			return nil, nil, err
+		}
+		sign = func(digest []byte) ([]byte, error) {
+			return s.sign(k.dev, k.handle, k.password, digest, scheme)
+		}
+		return sign, func() { tpm2.FlushContext(k.dev, s.handle) }, nil
+	default:
+		sign = func(digest []byte) ([]byte, error) {
+			sig, err := tpm2.Sign(k.dev, k.handle, k.password, digest, scheme)
+			if err != nil {
+				return nil, err
+			}
+			return sig.RSA.Signature, nil
+		}
+		return sign, func() {}, nil
+	}
+}
+
+// checkSaltLength makes sure a PSS signature has the salt length that was asked for. Most TPMs
+// use a salt as long as the hash, but some use the largest that fits.
+func (k RSAPrivateKey) checkSaltLength(opts crypto.SignerOpts, signature []byte) error {
+	pss, ok := opts.(*rsa.PSSOptions)
+	if !ok || pss.SaltLength == rsa.PSSSaltLengthAuto || k.signatureAlgorithm(opts) != tpm2.AlgRSAPSS {
+		return nil
+	}
+	n, err := PSSSaltLength(k.publicKey.(*rsa.PublicKey), opts.HashFunc(), signature)
+	if err != nil {
+		return err
+	}
+	if n != opts.HashFunc().Size() {
+		return fmt.Errorf("the TPM signed with a salt of %d bytes instead of %d, use rsa.PSSSaltLengthAuto to accept it", n, opts.HashFunc().Size())
+	}
+	return nil
+}
+
+// signOnly returns true if the key was created with WithSignOnlyPolicy.
+func (k RSAPrivateKey) signOnly() bool {
+	return k.pub.Attributes&tpm2.FlagUserWithAuth == 0 && bytes.Equal(k.pub.AuthPolicy, signOnlyPolicy())
+}
+
+// signInPolicySession signs a digest with a key that requires a policy, such as keys created with
+// WithSignOnlyPolicy. TPM2_Sign is authorized with a policy session, in which the policy has
+// been satisfied, instead of the plain password.
+func signInPolicySession(dev io.ReadWriter, session, handle tpmutil.Handle, password string, digest []byte, scheme *tpm2.SigScheme) ([]byte, error) {
+	// The digest wasn't produced by the TPM, so pass a NULL hash check ticket
+	cmd, err := encodeCommand(
+		[]interface{}{handle},
+		[]tpm2.AuthCommand{{Session: session, Attributes: tpm2.AttrContinueSession, Auth: []byte(password)}},
+		digest, scheme.Alg, scheme.Hash, tpm2.TagHashCheck, tpm2.HandleNull, []byte(nil),
+	)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := runCommand(dev, tpm2.TagSessions, cmdSign, cmd)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		paramSize uint32
+		sigAlg    tpm2.Algorithm
+		hash      tpm2.Algorithm
+		sig       []byte
+	)
+	if _, err := tpmutil.Unpack(resp, &paramSize, &sigAlg, &hash, &sig); err != nil {
+		return nil, err
+	}
+	return sig, nil
 }
 
 // Decrypt decrypts ciphertext with the key in the TPM. If opts is nil or of type
 // *PKCS1v15DecryptOptions then PKCS#1 v1.5 decryption is performed. Otherwise opts must have
 // type *OAEPOptions and OAEP decryption is performed. tpm2.FlagDecrypt needs to be set and
-// tpm2.FlagRestricted clear in the key properties. Implements crypto.Decrypter.
+// tpm2.FlagRestricted clear in the key properties. Implements crypto.Decrypter. Like Sign, it's
+// safe to call concurrently.
 // Note that using OAEP with a label requires a null-terminated string.
 func (k RSAPrivateKey) Decrypt(rand io.Reader, msg []byte, opts crypto.DecrypterOpts) ([]byte, error) {
+	if k.pub.Attributes&tpm2.FlagDecrypt == 0 {
+		return nil, errors.New("key can't be used for decryption, tpm2.FlagDecrypt is not set")
+	}
+	if err := k.allow(); err != nil {
+		return nil, err
+	}
+	defer lockDevice(k.dev)()
 	switch opt := opts.(type) {
 	case *rsa.OAEPOptions:
-		hash, ok := tpmToHashFunc[opt.Hash]
-		if !ok {
-			return nil, fmt.Errorf("unsupported hash algorithm: %d (%s)", opt.Hash, hashToName[opt.Hash])
+		hash, err := hashAlgorithm(k.dev, opt.Hash)
+		if err != nil {
+			return nil, err
 		}
 		scheme := &tpm2.AsymScheme{
 			Alg:  tpm2.AlgOAEP,
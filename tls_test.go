@@ -9,11 +9,13 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"math/big"
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"sync"
 	"testing"
 	"time"
 
@@ -36,9 +38,9 @@ func TestMutualTLS(t *testing.T) {
 	)
 
 	// Generate the primary client key as well as a server key (could use the same)
-	clientPub, err := GenRSAPrimaryKey(dev, clientHandle, pw, pw, clientAttr)
+	_, err = GenRSAPrimaryKey(dev, clientHandle, pw, pw, clientAttr)
 	require.NoError(t, err)
-	serverPub, err := GenRSAPrimaryKey(dev, serverHandle, pw, pw, serverAttr)
+	_, err = GenRSAPrimaryKey(dev, serverHandle, pw, pw, serverAttr)
 	require.NoError(t, err)
 
 	// Use the private keys in the TPM
@@ -47,6 +49,12 @@ func TestMutualTLS(t *testing.T) {
 	serverPriv, err := NewRSAPrivateKey(dev, serverHandle, pw)
 	require.NoError(t, err)
 
+	testMutualTLS(t, clientPriv, serverPriv)
+}
+
+// testMutualTLS issues certificates for the client and server keys from the test CA and
+// performs an HTTP request over a mutual TLS connection.
+func testMutualTLS(t *testing.T, clientPriv, serverPriv Signer) {
 	// Load the CA
 	caCrt, caKey, err := LoadKeyPair("testdata/ca.crt", "testdata/ca.key")
 	require.NoError(t, err)
@@ -72,7 +80,7 @@ func TestMutualTLS(t *testing.T) {
 		rand.Reader,
 		&clientTemplate,
 		caCrt,
-		clientPub,
+		clientPriv.Public(),
 		caKey,
 	)
 	require.NoError(t, err)
@@ -80,7 +88,7 @@ func TestMutualTLS(t *testing.T) {
 		rand.Reader,
 		&serverTemplate,
 		caCrt,
-		serverPub,
+		serverPriv.Public(),
 		caKey,
 	)
 	require.NoError(t, err)
@@ -183,11 +191,114 @@ func TestSign(t *testing.T) {
 			}
 		})
 	}
+
+	// Unsupported algorithms are reported without sending anything to the TPM
+	_, err = priv.Sign(nil, digestSHA256[:], crypto.SHA224)
+	require.Equal(t, UnsupportedHashError{Hash: crypto.SHA224}, err)
+	_, err = NewECPrivateKey(dev, handle, pw)
+	require.Equal(t, UnsupportedKeyError{Key: pub}, err)
+}
+
+func TestSignPSSSaltLength(t *testing.T) {
+	dev, err := simulator.Get()
+	require.NoError(t, err)
+	defer dev.Close()
+
+	const (
+		handle = 0x81000000
+		pw     = ""
+		attr   = tpm2.FlagSign | tpm2.FlagUserWithAuth | tpm2.FlagSensitiveDataOrigin
+	)
+
+	pub, err := GenRSAPrimaryKey(dev, handle, pw, pw, attr)
+	require.NoError(t, err)
+	priv, err := NewRSAPrivateKey(dev, handle, pw)
+	require.NoError(t, err)
+	digest := sha256.Sum256([]byte("This is a test"))
+
+	tests := map[string]struct {
+		saltLength int
+		valid      bool
+	}{
+		"auto":        {rsa.PSSSaltLengthAuto, true},
+		"equals hash": {rsa.PSSSaltLengthEqualsHash, true},
+		"hash size":   {sha256.Size, true},
+		"shorter":     {20, false},
+		"longer":      {64, false},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			opts := &rsa.PSSOptions{SaltLength: test.saltLength, Hash: crypto.SHA256}
+			signature, err := priv.Sign(nil, digest[:], opts)
+			if !test.valid {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+
+			// The signature verifies with the requested salt length as well as auto-detection
+			require.NoError(t, rsa.VerifyPSS(pub.(*rsa.PublicKey), crypto.SHA256, digest[:], signature, opts))
+			require.NoError(t, rsa.VerifyPSS(pub.(*rsa.PublicKey), crypto.SHA256, digest[:], signature, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthAuto}))
+		})
+	}
+}
+
+func TestSignConcurrent(t *testing.T) {
+	dev, err := simulator.Get()
+	require.NoError(t, err)
+	defer dev.Close()
+
+	const (
+		pw   = ""
+		attr = tpm2.FlagSign | tpm2.FlagUserWithAuth | tpm2.FlagSensitiveDataOrigin
+	)
+
+	// Two keys sharing the device, one of them signing with a policy session which takes
+	// several commands
+	sel := tpm2.PCRSelection{Hash: tpm2.AlgSHA256, PCRs: []int{7}}
+	policy, err := PolicyDigest(dev, PCRPolicy(sel, nil))
+	require.NoError(t, err)
+	_, err = GenRSAPrimaryKey(dev, 0x81000000, pw, pw, attr)
+	require.NoError(t, err)
+	_, err = GenRSAPrimaryKey(dev, 0x81000001, pw, pw, attr, WithPolicy(policy))
+	require.NoError(t, err)
+	plain, err := NewRSAPrivateKey(dev, 0x81000000, pw)
+	require.NoError(t, err)
+	withPolicy, err := NewRSAPrivateKeyWithPolicy(dev, 0x81000001, sel)
+	require.NoError(t, err)
+	keys := []RSAPrivateKey{plain, withPolicy}
+
+	var wg sync.WaitGroup
+	errs := make([]error, 50)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			key := keys[i%len(keys)]
+			digest := sha256.Sum256([]byte(fmt.Sprintf("message %d", i)))
+			signature, err := key.Sign(nil, digest[:], crypto.SHA256)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			errs[i] = rsa.VerifyPKCS1v15(key.Public().(*rsa.PublicKey), crypto.SHA256, digest[:], signature)
+		}(i)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		require.NoError(t, err)
+	}
+
+	// The lock of the device isn't kept once it's no longer used
+	devLocksMu.Lock()
+	require.Empty(t, devLocks)
+	devLocksMu.Unlock()
 }
 
 func TestDecrypt(t *testing.T) {
 	dev, err := simulator.Get()
 	require.NoError(t, err)
+	defer dev.Close()
 
 	const (
 		handle = 0x81000000
@@ -242,4 +353,225 @@ func TestDecrypt(t *testing.T) {
 			require.Equal(t, data, decrypted)
 		})
 	}
+
+	// Keys without FlagDecrypt are rejected before calling the TPM
+	const signHandle = 0x81000001
+	_, err = GenRSAPrimaryKey(dev, signHandle, pw, pw, tpm2.FlagSign|tpm2.FlagUserWithAuth|tpm2.FlagSensitiveDataOrigin)
+	require.NoError(t, err)
+	signer, err := NewRSAPrivateKey(dev, signHandle, pw)
+	require.NoError(t, err)
+	encrypted, err := rsa.EncryptPKCS1v15(rand.Reader, signer.Public().(*rsa.PublicKey), data)
+	require.NoError(t, err)
+	_, err = signer.Decrypt(rand.Reader, encrypted, nil)
+	require.EqualError(t, err, "key can't be used for decryption, tpm2.FlagDecrypt is not set")
+}
+
+func TestNewRSAPrivateKeyWithPolicy(t *testing.T) {
+	dev, err := simulator.Get()
+	require.NoError(t, err)
+	defer dev.Close()
+
+	const (
+		handle = 0x81000000
+		pw     = ""
+		attr   = tpm2.FlagSign | tpm2.FlagFixedTPM | tpm2.FlagUserWithAuth | tpm2.FlagFixedParent | tpm2.FlagSensitiveDataOrigin
+	)
+	sel := tpm2.PCRSelection{Hash: tpm2.AlgSHA256, PCRs: []int{7}}
+
+	// Bind the key to the current value of PCR 7
+	policy, err := PolicyDigest(dev, PCRPolicy(sel, nil))
+	require.NoError(t, err)
+	pub, err := GenRSAPrimaryKey(dev, handle, pw, pw, attr, WithPolicy(policy))
+	require.NoError(t, err)
+	priv, err := NewRSAPrivateKeyWithPolicy(dev, handle, sel)
+	require.NoError(t, err)
+
+	digest := sha256.Sum256([]byte("This is a test"))
+	for i := 0; i < 3; i++ {
+		signature, err := priv.Sign(nil, digest[:], crypto.SHA256)
+		require.NoError(t, err)
+		require.NoError(t, rsa.VerifyPKCS1v15(pub.(*rsa.PublicKey), crypto.SHA256, digest[:], signature))
+	}
+
+	// No sessions are left behind
+	sessions, err := GetHandles(dev, tpm2.TPMProp(tpm2.HandleTypeLoadedSession)<<24)
+	require.NoError(t, err)
+	require.Empty(t, sessions)
+
+	// The key can't be used after the PCR changed
+	require.NoError(t, tpm2.PCRExtend(dev, 7, tpm2.AlgSHA256, digest[:], ""))
+	_, err = priv.Sign(nil, digest[:], crypto.SHA256)
+	require.Error(t, err)
+	sessions, err = GetHandles(dev, tpm2.TPMProp(tpm2.HandleTypeLoadedSession)<<24)
+	require.NoError(t, err)
+	require.Empty(t, sessions)
+	// There's nothing left to release
+	var closer io.Closer = priv
+	require.NoError(t, closer.Close())
+}
+
+func TestNewRSAPrivateKeyPinned(t *testing.T) {
+	dev, err := simulator.Get()
+	require.NoError(t, err)
+	defer dev.Close()
+
+	const (
+		handle = 0x81000000
+		pw     = ""
+		attr   = tpm2.FlagSign | tpm2.FlagUserWithAuth | tpm2.FlagSensitiveDataOrigin
+	)
+
+	pub, err := GenRSAPrimaryKey(dev, handle, pw, pw, attr)
+	require.NoError(t, err)
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	_, err = NewRSAPrivateKeyPinned(dev, handle, pw, pub)
+	require.NoError(t, err)
+	_, err = NewRSAPrivateKeyPinned(dev, handle, pw, &other.PublicKey)
+	require.Error(t, err)
+}
+
+func TestNewRSAPrivateKeyFromPublic(t *testing.T) {
+	sim, err := simulator.Get()
+	require.NoError(t, err)
+	defer sim.Close()
+
+	const (
+		handle   = 0x81000000
+		ecHandle = 0x81000001
+		pw       = ""
+		attr     = tpm2.FlagSign | tpm2.FlagUserWithAuth | tpm2.FlagSensitiveDataOrigin
+	)
+	pub, err := GenRSAPrimaryKey(sim, handle, pw, pw, attr)
+	require.NoError(t, err)
+	public, _, err := ReadPublicKey(sim, handle)
+	require.NoError(t, err)
+
+	// Nothing is sent to the TPM until the key is used
+	dev := &recordingDev{ReadWriteCloser: sim}
+	priv, err := NewRSAPrivateKeyFromPublic(dev, handle, pw, public)
+	require.NoError(t, err)
+	require.Zero(t, dev.written.Len())
+	require.Equal(t, pub, priv.Public())
+
+	digest := sha256.Sum256([]byte("reload"))
+	sig, err := priv.Sign(nil, digest[:], crypto.SHA256)
+	require.NoError(t, err)
+	require.NoError(t, rsa.VerifyPKCS1v15(pub.(*rsa.PublicKey), crypto.SHA256, digest[:], sig))
+
+	// The type is still checked
+	_, err = GenECPrimaryKey(sim, ecHandle, pw, pw, attr, tpm2.CurveNISTP256)
+	require.NoError(t, err)
+	ecPublic, ecPub, err := ReadPublicKey(sim, ecHandle)
+	require.NoError(t, err)
+	_, err = NewRSAPrivateKeyFromPublic(sim, ecHandle, pw, ecPublic)
+	require.Equal(t, UnsupportedKeyError{Key: ecPub}, err)
+}
+
+func TestSignDigestLength(t *testing.T) {
+	sim, err := simulator.Get()
+	require.NoError(t, err)
+	defer sim.Close()
+
+	const (
+		handle   = 0x81000000
+		ecHandle = 0x81000001
+		pw       = ""
+		attr     = tpm2.FlagSign | tpm2.FlagUserWithAuth | tpm2.FlagSensitiveDataOrigin
+	)
+	_, err = GenRSAPrimaryKey(sim, handle, pw, pw, attr)
+	require.NoError(t, err)
+	_, err = GenECPrimaryKey(sim, ecHandle, pw, pw, attr, tpm2.CurveNISTP256)
+	require.NoError(t, err)
+
+	// Invalid digests are rejected before anything is sent to the TPM
+	dev := &recordingDev{ReadWriteCloser: sim}
+	rsaKey, err := NewRSAPrivateKey(dev, handle, pw)
+	require.NoError(t, err)
+	ecKey, err := NewECPrivateKey(dev, ecHandle, pw)
+	require.NoError(t, err)
+	dev.written.Reset()
+
+	sha1Digest := sha1.Sum([]byte("This is a test"))
+	sha256Digest := sha256.Sum256([]byte("This is a test"))
+	tests := []struct {
+		name   string
+		digest []byte
+		opts   crypto.SignerOpts
+		err    string
+	}{
+		{"nil digest", nil, crypto.SHA256, "invalid digest length for SHA256, expected 32 bytes, got 0"},
+		{"empty digest", []byte{}, crypto.SHA256, "invalid digest length for SHA256, expected 32 bytes, got 0"},
+		{"SHA1 digest with SHA256", sha1Digest[:], crypto.SHA256, "invalid digest length for SHA256, expected 32 bytes, got 20"},
+		{"SHA256 digest with SHA1", sha256Digest[:], crypto.SHA1, "invalid digest length for SHA1, expected 20 bytes, got 32"},
+		{"SHA256 digest with SHA384", sha256Digest[:], crypto.SHA384, "invalid digest length for SHA384, expected 48 bytes, got 32"},
+		{"truncated digest", sha256Digest[:31], crypto.SHA256, "invalid digest length for SHA256, expected 32 bytes, got 31"},
+		{"unsupported hash", sha256Digest[:], crypto.MD5, "unsupported hash algorithm: 2 (MD5)"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := rsaKey.Sign(nil, test.digest, test.opts)
+			require.EqualError(t, err, test.err)
+			_, err = ecKey.Sign(nil, test.digest, test.opts)
+			require.EqualError(t, err, test.err)
+		})
+	}
+	require.Zero(t, dev.written.Len())
+
+	// Batches report which digest is invalid
+	_, err = rsaKey.SignBatch([][]byte{sha256Digest[:], sha1Digest[:]}, crypto.SHA256)
+	require.EqualError(t, err, "signing digest 1: invalid digest length for SHA256, expected 32 bytes, got 20")
+}
+
+func TestSignScheme(t *testing.T) {
+	sim, err := simulator.Get()
+	require.NoError(t, err)
+	defer sim.Close()
+
+	const (
+		handle = 0x81000000
+		pw     = ""
+		attr   = tpm2.FlagSign | tpm2.FlagUserWithAuth | tpm2.FlagSensitiveDataOrigin
+	)
+	pub, err := GenRSAPrimaryKey(sim, handle, pw, pw, attr)
+	require.NoError(t, err)
+	dev := &recordingDev{ReadWriteCloser: sim}
+	priv, err := NewRSAPrivateKey(dev, handle, pw)
+	require.NoError(t, err)
+
+	digest := sha256.Sum256([]byte("This is a test"))
+	pssOpts := &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: crypto.SHA256}
+	tests := map[string]struct {
+		scheme   tpm2.Algorithm
+		opts     crypto.SignerOpts
+		expected crypto.SignerOpts // How the signature needs to be verified
+	}{
+		"PSS with hash":           {tpm2.AlgRSAPSS, crypto.SHA256, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthAuto, Hash: crypto.SHA256}},
+		"PSS with PSS options":    {tpm2.AlgRSAPSS, pssOpts, pssOpts},
+		"PKCS#1 with PSS options": {tpm2.AlgRSASSA, pssOpts, crypto.SHA256},
+		"PKCS#1 with hash":        {tpm2.AlgRSASSA, crypto.SHA256, crypto.SHA256},
+		"selected by opts":        {tpm2.AlgNull, pssOpts, pssOpts},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			sig, err := priv.WithSignScheme(test.scheme).Sign(nil, digest[:], test.opts)
+			require.NoError(t, err)
+			require.NoError(t, Verify(pub, digest[:], sig, test.expected))
+		})
+	}
+
+	// Schemes the key doesn't support are rejected without sending anything to the TPM
+	dev.written.Reset()
+	fixed := priv
+	fixed.pub.RSAParameters = &tpm2.RSAParams{Sign: &tpm2.SigScheme{Alg: tpm2.AlgRSASSA, Hash: tpm2.AlgSHA256}}
+	_, err = fixed.WithSignScheme(tpm2.AlgRSAPSS).Sign(nil, digest[:], crypto.SHA256)
+	require.EqualError(t, err, "key is restricted to the PKCS#1 v1.5 signature scheme, can't sign with PSS")
+	_, err = priv.WithSignScheme(tpm2.AlgECDSA).Sign(nil, digest[:], crypto.SHA256)
+	require.EqualError(t, err, "unsupported RSA signature scheme 0x18")
+	require.Zero(t, dev.written.Len())
+
+	// Keys forced to PSS can't be used for SSH
+	_, err = SSHSigner(priv.WithSignScheme(tpm2.AlgRSAPSS))
+	require.Error(t, err)
 }
@@ -0,0 +1,131 @@
+package tpmk
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpmutil"
+)
+
+// Verify checks a signature made by Sign, the inverse of it in software. Like Sign, it uses
+// RSASSA-PSS if opts are *rsa.PSSOptions and PKCS#1 v1.5 otherwise for RSA keys. ECDSA signatures
+// are expected to be ASN.1 encoded, the default of ECPrivateKey. The salt length in PSS options
+// is checked as given, use rsa.PSSSaltLengthAuto to accept any.
+func Verify(pub crypto.PublicKey, digest, signature []byte, opts crypto.SignerOpts) error {
+	if opts == nil {
+		return errors.New("missing signer options")
+	}
+	pss, ok := opts.(*rsa.PSSOptions)
+	if !ok {
+		return verifyPKCS1OrECDSA(pub, opts.HashFunc(), digest, signature)
+	}
+	rsaPub, ok := pub.(*rsa.PublicKey)
+	if !ok {
+		return fmt.Errorf("PSS is not supported by %T keys", pub)
+	}
+	return rsa.VerifyPSS(rsaPub, pss.Hash, digest, signature, pss)
+}
+
+// Tag of the tickets produced by TPM2_VerifySignature for keys outside the Null hierarchy, missing
+// in go-tpm
+const tagVerified tpmutil.Tag = 0x8022
+
+// SignatureItem is a signature over a digest to be verified by the TPM. If Opts are
+// *rsa.PSSOptions, the signature is expected to use PSS, PKCS#1 1.5 otherwise.
+type SignatureItem struct {
+	Digest    []byte
+	Signature []byte
+	Opts      crypto.SignerOpts
+}
+
+// VerifyResult holds the outcome of verifying a single signature. If the signature is valid,
+// Err is nil and Ticket holds the TPM's TPM_ST_VERIFIED ticket for the owner hierarchy, which can
+// be passed to commands like TPM2_PolicyAuthorize as proof that the TPM checked it.
+type VerifyResult struct {
+	Ticket *tpm2.Ticket
+	Err    error
+}
+
+// VerifySignatures checks a list of signatures made with the private key of pub in the TPM. The
+// public key is loaded into the owner hierarchy once and used for all verifications, so the
+// tickets are bound to it. Keys loaded into the Null hierarchy only produce NULL tickets. The returned
+// results are in the same order as the items. An error is only returned if the key could not be
+// loaded or the communication with the TPM failed, invalid signatures and items with missing or
+// unsupported options are reported in the results.
+func VerifySignatures(dev io.ReadWriteCloser, pub crypto.PublicKey, items []SignatureItem) ([]VerifyResult, error) {
+	rsaPub, ok := pub.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("unsupported key type %T", pub)
+	}
+	handle, _, err := tpm2.LoadExternal(dev, tpm2.Public{
+		Type:       tpm2.AlgRSA,
+		NameAlg:    tpm2.AlgSHA256,
+		Attributes: tpm2.FlagSign | tpm2.FlagUserWithAuth,
+		RSAParameters: &tpm2.RSAParams{
+			Sign: &tpm2.SigScheme{
+				Alg:  tpm2.AlgNull,
+				Hash: tpm2.AlgNull,
+			},
+			KeyBits:  uint16(rsaPub.Size() * 8),
+			Exponent: uint32(rsaPub.E),
+			Modulus:  rsaPub.N,
+		},
+	}, tpm2.Private{}, tpm2.HandleOwner)
+	if err != nil {
+		return nil, err
+	}
+	defer tpm2.FlushContext(dev, handle)
+
+	results := make([]VerifyResult, len(items))
+	for i, item := range items {
+		alg, hash, err := itemScheme(item)
+		if err != nil {
+			results[i].Err = err
+			continue
+		}
+		ticket, err := verifySignature(dev, handle, item, alg, hash)
+		if err != nil && !isTPMError(err) {
+			return nil, err
+		}
+		results[i] = VerifyResult{ticket, err}
+	}
+	return results, nil
+}
+
+// itemScheme returns the signature scheme and hash algorithm of an item, or an error if they
+// aren't valid.
+func itemScheme(item SignatureItem) (alg, hash tpm2.Algorithm, err error) {
+	if item.Opts == nil {
+		return 0, 0, errors.New("missing signer options")
+	}
+	hash, ok := tpmToHashFunc[item.Opts.HashFunc()]
+	if !ok {
+		return 0, 0, UnsupportedHashError{Hash: item.Opts.HashFunc()}
+	}
+	alg = tpm2.AlgRSASSA
+	if _, ok := item.Opts.(*rsa.PSSOptions); ok {
+		alg = tpm2.AlgRSAPSS
+	}
+	return alg, hash, nil
+}
+
+// verifySignature checks a single RSA signature with a key loaded in the TPM.
+func verifySignature(dev io.ReadWriter, key tpmutil.Handle, item SignatureItem, alg, hash tpm2.Algorithm) (*tpm2.Ticket, error) {
+	cmd, err := encodeCommand([]interface{}{key}, nil, item.Digest, alg, hash, item.Signature)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := runCommand(dev, tpm2.TagNoSessions, cmdVerifySig, cmd)
+	if err != nil {
+		return nil, err
+	}
+	var ticket tpm2.Ticket
+	if _, err := tpmutil.Unpack(resp, &ticket.Type, &ticket.Hierarchy, &ticket.Digest); err != nil {
+		return nil, err
+	}
+	return &ticket, nil
+}
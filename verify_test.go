@@ -0,0 +1,130 @@
+package tpmk
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"testing"
+
+	"github.com/google/go-tpm-tools/simulator"
+	"github.com/google/go-tpm/tpm2"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerifySignatures(t *testing.T) {
+	dev, err := simulator.Get()
+	require.NoError(t, err)
+	defer dev.Close()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	digest := sha256.Sum256([]byte("This is a test"))
+	pss := &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: crypto.SHA256}
+	pkcs1, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	require.NoError(t, err)
+	pssSig, err := rsa.SignPSS(rand.Reader, key, crypto.SHA256, digest[:], pss)
+	require.NoError(t, err)
+	otherSig, err := rsa.SignPKCS1v15(rand.Reader, other, crypto.SHA256, digest[:])
+	require.NoError(t, err)
+	wrongDigest := sha256.Sum256([]byte("Something else"))
+
+	items := []SignatureItem{
+		{digest[:], pkcs1, crypto.SHA256},
+		{digest[:], pssSig, pss},
+		{digest[:], otherSig, crypto.SHA256},
+		{wrongDigest[:], pkcs1, crypto.SHA256},
+		{digest[:], pssSig, crypto.SHA256},
+		{digest[:], pkcs1, nil},
+		{digest[:], pkcs1, crypto.MD5},
+		{digest[:], pkcs1, crypto.SHA256},
+	}
+	valid := []bool{true, true, false, false, false, false, false, true}
+
+	results, err := VerifySignatures(dev, &key.PublicKey, items)
+	require.NoError(t, err)
+	require.Len(t, results, len(items))
+	for i, res := range results {
+		if valid[i] {
+			require.NoError(t, res.Err, "item %d", i)
+			require.NotNil(t, res.Ticket, "item %d", i)
+			require.Equal(t, tagVerified, res.Ticket.Type, "item %d", i)
+			require.EqualValues(t, tpm2.HandleOwner, res.Ticket.Hierarchy, "item %d", i)
+			require.NotEmpty(t, res.Ticket.Digest, "item %d", i)
+			continue
+		}
+		require.Error(t, res.Err, "item %d", i)
+		require.Nil(t, res.Ticket, "item %d", i)
+	}
+	require.EqualError(t, results[5].Err, "missing signer options")
+	require.IsType(t, UnsupportedHashError{}, results[6].Err)
+}
+
+func TestVerify(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	digest := sha256.Sum256([]byte("This is a test"))
+	other := sha256.Sum256([]byte("Something else"))
+	tests := map[string]struct {
+		key  crypto.Signer
+		opts crypto.SignerOpts
+	}{
+		"RSA-PKCS#1 v1.5":          {rsaKey, crypto.SHA256},
+		"RSA-PSS":                  {rsaKey, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthAuto, Hash: crypto.SHA256}},
+		"RSA-PSS salt equals hash": {rsaKey, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: crypto.SHA256}},
+		"ECDSA":                    {ecKey, crypto.SHA256},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			sig, err := test.key.Sign(rand.Reader, digest[:], test.opts)
+			require.NoError(t, err)
+			require.NoError(t, Verify(test.key.Public(), digest[:], sig, test.opts))
+			require.Error(t, Verify(test.key.Public(), other[:], sig, test.opts))
+		})
+	}
+
+	// Options that don't match the signature or key
+	sig, err := rsaKey.Sign(rand.Reader, digest[:], crypto.SHA256)
+	require.NoError(t, err)
+	require.Error(t, Verify(rsaKey.Public(), digest[:], sig, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthAuto, Hash: crypto.SHA256}))
+	require.EqualError(t, Verify(rsaKey.Public(), digest[:], sig, nil), "missing signer options")
+	require.EqualError(t, Verify(ecKey.Public(), digest[:], sig, &rsa.PSSOptions{Hash: crypto.SHA256}), "PSS is not supported by *ecdsa.PublicKey keys")
+	require.EqualError(t, Verify("key", digest[:], sig, crypto.SHA256), "unsupported key type string")
+}
+
+func TestVerifyTPMSignature(t *testing.T) {
+	dev, err := simulator.Get()
+	require.NoError(t, err)
+	defer dev.Close()
+
+	const (
+		handle = 0x81000000
+		pw     = ""
+		attr   = tpm2.FlagSign | tpm2.FlagUserWithAuth | tpm2.FlagSensitiveDataOrigin
+	)
+	pub, err := GenRSAPrimaryKey(dev, handle, pw, pw, attr)
+	require.NoError(t, err)
+	priv, err := NewRSAPrivateKey(dev, handle, pw)
+	require.NoError(t, err)
+
+	// Signatures of the TPM verify with the options they were made with
+	digest := sha256.Sum256([]byte("This is a test"))
+	pkcs1 := crypto.SHA256
+	pss := &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthAuto, Hash: crypto.SHA256}
+	for _, opts := range []crypto.SignerOpts{pkcs1, pss} {
+		sig, err := priv.Sign(nil, digest[:], opts)
+		require.NoError(t, err)
+		require.NoError(t, Verify(pub, digest[:], sig, opts))
+	}
+	sig, err := priv.Sign(nil, digest[:], pkcs1)
+	require.NoError(t, err)
+	require.Error(t, Verify(pub, digest[:], sig, pss))
+}
@@ -0,0 +1,471 @@
+package tpmk
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+
+	"github.com/google/go-tpm/tpmutil"
+)
+
+// deviceExtKeyUsage contains the extended key usages of device certificates, which are used on
+// both sides of mutual TLS connections.
+var deviceExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth}
+
+// VerifyChain parses a device certificate in DER format and verifies it against the given pools
+// of intermediate and root certificates. A chain is accepted if the certificate allows TLS server
+// or client authentication, or has no extended key usages. Returns all valid chains, each
+// starting with the device certificate.
+func VerifyChain(leafDER []byte, intermediates, roots *x509.CertPool) ([][]*x509.Certificate, error) {
+	leaf, err := x509.ParseCertificate(leafDER)
+	if err != nil {
+		return nil, err
+	}
+	return leaf.Verify(x509.VerifyOptions{
+		Intermediates: intermediates,
+		Roots:         roots,
+		KeyUsages:     deviceExtKeyUsage,
+	})
+}
+
+// IssueRequest is a certificate to be issued by IssueCertificates.
+type IssueRequest struct {
+	Template  *x509.Certificate
+	PublicKey crypto.PublicKey
+}
+
+// IssueCertificates issues a batch of DER-encoded certificates signed by a CA key. All requests
+// are validated and encoded before anything is signed, to avoid spending TPM signing operations
+// on a batch that would fail part-way through. The certificates are then signed in one batch if
+// the CA key has a SignBatch method like RSAPrivateKey, so a CA key with a policy or HMAC session
+// starts it once for the whole batch rather than once per certificate. Other keys sign the
+// certificates one by one. The CA key should be initialized once and reused for all batches
+// rather than per certificate. rand is passed on to the signer, crypto/rand.Reader is used if
+// it's nil. Keys in the TPM don't use it.
+func IssueCertificates(rand io.Reader, ca crypto.Signer, caCert *x509.Certificate, requests []IssueRequest) ([][]byte, error) {
+	rand = randOrDefault(rand)
+	serials := make(map[string]bool)
+	for i, r := range requests {
+		if r.Template == nil || r.PublicKey == nil {
+			return nil, fmt.Errorf("request %d: missing template or public key", i)
+		}
+		if r.Template.SerialNumber == nil {
+			return nil, fmt.Errorf("request %d: missing serial number", i)
+		}
+		serial := r.Template.SerialNumber.String()
+		if serials[serial] {
+			return nil, fmt.Errorf("request %d: duplicate serial number %s", i, serial)
+		}
+		serials[serial] = true
+	}
+
+	// Encode all certificates, and group them by signature algorithm since a batch is signed with
+	// the same options
+	standIn, err := ecdsa.GenerateKey(elliptic.P256(), rand)
+	if err != nil {
+		return nil, err
+	}
+	unsigned := make([]unsignedCertificate, len(requests))
+	groups := make(map[x509.SignatureAlgorithm][]int)
+	for i, r := range requests {
+		c, err := encodeTBSCertificate(rand, standIn, ca.Public(), caCert, r)
+		if err != nil {
+			return nil, fmt.Errorf("request %d: %v", i, err)
+		}
+		unsigned[i] = c
+		groups[c.algorithm] = append(groups[c.algorithm], i)
+	}
+
+	certs := make([][]byte, len(requests))
+	for alg, indexes := range groups {
+		opts := certAlgorithms[alg].opts
+		digests := make([][]byte, len(indexes))
+		for j, i := range indexes {
+			h := opts.HashFunc().New()
+			h.Write(unsigned[i].tbs)
+			digests[j] = h.Sum(nil)
+		}
+		signatures, err := signDigests(rand, ca, digests, opts)
+		if err != nil {
+			return nil, err
+		}
+		for j, i := range indexes {
+			// Like x509.CreateCertificate, make sure the signer produced a valid signature
+			if err := caCert.CheckSignature(alg, unsigned[i].tbs, signatures[j]); err != nil {
+				return nil, fmt.Errorf("request %d: invalid signature from CA key: %v", i, err)
+			}
+			if certs[i], err = unsigned[i].sign(signatures[j]); err != nil {
+				return nil, fmt.Errorf("request %d: %v", i, err)
+			}
+		}
+	}
+	return certs, nil
+}
+
+// Signature algorithms supported by IssueCertificates, with the options to sign with and their
+// object identifier.
+var certAlgorithms = map[x509.SignatureAlgorithm]struct {
+	opts crypto.SignerOpts
+	oid  asn1.ObjectIdentifier
+}{
+	x509.SHA256WithRSA:    {crypto.SHA256, asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 11}},
+	x509.SHA384WithRSA:    {crypto.SHA384, asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 12}},
+	x509.SHA512WithRSA:    {crypto.SHA512, asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 13}},
+	x509.SHA256WithRSAPSS: {&rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: crypto.SHA256}, oidRSAPSS},
+	x509.SHA384WithRSAPSS: {&rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: crypto.SHA384}, oidRSAPSS},
+	x509.SHA512WithRSAPSS: {&rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: crypto.SHA512}, oidRSAPSS},
+	x509.ECDSAWithSHA256:  {crypto.SHA256, asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 2}},
+	x509.ECDSAWithSHA384:  {crypto.SHA384, asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 3}},
+	x509.ECDSAWithSHA512:  {crypto.SHA512, asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 4}},
+}
+
+// Object identifiers used in the parameters of RSASSA-PSS signatures (RFC 4055)
+var (
+	oidRSAPSS = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 10}
+	oidMGF1   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 8}
+	oidHashes = map[crypto.Hash]asn1.ObjectIdentifier{
+		crypto.SHA256: {2, 16, 840, 1, 101, 3, 4, 2, 1},
+		crypto.SHA384: {2, 16, 840, 1, 101, 3, 4, 2, 2},
+		crypto.SHA512: {2, 16, 840, 1, 101, 3, 4, 2, 3},
+	}
+)
+
+// pssParameters is the RSASSA-PSS-params structure of RFC 4055.
+type pssParameters struct {
+	Hash         pkix.AlgorithmIdentifier `asn1:"explicit,tag:0"`
+	MGF          pkix.AlgorithmIdentifier `asn1:"explicit,tag:1"`
+	SaltLength   int                      `asn1:"explicit,tag:2"`
+	TrailerField int                      `asn1:"optional,explicit,tag:3,default:1"`
+}
+
+// certAlgorithm returns the signature algorithm of a certificate signed by a CA key, the one
+// requested in the template or the default of x509.CreateCertificate for the key.
+func certAlgorithm(caPub crypto.PublicKey, requested x509.SignatureAlgorithm) (x509.SignatureAlgorithm, error) {
+	alg := requested
+	switch pub := caPub.(type) {
+	case *rsa.PublicKey:
+		switch alg {
+		case x509.UnknownSignatureAlgorithm:
+			return x509.SHA256WithRSA, nil
+		case x509.SHA256WithRSA, x509.SHA384WithRSA, x509.SHA512WithRSA, x509.SHA256WithRSAPSS, x509.SHA384WithRSAPSS, x509.SHA512WithRSAPSS:
+			return alg, nil
+		}
+	case *ecdsa.PublicKey:
+		if alg == x509.UnknownSignatureAlgorithm {
+			switch pub.Curve {
+			case elliptic.P256():
+				return x509.ECDSAWithSHA256, nil
+			case elliptic.P384():
+				return x509.ECDSAWithSHA384, nil
+			case elliptic.P521():
+				return x509.ECDSAWithSHA512, nil
+			}
+			return 0, fmt.Errorf("unsupported curve %s", pub.Curve.Params().Name)
+		}
+		switch alg {
+		case x509.ECDSAWithSHA256, x509.ECDSAWithSHA384, x509.ECDSAWithSHA512:
+			return alg, nil
+		}
+	default:
+		return 0, UnsupportedKeyError{Key: caPub}
+	}
+	return 0, fmt.Errorf("signature algorithm %s can't be used with a %T CA key", alg, caPub)
+}
+
+// algorithmIdentifier returns the encoded AlgorithmIdentifier of a signature algorithm, with
+// the same parameters as x509.CreateCertificate uses.
+func algorithmIdentifier(alg x509.SignatureAlgorithm) ([]byte, error) {
+	a := certAlgorithms[alg]
+	id := pkix.AlgorithmIdentifier{Algorithm: a.oid}
+	switch alg {
+	case x509.SHA256WithRSA, x509.SHA384WithRSA, x509.SHA512WithRSA:
+		id.Parameters = asn1.NullRawValue
+	case x509.SHA256WithRSAPSS, x509.SHA384WithRSAPSS, x509.SHA512WithRSAPSS:
+		hash := pkix.AlgorithmIdentifier{Algorithm: oidHashes[a.opts.HashFunc()], Parameters: asn1.NullRawValue}
+		mgfParams, err := asn1.Marshal(hash)
+		if err != nil {
+			return nil, err
+		}
+		params, err := asn1.Marshal(pssParameters{
+			Hash:         hash,
+			MGF:          pkix.AlgorithmIdentifier{Algorithm: oidMGF1, Parameters: asn1.RawValue{FullBytes: mgfParams}},
+			SaltLength:   a.opts.HashFunc().Size(),
+			TrailerField: 1,
+		})
+		if err != nil {
+			return nil, err
+		}
+		id.Parameters = asn1.RawValue{FullBytes: params}
+	}
+	return asn1.Marshal(id)
+}
+
+// rawCertificate is the ASN.1 structure of a certificate (RFC 5280, Section 4.1).
+type rawCertificate struct {
+	TBSCertificate     asn1.RawValue
+	SignatureAlgorithm asn1.RawValue
+	SignatureValue     asn1.BitString
+}
+
+// unsignedCertificate is the encoded to-be-signed part of a certificate and its signature
+// algorithm, ready to be signed.
+type unsignedCertificate struct {
+	tbs         []byte
+	algorithmID []byte
+	algorithm   x509.SignatureAlgorithm
+}
+
+// sign returns the DER-encoded certificate with the signature.
+func (c unsignedCertificate) sign(signature []byte) ([]byte, error) {
+	return asn1.Marshal(rawCertificate{
+		TBSCertificate:     asn1.RawValue{FullBytes: c.tbs},
+		SignatureAlgorithm: asn1.RawValue{FullBytes: c.algorithmID},
+		SignatureValue:     asn1.BitString{Bytes: signature, BitLength: 8 * len(signature)},
+	})
+}
+
+// encodeTBSCertificate encodes the to-be-signed part of a certificate for the CA key. Since
+// x509.CreateCertificate always signs the certificate itself, it's used with a cheap software
+// stand-in key to encode the fields and extensions, and the signature algorithm in the result is
+// then replaced with the one of the CA key. The issuer and authority key ID come from the CA
+// certificate, so the result is the same as if the CA key had been used.
+func encodeTBSCertificate(rand io.Reader, standIn *ecdsa.PrivateKey, caPub crypto.PublicKey, caCert *x509.Certificate, r IssueRequest) (unsignedCertificate, error) {
+	alg, err := certAlgorithm(caPub, r.Template.SignatureAlgorithm)
+	if err != nil {
+		return unsignedCertificate{}, err
+	}
+	algorithmID, err := algorithmIdentifier(alg)
+	if err != nil {
+		return unsignedCertificate{}, err
+	}
+
+	template := *r.Template
+	template.SignatureAlgorithm = x509.UnknownSignatureAlgorithm
+	parent := *caCert
+	parent.PublicKey = standIn.Public()
+	der, err := x509.CreateCertificate(rand, &template, &parent, r.PublicKey, standIn)
+	if err != nil {
+		return unsignedCertificate{}, err
+	}
+	var cert rawCertificate
+	if _, err := asn1.Unmarshal(der, &cert); err != nil {
+		return unsignedCertificate{}, err
+	}
+
+	// The fields of the TBSCertificate are version, serialNumber, signature, etc
+	var fields [][]byte
+	for rest := cert.TBSCertificate.Bytes; len(rest) > 0; {
+		var field asn1.RawValue
+		if rest, err = asn1.Unmarshal(rest, &field); err != nil {
+			return unsignedCertificate{}, err
+		}
+		fields = append(fields, field.FullBytes)
+	}
+	if len(fields) < 3 {
+		return unsignedCertificate{}, errors.New("invalid TBSCertificate")
+	}
+	fields[2] = algorithmID
+	tbs, err := asn1.Marshal(asn1.RawValue{Tag: asn1.TagSequence, IsCompound: true, Bytes: bytes.Join(fields, nil)})
+	if err != nil {
+		return unsignedCertificate{}, err
+	}
+	return unsignedCertificate{tbs: tbs, algorithmID: algorithmID, algorithm: alg}, nil
+}
+
+// batchSigner is implemented by keys that can sign several digests at once.
+type batchSigner interface {
+	SignBatch(digests [][]byte, opts crypto.SignerOpts) ([][]byte, error)
+}
+
+// signDigests signs all digests in one batch if the key supports it, or one by one.
+func signDigests(rand io.Reader, key crypto.Signer, digests [][]byte, opts crypto.SignerOpts) ([][]byte, error) {
+	if b, ok := key.(batchSigner); ok {
+		return b.SignBatch(digests, opts)
+	}
+	signatures := make([][]byte, 0, len(digests))
+	for i, digest := range digests {
+		sig, err := key.Sign(rand, digest, opts)
+		if err != nil {
+			return nil, fmt.Errorf("signing digest %d: %v", i, err)
+		}
+		signatures = append(signatures, sig)
+	}
+	return signatures, nil
+}
+
+// Size of serial numbers generated by SignCertificate
+const serialBits = 128
+
+// SignCertificate signs a certificate for pub with a CA key, typically one in the TPM, and
+// returns it in DER format. parent is the CA certificate, or nil for a self-signed certificate.
+// Unlike x509.CreateCertificate, it guards against mistakes that produce invalid certificates.
+// If the template has no serial number, a random 128-bit one is used, and zero or negative
+// serial numbers, which RFC 5280 doesn't allow, are rejected. NotAfter needs to be after
+// NotBefore. The template isn't modified. rand is used like in IssueCertificates.
+func SignCertificate(rand io.Reader, template, parent *x509.Certificate, pub crypto.PublicKey, caKey crypto.Signer) ([]byte, error) {
+	if template == nil {
+		return nil, errors.New("missing certificate template")
+	}
+	if !template.NotAfter.After(template.NotBefore) {
+		return nil, fmt.Errorf("certificate expires (%s) before it becomes valid (%s)", template.NotAfter, template.NotBefore)
+	}
+	rand = randOrDefault(rand)
+	tmpl := *template
+	switch {
+	case tmpl.SerialNumber == nil:
+		b := make([]byte, serialBits/8)
+		if _, err := io.ReadFull(rand, b); err != nil {
+			return nil, err
+		}
+		// Make sure the serial isn't zero and keeps its size
+		b[0] |= 0x40
+		tmpl.SerialNumber = new(big.Int).SetBytes(b)
+	case tmpl.SerialNumber.Sign() <= 0:
+		return nil, fmt.Errorf("invalid serial number %s, it needs to be positive", tmpl.SerialNumber)
+	}
+	if parent == nil {
+		parent = &tmpl
+	}
+	return x509.CreateCertificate(rand, &tmpl, parent, pub, caKey)
+}
+
+// CreateCertificateRequest creates a certificate signing request for a key, typically an
+// RSAPrivateKey or ECPrivateKey in the TPM, and returns it in PEM format. The template may be nil
+// for a request without subject. If signing with the key fails, its error is returned rather
+// than the one of the x509 package. rand is used like in IssueCertificates.
+func CreateCertificateRequest(rand io.Reader, key crypto.Signer, template *x509.CertificateRequest) ([]byte, error) {
+	switch key.Public().(type) {
+	case *rsa.PublicKey, *ecdsa.PublicKey:
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", key.Public())
+	}
+	if template == nil {
+		template = &x509.CertificateRequest{}
+	}
+	signer := &signErrorRecorder{Signer: key}
+	der, err := x509.CreateCertificateRequest(randOrDefault(rand), template, signer)
+	if signer.err != nil {
+		return nil, fmt.Errorf("signing certificate request: %v", signer.err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der}), nil
+}
+
+// signErrorRecorder wraps a signer and keeps the error of the last signature.
+type signErrorRecorder struct {
+	crypto.Signer
+	err error
+}
+
+func (s *signErrorRecorder) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	sig, err := s.Signer.Sign(rand, digest, opts)
+	s.err = err
+	return sig, err
+}
+
+// BuildServerCertificate assembles a TLS certificate from a leaf certificate for a key in the
+// TPM and the intermediate certificates of its chain, in any order. The intermediates are sorted
+// so each one is followed by its issuer, as required in TLS handshakes. It fails if the leaf
+// doesn't belong to the key, or if an intermediate isn't part of the chain.
+func BuildServerCertificate(dev io.ReadWriteCloser, handle tpmutil.Handle, password string, leafDER []byte, intermediates [][]byte) (tls.Certificate, error) {
+	leaf, err := x509.ParseCertificate(leafDER)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	key, err := NewRSAPrivateKeyPinned(dev, handle, password, leaf.PublicKey)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	remaining := make([]*x509.Certificate, 0, len(intermediates))
+	for i, der := range intermediates {
+		c, err := x509.ParseCertificate(der)
+		if err != nil {
+			return tls.Certificate{}, fmt.Errorf("intermediate %d: %v", i, err)
+		}
+		remaining = append(remaining, c)
+	}
+
+	// Follow the issuers starting from the leaf
+	chain := [][]byte{leaf.Raw}
+	for current := leaf; len(remaining) > 0; {
+		next := -1
+		for i, c := range remaining {
+			if bytes.Equal(c.RawSubject, current.RawIssuer) && current.CheckSignatureFrom(c) == nil {
+				next = i
+				break
+			}
+		}
+		if next < 0 {
+			return tls.Certificate{}, fmt.Errorf("intermediate %q is not part of the chain of %q", remaining[0].Subject, leaf.Subject)
+		}
+		current = remaining[next]
+		chain = append(chain, current.Raw)
+		remaining = append(remaining[:next], remaining[next+1:]...)
+	}
+	return tls.Certificate{Certificate: chain, PrivateKey: key, Leaf: leaf}, nil
+}
+
+// TLSCertificate returns a TLS certificate with a key in the TPM and its DER-encoded certificate,
+// followed by the intermediate certificates of its chain, if any. The intermediates need to be
+// in the order they're sent in the handshake, each one issued by the next. Use
+// BuildServerCertificate to have them sorted. It fails if the certificate doesn't belong to the
+// key or if the chain is broken, which otherwise only shows during the handshake, typically as
+// an "unknown certificate authority" error in the client. When building a tls.Certificate by
+// hand, Certificate needs to hold the chain in the same order, starting with the leaf.
+func TLSCertificate(dev io.ReadWriteCloser, handle tpmutil.Handle, password string, certDER []byte, intermediates ...[]byte) (tls.Certificate, error) {
+	crt, err := BuildServerCertificate(dev, handle, password, certDER, intermediates)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	for i := range intermediates {
+		if !bytes.Equal(crt.Certificate[i+1], intermediates[i]) {
+			return tls.Certificate{}, fmt.Errorf("intermediate %d is out of order, each certificate needs to be followed by its issuer", i)
+		}
+	}
+	return crt, nil
+}
+
+// PinMode selects the data a certificate fingerprint is computed over.
+type PinMode int
+
+const (
+	// PinSPKI fingerprints the SubjectPublicKeyInfo. The pin remains valid when the certificate is
+	// renewed for the same key, which is typically the case for keys in a TPM.
+	PinSPKI PinMode = iota
+	// PinCert fingerprints the whole DER-encoded certificate.
+	PinCert
+)
+
+// FingerprintCert returns the base64-encoded SHA-256 fingerprint of a certificate, as used to pin
+// it in clients. It's the format of HPKP and curl's --pinnedpubkey.
+func FingerprintCert(cert *x509.Certificate, mode PinMode) (string, error) {
+	var data []byte
+	switch mode {
+	case PinSPKI:
+		data = cert.RawSubjectPublicKeyInfo
+	case PinCert:
+		data = cert.Raw
+	default:
+		return "", fmt.Errorf("unsupported pin mode %d", mode)
+	}
+	if len(data) == 0 {
+		return "", errors.New("certificate is not parsed from DER")
+	}
+	sum := sha256.Sum256(data)
+	return base64.StdEncoding.EncodeToString(sum[:]), nil
+}
@@ -0,0 +1,567 @@
+package tpmk
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/go-tpm-tools/simulator"
+	"github.com/google/go-tpm/tpm2"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerifyChain(t *testing.T) {
+	dev, err := simulator.Get()
+	require.NoError(t, err)
+	defer dev.Close()
+
+	const (
+		handle = 0x81000000
+		pw     = ""
+		attr   = tpm2.FlagSign | tpm2.FlagFixedTPM | tpm2.FlagUserWithAuth | tpm2.FlagFixedParent | tpm2.FlagSensitiveDataOrigin
+	)
+
+	pub, err := GenRSAPrimaryKey(dev, handle, pw, pw, attr)
+	require.NoError(t, err)
+
+	// Load the CA
+	caCrt, caKey, err := LoadKeyPair("testdata/ca.crt", "testdata/ca.key")
+	require.NoError(t, err)
+	roots := x509.NewCertPool()
+	roots.AddCert(caCrt)
+
+	tests := map[string]struct {
+		extKeyUsage []x509.ExtKeyUsage
+		valid       bool
+	}{
+		"device usages":      {deviceExtKeyUsage, true},
+		"no usages":          {nil, true},
+		"client auth only":   {[]x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}, true},
+		"email protection":   {[]x509.ExtKeyUsage{x509.ExtKeyUsageEmailProtection}, false},
+		"code signing only":  {[]x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning}, false},
+		"any extended usage": {[]x509.ExtKeyUsage{x509.ExtKeyUsageAny}, true},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			template := x509.Certificate{
+				NotBefore:    time.Now(),
+				NotAfter:     time.Now().AddDate(0, 0, 1),
+				KeyUsage:     x509.KeyUsageDigitalSignature,
+				ExtKeyUsage:  test.extKeyUsage,
+				SerialNumber: big.NewInt(1),
+			}
+			der, err := x509.CreateCertificate(rand.Reader, &template, caCrt, pub, caKey)
+			require.NoError(t, err)
+
+			chains, err := VerifyChain(der, nil, roots)
+			if !test.valid {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Len(t, chains, 1)
+			require.Equal(t, der, chains[0][0].Raw)
+			require.Equal(t, caCrt.Raw, chains[0][1].Raw)
+		})
+	}
+}
+
+func TestIssueCertificates(t *testing.T) {
+	dev, err := simulator.Get()
+	require.NoError(t, err)
+	defer dev.Close()
+
+	// A CA key with a policy signs the whole batch in one session
+	ca, caCrt, requests := setupTPMCA(t, dev, 5, WithSignOnlyPolicy())
+	requests[1].Template.SignatureAlgorithm = x509.SHA256WithRSAPSS
+
+	certs, err := IssueCertificates(nil, ca, caCrt, requests)
+	require.NoError(t, err)
+	require.Len(t, certs, len(requests))
+	roots := x509.NewCertPool()
+	roots.AddCert(caCrt)
+	for i, der := range certs {
+		chains, err := VerifyChain(der, nil, roots)
+		require.NoError(t, err)
+		cert := chains[0][0]
+		require.Equal(t, requests[i].Template.Subject.CommonName, cert.Subject.CommonName)
+		require.Equal(t, requests[i].Template.SerialNumber, cert.SerialNumber)
+		require.Equal(t, caCrt.SubjectKeyId, cert.AuthorityKeyId)
+	}
+	cert, err := x509.ParseCertificate(certs[1])
+	require.NoError(t, err)
+	require.Equal(t, x509.SHA256WithRSAPSS, cert.SignatureAlgorithm)
+
+	// PKCS#1 v1.5 signatures are deterministic, so the certificates are the same as those of
+	// x509.CreateCertificate, but take fewer TPM commands
+	counter := NewCommandCounter(dev)
+	countCommands := func(f func()) int {
+		counter.Reset()
+		f()
+		var total int
+		for _, count := range counter.Counts() {
+			total += count
+		}
+		return total
+	}
+	counted, err := NewRSAPrivateKey(counter, tpmCAHandle, "")
+	require.NoError(t, err)
+	requests[1].Template.SignatureAlgorithm = x509.UnknownSignatureAlgorithm
+	var loop [][]byte
+	loopCommands := countCommands(func() {
+		for _, r := range requests {
+			der, err := x509.CreateCertificate(rand.Reader, r.Template, caCrt, r.PublicKey, counted)
+			require.NoError(t, err)
+			loop = append(loop, der)
+		}
+	})
+	batchCommands := countCommands(func() {
+		certs, err = IssueCertificates(nil, counted, caCrt, requests)
+		require.NoError(t, err)
+	})
+	require.Equal(t, loop, certs)
+	require.True(t, batchCommands < loopCommands, "%d commands in a batch, %d in a loop", batchCommands, loopCommands)
+
+	// Keys without SignBatch sign one certificate at a time
+	fake, err := NewFakeSigner(2048)
+	require.NoError(t, err)
+	fakeTemplate := *caCrt
+	fakeTemplate.PublicKey = fake.Public()
+	fakeCrt, err := x509.ParseCertificate(mustCreateCertificate(t, &fakeTemplate, fake))
+	require.NoError(t, err)
+	certs, err = IssueCertificates(nil, fake, fakeCrt, requests[:2])
+	require.NoError(t, err)
+	for _, der := range certs {
+		cert, err := x509.ParseCertificate(der)
+		require.NoError(t, err)
+		require.NoError(t, cert.CheckSignatureFrom(fakeCrt))
+	}
+
+	// A CA certificate that doesn't belong to the key is caught
+	_, err = IssueCertificates(nil, ca, fakeCrt, requests[:1])
+	require.Error(t, err)
+
+	// A duplicate serial fails the whole batch before signing
+	requests[4].Template.SerialNumber = requests[0].Template.SerialNumber
+	_, err = IssueCertificates(nil, ca, caCrt, requests)
+	require.Error(t, err)
+}
+
+// mustCreateCertificate self-signs a certificate with the key.
+func mustCreateCertificate(t *testing.T, template *x509.Certificate, key crypto.Signer) []byte {
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	require.NoError(t, err)
+	return der
+}
+
+func BenchmarkIssueCertificates(b *testing.B) {
+	sim, err := simulator.Get()
+	require.NoError(b, err)
+	defer sim.Close()
+
+	// Every signature with a policy key needs a session, which batching saves. The simulator runs
+	// commands much faster than a real TPM, so the number of commands is reported as well.
+	const n = 16
+	_, caCrt, requests := setupTPMCA(b, sim, n, WithSignOnlyPolicy())
+	dev := NewCommandCounter(sim)
+	ca, err := NewRSAPrivateKey(dev, tpmCAHandle, "")
+	require.NoError(b, err)
+	reportCommands := func(b *testing.B) {
+		var total int
+		for _, count := range dev.Counts() {
+			total += count
+		}
+		b.ReportMetric(float64(total)/float64(b.N), "commands/op")
+	}
+
+	b.Run("loop", func(b *testing.B) {
+		dev.Reset()
+		for i := 0; i < b.N; i++ {
+			for _, r := range requests {
+				_, err := x509.CreateCertificate(rand.Reader, r.Template, caCrt, r.PublicKey, ca)
+				require.NoError(b, err)
+			}
+		}
+		reportCommands(b)
+	})
+	b.Run("batch", func(b *testing.B) {
+		dev.Reset()
+		for i := 0; i < b.N; i++ {
+			_, err := IssueCertificates(nil, ca, caCrt, requests)
+			require.NoError(b, err)
+		}
+		reportCommands(b)
+	})
+}
+
+const tpmCAHandle = 0x81000000
+
+// setupTPMCA creates a self-signed CA with its key in the TPM, as well as n requests for
+// device certificates. The options are used to create the CA key.
+func setupTPMCA(t require.TestingT, dev *simulator.Simulator, n int, opts ...KeyOption) (RSAPrivateKey, *x509.Certificate, []IssueRequest) {
+	const attr = tpm2.FlagSign | tpm2.FlagFixedTPM | tpm2.FlagUserWithAuth | tpm2.FlagFixedParent | tpm2.FlagSensitiveDataOrigin
+
+	_, err := GenRSAPrimaryKey(dev, tpmCAHandle, "", "", attr, opts...)
+	require.NoError(t, err)
+	ca, err := NewRSAPrivateKey(dev, tpmCAHandle, "")
+	require.NoError(t, err)
+	caTemplate := x509.Certificate{
+		Subject:               pkix.Name{CommonName: "TPM CA"},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().AddDate(0, 0, 1),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		SerialNumber:          big.NewInt(1),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &caTemplate, &caTemplate, ca.Public(), ca)
+	require.NoError(t, err)
+	caCrt, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	// All devices can use the same key, only the certificates matter here
+	deviceKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	requests := make([]IssueRequest, n)
+	for i := range requests {
+		requests[i] = IssueRequest{
+			Template: &x509.Certificate{
+				Subject:      pkix.Name{CommonName: fmt.Sprintf("device-%d", i)},
+				NotBefore:    time.Now(),
+				NotAfter:     time.Now().AddDate(0, 0, 1),
+				KeyUsage:     x509.KeyUsageDigitalSignature,
+				ExtKeyUsage:  deviceExtKeyUsage,
+				SerialNumber: big.NewInt(int64(i + 2)),
+			},
+			PublicKey: &deviceKey.PublicKey,
+		}
+	}
+	return ca, caCrt, requests
+}
+
+func TestCreateCertificateRequest(t *testing.T) {
+	dev, err := simulator.Get()
+	require.NoError(t, err)
+	defer dev.Close()
+
+	const (
+		rsaHandle = 0x81000000
+		ecHandle  = 0x81000001
+		pw        = ""
+		attr      = tpm2.FlagSign | tpm2.FlagFixedTPM | tpm2.FlagUserWithAuth | tpm2.FlagFixedParent | tpm2.FlagSensitiveDataOrigin
+	)
+	_, err = GenRSAPrimaryKey(dev, rsaHandle, pw, pw, attr)
+	require.NoError(t, err)
+	_, err = GenECPrimaryKey(dev, ecHandle, pw, pw, attr, tpm2.CurveNISTP256)
+	require.NoError(t, err)
+	rsaKey, err := NewRSAPrivateKey(dev, rsaHandle, pw)
+	require.NoError(t, err)
+	ecKey, err := NewECPrivateKey(dev, ecHandle, pw)
+	require.NoError(t, err)
+
+	template := &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: "device"},
+		DNSNames: []string{"device.local"},
+	}
+	tests := map[string]Signer{
+		"RSA": rsaKey,
+		"EC":  ecKey,
+	}
+	for name, key := range tests {
+		t.Run(name, func(t *testing.T) {
+			b, err := CreateCertificateRequest(nil, key, template)
+			require.NoError(t, err)
+			blk, _ := pem.Decode(b)
+			require.NotNil(t, blk)
+			require.Equal(t, "CERTIFICATE REQUEST", blk.Type)
+			csr, err := x509.ParseCertificateRequest(blk.Bytes)
+			require.NoError(t, err)
+			require.NoError(t, csr.CheckSignature())
+			require.Equal(t, key.Public(), csr.PublicKey)
+			require.Equal(t, "device", csr.Subject.CommonName)
+			require.Equal(t, []string{"device.local"}, csr.DNSNames)
+		})
+	}
+
+	// Errors of the TPM are returned as they are
+	wrongPW, err := NewRSAPrivateKey(dev, rsaHandle, "wrong")
+	require.NoError(t, err)
+	_, err = CreateCertificateRequest(nil, wrongPW, nil)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "signing certificate request: session 1, error code 0xe")
+}
+
+func TestBuildServerCertificate(t *testing.T) {
+	dev, err := simulator.Get()
+	require.NoError(t, err)
+	defer dev.Close()
+
+	const (
+		handle = 0x81000000
+		pw     = ""
+		attr   = tpm2.FlagSign | tpm2.FlagFixedTPM | tpm2.FlagUserWithAuth | tpm2.FlagFixedParent | tpm2.FlagSensitiveDataOrigin
+	)
+	pub, err := GenRSAPrimaryKey(dev, handle, pw, pw, attr)
+	require.NoError(t, err)
+
+	// Build a chain of root -> intermediate 1 -> intermediate 2 -> leaf
+	rootCrt, rootKey, err := LoadKeyPair("testdata/ca.crt", "testdata/ca.key")
+	require.NoError(t, err)
+	intermediate := func(name string, serial int64, parent *x509.Certificate, parentKey interface{}) (*x509.Certificate, *rsa.PrivateKey) {
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		require.NoError(t, err)
+		template := x509.Certificate{
+			Subject:               pkix.Name{CommonName: name},
+			NotBefore:             time.Now(),
+			NotAfter:              time.Now().AddDate(0, 0, 1),
+			KeyUsage:              x509.KeyUsageCertSign,
+			BasicConstraintsValid: true,
+			IsCA:                  true,
+			SerialNumber:          big.NewInt(serial),
+		}
+		der, err := x509.CreateCertificate(rand.Reader, &template, parent, &key.PublicKey, parentKey)
+		require.NoError(t, err)
+		crt, err := x509.ParseCertificate(der)
+		require.NoError(t, err)
+		return crt, key
+	}
+	int1Crt, int1Key := intermediate("intermediate 1", 10, rootCrt, rootKey)
+	int2Crt, int2Key := intermediate("intermediate 2", 11, int1Crt, int1Key)
+	leafTemplate := x509.Certificate{
+		Subject:      pkix.Name{CommonName: "device"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().AddDate(0, 0, 1),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  deviceExtKeyUsage,
+		SerialNumber: big.NewInt(12),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	leafDER, err := x509.CreateCertificate(rand.Reader, &leafTemplate, int2Crt, pub, int2Key)
+	require.NoError(t, err)
+
+	// Intermediates out of order are sorted by issuer
+	crt, err := BuildServerCertificate(dev, handle, pw, leafDER, [][]byte{int1Crt.Raw, int2Crt.Raw})
+	require.NoError(t, err)
+	require.Equal(t, [][]byte{leafDER, int2Crt.Raw, int1Crt.Raw}, crt.Certificate)
+
+	// Serve it to a client that only trusts the root, so needs the intermediates
+	roots := x509.NewCertPool()
+	roots.AddCert(rootCrt)
+	get := func(crt tls.Certificate) error {
+		server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintln(w, "Hello, client")
+		}))
+		server.TLS = &tls.Config{Certificates: []tls.Certificate{crt}}
+		server.StartTLS()
+		defer server.Close()
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}}}
+		res, err := client.Get(server.URL)
+		if err != nil {
+			return err
+		}
+		return res.Body.Close()
+	}
+	require.NoError(t, get(crt))
+
+	// Without the chain, the client can't verify the server
+	leafOnly := crt
+	leafOnly.Certificate = crt.Certificate[:1]
+	require.Error(t, get(leafOnly))
+
+	// Unrelated intermediates are rejected
+	other, _ := intermediate("other", 13, rootCrt, rootKey)
+	_, err = BuildServerCertificate(dev, handle, pw, leafDER, [][]byte{int1Crt.Raw, int2Crt.Raw, other.Raw})
+	require.Error(t, err)
+
+	// A leaf for a different key is rejected
+	int2Leaf, err := x509.CreateCertificate(rand.Reader, &leafTemplate, int1Crt, &int2Key.PublicKey, int1Key)
+	require.NoError(t, err)
+	_, err = BuildServerCertificate(dev, handle, pw, int2Leaf, [][]byte{int1Crt.Raw})
+	require.Error(t, err)
+}
+
+func TestTLSCertificate(t *testing.T) {
+	dev, err := simulator.Get()
+	require.NoError(t, err)
+	defer dev.Close()
+
+	const (
+		handle = 0x81000000
+		pw     = ""
+		attr   = tpm2.FlagSign | tpm2.FlagFixedTPM | tpm2.FlagUserWithAuth | tpm2.FlagFixedParent | tpm2.FlagSensitiveDataOrigin
+	)
+	pub, err := GenRSAPrimaryKey(dev, handle, pw, pw, attr)
+	require.NoError(t, err)
+
+	caCrt, caKey, err := LoadKeyPair("testdata/ca.crt", "testdata/ca.key")
+	require.NoError(t, err)
+	template := x509.Certificate{
+		Subject:      pkix.Name{CommonName: "device"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().AddDate(0, 0, 1),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  deviceExtKeyUsage,
+		SerialNumber: big.NewInt(1),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, caCrt, pub, caKey)
+	require.NoError(t, err)
+
+	crt, err := TLSCertificate(dev, handle, pw, der)
+	require.NoError(t, err)
+	require.Equal(t, [][]byte{der}, crt.Certificate)
+	require.Equal(t, pub, crt.PrivateKey.(RSAPrivateKey).Public())
+	require.Equal(t, "device", crt.Leaf.Subject.CommonName)
+
+	// A certificate for a different key is rejected
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	otherDER, err := x509.CreateCertificate(rand.Reader, &template, caCrt, &other.PublicKey, caKey)
+	require.NoError(t, err)
+	_, err = TLSCertificate(dev, handle, pw, otherDER)
+	require.EqualError(t, err, "key at handle 0x81000000 doesn't match the pinned public key")
+
+	// A leaf issued by intermediates, root -> intermediate 1 -> intermediate 2 -> leaf
+	intermediate := func(name string, serial int64, parent *x509.Certificate, parentKey interface{}) (*x509.Certificate, *rsa.PrivateKey) {
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		require.NoError(t, err)
+		der, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+			Subject:               pkix.Name{CommonName: name},
+			NotBefore:             time.Now(),
+			NotAfter:              time.Now().AddDate(0, 0, 1),
+			KeyUsage:              x509.KeyUsageCertSign,
+			BasicConstraintsValid: true,
+			IsCA:                  true,
+			SerialNumber:          big.NewInt(serial),
+		}, parent, &key.PublicKey, parentKey)
+		require.NoError(t, err)
+		crt, err := x509.ParseCertificate(der)
+		require.NoError(t, err)
+		return crt, key
+	}
+	int1Crt, int1Key := intermediate("intermediate 1", 10, caCrt, caKey)
+	int2Crt, int2Key := intermediate("intermediate 2", 11, int1Crt, int1Key)
+	leafDER, err := x509.CreateCertificate(rand.Reader, &template, int2Crt, pub, int2Key)
+	require.NoError(t, err)
+
+	crt, err = TLSCertificate(dev, handle, pw, leafDER, int2Crt.Raw, int1Crt.Raw)
+	require.NoError(t, err)
+	require.Equal(t, [][]byte{leafDER, int2Crt.Raw, int1Crt.Raw}, crt.Certificate)
+	roots := x509.NewCertPool()
+	roots.AddCert(caCrt)
+	_, err = crt.Leaf.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: certPool(t, crt.Certificate[1:]...),
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	require.NoError(t, err)
+
+	// Broken chains are rejected
+	_, err = TLSCertificate(dev, handle, pw, leafDER, int1Crt.Raw, int2Crt.Raw)
+	require.EqualError(t, err, "intermediate 0 is out of order, each certificate needs to be followed by its issuer")
+	_, err = TLSCertificate(dev, handle, pw, leafDER, int1Crt.Raw)
+	require.Error(t, err)
+	other2Crt, _ := intermediate("intermediate 2", 12, int1Crt, int1Key)
+	_, err = TLSCertificate(dev, handle, pw, leafDER, other2Crt.Raw, int1Crt.Raw)
+	require.Error(t, err)
+}
+
+// certPool returns a pool with the DER-encoded certificates.
+func certPool(t *testing.T, ders ...[]byte) *x509.CertPool {
+	pool := x509.NewCertPool()
+	for _, der := range ders {
+		crt, err := x509.ParseCertificate(der)
+		require.NoError(t, err)
+		pool.AddCert(crt)
+	}
+	return pool
+}
+
+func TestFingerprintCert(t *testing.T) {
+	crt, _, err := LoadKeyPair("testdata/ca.crt", "testdata/ca.key")
+	require.NoError(t, err)
+
+	// Expected values calculated with openssl
+	tests := map[string]struct {
+		mode     PinMode
+		expected string
+	}{
+		"spki": {PinSPKI, "SIfMjoXeQJbSQwDCy1v9NQHAmtWTyI/9l7PLLeNln/o="},
+		"cert": {PinCert, "MEqOS+8z9bZMWBmqNcyhIEe3M86g6B5GEwYKkyFLDRc="},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			pin, err := FingerprintCert(crt, test.mode)
+			require.NoError(t, err)
+			require.Equal(t, test.expected, pin)
+		})
+	}
+
+	// Templates that weren't parsed can't be fingerprinted
+	_, err = FingerprintCert(&x509.Certificate{}, PinCert)
+	require.Error(t, err)
+}
+
+func TestSignCertificate(t *testing.T) {
+	dev, err := simulator.Get()
+	require.NoError(t, err)
+	defer dev.Close()
+
+	ca, caCrt, _ := setupTPMCA(t, dev, 0)
+	deviceKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	now := time.Now()
+
+	// Without serial, a random one is generated for every certificate
+	template := &x509.Certificate{
+		Subject:   pkix.Name{CommonName: "device"},
+		NotBefore: now,
+		NotAfter:  now.AddDate(0, 0, 1),
+	}
+	serials := make(map[string]bool)
+	for i := 0; i < 2; i++ {
+		der, err := SignCertificate(nil, template, caCrt, deviceKey.Public(), ca)
+		require.NoError(t, err)
+		crt, err := x509.ParseCertificate(der)
+		require.NoError(t, err)
+		require.NoError(t, crt.CheckSignatureFrom(caCrt))
+		require.Equal(t, 1, crt.SerialNumber.Sign())
+		require.True(t, crt.SerialNumber.BitLen() > 120)
+		serials[crt.SerialNumber.String()] = true
+	}
+	require.Len(t, serials, 2)
+	require.Nil(t, template.SerialNumber)
+
+	// Self-signed
+	der, err := SignCertificate(nil, &x509.Certificate{SerialNumber: big.NewInt(7), NotBefore: now, NotAfter: now.Add(time.Hour)}, nil, ca.Public(), ca)
+	require.NoError(t, err)
+	crt, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	require.NoError(t, crt.CheckSignature(crt.SignatureAlgorithm, crt.RawTBSCertificate, crt.Signature))
+	require.Equal(t, big.NewInt(7), crt.SerialNumber)
+
+	invalid := map[string]*x509.Certificate{
+		"zero serial":       {SerialNumber: big.NewInt(0), NotBefore: now, NotAfter: now.Add(time.Hour)},
+		"negative serial":   {SerialNumber: big.NewInt(-1), NotBefore: now, NotAfter: now.Add(time.Hour)},
+		"no validity":       {SerialNumber: big.NewInt(1)},
+		"expires at start":  {SerialNumber: big.NewInt(1), NotBefore: now, NotAfter: now},
+		"expires too early": {SerialNumber: big.NewInt(1), NotBefore: now, NotAfter: now.Add(-time.Hour)},
+		"no template":       nil,
+	}
+	for name, template := range invalid {
+		t.Run(name, func(t *testing.T) {
+			_, err := SignCertificate(nil, template, caCrt, deviceKey.Public(), ca)
+			require.Error(t, err)
+		})
+	}
+}